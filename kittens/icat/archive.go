@@ -0,0 +1,55 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+var _ = fmt.Print
+
+// Return the path of the zip archive if arg is one, either by having the
+// zip:// prefix or the .zip extension
+func zip_archive_path(arg string) (string, bool) {
+	if path, found := strings.CutPrefix(arg, "zip://"); found {
+		return path, true
+	}
+	return arg, strings.HasSuffix(strings.ToLower(arg), ".zip")
+}
+
+// Return an input for every image in the zip archive, in the order in which
+// they are stored in it, so that pages are displayed sequentially. Entries
+// are recognized as images the same way as files in directories are.
+func process_zip(path string) (results []input_arg, err error) {
+	// The archive is never closed as its entries are read by the workers
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "Open", Path: path, Err: err}
+	}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if is_image_name(f.Name) || has_image_signature(func() (io.ReadCloser, error) { return f.Open() }) {
+			results = append(results, input_arg{arg: path, value: path + "/" + f.Name, zip_entry: f})
+		}
+	}
+	return
+}
+
+// Decompress an entry of a zip archive into memory
+func read_zip_entry(f *zip.File) ([]byte, error) {
+	if err := check_size_limit(int64(f.UncompressedSize64)); err != nil {
+		return nil, err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return read_all_limited(rc)
+}
@@ -0,0 +1,50 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"image"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+// Bilevel document formats that have no header that can be sniffed, so they
+// are recognized by file extension
+var bilevel_formats = map[string]string{
+	"image/g3fax":   "G3FAX",
+	"image/x-g4fax": "G4FAX",
+	"image/x-jbig2": "JBIG2",
+}
+
+func bilevel_format(name string) string {
+	if name == "" {
+		return ""
+	}
+	return bilevel_formats[utils.GuessMimeType(name)]
+}
+
+func probe_bilevel_input(p *probed_input, format string) {
+	p.imgd.format_uppercase = format
+	p.can_use_go = true
+	if format != "JBIG2" {
+		// the height is only known after decoding, it is updated then
+		p.imgd.canvas_width, p.imgd.canvas_height = opts.FaxWidth, opts.FaxWidth
+	}
+}
+
+func load_bilevel_image(imgd *image_data, src *opened_input) (image.Image, error) {
+	switch imgd.format_uppercase {
+	case "JBIG2":
+		if err := src.PutOnFilesystem(); err != nil {
+			return nil, err
+		}
+		return images.DecodeJBIG2WithJbig2dec(src.FileSystemName())
+	default:
+		defer src.Rewind()
+		return images.DecodeFax(src.file, imgd.format_uppercase == "G4FAX", opts.FaxWidth)
+	}
+}
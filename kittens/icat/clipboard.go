@@ -0,0 +1,202 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"kitty/tools/tui"
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The MIME types of images that are read from the clipboard, in order of preference
+var clipboard_image_types = []string{"image/png", "image/tiff"}
+
+var errNoClipboardImage = errors.New("The clipboard does not contain a PNG or TIFF image")
+
+func pick_clipboard_image_type(available []string) string {
+	for _, q := range clipboard_image_types {
+		for _, x := range available {
+			if strings.TrimSpace(x) == q {
+				return q
+			}
+		}
+	}
+	return ""
+}
+
+// The clipboard protocol is specific to kitty and cannot be used through tmux
+func terminal_supports_clipboard_protocol() bool {
+	return (os.Getenv("KITTY_WINDOW_ID") != "" || os.Getenv("TERM") == "xterm-kitty") && tui.TmuxSocketAddress() == ""
+}
+
+func encode_clipboard_read_request(payload string) string {
+	return "\x1b]5522;type=read;" + base64.StdEncoding.EncodeToString([]byte(payload)) + "\x1b\\"
+}
+
+// Read an image from the clipboard using the clipboard protocol of the
+// terminal, first asking for the available MIME types, then for the data of
+// the best one
+func read_clipboard_in_band() (ans []byte, err error) {
+	lp, err := loop.New(loop.NoAlternateScreen, loop.NoRestoreColors, loop.NoMouseTracking)
+	if err != nil {
+		return
+	}
+	var available_mimes []string
+	reading_available_mimes := true
+	var data bytes.Buffer
+	lp.OnInitialize = func() (string, error) {
+		lp.QueueWriteString(encode_clipboard_read_request("."))
+		return "", nil
+	}
+	lp.OnEscapeCode = func(etype loop.EscapeCodeType, raw []byte) error {
+		q, found := strings.CutPrefix(string(raw), "5522;")
+		if etype != loop.OSC || !found {
+			return nil
+		}
+		metadata, payload, _ := strings.Cut(q, ";")
+		status := ""
+		for _, record := range strings.Split(metadata, ":") {
+			if k, v, _ := strings.Cut(record, "="); k == "status" {
+				status = v
+			}
+		}
+		switch status {
+		case "DATA":
+			chunk, err := base64.StdEncoding.DecodeString(payload)
+			if err != nil {
+				return fmt.Errorf("Received clipboard data from the terminal with invalid base64 encoding")
+			}
+			if reading_available_mimes {
+				available_mimes = append(available_mimes, strings.Fields(string(chunk))...)
+			} else {
+				data.Write(chunk)
+			}
+		case "OK":
+		case "DONE":
+			if !reading_available_mimes {
+				ans = data.Bytes()
+				lp.Quit(0)
+				return nil
+			}
+			reading_available_mimes = false
+			mime := pick_clipboard_image_type(available_mimes)
+			if mime == "" {
+				return errNoClipboardImage
+			}
+			lp.QueueWriteString(encode_clipboard_read_request(mime))
+		case "EPERM":
+			return fmt.Errorf("Permission to read the clipboard was denied")
+		default:
+			return fmt.Errorf("The terminal failed to read the clipboard with error: %s", status)
+		}
+		return nil
+	}
+	lp.OnKeyEvent = func(event *loop.KeyEvent) error {
+		if event.MatchesPressOrRepeat("ctrl+c") || event.MatchesPressOrRepeat("esc") {
+			event.Handled = true
+			return fmt.Errorf("Reading the clipboard was aborted by the user")
+		}
+		return nil
+	}
+	err = lp.Run()
+	if err != nil {
+		return nil, err
+	}
+	ds := lp.DeathSignalName()
+	if ds != "" {
+		fmt.Println("Killed by signal: ", ds)
+		lp.KillIfSignalled()
+	}
+	return
+}
+
+func run_clipboard_helper(cmd ...string) ([]byte, error) {
+	output, err := exec.Command(cmd[0], cmd[1:]...).Output()
+	if err != nil {
+		var exit_err *exec.ExitError
+		if errors.As(err, &exit_err) {
+			return nil, fmt.Errorf("Running the command: %s\nFailed with error:\n%s", strings.Join(cmd, " "), string(exit_err.Stderr))
+		}
+		return nil, err
+	}
+	return output, nil
+}
+
+// Read an image from the clipboard on macOS using AppleScript, which outputs
+// the data as «data PNGf89504E47...»
+func read_clipboard_with_osascript() ([]byte, error) {
+	info, err := run_clipboard_helper("osascript", "-e", "clipboard info")
+	if err != nil {
+		return nil, err
+	}
+	class := ""
+	for _, q := range []string{"PNGf", "TIFF"} {
+		if bytes.Contains(info, []byte("«class "+q+"»")) || (q == "TIFF" && bytes.Contains(info, []byte("TIFF picture"))) {
+			class = q
+			break
+		}
+	}
+	if class == "" {
+		return nil, errNoClipboardImage
+	}
+	output, err := run_clipboard_helper("osascript", "-e", "get the clipboard as «class "+class+"»")
+	if err != nil {
+		return nil, err
+	}
+	q, found := strings.CutPrefix(strings.TrimSpace(string(output)), "«data "+class)
+	if !found || !strings.HasSuffix(q, "»") {
+		return nil, fmt.Errorf("Unexpected output from osascript when reading the clipboard")
+	}
+	return hex.DecodeString(strings.TrimSuffix(q, "»"))
+}
+
+// Read an image from the clipboard using programs such as wl-paste and xclip,
+// for terminals that do not support the clipboard protocol
+func read_clipboard_with_helper() ([]byte, error) {
+	if runtime.GOOS == "darwin" {
+		return read_clipboard_with_osascript()
+	}
+	var list_types, get_data []string
+	switch {
+	case os.Getenv("WAYLAND_DISPLAY") != "" && utils.Which("wl-paste") != "":
+		list_types, get_data = []string{"wl-paste", "--list-types"}, []string{"wl-paste", "--no-newline", "--type"}
+	case os.Getenv("DISPLAY") != "" && utils.Which("xclip") != "":
+		list_types, get_data = []string{"xclip", "-selection", "clipboard", "-target", "TARGETS", "-out"}, []string{"xclip", "-selection", "clipboard", "-out", "-target"}
+	default:
+		return nil, fmt.Errorf("Reading images from the clipboard requires a terminal that supports the kitty clipboard protocol or one of the programs wl-paste or xclip")
+	}
+	types, err := run_clipboard_helper(list_types...)
+	if err != nil {
+		return nil, err
+	}
+	mime := pick_clipboard_image_type(strings.Split(string(types), "\n"))
+	if mime == "" {
+		return nil, errNoClipboardImage
+	}
+	return run_clipboard_helper(append(get_data, mime)...)
+}
+
+// Read the image on the clipboard for --clipboard
+func read_clipboard_image() (data []byte, err error) {
+	if terminal_supports_clipboard_protocol() {
+		data, err = read_clipboard_in_band()
+	} else {
+		data, err = read_clipboard_with_helper()
+	}
+	if err == nil && len(data) == 0 {
+		err = errNoClipboardImage
+	}
+	return
+}
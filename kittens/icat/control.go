@@ -0,0 +1,92 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"kitty/tools/tty"
+	"kitty/tools/tui/graphics"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+var control_file *os.File
+
+func parse_control_fd() (err error) {
+	if !opts.HoldOpen {
+		return
+	}
+	if opts.ControlFd == 0 {
+		control_file = os.Stdin
+		// STDIN is used for commands so cannot also be used for image data
+		opts.Stdin = "no"
+		return
+	}
+	if _, err = unix.FcntlInt(uintptr(opts.ControlFd), unix.F_GETFD, 0); err != nil {
+		return fmt.Errorf("Invalid value for --control-fd: %d is not an open file descriptor", opts.ControlFd)
+	}
+	control_file = os.NewFile(uintptr(opts.ControlFd), "control")
+	return
+}
+
+// Read commands from the control fd, one per line, until it is closed or a
+// quit command is received. See the documentation of --hold-open for the
+// protocol.
+func run_control_loop(t *tty.Term, display func(items []input_arg)) error {
+	scanner := bufio.NewScanner(control_file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmd, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+		switch cmd {
+		case "display":
+			if rest == "" {
+				print_error("The display command requires a path or URL\r\n")
+				continue
+			}
+			// only the input in the command, not STDIN or the clipboard again
+			items, err := resolve_args(rest)
+			if err != nil {
+				report_failure("display", rest, err)
+				continue
+			}
+			display(select_only(items))
+		case "clear":
+			cc := &graphics.GraphicsCommand{}
+			cc.SetAction(graphics.GRT_action_delete)
+			if rest == "" {
+				cc.SetDelete(graphics.GRT_free_visible)
+			} else {
+				id, err := strconv.ParseUint(rest, 10, 32)
+				if err != nil || id == 0 {
+					print_error("Invalid image id for the clear command: %s\r\n", rest)
+					continue
+				}
+				cc.SetDelete(graphics.GRT_free_by_id).SetImageId(uint32(id))
+			}
+			cc.WriteWithPayloadTo(os.Stdout, nil)
+		case "resize":
+			sz, err := t.GetSize()
+			if err != nil {
+				print_error("Failed to query terminal size: %s\r\n", err)
+				continue
+			}
+			screen_size = sz
+		case "quit":
+			return nil
+		default:
+			print_error("Unknown control command: %#v\r\n", cmd)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,137 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var _ = fmt.Print
+
+const (
+	basic_auth  = "basic"
+	bearer_auth = "bearer"
+)
+
+type credential struct {
+	// Either basic_auth, the default, or bearer_auth
+	Scheme   string `json:"scheme"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+func (c *credential) validate() error {
+	switch c.Scheme {
+	case "", basic_auth:
+		c.Scheme = basic_auth
+	case bearer_auth:
+		if c.Token == "" {
+			return fmt.Errorf("No token specified for bearer authentication")
+		}
+	default:
+		return fmt.Errorf("Unknown authentication scheme: %#v, must be %s or %s", c.Scheme, basic_auth, bearer_auth)
+	}
+	return nil
+}
+
+// Credentials keyed by scheme://host or host, with an optional :port
+var credentials map[string]credential
+
+// The file is either a JSON object mapping hosts to objects with scheme,
+// username, password or token keys, or lines of the form:
+// host = [basic] username:password or host = bearer TOKEN. Blank lines and
+// lines starting with # are ignored.
+func parse_credentials(data []byte) (ans map[string]credential, err error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err = json.Unmarshal(trimmed, &ans); err != nil {
+			return nil, fmt.Errorf("Invalid JSON in credentials file: %w", err)
+		}
+		for host, c := range ans {
+			if err = c.validate(); err != nil {
+				return nil, fmt.Errorf("Invalid credentials for %s in credentials file: %w", host, err)
+			}
+			ans[host] = c
+		}
+		return
+	}
+	ans = make(map[string]credential)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lnum := 1; scanner.Scan(); lnum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		host, val, found := strings.Cut(line, "=")
+		host, val = strings.TrimSpace(host), strings.TrimSpace(val)
+		if !found || host == "" {
+			return nil, fmt.Errorf("Invalid line %d in credentials file, lines must be of the form: host = username:password", lnum)
+		}
+		var c credential
+		if scheme, rest, _ := strings.Cut(val, " "); scheme == basic_auth || scheme == bearer_auth {
+			c.Scheme, val = scheme, strings.TrimSpace(rest)
+		}
+		if c.Scheme == bearer_auth {
+			c.Token = val
+		} else {
+			c.Username, c.Password, _ = strings.Cut(val, ":")
+		}
+		if err = c.validate(); err != nil {
+			return nil, fmt.Errorf("Invalid line %d in credentials file: %w", lnum, err)
+		}
+		ans[host] = c
+	}
+	return ans, scanner.Err()
+}
+
+func parse_credentials_file() (err error) {
+	if opts.CredentialsFile == "" {
+		return
+	}
+	s, err := os.Stat(opts.CredentialsFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read credentials file with error: %w", err)
+	}
+	if s.Mode().Perm()&0o004 != 0 {
+		print_error("\x1b[33mWarning\x1b[39m: the credentials file %s is readable by all users, restrict its permissions with: chmod go-rwx %s", opts.CredentialsFile, opts.CredentialsFile)
+	}
+	data, err := os.ReadFile(opts.CredentialsFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read credentials file with error: %w", err)
+	}
+	credentials, err = parse_credentials(data)
+	return
+}
+
+// Keys without a scheme match only https URLs, so that credentials are never
+// sent in the clear unless the file explicitly asks for it
+func credential_for(u *url.URL) (credential, bool) {
+	keys := []string{u.Scheme + "://" + u.Host, u.Scheme + "://" + u.Hostname()}
+	if u.Scheme == "https" {
+		keys = append(keys, u.Host, u.Hostname())
+	}
+	for _, key := range keys {
+		if c, found := credentials[key]; found {
+			return c, true
+		}
+	}
+	return credential{}, false
+}
+
+// Add the Authorization header for the host of the request, if any
+func add_credentials(req *http.Request) {
+	if c, found := credential_for(req.URL); found {
+		if c.Scheme == bearer_auth {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		} else {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestParseCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name, data string
+		expected   map[string]credential
+		err        bool
+	}{
+		{name: "empty", data: "", expected: map[string]credential{}},
+		{name: "comments", data: "# a comment\n\n  # indented = x:y\n", expected: map[string]credential{}},
+		{name: "basic", data: "example.com = user:pass:word\nhttps://example.org:8443 = basic u:p", expected: map[string]credential{
+			"example.com":              {Scheme: basic_auth, Username: "user", Password: "pass:word"},
+			"https://example.org:8443": {Scheme: basic_auth, Username: "u", Password: "p"},
+		}},
+		{name: "bearer", data: "example.com = bearer  abc:def ", expected: map[string]credential{
+			"example.com": {Scheme: bearer_auth, Token: "abc:def"},
+		}},
+		{name: "token user is not special", data: "example.com = token:abc", expected: map[string]credential{
+			"example.com": {Scheme: basic_auth, Username: "token", Password: "abc"},
+		}},
+		{name: "json", data: `{"example.com": {"username": "u", "password": "p"}, "http://example.org": {"scheme": "bearer", "token": "t"}}`, expected: map[string]credential{
+			"example.com":        {Scheme: basic_auth, Username: "u", Password: "p"},
+			"http://example.org": {Scheme: bearer_auth, Token: "t"},
+		}},
+		{name: "missing equals", data: "# ok\nexample.com user:pass", err: true},
+		{name: "missing host", data: " = user:pass", err: true},
+		{name: "empty token", data: "example.com = bearer ", err: true},
+		{name: "invalid json", data: `{"example.com": `, err: true},
+		{name: "unknown json scheme", data: `{"example.com": {"scheme": "digest"}}`, err: true},
+		{name: "empty json token", data: `{"example.com": {"scheme": "bearer"}}`, err: true},
+	} {
+		actual, err := parse_credentials([]byte(tc.data))
+		if tc.err {
+			if err == nil {
+				t.Fatalf("%s: parsing did not fail, got: %v", tc.name, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if diff := cmp.Diff(tc.expected, actual); diff != "" {
+			t.Fatalf("%s: unexpected credentials:\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestCredentialFor(t *testing.T) {
+	orig := credentials
+	defer func() { credentials = orig }()
+	credentials = map[string]credential{
+		"example.com":              {Username: "host"},
+		"example.com:8443":         {Username: "host-port"},
+		"http://plain.example.com": {Username: "http-url"},
+		"https://secure.example":   {Username: "https-url"},
+	}
+	for _, tc := range []struct{ url, expected string }{
+		{"https://example.com/a.png", "host"},
+		{"https://example.com:8443/a.png", "host-port"},
+		{"https://example.com:9000/a.png", "host"},
+		{"http://example.com/a.png", ""},
+		{"http://example.com:8443/a.png", ""},
+		{"http://plain.example.com/a.png", "http-url"},
+		{"https://plain.example.com/a.png", ""},
+		{"https://secure.example/a.png", "https-url"},
+		{"http://secure.example/a.png", ""},
+		{"https://other.example/a.png", ""},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, found := credential_for(u)
+		if found != (tc.expected != "") || c.Username != tc.expected {
+			t.Fatalf("Unexpected credentials for %s: %#v (found: %v) expected: %#v", tc.url, c.Username, found, tc.expected)
+		}
+	}
+}
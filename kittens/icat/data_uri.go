@@ -0,0 +1,100 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var _ = fmt.Print
+
+func is_data_uri(arg string) bool {
+	return strings.HasPrefix(arg, "data:")
+}
+
+// A short name for a data URI for use in messages, as the URI itself can be huge
+func data_uri_name(uri string) string {
+	header, _, _ := strings.Cut(uri, ",")
+	return header + ",…"
+}
+
+// Decode a data URI of the form data:[<mediatype>][;base64],<data> as
+// described in RFC 2397. The media type must be an image type.
+func decode_data_uri(uri string) ([]byte, error) {
+	header, payload, found := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !found {
+		return nil, fmt.Errorf("Malformed data URI, no comma separating the media type from the data")
+	}
+	params := strings.Split(header, ";")
+	is_base64 := len(params) > 1 && strings.EqualFold(params[len(params)-1], "base64")
+	if is_base64 {
+		params = params[:len(params)-1]
+	}
+	media_type := strings.ToLower(strings.TrimSpace(params[0]))
+	if media_type == "" {
+		// the default media type
+		media_type = "text/plain"
+	}
+	if !strings.HasPrefix(media_type, "image/") {
+		return nil, fmt.Errorf("Unsupported media type in data URI: %s, only images can be displayed", media_type)
+	}
+	// percent encoding can be used for both plain and base64 data
+	payload, err := url.PathUnescape(strings.TrimSpace(payload))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid percent encoding in data URI: %w", err)
+	}
+	if !is_base64 {
+		return []byte(payload), nil
+	}
+	// whitespace is ignored in base64 data, which is often wrapped
+	payload = strings.Join(strings.Fields(payload), "")
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		// some producers omit the padding
+		if data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "=")); err != nil {
+			return nil, fmt.Errorf("Invalid base64 data in data URI: %w", err)
+		}
+	}
+	return data, nil
+}
+
+// Return true if data read from STDIN is a data URI rather than image data
+func is_data_uri_bytes(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("data:"))
+}
+
+// Replace the data read from STDIN with the image data it contains, if it is a
+// data URI
+func decode_stdin_data_uri(f *opened_input) error {
+	var text []byte
+	switch src := f.file.(type) {
+	case *BytesBuf:
+		text = src.data
+	case *os.File:
+		// data that was written to a temporary file, read it back as the
+		// whole URI is needed to decode it
+		head := make([]byte, len("data:"))
+		if n, _ := src.ReadAt(head, 0); !is_data_uri_bytes(head[:n]) {
+			return nil
+		}
+		var err error
+		if text, err = read_all_limited(src); err != nil {
+			return err
+		}
+	}
+	if !is_data_uri_bytes(text) {
+		return nil
+	}
+	data, err := decode_data_uri(string(text))
+	if err != nil {
+		return err
+	}
+	f.Release()
+	f.file = &BytesBuf{data: data}
+	return nil
+}
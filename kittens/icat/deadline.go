@@ -0,0 +1,52 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+var errDeadlineReached = errors.New("The --deadline was reached")
+var deadline_reached atomic.Bool
+
+// How long to wait, after the deadline, for images being processed to notice
+// that processing has stopped
+const deadline_grace_period = time.Second
+
+// Stop processing when --deadline is reached. Downloads are cancelled as they
+// watch keep_going and ImageMagick is killed. The returned channel is closed
+// when the deadline is reached, it is nil if there is no deadline.
+func start_deadline() (reached <-chan struct{}, stop func()) {
+	if opts.Deadline <= 0 {
+		return nil, func() {}
+	}
+	ch := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	images.MagickContext = ctx
+	t := time.AfterFunc(time.Duration(opts.Deadline*float64(time.Second)), func() {
+		deadline_reached.Store(true)
+		keep_going.Store(false)
+		cancel()
+		close(ch)
+	})
+	return ch, func() {
+		t.Stop()
+		cancel()
+	}
+}
+
+// Report an input whose processing was stopped before it finished as skipped,
+// when the deadline was reached
+func report_stopped(index int, source_name string) {
+	if deadline_reached.Load() {
+		report_error(index, source_name, "Skipped", errDeadlineReached)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"time"
 
 	"kitty/tools/tui/graphics"
 	"kitty/tools/tui/loop"
@@ -17,121 +16,82 @@ import (
 
 var _ = fmt.Print
 
-func DetectSupport(timeout time.Duration) (memory, files, direct bool, err error) {
+// Whether the terminal supports the graphics protocol and which of its
+// transmission mediums
+type graphics_support struct {
+	memory, files, direct bool
+}
+
+// Return a query that detects support for the graphics protocol, filling in ans
+func graphics_support_query(ans *graphics_support) *terminal_query {
 	temp_files_to_delete := make([]string, 0, 8)
 	shm_files_to_delete := make([]shm.MMap, 0, 8)
 	var direct_query_id, file_query_id, memory_query_id uint32
-	lp, e := loop.New(loop.NoAlternateScreen, loop.NoRestoreColors, loop.NoMouseTracking)
-	if e != nil {
-		err = e
-		return
-	}
-	print_error := func(format string, args ...any) {
-		lp.Println(fmt.Sprintf(format, args...))
-	}
-
-	defer func() {
-		if len(temp_files_to_delete) > 0 && transfer_by_file != supported {
-			for _, name := range temp_files_to_delete {
-				os.Remove(name)
-			}
-		}
-		if len(shm_files_to_delete) > 0 && transfer_by_memory != supported {
-			for _, name := range shm_files_to_delete {
-				name.Unlink()
+	return &terminal_query{
+		write: func(lp *loop.Loop) {
+			print_error := func(format string, args ...any) {
+				lp.Println(fmt.Sprintf(format, args...))
 			}
-		}
-	}()
-
-	lp.OnInitialize = func() (string, error) {
-		var iid uint32
-		lp.AddTimer(timeout, false, func(loop.IdType) error {
-			return fmt.Errorf("Timed out waiting for a response form the terminal: %w", os.ErrDeadlineExceeded)
-		})
-
-		g := func(t graphics.GRT_t, payload string) uint32 {
-			iid += 1
-			g1 := &graphics.GraphicsCommand{}
-			g1.SetTransmission(t).SetAction(graphics.GRT_action_query).SetImageId(iid).SetDataWidth(1).SetDataHeight(1).SetFormat(
-				graphics.GRT_format_rgb).SetDataSize(uint64(len(payload)))
-			g1.WriteWithPayloadToLoop(lp, utils.UnsafeStringToBytes(payload))
-			return iid
-		}
-
-		direct_query_id = g(graphics.GRT_transmission_direct, "123")
-		tf, err := images.CreateTempInRAM()
-		if err == nil {
-			file_query_id = g(graphics.GRT_transmission_tempfile, tf.Name())
-			temp_files_to_delete = append(temp_files_to_delete, tf.Name())
-			tf.Write([]byte{1, 2, 3})
-			tf.Close()
-		} else {
-			print_error("Failed to create temporary file for data transfer, file based transfer is disabled. Error: %v", err)
-		}
-		sf, err := shm.CreateTemp("icat-", 3)
-		if err == nil {
-			memory_query_id = g(graphics.GRT_transmission_sharedmem, sf.Name())
-			shm_files_to_delete = append(shm_files_to_delete, sf)
-			copy(sf.Slice(), []byte{1, 2, 3})
-			sf.Close()
-		} else {
-			var ens *shm.ErrNotSupported
-			if !errors.As(err, &ens) {
-				print_error("Failed to create SHM for data transfer, memory based transfer is disabled. Error: %v", err)
+			var iid uint32
+			g := func(t graphics.GRT_t, payload string) uint32 {
+				iid += 1
+				g1 := &graphics.GraphicsCommand{}
+				g1.SetTransmission(t).SetAction(graphics.GRT_action_query).SetImageId(iid).SetDataWidth(1).SetDataHeight(1).SetFormat(
+					graphics.GRT_format_rgb).SetDataSize(uint64(len(payload)))
+				g1.WriteWithPayloadToLoop(lp, utils.UnsafeStringToBytes(payload))
+				return iid
 			}
-		}
-		lp.QueueWriteString("\x1b[c")
 
-		return "", nil
-	}
-
-	lp.OnEscapeCode = func(etype loop.EscapeCodeType, payload []byte) (err error) {
-		switch etype {
-		case loop.CSI:
-			if len(payload) > 3 && payload[0] == '?' && payload[len(payload)-1] == 'c' {
-				lp.Quit(0)
-				return nil
+			direct_query_id = g(graphics.GRT_transmission_direct, "123")
+			tf, err := images.CreateTempInRAM()
+			if err == nil {
+				file_query_id = g(graphics.GRT_transmission_tempfile, tf.Name())
+				temp_files_to_delete = append(temp_files_to_delete, tf.Name())
+				tf.Write([]byte{1, 2, 3})
+				tf.Close()
+			} else {
+				print_error("Failed to create temporary file for data transfer, file based transfer is disabled. Error: %v", err)
 			}
-		case loop.APC:
-			g := graphics.GraphicsCommandFromAPC(payload)
-			if g != nil {
-				if g.ResponseMessage() == "OK" {
-					switch g.ImageId() {
-					case direct_query_id:
-						direct = true
-					case file_query_id:
-						files = true
-					case memory_query_id:
-						memory = true
-					}
+			sf, err := shm.CreateTemp("icat-", 3)
+			if err == nil {
+				memory_query_id = g(graphics.GRT_transmission_sharedmem, sf.Name())
+				shm_files_to_delete = append(shm_files_to_delete, sf)
+				copy(sf.Slice(), []byte{1, 2, 3})
+				sf.Close()
+			} else {
+				var ens *shm.ErrNotSupported
+				if !errors.As(err, &ens) {
+					print_error("Failed to create SHM for data transfer, memory based transfer is disabled. Error: %v", err)
 				}
+			}
+		},
+		on_escape_code: func(etype loop.EscapeCodeType, payload []byte) {
+			if etype != loop.APC {
 				return
 			}
-		}
-		return
-	}
-
-	lp.OnKeyEvent = func(event *loop.KeyEvent) error {
-		if event.MatchesPressOrRepeat("ctrl+c") {
-			event.Handled = true
-			print_error("Waiting for response from terminal, aborting now could lead to corruption")
-		}
-		if event.MatchesPressOrRepeat("ctrl+z") {
-			event.Handled = true
-		}
-		return nil
-	}
-
-	err = lp.Run()
-	if err != nil {
-		return
-	}
-	ds := lp.DeathSignalName()
-	if ds != "" {
-		fmt.Println("Killed by signal: ", ds)
-		lp.KillIfSignalled()
-		return
+			if g := graphics.GraphicsCommandFromAPC(payload); g != nil && g.ResponseMessage() == "OK" {
+				switch g.ImageId() {
+				case direct_query_id:
+					ans.direct = true
+				case file_query_id:
+					ans.files = true
+				case memory_query_id:
+					ans.memory = true
+				}
+			}
+		},
+		finish: func(error) {
+			// the terminal deletes the files it reads
+			if !ans.files {
+				for _, name := range temp_files_to_delete {
+					os.Remove(name)
+				}
+			}
+			if !ans.memory {
+				for _, name := range shm_files_to_delete {
+					name.Unlink()
+				}
+			}
+		},
 	}
-
-	return
 }
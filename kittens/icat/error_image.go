@@ -0,0 +1,89 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+const builtin_error_image_width, builtin_error_image_height = 160, 120
+
+// A light gray box with a border and a red cross
+func builtin_error_image() image.Image {
+	w, h := builtin_error_image_width, builtin_error_image_height
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	bg, border, cross := color.NRGBA{224, 224, 224, 255}, color.NRGBA{128, 128, 128, 255}, color.NRGBA{204, 0, 0, 255}
+	const thickness = 3
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := bg
+			if x < thickness || y < thickness || x >= w-thickness || y >= h-thickness {
+				c = border
+			} else {
+				// distance from the two diagonals, scaled by the width
+				d1, d2 := x*h-y*w, x*h-(h-1-y)*w
+				if d1 < 0 {
+					d1 = -d1
+				}
+				if d2 < 0 {
+					d2 = -d2
+				}
+				if d1 < thickness*w || d2 < thickness*w {
+					c = cross
+				}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+var error_image struct {
+	sync.Once
+	img image.Image
+	err error
+}
+
+func load_error_image() (image.Image, error) {
+	error_image.Do(func() {
+		if opts.OnErrorImage == "builtin" {
+			error_image.img = builtin_error_image()
+			return
+		}
+		data, err := images.OpenImageFromPath(opts.OnErrorImage)
+		if err != nil {
+			error_image.err = fmt.Errorf("Failed to load --on-error-image with error: %w", err)
+			return
+		}
+		error_image.img = data.Frames[0].Img
+	})
+	return error_image.img, error_image.err
+}
+
+// Return an image_data for displaying the --on-error-image in place of an
+// image that failed to be processed. Returns failed unchanged if the error
+// image could not be loaded.
+func error_placeholder(failed *image_data) *image_data {
+	img, err := load_error_image()
+	if err != nil {
+		print_error("%s\r\n", err)
+		return failed
+	}
+	imgd := &image_data{
+		source_name: failed.source_name, image_id: failed.image_id, index: failed.index,
+		use_unicode_placeholder: failed.use_unicode_placeholder, passthrough_mode: failed.passthrough_mode,
+		canvas_width: img.Bounds().Dx(), canvas_height: img.Bounds().Dy(), format_uppercase: "ERROR-IMAGE",
+	}
+	set_basic_metadata(imgd)
+	scale_image(imgd)
+	add_frame(&images.Context{}, imgd, img)
+	imgd.finish_padding()
+	return imgd
+}
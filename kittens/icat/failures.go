@@ -0,0 +1,77 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"net"
+	"os"
+)
+
+var _ = fmt.Print
+
+// Exit codes for when some or all of the inputs could not be displayed, other
+// errors exit with code 1
+const (
+	exit_code_some_failed = 2
+	exit_code_all_failed  = 3
+)
+
+func exit_code(num_displayed, num_failed int) int {
+	switch {
+	case num_failed == 0:
+		return 0
+	case num_displayed == 0:
+		return exit_code_all_failed
+	}
+	return exit_code_some_failed
+}
+
+// A short, stable name for the kind of error, for --errors-format=json, so
+// that scripts do not have to parse error messages
+func error_class(err error) string {
+	var sle *size_limit_error
+	var se *http_status_error
+	var ne net.Error
+	switch {
+	case errors.Is(err, errDeadlineReached):
+		return "deadline"
+	case errors.As(err, &sle):
+		return "size-limit"
+	case errors.As(err, &se):
+		return "http-status"
+	case errors.As(err, &ne):
+		return "network"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not-found"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission"
+	case errors.Is(err, image.ErrFormat):
+		return "unknown-format"
+	}
+	return "other"
+}
+
+// Report that the specified action failed for an input, as text or, with
+// --errors-format=json, as a JSON object per line
+func report_failure(action, source_name string, err error) {
+	if opts.ErrorsFormat == "json" {
+		data, _ := json.Marshal(struct {
+			Source  string `json:"source"`
+			Action  string `json:"action"`
+			Message string `json:"message"`
+			Class   string `json:"class"`
+		}{source_name, action, err.Error(), error_class(err)})
+		fmt.Fprintln(os.Stderr, string(data))
+		return
+	}
+	if source_name == "" {
+		print_error("Failed to %s: %s\r\n", action, err)
+	} else {
+		print_error("Failed to %s \x1b[31m%s\x1b[39m: %s\r\n", action, source_name, err)
+	}
+}
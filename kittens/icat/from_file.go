@@ -0,0 +1,53 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var _ = fmt.Print
+
+// Read the inputs listed in the --from-file file, one per line, ignoring blank
+// lines and comments
+func parse_from_file() (args []string, err error) {
+	if opts.FromFile == "" {
+		return
+	}
+	var src io.Reader = os.Stdin
+	name := "STDIN"
+	if opts.FromFile == "-" {
+		if opts.HoldOpen && opts.ControlFd == 0 {
+			return nil, fmt.Errorf("Cannot use --from-file=- with --hold-open as commands are read from STDIN, use --control-fd")
+		}
+		if opts.Stdin == "yes" {
+			return nil, fmt.Errorf("Cannot use --from-file=- with --stdin=yes as STDIN cannot be both a list of inputs and image data")
+		}
+		// STDIN is the list of inputs so cannot also be used for image data
+		opts.Stdin = "no"
+	} else {
+		f, err := os.Open(opts.FromFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open the --from-file file with error: %w", err)
+		}
+		defer f.Close()
+		src, name = f, opts.FromFile
+	}
+	scanner := bufio.NewScanner(src)
+	// allow for very long URLs, such as data: URIs
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			args = append(args, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read the list of inputs from %s with error: %w", name, err)
+	}
+	return
+}
@@ -0,0 +1,74 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+// Return HEIF or AVIF if the file starts with an ftyp box with one of their
+// brands, otherwise the empty string
+func heif_format(f *opened_input) string {
+	defer f.Rewind()
+	header := make([]byte, images.SniffLength)
+	n, _ := io.ReadFull(f.file, header)
+	return images.HEIFFormat(header[:n])
+}
+
+func have_magick() bool {
+	// without the magick program, the ImageMagick 6 programs are used
+	return images.MagickExe() != "magick" || utils.Which("identify") != ""
+}
+
+// Prepare a HEIF or AVIF image for rendering. The primary image is decoded
+// with libheif if kitty was built with it, otherwise ImageMagick is used.
+func probe_heif_input(p *probed_input, format string) error {
+	if !have_libheif || opts.Engine == "magick" {
+		if !have_magick() {
+			return fmt.Errorf("Displaying %s images requires kitty to be built with libheif or ImageMagick to be installed", format)
+		}
+		return nil
+	}
+	ra, ok := p.file.file.(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("%s image data cannot be read randomly", format)
+	}
+	h, err := images.ParseHEIF(ra)
+	if err != nil {
+		return err
+	}
+	imgd := &p.imgd
+	imgd.format_uppercase = h.Format
+	imgd.canvas_width, imgd.canvas_height = h.Width, h.Height
+	if !opts.NoExif {
+		imgd.orientation = h.Orientation
+		if imgd.orientation > 4 {
+			// these orientations rotate the image by 90 degrees
+			imgd.canvas_width, imgd.canvas_height = imgd.canvas_height, imgd.canvas_width
+		}
+	}
+	if h.NumImages > 1 {
+		imgd.info = append(imgd.info, fmt.Sprintf("Displaying the primary image of the %d images in the file", h.NumImages))
+	}
+	if opts.ShowLocation {
+		imgd.caption = location_caption(&p.file, h.Format)
+	}
+	p.can_use_go = true
+	return nil
+}
+
+func load_heif_image(src *opened_input) (image.Image, error) {
+	data, err := io.ReadAll(src.file)
+	src.Rewind()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read HEIF file: %w", err)
+	}
+	return decode_heif_image(data)
+}
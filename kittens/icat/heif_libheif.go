@@ -0,0 +1,80 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+//go:build libheif
+
+package icat
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"unsafe"
+)
+
+var _ = fmt.Print
+
+const have_libheif = true
+
+func heif_error(prefix string, err C.struct_heif_error) error {
+	if err.code == C.heif_error_Ok {
+		return nil
+	}
+	return fmt.Errorf("%s: %s", prefix, C.GoString(err.message))
+}
+
+func decode_heif_image(data []byte) (image.Image, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Empty HEIF file")
+	}
+	ctx := C.heif_context_alloc()
+	if ctx == nil {
+		return nil, fmt.Errorf("Failed to initialize libheif")
+	}
+	defer C.heif_context_free(ctx)
+	// libheif copies the data, so it does not keep a pointer to Go memory
+	if err := heif_error("libheif failed to read image", C.heif_context_read_from_memory(ctx, unsafe.Pointer(&data[0]), C.size_t(len(data)), nil)); err != nil {
+		return nil, err
+	}
+	var handle *C.struct_heif_image_handle
+	if err := heif_error("libheif failed to find the primary image", C.heif_context_get_primary_image_handle(ctx, &handle)); err != nil {
+		return nil, err
+	}
+	defer C.heif_image_handle_release(handle)
+	options := C.heif_decoding_options_alloc()
+	defer C.heif_decoding_options_free(options)
+	// the rotation and mirroring are applied as the orientation of the image
+	// so that --no-exif works as for other formats
+	options.ignore_transformations = 1
+	var img *C.struct_heif_image
+	if err := heif_error("libheif failed to decode image", C.heif_decode_image(handle, &img, C.heif_colorspace_RGB, C.heif_chroma_interleaved_RGBA, options)); err != nil {
+		return nil, err
+	}
+	defer C.heif_image_release(img)
+	var stride C.int
+	plane := C.heif_image_get_plane_readonly(img, C.heif_channel_interleaved, &stride)
+	if plane == nil {
+		return nil, fmt.Errorf("libheif produced an image with no pixels")
+	}
+	width, height := int(C.heif_image_get_width(img, C.heif_channel_interleaved)), int(C.heif_image_get_height(img, C.heif_channel_interleaved))
+	pix := unsafe.Slice((*byte)(unsafe.Pointer(plane)), int(stride)*height)
+	r := image.Rect(0, 0, width, height)
+	var ans image.Image
+	var dest []byte
+	if C.heif_image_handle_is_premultiplied_alpha(handle) != 0 {
+		rgba := image.NewRGBA(r)
+		ans, dest = rgba, rgba.Pix
+	} else {
+		nrgba := image.NewNRGBA(r)
+		ans, dest = nrgba, nrgba.Pix
+	}
+	for y := 0; y < height; y++ {
+		copy(dest[y*4*width:(y+1)*4*width], pix[y*int(stride):])
+	}
+	return ans, nil
+}
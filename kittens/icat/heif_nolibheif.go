@@ -0,0 +1,18 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+//go:build !libheif
+
+package icat
+
+import (
+	"fmt"
+	"image"
+)
+
+var _ = fmt.Print
+
+const have_libheif = false
+
+func decode_heif_image(data []byte) (image.Image, error) {
+	return nil, fmt.Errorf("Not built with libheif support")
+}
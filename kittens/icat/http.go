@@ -0,0 +1,401 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"kitty"
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+// The number of times a download is retried after a transient failure and
+// the delay before the first retry, which doubles for every retry
+const max_http_retries = 3
+const initial_http_retry_delay = 500 * time.Millisecond
+
+// The longest delay requested by a Retry-After header that is waited for,
+// downloads from servers asking for longer delays fail instead
+const max_retry_after = 2 * time.Minute
+
+var http_client = &http.Client{CheckRedirect: check_redirect}
+
+// With --proxy, the proxy for all requests, overriding the proxy environment variables
+var proxy_url *url.URL
+
+func parse_proxy() error {
+	if opts.Proxy == "" {
+		// the default transport uses the proxy environment variables
+		return nil
+	}
+	raw := opts.Proxy
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("Invalid value for --proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("Invalid value for --proxy, unsupported scheme: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("Invalid value for --proxy, no host specified: %s", opts.Proxy)
+	}
+	proxy_url = u
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyURL(u)
+	http_client.Transport = t
+	return nil
+}
+
+// Return true if err is a failure to connect to the proxy, rather than to the server
+func is_proxy_error(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "proxyconnect"
+}
+
+func check_redirect(req *http.Request, via []*http.Request) error {
+	if len(via) > opts.MaxRedirects {
+		return fmt.Errorf("too many redirects, at most %d are followed as set by --max-redirects", utils.Max(0, opts.MaxRedirects))
+	}
+	return nil
+}
+
+func user_agent() string {
+	if opts.UserAgent != "" {
+		return opts.UserAgent
+	}
+	return "kitty-icat/" + kitty.VersionString
+}
+
+// Media types servers commonly use for images when they do not know better
+var generic_media_types = map[string]bool{"application/octet-stream": true, "binary/octet-stream": true, "application/binary": true}
+
+// Return an error if the response is not an image, for example, an HTML page
+// explaining an error. Servers sometimes use misleading media types, so data
+// that starts like an image is accepted whatever its Content-Type.
+func check_content_type(resp *http.Response, data []byte) error {
+	if images.SniffImageType(data) != "" {
+		return nil
+	}
+	media_type := ""
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if media_type, _, err = mime.ParseMediaType(ct); err != nil {
+			return nil
+		}
+	} else if strings.HasPrefix(http.DetectContentType(data), "text/html") {
+		media_type = "text/html"
+	}
+	if media_type == "" || strings.HasPrefix(media_type, "image/") || generic_media_types[media_type] {
+		return nil
+	}
+	var err error
+	if media_type == "text/html" || media_type == "application/xhtml+xml" {
+		err = fmt.Errorf("server returned an HTML page instead of an image, the URL is probably for a web page or the server reported an error")
+	} else {
+		err = fmt.Errorf("server returned data of type %s instead of an image", media_type)
+	}
+	if s := body_snippet(data); s != "" {
+		err = fmt.Errorf("%w, it starts with: %s", err, s)
+	}
+	return err
+}
+
+// The start of the text of a response, with any markup removed, such as the
+// message on an error page. Empty if the response is not text.
+func body_snippet(data []byte) string {
+	const max_runes = 120
+	data = data[:utils.Min(len(data), 4096)]
+	// the data can end in the middle of a character
+	for i := 0; i < utf8.UTFMax && len(data) > 0 && !utf8.Valid(data); i++ {
+		data = data[:len(data)-1]
+	}
+	if !utf8.Valid(data) {
+		return ""
+	}
+	// scripts, styles and comments are not part of the text
+	text := utils.MustCompile(`(?is)<(?:script|style)\b.*?</(?:script|style)\s*>|<!--.*?-->`).ReplaceAllString(string(data), " ")
+	text = utils.MustCompile(`<[^>]*>`).ReplaceAllString(text, " ")
+	text = strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+	if strings.IndexFunc(text, func(r rune) bool { return !unicode.IsPrint(r) }) > -1 {
+		return ""
+	}
+	if runes := []rune(text); len(runes) > max_runes {
+		text = string(runes[:max_runes]) + "…"
+	}
+	return text
+}
+
+var errDownloadCancelled = errors.New("Download cancelled")
+
+// Bounds the number of simultaneous downloads to --http-concurrency, nil for no limit
+var download_slots chan struct{}
+
+// Bounds the number of simultaneous downloads from each server to half of
+// --http-concurrency, so that a slow server cannot hold up downloads from
+// the others
+var host_download_slots = struct {
+	sync.Mutex
+	slots map[string]chan struct{}
+}{slots: make(map[string]chan struct{})}
+
+func setup_download_slots(num_cpus int) {
+	if download_slots != nil {
+		// already setup for a previous batch of inputs
+		return
+	}
+	n := opts.HttpConcurrency
+	if n == 0 {
+		n = utils.Min(8, 2*num_cpus)
+	}
+	if n > 0 {
+		download_slots = make(chan struct{}, n)
+	}
+}
+
+func slots_for_host(host string) chan struct{} {
+	host_download_slots.Lock()
+	defer host_download_slots.Unlock()
+	ans := host_download_slots.slots[host]
+	if ans == nil {
+		ans = make(chan struct{}, utils.Max(1, cap(download_slots)/2))
+		host_download_slots.slots[host] = ans
+	}
+	return ans
+}
+
+// Wait for a download slot for host, returning false if ctx is cancelled first
+func acquire_download_slot(ctx context.Context, host string) bool {
+	if download_slots == nil {
+		return true
+	}
+	select {
+	case slots_for_host(host) <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case download_slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		<-slots_for_host(host)
+		return false
+	}
+}
+
+func release_download_slot(host string) {
+	if download_slots != nil {
+		<-download_slots
+		<-slots_for_host(host)
+	}
+}
+
+type http_status_error struct {
+	status      string
+	status_code int
+	retry_after time.Duration // from the Retry-After header of 429 and 503 responses, zero if absent
+}
+
+func (self *http_status_error) Error() string {
+	return fmt.Sprintf("bad status: %v", self.status)
+}
+
+// Parse the value of a Retry-After header, either a number of seconds or a date
+func parse_retry_after(val string, now time.Time) time.Duration {
+	val = strings.TrimSpace(val)
+	if secs, err := strconv.Atoi(val); err == nil {
+		return time.Duration(utils.Max(0, secs)) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+func http_timeout() time.Duration {
+	return time.Duration(opts.HttpTimeout * float64(time.Second))
+}
+
+// Return a context that is cancelled when processing is stopped, as
+// signalled by keep_going
+func context_cancelled_on_stop() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !keep_going.Load() {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+func is_timeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+func is_transient_http_error(err error) bool {
+	var se *http_status_error
+	if errors.As(err, &se) {
+		return se.status_code >= 500 || se.status_code == http.StatusTooManyRequests
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// Make a GET request for url, with --http-timeout applied to the request
+// including reading the body. The returned cancel function must be called
+// once the body has been read. If cached is not nil, the request is
+// conditional and the response can be 304 Not Modified.
+func http_get(parent context.Context, url string, cached *http_cache_entry) (resp *http.Response, cancel context.CancelFunc, err error) {
+	ctx, cancel := parent, context.CancelFunc(func() {})
+	if t := http_timeout(); t > 0 {
+		ctx, cancel = context.WithTimeout(parent, t)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", user_agent())
+	add_credentials(req)
+	if cached != nil {
+		cached.add_validators(req)
+	}
+	if resp, err = http_client.Do(req); err != nil {
+		cancel()
+		if is_proxy_error(err) {
+			proxy := "the proxy"
+			if proxy_url != nil {
+				proxy += " " + proxy_url.Redacted()
+			}
+			err = fmt.Errorf("could not connect to %s: %w", proxy, err)
+		}
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return resp, cancel, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		se := &http_status_error{status: resp.Status, status_code: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			se.retry_after = parse_retry_after(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return nil, nil, se
+	}
+	return resp, cancel, nil
+}
+
+func download_once(ctx context.Context, url, host string, cached *http_cache_entry) ([]byte, error) {
+	if !acquire_download_slot(ctx, host) {
+		return nil, ctx.Err()
+	}
+	defer release_download_slot(host)
+	resp, cancel, err := http_get(ctx, url, cached)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		cache_download(cached, resp)
+		return cached.Data, nil
+	}
+	// ContentLength is -1 for chunked responses, which are limited as they are read
+	if err = check_size_limit(resp.ContentLength); err != nil {
+		return nil, err
+	}
+	data, err := read_all_limited(resp.Body)
+	if err == nil {
+		err = check_content_type(resp, data)
+	}
+	if err == nil && http_cache_enabled() {
+		cache_download(&http_cache_entry{URL: url, Data: data}, resp)
+	}
+	return data, err
+}
+
+// Download url, retrying transient failures such as reset connections and
+// server errors with exponential backoff, or after the delay the server asks
+// for with Retry-After. Requests are throttled by --rate-limit. Returns
+// errDownloadCancelled if processing is stopped and an error saying so if the
+// download timed out. With --cache-dir, data that the server says is still
+// current is read from the cache instead.
+func download(url string) (data []byte, err error) {
+	var cached *http_cache_entry
+	if http_cache_enabled() {
+		if cached = read_http_cache(url); cached != nil && cached.is_fresh() {
+			return cached.Data, nil
+		}
+	}
+	ctx, cancel := context_cancelled_on_stop()
+	defer cancel()
+	host := url_host(url)
+	delay := initial_http_retry_delay
+	for attempt := 0; ; attempt++ {
+		if !wait_for_rate_limit(host) {
+			return nil, errDownloadCancelled
+		}
+		data, err = download_once(ctx, url, host, cached)
+		switch {
+		case err == nil:
+			return data, nil
+		case ctx.Err() != nil:
+			return nil, errDownloadCancelled
+		case is_timeout(err):
+			return nil, fmt.Errorf("timed out after %gs", opts.HttpTimeout)
+		case !is_transient_http_error(err):
+			return nil, err
+		case attempt >= max_http_retries:
+			return nil, fmt.Errorf("%w, giving up after %d retries", err, attempt)
+		}
+		wait := delay
+		var se *http_status_error
+		if errors.As(err, &se) && se.retry_after > 0 {
+			if se.retry_after > max_retry_after {
+				return nil, fmt.Errorf("%w, the server asked to retry after %s, which is too long to wait", err, se.retry_after.Round(time.Second))
+			}
+			// the server is overloaded or rate limiting, so pause all requests to it
+			wait = se.retry_after
+			pause_requests(host, time.Now().Add(wait))
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errDownloadCancelled
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,142 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ = fmt.Print
+
+// A downloaded image, stored with what is needed to check if it is still
+// current with a conditional request
+type http_cache_entry struct {
+	URL          string
+	ETag         string
+	LastModified string
+	// The cached data is used without checking with the server until then
+	FreshUntil time.Time
+	Data       []byte
+}
+
+var http_cache_lock sync.Mutex
+
+func http_cache_enabled() bool {
+	return !opts.NoCache && opts.CacheDir != ""
+}
+
+func http_cache_path(url string) string {
+	h := sha256.Sum256([]byte(url))
+	return filepath.Join(opts.CacheDir, hex.EncodeToString(h[:])+".download")
+}
+
+func read_http_cache(url string) *http_cache_entry {
+	path := http_cache_path(url)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var ans http_cache_entry
+	if gob.NewDecoder(bytes.NewReader(data)).Decode(&ans) != nil || ans.URL != url {
+		os.Remove(path)
+		return nil
+	}
+	// the modification time is used to evict the least recently used downloads
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return &ans
+}
+
+func write_http_cache(e *http_cache_entry) (err error) {
+	if err = os.MkdirAll(opts.CacheDir, 0o700); err != nil {
+		return
+	}
+	f, err := os.CreateTemp(opts.CacheDir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	err = gob.NewEncoder(f).Encode(e)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(f.Name(), http_cache_path(e.URL)); err != nil {
+		return
+	}
+	http_cache_lock.Lock()
+	defer http_cache_lock.Unlock()
+	return trim_cache_dir(opts.CacheDir, ".download")
+}
+
+// Add the headers that make the server reply with 304 Not Modified if the
+// cached data is still current
+func (self *http_cache_entry) add_validators(req *http.Request) {
+	if self.ETag != "" {
+		req.Header.Set("If-None-Match", self.ETag)
+	}
+	if self.LastModified != "" {
+		req.Header.Set("If-Modified-Since", self.LastModified)
+	}
+}
+
+func (self *http_cache_entry) is_fresh() bool {
+	return time.Now().Before(self.FreshUntil)
+}
+
+// Update the entry from the headers of a response to a conditional or a
+// normal request, returning false if the response must not be cached
+func (self *http_cache_entry) update(resp *http.Response) bool {
+	self.FreshUntil = time.Time{}
+	max_age, has_max_age := 0, false
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			return false
+		case "no-cache":
+			// can be cached but must be checked with the server every time
+			max_age, has_max_age = 0, true
+		case "max-age":
+			if n, err := strconv.Atoi(strings.Trim(val, `"`)); err == nil && !has_max_age {
+				max_age, has_max_age = n, true
+			}
+		}
+	}
+	if has_max_age {
+		self.FreshUntil = time.Now().Add(time.Duration(max_age) * time.Second)
+	} else if t, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		self.FreshUntil = t
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		self.ETag = etag
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		self.LastModified = lm
+	}
+	// without validators stale data cannot be reused, so there is no point caching it
+	return self.is_fresh() || self.ETag != "" || self.LastModified != ""
+}
+
+// Store or remove the cached data for the URL, as the response allows.
+// Failing to store it is not an error, it is simply downloaded again.
+func cache_download(e *http_cache_entry, resp *http.Response) {
+	if e.update(resp) {
+		write_http_cache(e)
+	} else {
+		os.Remove(http_cache_path(e.URL))
+	}
+}
@@ -0,0 +1,65 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"io"
+
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+// Switch the input to the specified image, from one, of an ICO icon, or if
+// page is zero, to the smallest image that is at least as large as the size
+// the icon will be displayed at, rather than the largest image, which is
+// what is decoded by default
+func select_ico_image(p *probed_input, page int) error {
+	ra, ok := p.file.file.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+	entries, err := images.ICOEntries(ra)
+	if err != nil {
+		return err
+	}
+	largest := 0
+	for i, e := range entries {
+		if e.Width*e.Height > entries[largest].Width*entries[largest].Height {
+			largest = i
+		}
+	}
+	chosen := largest
+	if page > 0 {
+		if page > len(entries) {
+			return fmt.Errorf("The icon has only %d images, cannot select image %d", len(entries), page)
+		}
+		chosen = page - 1
+	} else if screen_size != nil {
+		// the size the largest image is displayed at, without modifying imgd.
+		// When images are not displayed, such as with --detect, the largest is used.
+		imgd := p.imgd
+		imgd.canvas_width, imgd.canvas_height = entries[largest].Width, entries[largest].Height
+		set_basic_metadata(&imgd)
+		needed_width, needed_height := images.FitImage(imgd.canvas_width, imgd.canvas_height, imgd.available_width, imgd.available_height)
+		for i, e := range entries {
+			c := entries[chosen]
+			if e.Width >= needed_width && e.Height >= needed_height && (e.Width*e.Height < c.Width*c.Height || (e.Width == c.Width && e.Height == c.Height && e.BitsPerPixel > c.BitsPerPixel)) {
+				chosen = i
+			}
+		}
+	}
+	e := entries[chosen]
+	data, err := images.ICOWithEntry(ra, e)
+	if err != nil {
+		return err
+	}
+	p.file.Release()
+	p.file.file = &BytesBuf{data: data}
+	p.imgd.canvas_width, p.imgd.canvas_height = e.Width, e.Height
+	if len(entries) > 1 {
+		p.imgd.info = append(p.imgd.info, fmt.Sprintf("Using image %d of %d in the icon with size %dx%d", chosen+1, len(entries), e.Width, e.Height))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+const max_magic_bytes_to_dump = 64
+
+func read_first_n_bytes(arg input_arg, n int) ([]byte, error) {
+	var src io.Reader
+	if arg.is_http_url {
+		resp, cancel, err := http_get(context.Background(), arg.value, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer cancel()
+		defer resp.Body.Close()
+		data, err := io.ReadAll(io.LimitReader(resp.Body, int64(n)))
+		if err == nil {
+			err = check_content_type(resp, data)
+		}
+		return data, err
+	} else if arg.is_data_uri {
+		data, err := decode_data_uri(arg.value)
+		if err != nil {
+			return nil, err
+		}
+		src = bytes.NewReader(data)
+	} else if arg.zip_entry != nil {
+		rc, err := arg.zip_entry.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		src = rc
+	} else if arg.is_clipboard {
+		if arg.clipboard_err != nil {
+			return nil, arg.clipboard_err
+		}
+		src = bytes.NewReader(arg.clipboard_data)
+	} else if arg.stdin_data != nil {
+		src = bytes.NewReader(arg.stdin_data)
+	} else if arg.value == "" {
+		src = os.Stdin
+	} else {
+		f, err := os.Open(arg.value)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		src = f
+	}
+	return io.ReadAll(io.LimitReader(src, int64(n)))
+}
+
+// Print a human readable report about how the format of each input is
+// recognized, using only its first n bytes
+func identify_formats(items []input_arg, n int) error {
+	w := os.Stdout
+	for i, arg := range items {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		name := arg.value
+		if name == "" {
+			name = arg.stdin_name()
+		} else if arg.is_data_uri {
+			name = data_uri_name(arg.value)
+		}
+		fmt.Fprintln(w, name)
+		data, err := read_first_n_bytes(arg, n)
+		if err != nil {
+			fmt.Fprintf(w, "  Could not read: %s\n", err)
+			continue
+		}
+		fmt.Fprintf(w, "  Read: %d of %d requested bytes\n", len(data), n)
+		if len(data) == 0 {
+			continue
+		}
+		if arg.value != "" && !arg.is_data_uri {
+			if mt := utils.GuessMimeType(arg.value); mt != "" {
+				fmt.Fprintf(w, "  Type from name: %s\n", mt)
+			}
+		}
+		dump := data[:utils.Min(len(data), max_magic_bytes_to_dump)]
+		fmt.Fprintln(w, "  Magic bytes:")
+		for _, line := range strings.Split(strings.TrimRight(hex.Dump(dump), "\n"), "\n") {
+			fmt.Fprintln(w, "    "+line)
+		}
+		c, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if format == "" {
+			fmt.Fprintln(w, "  Detected format: unknown")
+			fmt.Fprintln(w, "  Decoder: none built-in, ImageMagick will be used if it is installed")
+			continue
+		}
+		fmt.Fprintf(w, "  Detected format: %s\n", format)
+		fmt.Fprintf(w, "  Decoder: built-in %s decoder\n", format)
+		if is_raw_file(arg.value) {
+			fmt.Fprintln(w, "  Note: this is a camera RAW file, its embedded preview or --full-raw will be used instead")
+		}
+		if err != nil {
+			fmt.Fprintf(w, "  Header: could not be decoded from the first %d bytes: %s\n", len(data), err)
+		} else {
+			fmt.Fprintf(w, "  Header: %dx%d pixels\n", c.Width, c.Height)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+const reverse_geocode_url = "https://nominatim.openstreetmap.org/reverse"
+
+func format_coordinate(val float64, positive, negative string) string {
+	suffix := positive
+	if val < 0 {
+		suffix = negative
+	}
+	return fmt.Sprintf("%.5f° %s", math.Abs(val), suffix)
+}
+
+func reverse_geocode(loc *images.GPSLocation) (string, error) {
+	q := url.Values{}
+	q.Set("format", "jsonv2")
+	q.Set("zoom", "14")
+	q.Set("lat", fmt.Sprintf("%.6f", loc.Latitude))
+	q.Set("lon", fmt.Sprintf("%.6f", loc.Longitude))
+	req, err := http.NewRequest(http.MethodGet, reverse_geocode_url+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	// Nominatim usage policy requires an identifying User-Agent
+	req.Header.Set("User-Agent", "kitty-icat")
+	client := http.Client{Timeout: 10 * time.Second, Transport: http_client.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Bad status from reverse geocoding service: %v", resp.Status)
+	}
+	var result struct {
+		DisplayName string `json:"display_name"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.DisplayName, nil
+}
+
+// Return a caption describing the location at which the image was taken, or
+// an empty string if the image has no GPS data
+func location_caption(f *opened_input, format_uppercase string) string {
+	ra, ok := f.file.(io.ReaderAt)
+	if !ok {
+		return ""
+	}
+	loc := images.GPSFromEXIF(ra, format_uppercase)
+	if loc == nil {
+		return ""
+	}
+	ans := format_coordinate(loc.Latitude, "N", "S") + ", " + format_coordinate(loc.Longitude, "E", "W")
+	if loc.HasAltitude {
+		ans += fmt.Sprintf(", %.0f m", loc.Altitude)
+	}
+	if opts.ReverseGeocode {
+		if name, err := reverse_geocode(loc); err == nil && name != "" {
+			ans = name + " (" + ans + ")"
+		}
+	}
+	return ans
+}
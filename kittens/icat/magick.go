@@ -4,6 +4,8 @@ package icat
 
 import (
 	"fmt"
+	"io"
+	"os"
 
 	"kitty/tools/tui/graphics"
 	"kitty/tools/utils/images"
@@ -11,6 +13,10 @@ import (
 
 var _ = fmt.Print
 
+var magick_filters = map[string]string{
+	"lanczos": "Lanczos", "catmull-rom": "Catrom", "linear": "Triangle", "nearest": "Point", "area": "Box",
+}
+
 func Render(path string, ro *images.RenderOptions, frames []images.IdentifyRecord) (ans []*image_frame, err error) {
 	ro.TempfilenameTemplate = shm_template
 	image_frames, filenames, err := images.RenderWithMagick(path, ro, frames)
@@ -25,6 +31,13 @@ func Render(path string, ro *images.RenderOptions, frames []images.IdentifyRecor
 			if x.Is_opaque {
 				ans[i].transmission_format = graphics.GRT_format_rgb
 			}
+			ans[i].track()
+			if err = reduce_frame_bit_depth(ans[i]); err != nil {
+				for _, f := range filenames {
+					os.Remove(f)
+				}
+				return nil, err
+			}
 		}
 	}
 	return ans, err
@@ -40,19 +53,72 @@ func render_image_with_magick(imgd *image_data, src *opened_input) (err error) {
 		return err
 	}
 	imgd.format_uppercase = frames[0].Fmt_uppercase
+	if opts.NoExif {
+		// identify reports the sizes after applying the orientation
+		for i := range frames {
+			if f := &frames[i]; f.Dimensions_swapped {
+				f.Canvas.Width, f.Canvas.Height = f.Canvas.Height, f.Canvas.Width
+				f.Width, f.Height = f.Height, f.Width
+				f.Dimensions_swapped = false
+			}
+		}
+	} else if ra, ok := src.file.(io.ReaderAt); ok {
+		imgd.orientation = images.Orientation(ra, imgd.format_uppercase)
+	}
 	imgd.canvas_width, imgd.canvas_height = frames[0].Canvas.Width, frames[0].Canvas.Height
 	set_basic_metadata(imgd)
+	if err = crop_error(imgd); err != nil {
+		return err
+	}
 	if !imgd.needs_conversion {
 		make_output_from_input(imgd, src)
 		return nil
 	}
-	ro := images.RenderOptions{RemoveAlpha: remove_alpha, Flip: flip, Flop: flop}
+	ro := images.RenderOptions{RemoveAlpha: renderer.RemoveAlpha, Flip: renderer.Flip, Flop: renderer.Flop, Rotate: rotation, IgnoreOrientation: renderer.IgnoreOrientation}
+	if opts.FlattenAnimation != "none" {
+		ro.FlattenAnimation = opts.FlattenAnimation
+	}
 	if scale_image(imgd) {
 		ro.ResizeTo.X, ro.ResizeTo.Y = imgd.canvas_width, imgd.canvas_height
+		ro.ResizeFilter = magick_filters[interpolation_for(imgd.scaled_frac.x, imgd.scaled_frac.y)]
+	}
+	if imgd.padded_size.X > 0 {
+		ro.PadTo, ro.PadOffset = imgd.padded_size, imgd.pad_offset
+	}
+	ro.MaxDuration = max_animation_duration()
+	if imgd.crop != nil {
+		ro.Crop = *imgd.crop
+	}
+	if opts.Normalize != "none" || opts.AutoContrast {
+		ro.Normalize = "luminance"
+		if opts.Normalize == "per-channel" {
+			ro.Normalize = "per-channel"
+		}
+		if opts.AutoContrast {
+			ro.NormalizeClip = auto_contrast_clip * 100
+		}
+	}
+	if !tone_adjustment.IsIdentity() {
+		ro.Tone = &tone_adjustment
+	}
+	if imgd.format_uppercase == "WEBP" && len(frames) > 1 {
+		if ra, ok := src.file.(io.ReaderAt); ok {
+			if count, found := images.WebPLoopCount(ra); found {
+				// zero means forever
+				imgd.header_loops = count
+				if count == 0 {
+					imgd.header_loops = -1
+				}
+			}
+		}
 	}
 	imgd.frames, err = Render(src.FileSystemName(), &ro, frames)
 	if err != nil {
 		return err
 	}
+	imgd.finish_padding()
+	if ro.FlattenAnimation == "" && len(imgd.frames) < len(frames) {
+		imgd.info = append(imgd.info, fmt.Sprintf("Animation truncated to the first %d of %d frames", len(imgd.frames), len(frames)))
+	}
 	return nil
 }
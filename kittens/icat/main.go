@@ -3,9 +3,13 @@
 package icat
 
 import (
+	"encoding/json"
 	"fmt"
+	"image"
+	"math"
 	"os"
-	"runtime"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -31,8 +35,22 @@ type Place struct {
 var opts *Options
 var place *Place
 var z_index int32
-var remove_alpha *images.NRGBColor
-var flip, flop bool
+var renderer images.Renderer // configured from the options, Flip turns images upside down and Flop mirrors them left to right, as in ImageMagick
+var fraction *struct{ x, y float64 }
+var center_crop_aspect float64
+var crop_rect *image.Rectangle
+
+// The clockwise rotation in degrees, in [0, 360)
+var rotation float64
+
+var dither_method = images.FloydSteinbergDither
+var dither_strength float32 = 1
+
+// Dither whenever colors are reduced, not just for --output-bit-depth
+var dither_always bool
+
+// From --gamma, --brightness and --contrast
+var tone_adjustment images.ToneAdjustment
 
 type transfer_mode int
 
@@ -46,29 +64,56 @@ var transfer_by_file, transfer_by_memory, transfer_by_stream transfer_mode
 
 var files_channel chan input_arg
 var output_channel chan *image_data
+var inflight chan struct{}
 var num_of_items int
 var keep_going *atomic.Bool
 var screen_size *unix.Winsize
+var cells_output *os.File
 
 func send_output(imgd *image_data) {
 	output_channel <- imgd
 }
 
+// Queue the inputs for the workers started by start_workers()
+func queue_inputs(items []input_arg) {
+	files_channel = make(chan input_arg, len(items))
+	for i, ia := range items {
+		ia.index = i
+		files_channel <- ia
+	}
+	num_of_items = len(items)
+}
+
+// Slots are acquired before an input is taken from files_channel, so the
+// images holding slots are always the oldest ones not yet displayed.
+func acquire_inflight_slot() {
+	if inflight != nil {
+		inflight <- struct{}{}
+	}
+}
+
+func release_inflight_slot() {
+	if inflight != nil {
+		<-inflight
+	}
+}
+
 func parse_mirror() (err error) {
-	flip = opts.Mirror == "both" || opts.Mirror == "vertical"
-	flop = opts.Mirror == "both" || opts.Mirror == "horizontal"
+	renderer.Flip = opts.Mirror == "both" || opts.Mirror == "vertical"
+	renderer.Flop = opts.Mirror == "both" || opts.Mirror == "horizontal"
 	return
 }
 
 func parse_background() (err error) {
-	if opts.Background == "" || opts.Background == "none" {
+	if opts.Background == "" || opts.Background == "none" || opts.Background == "terminal" {
+		// the terminal background is queried once the terminal is known
 		return nil
 	}
 	col, err := style.ParseColor(opts.Background)
 	if err != nil {
 		return fmt.Errorf("Invalid value for --background: %w", err)
 	}
-	remove_alpha = &images.NRGBColor{R: col.Red, G: col.Green, B: col.Blue}
+	renderer.RemoveAlpha = &images.NRGBColor{R: col.Red, G: col.Green, B: col.Blue}
 	return
 }
 
@@ -87,6 +132,159 @@ func parse_z_index() (err error) {
 	return
 }
 
+func parse_fraction() (err error) {
+	if opts.Fraction == "" {
+		return nil
+	}
+	x, y, found := strings.Cut(opts.Fraction, ",")
+	if !found {
+		y = x
+	}
+	fraction = &struct{ x, y float64 }{}
+	if fraction.x, err = strconv.ParseFloat(strings.TrimSpace(x), 64); err != nil {
+		return fmt.Errorf("Invalid value for --fraction with error: %w", err)
+	}
+	if fraction.y, err = strconv.ParseFloat(strings.TrimSpace(y), 64); err != nil {
+		return fmt.Errorf("Invalid value for --fraction with error: %w", err)
+	}
+	if fraction.x <= 0 || fraction.y <= 0 {
+		return fmt.Errorf("Invalid value for --fraction, fractions must be positive: %s", opts.Fraction)
+	}
+	return
+}
+
+func parse_center_crop() (err error) {
+	if opts.CenterCropToAspect == "" {
+		return nil
+	}
+	w, h, found := strings.Cut(opts.CenterCropToAspect, ":")
+	if !found {
+		h = "1"
+	}
+	var aw, ah float64
+	if aw, err = strconv.ParseFloat(strings.TrimSpace(w), 64); err == nil {
+		ah, err = strconv.ParseFloat(strings.TrimSpace(h), 64)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid value for --center-crop-to-aspect with error: %w", err)
+	}
+	if aw <= 0 || ah <= 0 {
+		return fmt.Errorf("Invalid value for --center-crop-to-aspect, the aspect ratio must be positive: %s", opts.CenterCropToAspect)
+	}
+	center_crop_aspect = aw / ah
+	return
+}
+
+func parse_crop() (err error) {
+	if opts.Crop == "" {
+		return nil
+	}
+	m := utils.MustCompile(`^(\d+)x(\d+)(?:([+-]\d+)([+-]\d+))?$`).FindStringSubmatch(strings.TrimSpace(opts.Crop))
+	if m == nil {
+		return fmt.Errorf("Invalid value for --crop, must be of the form WIDTHxHEIGHT+X+Y: %s", opts.Crop)
+	}
+	var n [4]int
+	for i, x := range m[1:] {
+		if x != "" {
+			if n[i], err = strconv.Atoi(x); err != nil {
+				return fmt.Errorf("Invalid value for --crop with error: %w", err)
+			}
+		}
+	}
+	if n[0] == 0 || n[1] == 0 {
+		return fmt.Errorf("Invalid value for --crop, the width and height must be positive: %s", opts.Crop)
+	}
+	r := image.Rect(n[2], n[3], n[2]+n[0], n[3]+n[1])
+	crop_rect = &r
+	return
+}
+
+func parse_rotate() (err error) {
+	if math.IsNaN(opts.Rotate) || math.IsInf(opts.Rotate, 0) {
+		return fmt.Errorf("Invalid value for --rotate: %v", opts.Rotate)
+	}
+	if rotation = math.Mod(opts.Rotate, 360); rotation < 0 {
+		rotation += 360
+	}
+	return
+}
+
+func parse_tone_adjustment() (err error) {
+	if math.IsNaN(opts.Gamma) || math.IsInf(opts.Gamma, 0) || opts.Gamma <= 0 {
+		return fmt.Errorf("Invalid value for --gamma, it must be a positive number: %v", opts.Gamma)
+	}
+	if math.IsNaN(opts.Brightness) || opts.Brightness < -100 || opts.Brightness > 100 {
+		return fmt.Errorf("Invalid value for --brightness, it must be a number from -100 to 100: %v", opts.Brightness)
+	}
+	if math.IsNaN(opts.Contrast) || opts.Contrast < -100 || opts.Contrast > 100 {
+		return fmt.Errorf("Invalid value for --contrast, it must be a number from -100 to 100: %v", opts.Contrast)
+	}
+	tone_adjustment = images.ToneAdjustment{Gamma: opts.Gamma, Brightness: opts.Brightness, Contrast: opts.Contrast}
+	return
+}
+
+func parse_dither() (err error) {
+	method, strength, has_strength := strings.Cut(strings.TrimSpace(opts.Dither), ":")
+	switch method {
+	case "auto":
+		dither_always = opts.ForceDither
+	case "none":
+		dither_method = images.NoDither
+	case "floyd-steinberg":
+		dither_always = true
+	case "ordered":
+		dither_method, dither_always = images.OrderedDither, true
+	default:
+		return fmt.Errorf("Invalid value for --dither, unknown method: %#v", method)
+	}
+	if has_strength {
+		s, err := strconv.ParseFloat(strength, 32)
+		if err != nil || s < 0 || s > 1 {
+			return fmt.Errorf("Invalid value for --dither, the strength must be a number from 0 to 1: %s", strength)
+		}
+		dither_strength = float32(s)
+	}
+	if (method != "auto" && method != "none") && opts.OutputBitDepth == "24" && quality_bits() == 8 && opts.TransmitFormat != "sixel" {
+		print_error("\x1b[33mWarning\x1b[39m: --dither has no effect as colors are not reduced, use --output-bit-depth or --quality to reduce them")
+	}
+	return
+}
+
+// Use the directory from --tmpdir for all temporary files, instead of
+// preferring shared memory
+func parse_tmpdir() (err error) {
+	if opts.Tmpdir == "" {
+		// temporary files are created in TMPDIR, if set, by os.CreateTemp()
+		return
+	}
+	dir, err := filepath.Abs(utils.Expanduser(opts.Tmpdir))
+	if err != nil {
+		return fmt.Errorf("Invalid value for --tmpdir: %w", err)
+	}
+	if s, err := os.Stat(dir); err != nil || !s.IsDir() {
+		return fmt.Errorf("Invalid value for --tmpdir, not a directory: %s", opts.Tmpdir)
+	}
+	images.TempDir = dir
+	return
+}
+
+// Remove temporary files and shared memory when killed by a signal, as they
+// would otherwise be left behind. Must be called after any use of loop.Loop,
+// which resets signal handlers when it finishes.
+func cleanup_on_signal() (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM, unix.SIGHUP)
+	go func() {
+		s := <-sigs
+		keep_going.Store(false)
+		remove_temporary_data()
+		// die with the signal, so that the parent process knows what happened
+		signal.Reset(s)
+		unix.Kill(os.Getpid(), s.(unix.Signal))
+	}()
+	return func() { signal.Stop(sigs) }
+}
+
 func parse_place() (err error) {
 	if opts.Place == "" {
 		return nil
@@ -123,17 +321,96 @@ func parse_place() (err error) {
 	return nil
 }
 
+func parse_output_cells() (err error) {
+	if opts.OutputCells == "none" {
+		return nil
+	}
+	switch opts.OutputCellsFd {
+	case 1:
+		cells_output = os.Stdout
+	case 2:
+		cells_output = os.Stderr
+	default:
+		if _, err = unix.FcntlInt(uintptr(opts.OutputCellsFd), unix.F_GETFD, 0); err != nil {
+			return fmt.Errorf("Invalid value for --output-cells-fd: %d is not an open file descriptor", opts.OutputCellsFd)
+		}
+		cells_output = os.NewFile(uintptr(opts.OutputCellsFd), "output-cells")
+	}
+	return
+}
+
 func print_error(format string, args ...any) {
 	fmt.Fprintf(os.Stderr, format, args...)
 	fmt.Fprintln(os.Stderr)
 }
 
+// Tell whoever is waiting on us that all images have been processed
+func notify_completion(num_displayed, num_failed int) {
+	switch opts.NotifyOnCompletion {
+	case "bell":
+		os.Stdout.WriteString("\a")
+	case "osc9":
+		msg := fmt.Sprintf("icat: done, displayed: %d", num_displayed)
+		if num_failed > 0 {
+			msg += fmt.Sprintf(", failed: %d", num_failed)
+		}
+		// OSC 9 is terminated by ST, so the message must not contain control codes
+		os.Stdout.WriteString("\x1b]9;" + msg + "\x1b\\")
+	}
+}
+
+func print_cells(imgd *image_data) {
+	if cells_output == nil {
+		return
+	}
+	if opts.OutputCells == "json" {
+		data, _ := json.Marshal(struct {
+			Source  string `json:"source"`
+			Columns int    `json:"columns"`
+			Rows    int    `json:"rows"`
+		}{imgd.source_name, imgd.width_cells, imgd.height_cells})
+		fmt.Fprintln(cells_output, string(data))
+	} else {
+		fmt.Fprintf(cells_output, "%d %d\n", imgd.width_cells, imgd.height_cells)
+	}
+}
+
 func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 	opts = o
+	renderer = images.Renderer{NoScaleDown: opts.NoScaleDown, IgnoreOrientation: opts.NoExif}
+	defer release_unreleased_frames()
 	err = parse_place()
 	if err != nil {
 		return 1, err
 	}
+	err = parse_fraction()
+	if err != nil {
+		return 1, err
+	}
+	err = parse_center_crop()
+	if err != nil {
+		return 1, err
+	}
+	err = parse_crop()
+	if err != nil {
+		return 1, err
+	}
+	err = parse_rotate()
+	if err != nil {
+		return 1, err
+	}
+	err = parse_tone_adjustment()
+	if err != nil {
+		return 1, err
+	}
+	err = parse_dither()
+	if err != nil {
+		return 1, err
+	}
+	err = parse_proxy()
+	if err != nil {
+		return 1, err
+	}
 	err = parse_z_index()
 	if err != nil {
 		return 1, err
@@ -146,6 +423,51 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 	if err != nil {
 		return 1, err
 	}
+	err = parse_output_cells()
+	if err != nil {
+		return 1, err
+	}
+	err = parse_control_fd()
+	if err != nil {
+		return 1, err
+	}
+	err = parse_credentials_file()
+	if err != nil {
+		return 1, err
+	}
+	err = parse_tmpdir()
+	if err != nil {
+		return 1, err
+	}
+	if opts.NoScaleDown && opts.Scale != "fit" {
+		return 1, fmt.Errorf("The --no-scale-down option cannot be used with --scale=%s", opts.Scale)
+	}
+	from_file_args, err := parse_from_file()
+	if err != nil {
+		return 1, err
+	}
+	args = append(args, from_file_args...)
+	if opts.PrintColor != "none" {
+		items, err := process_dirs(args...)
+		if err != nil {
+			return 1, err
+		}
+		return print_colors(select_only(items))
+	}
+	if opts.Detect {
+		items, err := process_dirs(args...)
+		if err != nil {
+			return 1, err
+		}
+		return print_metadata(select_only(items))
+	}
+	if opts.DecodeOnlyFirstN > 0 {
+		items, err := process_dirs(args...)
+		if err != nil {
+			return 1, err
+		}
+		return 0, identify_formats(items, opts.DecodeOnlyFirstN)
+	}
 	t, err := tty.OpenControllingTerm()
 	if err != nil {
 		return 1, fmt.Errorf("Failed to open controlling terminal with error: %w", err)
@@ -172,22 +494,21 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 	if err != nil {
 		return 1, err
 	}
-	if opts.Place != "" && len(items) > 1 {
+	items = select_only(items)
+	if opts.Place != "" && len(items) > 1 && opts.Montage == 0 {
 		return 1, fmt.Errorf("The --place option can only be used with a single image, not %d", len(items))
 	}
-	files_channel = make(chan input_arg, len(items))
-	for _, ia := range items {
-		files_channel <- ia
+	if err = setup_montage(); err != nil {
+		return 1, err
 	}
-	num_of_items = len(items)
+	queue_inputs(items)
 	output_channel = make(chan *image_data, 1)
 	keep_going = &atomic.Bool{}
 	keep_going.Store(true)
-	if !opts.DetectSupport && num_of_items > 0 {
-		num_workers := utils.Max(1, utils.Min(num_of_items, runtime.NumCPU()))
-		for i := 0; i < num_workers; i++ {
-			go run_worker()
-		}
+	deadline, stop_deadline := start_deadline()
+	defer stop_deadline()
+	if opts.MaxInflight > 0 {
+		inflight = make(chan struct{}, opts.MaxInflight)
 	}
 
 	passthrough_mode := no_passthrough
@@ -199,12 +520,46 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 			passthrough_mode = tmux_passthrough
 		}
 	}
-
-	if passthrough_mode == no_passthrough && (opts.TransferMode == "detect" || opts.DetectSupport) {
-		memory, files, direct, err := DetectSupport(time.Duration(opts.DetectionTimeout * float64(time.Second)))
-		if err != nil {
-			return 1, err
+	// all queries are sent to the terminal together. The workers are started
+	// first, so that decoding overlaps the round trip to the terminal, unless
+	// they need the scroll region or background color from the answers.
+	can_query := passthrough_mode == no_passthrough
+	var queries []*terminal_query
+	q, err := setup_scroll_region(can_query)
+	if err != nil {
+		return 1, err
+	}
+	if q != nil {
+		queries = append(queries, q)
+	}
+	if q = setup_terminal_background(can_query); q != nil {
+		queries = append(queries, q)
+	}
+	workers_need_answers := len(queries) > 0
+	start_workers_if_needed := func() {
+		if !opts.DetectSupport && num_of_items > 0 {
+			start_workers()
 		}
+	}
+	if !workers_need_answers {
+		start_workers_if_needed()
+	}
+	// sixel graphics are written to the terminal as is, there is nothing to detect
+	detect_graphics := can_query && ((opts.TransferMode == "detect" && opts.TransmitFormat != "sixel") || opts.DetectSupport)
+	var gs graphics_support
+	if detect_graphics {
+		queries = append(queries, graphics_support_query(&gs))
+	}
+	if err = query_terminal(time.Duration(opts.DetectionTimeout*float64(time.Second)), queries...); err != nil {
+		keep_going.Store(false)
+		return 1, err
+	}
+	if workers_need_answers {
+		start_workers_if_needed()
+	}
+
+	if detect_graphics {
+		memory, files, direct := gs.memory, gs.files, gs.direct
 		if !direct {
 			keep_going.Store(false)
 			return 1, fmt.Errorf("This terminal does not support the graphics protocol use a terminal such as kitty, WezTerm or Konsole that does. If you are running inside a terminal multiplexer such as tmux or screen that might be interfering as well.")
@@ -237,31 +592,156 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 		return 0, nil
 	}
 	use_unicode_placeholder := opts.UnicodePlaceholder
-	if passthrough_mode != no_passthrough {
+	if passthrough_mode != no_passthrough || opts.ScrollbackSafe {
 		use_unicode_placeholder = true
 	}
+	defer cleanup_on_signal()()
 	base_id := uint32(opts.ImageId)
-	for num_of_items > 0 {
-		imgd := <-output_channel
+	// the ids used with --image-id, zero without it
+	next_image_id := func() (id uint32) {
 		if base_id != 0 {
-			imgd.image_id = base_id
+			id = base_id
 			base_id++
 			if base_id == 0 {
 				base_id++
 			}
 		}
-		imgd.use_unicode_placeholder = use_unicode_placeholder
-		imgd.passthrough_mode = passthrough_mode
-		num_of_items--
-		if imgd.err != nil {
-			print_error("Failed to process \x1b[31m%s\x1b[39m: %s\r\n", imgd.source_name, imgd.err)
-		} else {
-			transmit_image(imgd)
+		return
+	}
+	// for the exit code, over all the batches of images with --hold-open
+	total_displayed, total_failed := 0, 0
+	display_pending := func() {
+		num_displayed, num_failed := 0, 0
+		defer func() {
+			total_displayed += num_displayed
+			total_failed += num_failed
+			notify_completion(num_displayed, num_failed)
+		}()
+		num_inputs := num_of_items
+		// with --in-order, images that finish before the ones preceding them
+		// are held back until those have been displayed
+		held_back := make(map[int]*image_data)
+		next_index := 0
+		// after the deadline, images still being processed get a short time
+		// to report that they were skipped, nil is returned after that
+		var grace_period <-chan time.Time
+		receive := func() *image_data {
+			for {
+				select {
+				case imgd := <-output_channel:
+					return imgd
+				case <-deadline:
+					deadline, grace_period = nil, time.After(deadline_grace_period)
+				case <-grace_period:
+					return nil
+				}
+			}
+		}
+		next_output := func() (imgd *image_data) {
+			if !opts.InOrder {
+				return receive()
+			}
+			for held_back[next_index] == nil {
+				if imgd = receive(); imgd == nil {
+					return
+				}
+				held_back[imgd.index] = imgd
+			}
+			imgd = held_back[next_index]
+			delete(held_back, next_index)
+			next_index++
+			return
+		}
+		for num_of_items > 0 {
+			imgd := next_output()
+			if imgd == nil {
+				for _, imgd := range held_back {
+					imgd.release_frames()
+				}
+				num_failed += num_of_items
+				print_error("%d images not displayed as the --deadline was reached\r\n", num_of_items)
+				num_of_items = 0
+				break
+			}
+			if deadline_reached.Load() && imgd.err == nil {
+				imgd.release_frames()
+				imgd.err = fmt.Errorf("Skipped: %w", errDeadlineReached)
+			}
+			if base_id != 0 && montage == nil {
+				imgd.image_id = next_image_id()
+			}
+			imgd.use_unicode_placeholder = use_unicode_placeholder
+			imgd.passthrough_mode = passthrough_mode
+			num_of_items--
 			if imgd.err != nil {
-				print_error("Failed to transmit \x1b[31m%s\x1b[39m: %s\r\n", imgd.source_name, imgd.err)
+				num_failed++
+				report_failure("process", imgd.source_name, imgd.err)
+				if opts.OnErrorImage != "" && !deadline_reached.Load() {
+					imgd = error_placeholder(imgd)
+				}
+			}
+			if montage != nil {
+				// displayed once all the images are in the grid
+				if err := montage.add(imgd); err != nil {
+					num_failed++
+					report_failure("add to the montage", imgd.source_name, err)
+				} else if imgd.err == nil {
+					if imgd.format_uppercase != "ERROR-IMAGE" {
+						num_displayed++
+					}
+					print_notes(imgd)
+				}
+			} else if imgd.err == nil {
+				transmit_image(imgd)
+				if imgd.err != nil {
+					num_failed++
+					report_failure("transmit", imgd.source_name, imgd.err)
+				} else {
+					if imgd.format_uppercase != "ERROR-IMAGE" {
+						num_displayed++
+					}
+					print_cells(imgd)
+					print_notes(imgd)
+				}
+			}
+			release_inflight_slot()
+		}
+		if montage != nil {
+			if imgd := montage.composite(num_inputs); imgd != nil {
+				imgd.image_id = next_image_id()
+				imgd.use_unicode_placeholder = use_unicode_placeholder
+				imgd.passthrough_mode = passthrough_mode
+				if imgd.err == nil {
+					transmit_image(imgd)
+				}
+				if imgd.err != nil {
+					// none of the images were displayed
+					num_displayed, num_failed = 0, num_failed+1
+					report_failure("display the montage", "", imgd.err)
+				} else {
+					print_cells(imgd)
+				}
 			}
 		}
 	}
+	display_pending()
+	if deadline_reached.Load() {
+		remove_temporary_data()
+		return 1, fmt.Errorf("Stopped as the --deadline of %gs was reached", opts.Deadline)
+	}
+	if opts.HoldOpen {
+		err = run_control_loop(t, func(items []input_arg) {
+			if len(items) > 0 {
+				queue_inputs(items)
+				start_workers()
+				display_pending()
+			}
+		})
+		if err != nil {
+			keep_going.Store(false)
+			return 1, fmt.Errorf("Failed to read from the control fd with error: %w", err)
+		}
+	}
 	keep_going.Store(false)
 	if opts.Hold {
 		fmt.Print("\r")
@@ -270,7 +750,19 @@ func main(cmd *cli.Command, o *Options, args []string) (rc int, err error) {
 		}
 		tui.HoldTillEnter(false)
 	}
-	return 0, nil
+	return exit_code(total_displayed, total_failed), nil
+}
+
+// Print the warning and, with --verbose, the notes about an image
+func print_notes(imgd *image_data) {
+	if imgd.warning != "" {
+		print_error("\x1b[33m%s\x1b[39m: %s\r\n", imgd.source_name, imgd.warning)
+	}
+	if opts.Verbose {
+		for _, x := range imgd.info {
+			print_error("%s: %s\r\n", imgd.source_name, x)
+		}
+	}
 }
 
 func EntryPoint(parent *cli.Command) {
@@ -0,0 +1,119 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+type image_metadata struct {
+	Source      string `json:"source"`
+	Format      string `json:"format"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Frames      int    `json:"frames"`
+	HasAlpha    bool   `json:"has_alpha"`
+	Orientation int    `json:"orientation"`
+}
+
+// Whether images in the color model can have transparent pixels, images
+// whose color model is color.RGBAModel, as used by decoders for opaque
+// truecolor images, are assumed to be opaque
+func color_model_has_alpha(m color.Model) bool {
+	switch m {
+	case color.NRGBAModel, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model, color.NYCbCrAModel:
+		return true
+	}
+	if p, ok := m.(color.Palette); ok {
+		for _, c := range p {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read the metadata of a probed input, decoding only its headers
+func read_metadata(p *probed_input) (ans image_metadata, err error) {
+	imgd := &p.imgd
+	ans = image_metadata{
+		Source: imgd.source_name, Format: imgd.format_uppercase, Width: imgd.canvas_width, Height: imgd.canvas_height,
+		Frames: 1, Orientation: utils.Max(1, imgd.orientation),
+	}
+	if ans.Source == "" {
+		ans.Source = "<stdin>"
+	}
+	switch {
+	case imgd.svg != nil:
+		ans.Width, ans.Height = svg_canvas_size(imgd.svg)
+		ans.HasAlpha = true
+	case p.can_use_go:
+		if imgd.predecoded == nil {
+			if c, _, err := image.DecodeConfig(p.file.file); err == nil {
+				ans.HasAlpha = color_model_has_alpha(c.ColorModel)
+			}
+			p.file.Rewind()
+		}
+		if ra, ok := p.file.file.(io.ReaderAt); ok {
+			ans.Frames = images.FrameCount(ra, imgd.format_uppercase)
+		}
+	default:
+		if err = p.file.PutOnFilesystem(); err != nil {
+			return
+		}
+		var frames []images.IdentifyRecord
+		if frames, err = images.IdentifyWithMagick(p.file.FileSystemName()); err != nil {
+			return
+		}
+		// identify reports the sizes after applying the orientation
+		ans.Format, ans.Width, ans.Height, ans.Frames = frames[0].Fmt_uppercase, frames[0].Canvas.Width, frames[0].Canvas.Height, len(frames)
+		for _, f := range frames {
+			ans.HasAlpha = ans.HasAlpha || !f.Is_opaque
+		}
+		if ra, ok := p.file.file.(io.ReaderAt); ok && !opts.NoExif {
+			ans.Orientation = utils.Max(1, images.Orientation(ra, ans.Format))
+		}
+	}
+	return
+}
+
+// Print the metadata of each input as a JSON object per line for --detect,
+// instead of displaying it
+func print_metadata(items []input_arg) (rc int, err error) {
+	num_identified, num_failed := 0, 0
+	output_channel = make(chan *image_data, 1)
+	keep_going = &atomic.Bool{}
+	keep_going.Store(true)
+	for _, item := range items {
+		p := probe_arg(item)
+		if p == nil {
+			imgd := <-output_channel
+			report_failure("process", imgd.source_name, imgd.err)
+			num_failed++
+			continue
+		}
+		m, err := read_metadata(p)
+		p.file.Release()
+		if err != nil {
+			report_failure("identify", m.Source, err)
+			num_failed++
+			continue
+		}
+		data, _ := json.Marshal(m)
+		fmt.Fprintln(os.Stdout, string(data))
+		num_identified++
+	}
+	return exit_code(num_identified, num_failed), nil
+}
@@ -0,0 +1,193 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var _ = fmt.Print
+
+// The --montage grid, nil if it is not used
+var montage *montage_grid
+
+type montage_grid struct {
+	tile_width, tile_height int
+	// the height of the labels under the images and the factor by which
+	// the font is scaled up, to suit the size of the cells
+	label_height, label_scale int
+	// the images and labels in the cells of the grid, keyed by the index of
+	// the input they were created from, so that the order of the cells is
+	// that of the inputs whatever order the images are processed in
+	tiles  map[int]image.Image
+	labels map[int]string
+}
+
+func setup_montage() error {
+	if opts.Montage == 0 {
+		return nil
+	}
+	if opts.Montage < 0 {
+		return fmt.Errorf("Invalid number of --montage columns: %d", opts.Montage)
+	}
+	if opts.MontagePadding < 0 {
+		return fmt.Errorf("Invalid --montage-padding: %d", opts.MontagePadding)
+	}
+	width, _ := display_area(&image_data{is_montage: true})
+	m := montage_grid{tiles: make(map[int]image.Image), labels: make(map[int]string)}
+	m.tile_width = (width - (opts.Montage-1)*opts.MontagePadding) / opts.Montage
+	if m.tile_width < 1 {
+		return fmt.Errorf("A --montage grid with %d columns and %d pixels of padding does not fit in the %d pixels available", opts.Montage, opts.MontagePadding, width)
+	}
+	// the cells are square, as is usual for thumbnails
+	m.tile_height = m.tile_width
+	if opts.MontageLabels {
+		_, ch := cell_size()
+		m.label_scale = utils.Max(1, ch/basicfont.Face7x13.Height)
+		m.label_height = (basicfont.Face7x13.Height + 2) * m.label_scale
+	}
+	montage = &m
+	return nil
+}
+
+// The label under an image, its file name, or the host for URLs with no path
+func montage_label(source_name string) string {
+	if u, err := url.Parse(source_name); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		if strings.Trim(u.Path, "/") == "" {
+			return u.Host
+		}
+		source_name = u.Path
+	}
+	return filepath.Base(source_name)
+}
+
+// Add an image to the grid, its cell is left empty if it could not be
+// processed. The frames of the image are released.
+func (m *montage_grid) add(imgd *image_data) error {
+	defer imgd.release_frames()
+	m.labels[imgd.index] = montage_label(imgd.source_name)
+	if imgd.err != nil {
+		return nil
+	}
+	f := imgd.frames[0]
+	if len(imgd.upgraded_frames) > 0 {
+		// the full quality version of the first frame of a --progressive-animation
+		f = imgd.upgraded_frames[0]
+	}
+	src, err := f.image()
+	if err != nil {
+		return err
+	}
+	// animations are represented by their first frame, which can be
+	// smaller than the canvas
+	size := image.Pt(imgd.canvas_width, imgd.canvas_height)
+	if imgd.padded_size.X > 0 {
+		size = imgd.padded_size
+	}
+	tile := image.NewNRGBA(image.Rectangle{Max: size})
+	(&images.Context{}).Paste(tile, src, image.Pt(f.left, f.top), nil)
+	m.tiles[imgd.index] = tile
+	return nil
+}
+
+// Draw text centered in an image of the specified width, using a small bitmap
+// font scaled up by label_scale. Text that is too wide is truncated.
+func (m *montage_grid) label_image(text string, width int) image.Image {
+	face := basicfont.Face7x13
+	w, h := utils.Max(1, width/m.label_scale), m.label_height/m.label_scale
+	measure := func(s string) int { return font.MeasureString(face, s).Round() }
+	if measure(text)+2 > w {
+		runes := []rune(text)
+		for len(runes) > 0 && measure(string(runes)+"...")+2 > w {
+			runes = runes[:len(runes)-1]
+		}
+		text = string(runes) + "..."
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	fg, outline := color.Color(color.White), color.Color(color.Black)
+	if renderer.RemoveAlpha != nil {
+		// the label is drawn onto the background color, so it needs no outline
+		if 299*int(renderer.RemoveAlpha.R)+587*int(renderer.RemoveAlpha.G)+114*int(renderer.RemoveAlpha.B) > 128000 {
+			fg = color.Black
+		}
+		outline = nil
+	}
+	x, y := (w-measure(text))/2, 1+face.Ascent
+	d := font.Drawer{Dst: img, Face: face}
+	if outline != nil {
+		// an outline keeps the text readable whatever the terminal background is
+		d.Src = image.NewUniform(outline)
+		for _, dx := range []int{-1, 0, 1} {
+			for _, dy := range []int{-1, 0, 1} {
+				d.Dot = fixed.P(x+dx, y+dy)
+				d.DrawString(text)
+			}
+		}
+	}
+	d.Src, d.Dot = image.NewUniform(fg), fixed.P(x, y)
+	d.DrawString(text)
+	if m.label_scale == 1 {
+		return img
+	}
+	return imaging.Resize(img, w*m.label_scale, h*m.label_scale, imaging.NearestNeighbor)
+}
+
+// Composite the images added to the grid into a single image, for the
+// specified number of inputs, and clear the grid. Returns nil if there are no
+// inputs.
+func (m *montage_grid) composite(num_inputs int) *image_data {
+	defer func() {
+		m.tiles, m.labels = make(map[int]image.Image), make(map[int]string)
+	}()
+	if num_inputs == 0 {
+		return nil
+	}
+	cols := utils.Min(opts.Montage, num_inputs)
+	rows := (num_inputs + cols - 1) / cols
+	pad, row_height := opts.MontagePadding, m.tile_height+m.label_height
+	canvas := image.NewNRGBA(image.Rect(0, 0, cols*m.tile_width+(cols-1)*pad, rows*row_height+(rows-1)*pad))
+	for i := 0; i < num_inputs; i++ {
+		cell := image.Rect(0, 0, m.tile_width, m.tile_height).Add(image.Pt((i%cols)*(m.tile_width+pad), (i/cols)*(row_height+pad)))
+		if tile := m.tiles[i]; tile != nil {
+			// centered in the cell
+			b := tile.Bounds()
+			r := b.Sub(b.Min).Add(cell.Min.Add(image.Pt((m.tile_width-b.Dx())/2, (m.tile_height-b.Dy())/2)))
+			// tiles larger than the cell, with --no-scale-down, are clipped
+			clipped := r.Intersect(cell)
+			draw.Draw(canvas, clipped, tile, b.Min.Add(clipped.Min.Sub(r.Min)), draw.Src)
+		}
+		if label, found := m.labels[i]; found && m.label_height > 0 {
+			r := image.Rect(cell.Min.X, cell.Max.Y, cell.Max.X, cell.Max.Y+m.label_height)
+			draw.Draw(canvas, r, m.label_image(label, m.tile_width), image.Point{}, draw.Over)
+		}
+	}
+	b := canvas.Bounds()
+	imgd := &image_data{canvas_width: b.Dx(), canvas_height: b.Dy(), format_uppercase: "MONTAGE", source_name: "montage", is_montage: true, frames: make([]*image_frame, 0, 1)}
+	imgd.available_width, imgd.available_height = display_area(imgd)
+	// tall grids scroll the screen, like text, unless they are placed in a rectangle
+	imgd.needs_scaling = place != nil && (b.Dx() > imgd.available_width || b.Dy() > imgd.available_height)
+	scale_image(imgd)
+	add_frame(&images.Context{}, imgd, canvas)
+	imgd.finish_padding()
+	if opts.OutputFormat == "png" && opts.TransmitFormat != "sixel" {
+		if err := encode_frames_as_png(imgd); err != nil {
+			imgd.release_frames()
+			imgd.err = fmt.Errorf("Could not encode image as PNG: %w", err)
+		}
+	}
+	return imgd
+}
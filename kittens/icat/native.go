@@ -3,25 +3,55 @@
 package icat
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/gif"
+	"image/png"
+	"io"
 	"kitty/tools/tui/graphics"
 	"kitty/tools/utils"
 	"kitty/tools/utils/images"
 	"kitty/tools/utils/shm"
+	"math"
+	"os"
+	"time"
 
 	"github.com/disintegration/imaging"
 )
 
 var _ = fmt.Print
 
+// Downscale ratio above which area averaging is used with --interpolation=auto
+const area_interpolation_threshold = 3
+
+// Return the interpolation to use for resizing by the specified fraction
+func interpolation_for(frac_x, frac_y float64) string {
+	if opts.IntegerScale && frac_x >= 1 && frac_y >= 1 {
+		return "nearest"
+	}
+	if opts.Interpolation != "auto" {
+		return opts.Interpolation
+	}
+	if frac_x > 0 && frac_y > 0 && 1/frac_x > area_interpolation_threshold && 1/frac_y > area_interpolation_threshold {
+		return "area"
+	}
+	return "lanczos"
+}
+
+var interpolation_filters = map[string]imaging.ResampleFilter{
+	"lanczos": imaging.Lanczos, "catmull-rom": imaging.CatmullRom, "linear": imaging.Linear,
+	"nearest": imaging.NearestNeighbor, "area": imaging.Box,
+}
+
 func resize_frame(imgd *image_data, img image.Image) (image.Image, image.Rectangle) {
 	b := img.Bounds()
 	left, top, width, height := b.Min.X, b.Min.Y, b.Dx(), b.Dy()
 	new_width := int(imgd.scaled_frac.x * float64(width))
 	new_height := int(imgd.scaled_frac.y * float64(height))
-	img = imaging.Resize(img, new_width, new_height, imaging.Lanczos)
+	img = imaging.Resize(img, new_width, new_height, interpolation_filters[interpolation_for(imgd.scaled_frac.x, imgd.scaled_frac.y)])
 	newleft := int(imgd.scaled_frac.x * float64(left))
 	newtop := int(imgd.scaled_frac.y * float64(top))
 	return img, image.Rect(newleft, newtop, newleft+new_width, newtop+new_height)
@@ -29,29 +59,223 @@ func resize_frame(imgd *image_data, img image.Image) (image.Image, image.Rectang
 
 const shm_template = "kitty-icat-*"
 
+var errFramesInTmpdir = errors.New("Frames are stored in files in --tmpdir")
+
+// Create shared memory for the pixels of a frame. With --tmpdir, frames are
+// instead stored in files in that directory, as shared memory can be too small
+// for large images.
+func create_frame_shm(size int) (shm.MMap, error) {
+	if opts.Tmpdir != "" {
+		return nil, errFramesInTmpdir
+	}
+	return shm.CreateTemp(shm_template, uint64(size))
+}
+
+// Bits per red, green and blue channel for --output-bit-depth
+var output_bit_depths = map[string][3]uint{"16": {5, 6, 5}, "12": {4, 4, 4}}
+
+// The bits per color channel kept with --quality, from 2 at quality 0 to 8 at quality 100
+func quality_bits() uint {
+	return uint(2 + utils.Max(0, utils.Min(opts.Quality, 100))*6/100)
+}
+
+// Reduce the color depth of a rendered frame with --output-bit-depth or --quality
+func reduce_frame_bit_depth(f *image_frame) (err error) {
+	bits, reduced := output_bit_depths[opts.OutputBitDepth]
+	dither, option := reduced, "--output-bit-depth"
+	if q := quality_bits(); q < 8 && (!reduced || q < bits[0]) {
+		// by default dithering is not used for --quality as the noise it
+		// adds defeats compression
+		bits, dither, reduced, option = [3]uint{q, q, q}, dither_always, true, "--quality"
+	}
+	if !reduced {
+		// full color output is never dithered as that would only add noise
+		return
+	}
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("Could not apply %s: %w", option, err)
+		}
+	}()
+	bytes_per_pixel := 4
+	if f.transmission_format == graphics.GRT_format_rgb {
+		bytes_per_pixel = 3
+	}
+	data := f.in_memory_bytes
+	if data == nil {
+		if data, err = os.ReadFile(f.filename); err != nil {
+			return
+		}
+		defer func() {
+			if err == nil {
+				err = os.WriteFile(f.filename, data, 0o600)
+			}
+		}()
+	}
+	if len(data) < f.width*f.height*bytes_per_pixel {
+		return fmt.Errorf("Frame data too short to reduce bit depth: %d < %d", len(data), f.width*f.height*bytes_per_pixel)
+	}
+	method := images.NoDither
+	if dither {
+		method = dither_method
+	}
+	images.ReduceBitDepth(data, f.width*bytes_per_pixel, f.width, f.height, bytes_per_pixel, bits, method, dither_strength)
+	return
+}
+
+// Reduce the color depth of a frame rendered by icat itself, failure only
+// means the frame is sent at full depth, so it is a warning
+func reduce_rendered_frame_bit_depth(imgd *image_data, f *image_frame) {
+	if err := reduce_frame_bit_depth(f); err != nil && imgd.warning == "" {
+		imgd.warning = fmt.Sprintf("Failed to reduce the color depth, the image is displayed at full depth: %s", err)
+	}
+}
+
+// Fraction of the darkest and brightest pixels ignored by --auto-contrast
+const auto_contrast_clip = 0.01
+
+func adjust_levels(imgd *image_data, img image.Image) image.Image {
+	if opts.Normalize == "none" && !opts.AutoContrast {
+		return img
+	}
+	if imgd.levels == nil {
+		// use the levels of the first frame for all frames of animations
+		clip := 0.0
+		if opts.AutoContrast {
+			clip = auto_contrast_clip
+		}
+		l := images.ComputeLevels(img, opts.Normalize == "per-channel", clip)
+		imgd.levels = &l
+	}
+	return imgd.levels.Apply(img)
+}
+
+func adjust_tones(img image.Image) image.Image {
+	if tone_adjustment.IsIdentity() {
+		return img
+	}
+	return tone_adjustment.Apply(img)
+}
+
+func convert_colors(imgd *image_data, img image.Image) image.Image {
+	if imgd.color_transform == nil {
+		return img
+	}
+	return imgd.color_transform.Apply(img)
+}
+
+// Crop a frame to --center-crop-to-aspect, keeping its position relative to the cropped canvas
+func crop_frame(imgd *image_data, img image.Image) image.Image {
+	if imgd.crop == nil {
+		return img
+	}
+	b := img.Bounds().Intersect(*imgd.crop)
+	if b.Empty() {
+		// the frame is entirely outside the crop, it still has to be
+		// displayed to preserve the timing of the animation
+		return image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	}
+	ans := imaging.Crop(img, b)
+	ans.Rect = ans.Rect.Add(b.Min.Sub(imgd.crop.Min))
+	return ans
+}
+
+// The size of a canvas rotated by --rotate, the same as the size of an image
+// rotated by imaging.Rotate(), so that rotated full frames cover it exactly
+func rotated_size(width, height int) (int, int) {
+	switch rotation {
+	case 0, 180:
+		return width, height
+	case 90, 270:
+		return height, width
+	}
+	sin, cos := math.Sincos(math.Pi * (360 - rotation) / 180)
+	w, h := float64(width-1), float64(height-1)
+	xs := []float64{0, w * cos, w*cos - h*sin, -h * sin}
+	ys := []float64{0, w * sin, w*sin + h*cos, h * cos}
+	size := func(v []float64) int {
+		lo, hi := v[0], v[0]
+		for _, x := range v[1:] {
+			lo, hi = math.Min(lo, x), math.Max(hi, x)
+		}
+		ans := hi - lo + 1
+		if ans-math.Floor(ans) > 0.1 {
+			ans++
+		}
+		return int(ans)
+	}
+	return size(xs), size(ys)
+}
+
+// Rotate a frame by --rotate, keeping its position relative to the rotated canvas
+func rotate_frame(imgd *image_data, img image.Image) image.Image {
+	if rotation == 0 {
+		return img
+	}
+	b := img.Bounds()
+	ans := imaging.Rotate(img, 360-rotation, color.Transparent)
+	from := imgd.rotate_from
+	to_x, to_y := rotated_size(from.X, from.Y)
+	// rotate the center of the frame about the center of the canvas
+	sin, cos := math.Sincos(rotation * math.Pi / 180)
+	cx, cy := float64(b.Min.X+b.Max.X-from.X)/2, float64(b.Min.Y+b.Max.Y-from.Y)/2
+	x := math.Round((float64(to_x-ans.Rect.Dx()))/2 + cx*cos - cy*sin)
+	y := math.Round((float64(to_y-ans.Rect.Dy()))/2 + cx*sin + cy*cos)
+	pos := image.Pt(utils.Max(0, utils.Min(int(x), to_x-ans.Rect.Dx())), utils.Max(0, utils.Min(int(y), to_y-ans.Rect.Dy())))
+	ans.Rect = ans.Rect.Add(pos)
+	return ans
+}
+
 func add_frame(ctx *images.Context, imgd *image_data, img image.Image) *image_frame {
+	r := renderer
+	if imgd.is_montage {
+		// the images in the grid have already been transformed
+		r.Flip, r.Flop = false, false
+	} else {
+		img = adjust_tones(adjust_levels(imgd, rotate_frame(imgd, convert_colors(imgd, crop_frame(imgd, img)))))
+	}
 	is_opaque := false
-	if imgd.format_uppercase == "JPEG" {
+	if imgd.format_uppercase == "JPEG" && math.Mod(rotation, 90) == 0 {
 		// special cased because EXIF orientation could have already changed this image to an NRGBA making IsOpaque() very slow
 		is_opaque = true
 	} else {
 		is_opaque = images.IsOpaque(img)
 	}
+	if imgd.padded_size.X > 0 && r.RemoveAlpha == nil {
+		// the padding is transparent
+		is_opaque = false
+	}
 	b := img.Bounds()
 	if imgd.scaled_frac.x != 0 {
 		img, b = resize_frame(imgd, img)
 	}
 	f := image_frame{width: b.Dx(), height: b.Dy(), number: len(imgd.frames) + 1, left: b.Min.X, top: b.Min.Y}
+	// the first frame defines the size of the image, so it is the one padded
+	// to whole cells, the other frames are offset by the padding
+	pad_first_frame := imgd.padded_size.X > 0 && f.number == 1
+	var paste_at image.Point
+	if pad_first_frame {
+		paste_at = imgd.pad_offset
+		// the padded frame is mirrored as a whole, so paste at the mirrored position
+		if r.Flip {
+			paste_at.Y = imgd.padded_size.Y - paste_at.Y - f.height
+		}
+		if r.Flop {
+			paste_at.X = imgd.padded_size.X - paste_at.X - f.width
+		}
+		f.width, f.height, f.left, f.top = imgd.padded_size.X, imgd.padded_size.Y, 0, 0
+	}
 	dest_rect := image.Rect(0, 0, f.width, f.height)
 	var final_img image.Image
 	bytes_per_pixel := 4
+	shm_failed := false
 
-	if is_opaque || remove_alpha != nil {
+	if is_opaque || r.RemoveAlpha != nil {
 		var rgb *images.NRGB
 		bytes_per_pixel = 3
-		m, err := shm.CreateTemp(shm_template, uint64(f.width*f.height*bytes_per_pixel))
+		m, err := create_frame_shm(f.width * f.height * bytes_per_pixel)
 		if err != nil {
-			rgb = images.NewNRGB(dest_rect)
+			rgb, shm_failed = images.NewNRGB(dest_rect), true
 		} else {
 			rgb = &images.NRGB{Pix: m.Slice(), Stride: bytes_per_pixel * f.width, Rect: dest_rect}
 			f.shm = m
@@ -59,11 +283,16 @@ func add_frame(ctx *images.Context, imgd *image_data, img image.Image) *image_fr
 		f.transmission_format = graphics.GRT_format_rgb
 		f.in_memory_bytes = rgb.Pix
 		final_img = rgb
+		if pad_first_frame && r.RemoveAlpha != nil {
+			for i := 0; i+2 < len(rgb.Pix); i += 3 {
+				rgb.Pix[i], rgb.Pix[i+1], rgb.Pix[i+2] = r.RemoveAlpha.R, r.RemoveAlpha.G, r.RemoveAlpha.B
+			}
+		}
 	} else {
 		var rgba *image.NRGBA
-		m, err := shm.CreateTemp(shm_template, uint64(f.width*f.height*bytes_per_pixel))
+		m, err := create_frame_shm(f.width * f.height * bytes_per_pixel)
 		if err != nil {
-			rgba = image.NewNRGBA(dest_rect)
+			rgba, shm_failed = image.NewNRGBA(dest_rect), true
 		} else {
 			rgba = &image.NRGBA{Pix: m.Slice(), Stride: bytes_per_pixel * f.width, Rect: dest_rect}
 			f.shm = m
@@ -72,55 +301,230 @@ func add_frame(ctx *images.Context, imgd *image_data, img image.Image) *image_fr
 		f.in_memory_bytes = rgba.Pix
 		final_img = rgba
 	}
-	ctx.PasteCenter(final_img, img, remove_alpha)
+	if pad_first_frame {
+		r.Paste(ctx, final_img, img, paste_at)
+	} else {
+		r.PasteCenter(ctx, final_img, img)
+	}
+	reduce_rendered_frame_bit_depth(imgd, &f)
 	imgd.frames = append(imgd.frames, &f)
-	if flip {
-		ctx.FlipPixelsV(bytes_per_pixel, f.width, f.height, f.in_memory_bytes)
+	r.Mirror(ctx, bytes_per_pixel, f.width, f.height, f.in_memory_bytes)
+	if r.Flip {
 		if f.height < imgd.canvas_height {
 			f.top = (2*imgd.canvas_height - f.height - f.top) % imgd.canvas_height
 		}
 	}
-	if flop {
-		ctx.FlipPixelsH(bytes_per_pixel, f.width, f.height, f.in_memory_bytes)
+	if r.Flop {
 		if f.width < imgd.canvas_width {
 			f.left = (2*imgd.canvas_width - f.width - f.left) % imgd.canvas_width
 		}
 	}
+	if imgd.padded_size.X > 0 && !pad_first_frame {
+		// the canvas is at the mirrored position within the padded first frame
+		offset := imgd.pad_offset
+		if r.Flip {
+			offset.Y = imgd.padded_size.Y - offset.Y - imgd.canvas_height
+		}
+		if r.Flop {
+			offset.X = imgd.padded_size.X - offset.X - imgd.canvas_width
+		}
+		f.left += offset.X
+		f.top += offset.Y
+	}
+	if shm_failed {
+		// shared memory is full or unavailable, as can happen in containers,
+		// or --tmpdir is used, so keep the pixels in a temporary file rather
+		// than in memory
+		spill_frame_to_file(&f)
+	}
+	f.track()
 	return &f
 }
 
-func scale_image(imgd *image_data) bool {
-	if imgd.needs_scaling {
-		width, height := imgd.canvas_width, imgd.canvas_height
-		if imgd.canvas_width < imgd.available_width && opts.ScaleUp && place != nil {
-			r := float64(imgd.available_width) / float64(imgd.canvas_width)
-			imgd.canvas_width, imgd.canvas_height = imgd.available_width, int(r*float64(imgd.canvas_height))
+func spill_frame_to_file(f *image_frame) {
+	tf, err := images.CreateTemp()
+	if err != nil {
+		return
+	}
+	_, err = tf.Write(f.in_memory_bytes)
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+		return
+	}
+	f.filename, f.filename_is_temporary, f.in_memory_bytes = tf.Name(), true, nil
+}
+
+// Return an image using the raw pixels of a frame as its pixel data
+func (f *image_frame) image() (image.Image, error) {
+	bytes_per_pixel := 4
+	if f.transmission_format == graphics.GRT_format_rgb {
+		bytes_per_pixel = 3
+	}
+	data := f.in_memory_bytes
+	if data == nil {
+		var err error
+		if data, err = os.ReadFile(f.filename); err != nil {
+			return nil, err
 		}
-		neww, newh := images.FitImage(imgd.canvas_width, imgd.canvas_height, imgd.available_width, imgd.available_height)
-		imgd.needs_scaling = false
+	}
+	if len(data) < f.width*f.height*bytes_per_pixel {
+		return nil, fmt.Errorf("Frame data too short: %d < %d", len(data), f.width*f.height*bytes_per_pixel)
+	}
+	r := image.Rect(0, 0, f.width, f.height)
+	if bytes_per_pixel == 3 {
+		return &images.NRGB{Pix: data, Stride: bytes_per_pixel * f.width, Rect: r}, nil
+	}
+	return &image.NRGBA{Pix: data, Stride: bytes_per_pixel * f.width, Rect: r}, nil
+}
+
+// Replace the raw pixels of a frame with their PNG encoding, for --output-format=png
+func encode_frame_as_png(f *image_frame) (err error) {
+	if f.transmission_format == graphics.GRT_format_png {
+		return
+	}
+	img, err := f.image()
+	if err != nil {
+		return
+	}
+	var b bytes.Buffer
+	if err = png.Encode(&b, img); err != nil {
+		return
+	}
+	f.release()
+	f.in_memory_bytes, f.transmission_format = b.Bytes(), graphics.GRT_format_png
+	return
+}
+
+func encode_frames_as_png(imgd *image_data) error {
+	for _, f := range append(imgd.frames, imgd.upgraded_frames...) {
+		if err := encode_frame_as_png(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scale_image(imgd *image_data) bool {
+	defer set_padding(imgd)
+	width, height := imgd.canvas_width, imgd.canvas_height
+	set_scaled_size := func(neww, newh int) {
 		imgd.scaled_frac.x = float64(neww) / float64(width)
 		imgd.scaled_frac.y = float64(newh) / float64(height)
 		imgd.canvas_width = int(imgd.scaled_frac.x * float64(width))
 		imgd.canvas_height = int(imgd.scaled_frac.y * float64(height))
+	}
+	if imgd.needs_scaling {
+		if imgd.integer_scale > 1 {
+			imgd.needs_scaling = false
+			imgd.scaled_frac.x, imgd.scaled_frac.y = float64(imgd.integer_scale), float64(imgd.integer_scale)
+			imgd.canvas_width, imgd.canvas_height = width*imgd.integer_scale, height*imgd.integer_scale
+			return true
+		}
+		imgd.needs_scaling = false
+		if opts.Scale == "stretch" && !imgd.is_montage {
+			// distorted to exactly the size of the display area
+			set_scaled_size(imgd.available_width, imgd.available_height)
+			return true
+		}
+		// with fill the image has already been cropped to the shape of the display area
+		r := renderer
+		r.AvailableWidth, r.AvailableHeight = imgd.available_width, imgd.available_height
+		r.ScaleUp = ((opts.ScaleUp || imgd.svg != nil) && place != nil) || opts.Scale == "fill"
+		neww, newh := r.ScaledSize(width, height)
+		set_scaled_size(round_to_cells(imgd, neww, newh))
+		return true
+	}
+	if neww, newh := round_to_cells(imgd, width, height); neww != width || newh != height {
+		set_scaled_size(neww, newh)
 		return true
 	}
 	return false
 }
 
 func load_one_frame_image(ctx *images.Context, imgd *image_data, src *opened_input) (img image.Image, err error) {
-	img, err = imaging.Decode(src.file, imaging.AutoOrientation(true))
-	src.Rewind()
+	switch {
+	case imgd.predecoded != nil:
+		img, imgd.predecoded = imgd.predecoded, nil
+	case imgd.format_uppercase == "RAW":
+		img, err = load_raw_image(src)
+	case imgd.format_uppercase == "HEIF" || imgd.format_uppercase == "AVIF":
+		img, err = load_heif_image(src)
+	case imgd.format_uppercase == "G3FAX" || imgd.format_uppercase == "G4FAX" || imgd.format_uppercase == "JBIG2":
+		img, err = load_bilevel_image(imgd, src)
+	default:
+		img, err = renderer.Decode(src.file)
+		if err != nil && (imgd.format_uppercase == "PNG" || imgd.format_uppercase == "JPEG") {
+			img, err = load_damaged_image(imgd, src, err)
+		}
+		src.Rewind()
+	}
 	if err != nil {
 		return
 	}
-	// reset the sizes as we read EXIF tags here which could have rotated the image
+	decoded_size_differs(imgd, img)
+	img = renderer.ApplyOrientation(img, imgd.orientation)
+	// reset the sizes as we read EXIF tags here which could have rotated the
+	// image and the decoded size could differ from the one in the header
 	imgd.canvas_width = img.Bounds().Dx()
 	imgd.canvas_height = img.Bounds().Dy()
+	imgd.crop = nil
+	imgd.rotate_from = image.Point{}
 	set_basic_metadata(imgd)
 	scale_image(imgd)
 	return
 }
 
+// Malformed images can have a size in their header that differs from the size
+// they decode to, making the metadata computed from the header wrong. Returns
+// true, with a warning, if the sizes differ.
+func decoded_size_differs(imgd *image_data, img image.Image) bool {
+	b, h := img.Bounds(), imgd.header_size
+	if h.X == 0 || h.Y == 0 || (b.Dx() == h.X && b.Dy() == h.Y) {
+		return false
+	}
+	msg := fmt.Sprintf("The decoded image is %dx%d pixels but its header says %dx%d, the image may be corrupt", b.Dx(), b.Dy(), h.X, h.Y)
+	if imgd.warning == "" {
+		imgd.warning = msg
+	} else {
+		imgd.info = append(imgd.info, msg)
+	}
+	// only warn once for images with several frames
+	imgd.header_size = image.Pt(b.Dx(), b.Dy())
+	return true
+}
+
+// Recompute the metadata of an animation whose frames have a different size
+// than its header says
+func check_animation_size(imgd *image_data, first_frame image.Image) {
+	if decoded_size_differs(imgd, first_frame) {
+		b := first_frame.Bounds()
+		imgd.canvas_width, imgd.canvas_height = b.Dx(), b.Dy()
+		imgd.crop = nil
+		imgd.rotate_from = image.Point{}
+		set_basic_metadata(imgd)
+	}
+}
+
+// Display whatever could be decoded of truncated images, such as ones still
+// being downloaded or written, failing with the original decode error if
+// nothing could be
+func load_damaged_image(imgd *image_data, src *opened_input, decode_err error) (image.Image, error) {
+	src.Rewind()
+	data, err := io.ReadAll(src.file)
+	if err != nil {
+		return nil, decode_err
+	}
+	img, err := images.DecodeTruncated(data)
+	if err != nil {
+		return nil, decode_err
+	}
+	imgd.warning = fmt.Sprintf("The image is truncated or corrupt (%s), displaying only the part that could be decoded", decode_err)
+	return img, nil
+}
+
 func calc_min_gap(gaps []int) int {
 	// Some broken GIF images have all zero gaps, browsers with their usual
 	// idiot ideas render these with a default 100ms gap https://bugzilla.mozilla.org/show_bug.cgi?id=125137
@@ -147,6 +551,95 @@ func (frame *image_frame) set_delay(gap, min_gap int) {
 	}
 }
 
+func max_animation_duration() time.Duration {
+	return time.Duration(opts.MaxAnimationDuration * float64(time.Second))
+}
+
+// Return the number of frames of an animation that start before
+// --max-animation-duration, given their delays in hundredths of a second
+func frames_within_max_duration(imgd *image_data, delays []int) int {
+	n := images.FramesWithinDuration(delays, max_animation_duration())
+	if n < len(delays) {
+		imgd.info = append(imgd.info, fmt.Sprintf("Animation truncated to the first %d of %d frames", n, len(delays)))
+	}
+	return n
+}
+
+// Drop the frames of a GIF animation that start after --max-animation-duration
+func truncate_gif_animation(imgd *image_data, gf *gif.GIF) {
+	images.TruncateGIF(gf, frames_within_max_duration(imgd, gf.Delay))
+}
+
+func add_apng_frames(ctx *images.Context, imgd *image_data, src *opened_input) error {
+	a, err := images.DecodeAPNG(src.file)
+	src.Rewind()
+	if err != nil {
+		return fmt.Errorf("Failed to decode animated PNG file with error: %w", err)
+	}
+	check_animation_size(imgd, a.Frames[0])
+	return add_animation_frames(ctx, imgd, a)
+}
+
+func add_webp_frames(ctx *images.Context, imgd *image_data, src *opened_input) error {
+	a, err := images.DecodeAnimatedWebP(src.file)
+	src.Rewind()
+	if err != nil {
+		return fmt.Errorf("Failed to decode animated WebP file with error: %w", err)
+	}
+	check_animation_size(imgd, a.Frames[0])
+	if opts.Loop == 0 {
+		// only the first frame, as for other animated formats with --loop=0
+		scale_image(imgd)
+		add_frame(ctx, imgd, a.Frames[0])
+		return nil
+	}
+	return add_animation_frames(ctx, imgd, a)
+}
+
+func add_animation_frames(ctx *images.Context, imgd *image_data, a *images.Animation) error {
+	n := frames_within_max_duration(imgd, a.Delays)
+	a.Frames, a.Delays = a.Frames[:n], a.Delays[:n]
+	// zero means forever
+	imgd.header_loops = a.LoopCount
+	if a.LoopCount == 0 {
+		imgd.header_loops = -1
+	}
+	if opts.FlattenAnimation != "none" {
+		img, err := images.FlattenFrames(a.Frames, opts.FlattenAnimation)
+		if err != nil {
+			return err
+		}
+		scale_image(imgd)
+		add_frame(ctx, imgd, img)
+		return nil
+	}
+	return add_coalesced_frames(ctx, imgd, a.Frames, a.Delays)
+}
+
+// The number of times to play the animation, negative for forever, taking
+// the loop count from the file header into account with
+// --honor-gif-loop-from-header
+func (imgd *image_data) loops() int {
+	if imgd.header_loops != 0 && opts.HonorGifLoopFromHeader {
+		return imgd.header_loops
+	}
+	return opts.Loop
+}
+
+// Convert the NETSCAPE loop count of a GIF, which is the number of times the
+// animation is repeated, to the number of times it is played
+func set_gif_header_loops(imgd *image_data, gf *gif.GIF) {
+	switch {
+	case gf.LoopCount == 0:
+		imgd.header_loops = -1
+	case gf.LoopCount < 0:
+		// no loop count extension, the animation is played once
+		imgd.header_loops = 1
+	default:
+		imgd.header_loops = gf.LoopCount + 1
+	}
+}
+
 func add_gif_frames(ctx *images.Context, imgd *image_data, gf *gif.GIF) error {
 	min_gap := images.CalcMinimumGIFGap(gf.Delay)
 	scale_image(imgd)
@@ -159,25 +652,150 @@ func add_gif_frames(ctx *images.Context, imgd *image_data, gf *gif.GIF) error {
 	return nil
 }
 
+// Add the frames of an animation that have been coalesced, so that every
+// frame is a complete image, with --smooth crossfade frames inserted between
+// consecutive frames. Complete frames are needed for blending and for
+// replacing the low quality frames sent first with --progressive-animation.
+// The delays are in hundredths of a second.
+func add_coalesced_frames(ctx *images.Context, imgd *image_data, keyframes []*image.NRGBA, delays []int) error {
+	num_inserted := opts.Smooth
+	if opts.MaxFrames > 0 {
+		num_inserted = utils.Min(num_inserted, opts.MaxFrames/len(keyframes)-1)
+	}
+	min_gap := images.CalcMinimumGIFGap(delays)
+	scale_image(imgd)
+	var sources []*image.NRGBA
+	for i, keyframe := range keyframes {
+		delay_ms := utils.Max(min_gap, delays[i]) * 10
+		if num_inserted > 0 && delay_ms > 0 {
+			delay_ms = utils.Max(1, delay_ms/(num_inserted+1))
+		}
+		if delay_ms == 0 {
+			delay_ms = -1
+		}
+		add_frame(ctx, imgd, keyframe).delay_ms = delay_ms
+		sources = append(sources, keyframe)
+		if num_inserted < 1 || (i == len(keyframes)-1 && imgd.loops() == 1) {
+			continue
+		}
+		// crossfade into the next frame, wrapping around for looping animations
+		next := keyframes[(i+1)%len(keyframes)]
+		for n := 1; n <= num_inserted; n++ {
+			blended := images.BlendFrames(keyframe, next, float64(n)/float64(num_inserted+1))
+			add_frame(ctx, imgd, blended).delay_ms = delay_ms
+			sources = append(sources, blended)
+		}
+	}
+	if opts.ProgressiveAnimation && len(imgd.frames) > 1 {
+		add_preview_frames(ctx, imgd, sources)
+	}
+	return nil
+}
+
+// Downscale factor and number of levels per color channel for the frames sent
+// first with --progressive-animation. These compress much better than the
+// full quality frames.
+const preview_downscale_factor, preview_color_levels = 4, 8
+
+func low_quality_preview(img *image.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	small := imaging.Resize(img, utils.Max(1, b.Dx()/preview_downscale_factor), utils.Max(1, b.Dy()/preview_downscale_factor), imaging.Box)
+	ans := imaging.Resize(small, b.Dx(), b.Dy(), imaging.NearestNeighbor)
+	const step = 256 / preview_color_levels
+	for i := 0; i+3 < len(ans.Pix); i += 4 {
+		for c := i; c < i+3; c++ {
+			ans.Pix[c] = ans.Pix[c]/step*step + step/2
+		}
+	}
+	return ans
+}
+
+// Create the low quality frames transmitted before imgd.frames, which are
+// then sent as replacements for them. The timing of the frames is the same.
+func add_preview_frames(ctx *images.Context, imgd *image_data, sources []*image.NRGBA) {
+	full := imgd.frames
+	imgd.frames = make([]*image_frame, 0, len(full))
+	for i, src := range sources {
+		add_frame(ctx, imgd, low_quality_preview(src)).delay_ms = full[i].delay_ms
+		full[i].replaces_preview = true
+	}
+	imgd.upgraded_frames = full
+}
+
 func render_image_with_go(imgd *image_data, src *opened_input) (err error) {
 	ctx := images.Context{}
 	switch {
-	case imgd.format_uppercase == "GIF" && opts.Loop != 0:
+	case imgd.format_uppercase == "GIF" && opts.FlattenAnimation != "none":
 		gif_frames, err := gif.DecodeAll(src.file)
 		src.Rewind()
 		if err != nil {
 			return fmt.Errorf("Failed to decode GIF file with error: %w", err)
 		}
-		err = add_gif_frames(&ctx, imgd, gif_frames)
+		truncate_gif_animation(imgd, gif_frames)
+		frames, err := images.CoalesceGIFFrames(gif_frames)
 		if err != nil {
 			return err
 		}
-	default:
-		img, err := load_one_frame_image(&ctx, imgd, src)
+		img, err := images.FlattenFrames(frames, opts.FlattenAnimation)
 		if err != nil {
 			return err
 		}
+		scale_image(imgd)
 		add_frame(&ctx, imgd, img)
+	case imgd.format_uppercase == "GIF" && opts.Loop != 0 && (opts.Smooth > 0 || opts.ProgressiveAnimation):
+		gif_frames, err := gif.DecodeAll(src.file)
+		src.Rewind()
+		if err != nil {
+			return fmt.Errorf("Failed to decode GIF file with error: %w", err)
+		}
+		truncate_gif_animation(imgd, gif_frames)
+		set_gif_header_loops(imgd, gif_frames)
+		frames, err := images.CoalesceGIFFrames(gif_frames)
+		if err != nil {
+			return err
+		}
+		if err = add_coalesced_frames(&ctx, imgd, frames, gif_frames.Delay); err != nil {
+			return err
+		}
+	case imgd.format_uppercase == "GIF" && opts.Loop != 0:
+		gif_frames, err := gif.DecodeAll(src.file)
+		src.Rewind()
+		if err != nil {
+			return fmt.Errorf("Failed to decode GIF file with error: %w", err)
+		}
+		truncate_gif_animation(imgd, gif_frames)
+		set_gif_header_loops(imgd, gif_frames)
+		err = add_gif_frames(&ctx, imgd, gif_frames)
+		if err != nil {
+			return err
+		}
+	case imgd.svg != nil:
+		if err = add_svg_frame(&ctx, imgd); err != nil {
+			return err
+		}
+	case imgd.animated_png && opts.Loop != 0:
+		if err = add_apng_frames(&ctx, imgd, src); err != nil {
+			return err
+		}
+	case imgd.animated_webp:
+		if err = add_webp_frames(&ctx, imgd, src); err != nil {
+			return err
+		}
+	default:
+		streamed := false
+		if can_stream(imgd) {
+			if streamed, err = add_streamed_frame(&ctx, imgd, src); err != nil {
+				return err
+			}
+		}
+		if !streamed {
+			img, err := load_one_frame_image(&ctx, imgd, src)
+			if err != nil {
+				return err
+			}
+			add_frame(&ctx, imgd, img)
+		}
 	}
+	imgd.finish_padding()
 	return nil
 }
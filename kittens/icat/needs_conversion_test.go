@@ -0,0 +1,55 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"testing"
+
+	"kitty/tools/cli"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ = fmt.Print
+
+func parse_options(t *testing.T, args ...string) *Options {
+	root := cli.NewRootCommand()
+	create_cmd(root, nil)
+	cmd, err := root.ParseArgs(append([]string{"kitten", "icat"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ans := &Options{}
+	if err = cmd.GetOptionValues(ans); err != nil {
+		t.Fatal(err)
+	}
+	return ans
+}
+
+func TestNeedsConversion(t *testing.T) {
+	orig_opts, orig_screen_size, orig_tone_adjustment := opts, screen_size, tone_adjustment
+	defer func() { opts, screen_size, tone_adjustment = orig_opts, orig_screen_size, orig_tone_adjustment }()
+	screen_size = &unix.Winsize{Row: 40, Col: 100, Xpixel: 1000, Ypixel: 800}
+	needs_conversion := func(args ...string) bool {
+		opts = parse_options(t, args...)
+		if err := parse_tone_adjustment(); err != nil {
+			t.Fatal(err)
+		}
+		imgd := image_data{format_uppercase: "PNG", canvas_width: 100, canvas_height: 100}
+		set_basic_metadata(&imgd)
+		return imgd.needs_conversion
+	}
+	if needs_conversion() {
+		t.Fatalf("A PNG image that fits on the screen was converted")
+	}
+	for _, args := range [][]string{
+		{"--output-bit-depth=16"},
+		{"--scale-up"},
+		{"--gamma=2"},
+	} {
+		if !needs_conversion(args...) {
+			t.Fatalf("A PNG image was not converted with: %v", args)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"sync/atomic"
+
+	"kitty/tools/utils/images"
+
+	"github.com/disintegration/imaging"
+)
+
+var _ = fmt.Print
+
+// Images are downsampled to fit within this size before analysis, for speed
+const color_analysis_size = 128
+
+func decode_for_color_analysis(p *probed_input) (image.Image, error) {
+	var data *images.ImageData
+	var err error
+	if p.imgd.svg != nil {
+		w, h := svg_canvas_size(p.imgd.svg)
+		return p.imgd.svg.Rasterize(images.FitImage(w, h, color_analysis_size, color_analysis_size))
+	}
+	if p.can_use_go {
+		data, err = images.OpenNativeImageFromReader(p.file.file)
+	} else {
+		if err = p.file.PutOnFilesystem(); err != nil {
+			return nil, err
+		}
+		data, err = images.OpenImageFromPathWithMagick(p.file.FileSystemName())
+	}
+	if err != nil {
+		return nil, err
+	}
+	img := data.Frames[0].Img
+	if b := img.Bounds(); b.Dx() > color_analysis_size || b.Dy() > color_analysis_size {
+		img = imaging.Fit(img, color_analysis_size, color_analysis_size, imaging.Box)
+	}
+	return img, nil
+}
+
+// Print the color of each input as specified by --print-color instead of
+// displaying it
+func print_colors(items []input_arg) (rc int, err error) {
+	num_printed, num_failed := 0, 0
+	output_channel = make(chan *image_data, 1)
+	keep_going = &atomic.Bool{}
+	keep_going.Store(true)
+	for _, item := range items {
+		p := probe_arg(item)
+		if p == nil {
+			imgd := <-output_channel
+			report_failure("process", imgd.source_name, imgd.err)
+			num_failed++
+			continue
+		}
+		img, err := decode_for_color_analysis(p)
+		p.file.Release()
+		if err != nil {
+			name := p.imgd.source_name
+			if name == "" {
+				name = "<stdin>"
+			}
+			report_failure("decode", name, err)
+			num_failed++
+			continue
+		}
+		var c images.NRGBColor
+		switch opts.PrintColor {
+		case "dominant":
+			c = images.DominantColor(img)
+		case "edge":
+			c = images.EdgeAverageColor(img)
+		default:
+			c = images.AverageColor(img)
+		}
+		if opts.PrintColorFormat == "json" {
+			data, _ := json.Marshal(struct {
+				Source string `json:"source"`
+				Color  string `json:"color"`
+			}{p.imgd.source_name, c.AsSharp()})
+			fmt.Fprintln(os.Stdout, string(data))
+		} else {
+			fmt.Fprintln(os.Stdout, c.AsSharp())
+		}
+		num_printed++
+	}
+	return exit_code(num_printed, num_failed), nil
+}
@@ -3,23 +3,30 @@
 package icat
 
 import (
-	"bytes"
+	"archive/zip"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
 	"io/fs"
-	"net/http"
+	"math"
+	"math/rand"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 
 	"kitty/tools/tty"
 	"kitty/tools/tui/graphics"
 	"kitty/tools/utils"
 	"kitty/tools/utils/images"
 	"kitty/tools/utils/shm"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"golang.org/x/exp/maps"
 )
 
 var _ = fmt.Print
@@ -55,6 +62,17 @@ func (self *BytesBuf) Read(p []byte) (n int, err error) {
 	return
 }
 
+func (self *BytesBuf) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off >= int64(len(self.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, self.data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
 func (self *BytesBuf) Close() error {
 	self.data = nil
 	self.pos = 0
@@ -65,21 +83,100 @@ type input_arg struct {
 	arg         string
 	value       string
 	is_http_url bool
+	is_data_uri bool
+	index       int // the position of the input in the list of inputs
+	// one of the images read from STDIN with --stdin-multiple
+	stdin_data  []byte
+	stdin_index int
+	// an image in a zip archive, value is the path of the archive joined with
+	// the name of the entry
+	zip_entry *zip.File
+	// a page of a multi-page TIFF image, from one, zero when the image is
+	// not split into its pages
+	page int
+	// the image read from the clipboard with --clipboard, or the error
+	// encountered reading it
+	is_clipboard   bool
+	clipboard_data []byte
+	clipboard_err  error
+}
+
+func (self input_arg) stdin_name() string {
+	if self.stdin_data != nil {
+		return fmt.Sprintf("<stdin:%d>", self.stdin_index)
+	}
+	return "<stdin>"
+}
+
+// Read all of STDIN and split it into the images concatenated in it
+func split_stdin() (results []input_arg, err error) {
+	data, err := read_all_limited(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from STDIN with error: %w", err)
+	}
+	parts, trailing, serr := images.SplitConcatenatedImages(data)
+	for i, part := range parts {
+		results = append(results, input_arg{arg: "/dev/stdin", stdin_data: part, stdin_index: i + 1})
+	}
+	if len(trailing) > 0 {
+		print_error("\x1b[33mWarning\x1b[39m: ignoring %d bytes after the last image read from STDIN: %s\r\n", len(trailing), serr)
+	}
+	return
 }
 
 func is_http_url(arg string) bool {
 	return strings.HasPrefix(arg, "https://") || strings.HasPrefix(arg, "http://")
 }
 
+func is_image_name(name string) bool {
+	return strings.HasPrefix(utils.GuessMimeType(name), "image/")
+}
+
+// Check the start of a file for the signature of an image format, for files
+// whose names do not indicate that they are images
+func has_image_signature(open func() (io.ReadCloser, error)) bool {
+	f, err := open()
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, images.SniffLength)
+	n, _ := io.ReadFull(f, header)
+	return images.SniffImageType(header[:n]) != ""
+}
+
 func process_dirs(args ...string) (results []input_arg, err error) {
 	results = make([]input_arg, 0, 64)
 	if opts.Stdin != "no" && (opts.Stdin == "yes" || !tty.IsTerminal(os.Stdin.Fd())) {
-		results = append(results, input_arg{arg: "/dev/stdin"})
+		if opts.StdinMultiple {
+			if results, err = split_stdin(); err != nil {
+				return nil, err
+			}
+		} else {
+			results = append(results, input_arg{arg: "/dev/stdin"})
+		}
+	}
+	if opts.Clipboard {
+		data, err := read_clipboard_image()
+		results = append(results, input_arg{arg: "<clipboard>", value: "<clipboard>", is_clipboard: true, clipboard_data: data, clipboard_err: err})
 	}
+	items, err := resolve_args(args...)
+	if err != nil {
+		return nil, err
+	}
+	return append(results, items...), nil
+}
+
+// Resolve the paths, URLs, globs, directories and archives specified as
+// inputs, without the inputs read from STDIN or the clipboard
+func resolve_args(args ...string) (results []input_arg, err error) {
+	results = make([]input_arg, 0, len(args))
 	for _, arg := range args {
 		if arg != "" {
 			if is_http_url(arg) {
 				results = append(results, input_arg{arg: arg, value: arg, is_http_url: true})
+			} else if is_data_uri(arg) {
+				results = append(results, input_arg{arg: arg, value: arg, is_data_uri: true})
 			} else {
 				if strings.HasPrefix(arg, "file://") {
 					u, err := url.Parse(arg)
@@ -88,33 +185,153 @@ func process_dirs(args ...string) (results []input_arg, err error) {
 					}
 					arg = u.Path
 				}
+				arg, is_zip := zip_archive_path(arg)
 				s, err := os.Stat(arg)
 				if err != nil {
-					return nil, &fs.PathError{Op: "Stat", Path: arg, Err: err}
+					// shells do not expand globs in some contexts, the literal
+					// path is tried first as it could contain glob characters
+					matches, gerr := expand_glob(arg)
+					if gerr != nil || len(matches) == 0 {
+						return nil, &fs.PathError{Op: "Stat", Path: arg, Err: err}
+					}
+					results = append(results, matches...)
+					continue
 				}
-				if s.IsDir() {
-					filepath.WalkDir(arg, func(path string, d fs.DirEntry, walk_err error) error {
-						if walk_err != nil {
-							if d == nil {
-								err = &fs.PathError{Op: "Stat", Path: arg, Err: walk_err}
-							}
-							return walk_err
-						}
-						if !d.IsDir() {
-							mt := utils.GuessMimeType(path)
-							if strings.HasPrefix(mt, "image/") {
-								results = append(results, input_arg{arg: arg, value: path})
-							}
-						}
-						return nil
-					})
+				if is_zip && !s.IsDir() {
+					entries, err := process_zip(arg)
+					if err != nil {
+						return nil, err
+					}
+					results = append(results, entries...)
+				} else if s.IsDir() {
+					results = append(results, walk_dir(arg, arg)...)
 				} else {
 					results = append(results, input_arg{arg: arg, value: arg})
 				}
 			}
 		}
 	}
-	return results, nil
+	return expand_tiff_pages(results), nil
+}
+
+// Replace multi-page TIFF images with their pages, unless --page is used to
+// select a single page
+func expand_tiff_pages(items []input_arg) []input_arg {
+	if opts.Page > 0 {
+		return items
+	}
+	ans := make([]input_arg, 0, len(items))
+	for _, item := range items {
+		num_pages := 1
+		if item.zip_entry == nil && !item.is_http_url && !item.is_data_uri && item.value != "" && utils.GuessMimeType(item.value) == "image/tiff" {
+			if f, err := os.Open(item.value); err == nil {
+				if pages, err := images.TIFFPages(f); err == nil {
+					num_pages = len(pages)
+				}
+				f.Close()
+			}
+		}
+		if num_pages < 2 {
+			ans = append(ans, item)
+			continue
+		}
+		for i := 0; i < num_pages; i++ {
+			item.page = i + 1
+			ans = append(ans, item)
+		}
+	}
+	return ans
+}
+
+func is_image_file(path string, d fs.DirEntry) bool {
+	return is_image_name(path) || (d.Type().IsRegular() && has_image_signature(func() (io.ReadCloser, error) { return os.Open(path) }))
+}
+
+// Return the images in the directory tree rooted at dir
+func walk_dir(arg, dir string) (results []input_arg) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, walk_err error) error {
+		if walk_err != nil {
+			return walk_err
+		}
+		if !d.IsDir() && is_image_file(path, d) {
+			results = append(results, input_arg{arg: arg, value: path})
+		}
+		return nil
+	})
+	return
+}
+
+// Return the images matching a glob pattern, which can use ** to match any
+// number of directories, in sorted order. Matching directories are searched
+// for images as if they were specified directly.
+func expand_glob(pattern string) (results []input_arg, err error) {
+	if !strings.ContainsAny(pattern, "*?[{") {
+		return nil, nil
+	}
+	matches, err := doublestar.FilepathGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	for _, path := range matches {
+		s, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if s.IsDir() {
+			results = append(results, walk_dir(pattern, path)...)
+		} else if is_image_file(path, fs.FileInfoToDirEntry(s)) {
+			results = append(results, input_arg{arg: pattern, value: path})
+		}
+	}
+	return
+}
+
+// Select a single item according to --only. Only local files are considered
+// for all criteria other than random, as the size and modification time of
+// URLs and STDIN are not known.
+func select_only(items []input_arg) []input_arg {
+	if opts.Only == "all" || len(items) < 2 {
+		return items
+	}
+	if opts.Only == "random" {
+		return []input_arg{items[rand.Intn(len(items))]}
+	}
+	var best *input_arg
+	var best_stat fs.FileInfo
+	for i, item := range items {
+		if item.is_http_url || item.is_data_uri || item.is_clipboard || item.value == "" {
+			continue
+		}
+		var s fs.FileInfo
+		var err error
+		if item.zip_entry != nil {
+			s = item.zip_entry.FileInfo()
+		} else if s, err = os.Stat(item.value); err != nil {
+			continue
+		}
+		if best != nil {
+			switch opts.Only {
+			case "largest":
+				if s.Size() <= best_stat.Size() {
+					continue
+				}
+			case "smallest":
+				if s.Size() >= best_stat.Size() {
+					continue
+				}
+			case "newest":
+				if !s.ModTime().After(best_stat.ModTime()) {
+					continue
+				}
+			}
+		}
+		best, best_stat = &items[i], s
+	}
+	if best == nil {
+		return items[:1]
+	}
+	return []input_arg{*best}
 }
 
 type opened_input struct {
@@ -122,6 +339,45 @@ type opened_input struct {
 	name_to_unlink string
 }
 
+// The temporary files of opened inputs, removed by remove_temporary_data()
+var temp_files = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+func register_temp_file(name string, add bool) {
+	temp_files.Lock()
+	defer temp_files.Unlock()
+	if add {
+		temp_files.names[name] = true
+	} else {
+		delete(temp_files.names, name)
+	}
+}
+
+// Remove all temporary files and shared memory, for when icat is killed or
+// stopped by --deadline while images are still being processed
+func remove_temporary_data() {
+	temp_files.Lock()
+	for name := range temp_files.names {
+		os.Remove(name)
+	}
+	temp_files.names = make(map[string]bool)
+	temp_files.Unlock()
+	unreleased_frames.Lock()
+	for frame := range unreleased_frames.frames {
+		// the shared memory is not unmapped, as workers could still be using it
+		if frame.shm != nil {
+			frame.shm.Unlink()
+		}
+		if frame.filename_is_temporary && frame.filename != "" {
+			os.Remove(frame.filename)
+		}
+	}
+	unreleased_frames.frames = make(map[*image_frame]bool)
+	unreleased_frames.Unlock()
+}
+
 func (self *opened_input) Rewind() {
 	if self.file != nil {
 		self.file.Seek(0, io.SeekStart)
@@ -135,6 +391,7 @@ func (self *opened_input) Release() {
 	}
 	if self.name_to_unlink != "" {
 		os.Remove(self.name_to_unlink)
+		register_temp_file(self.name_to_unlink, false)
 		self.name_to_unlink = ""
 	}
 }
@@ -147,10 +404,13 @@ func (self *opened_input) PutOnFilesystem() (err error) {
 	if err != nil {
 		return fmt.Errorf("Failed to create a temporary file to store input data with error: %w", err)
 	}
+	register_temp_file(f.Name(), true)
 	self.Rewind()
 	_, err = io.Copy(f, self.file)
 	if err != nil {
 		f.Close()
+		os.Remove(f.Name())
+		register_temp_file(f.Name(), false)
 		return fmt.Errorf("Failed to copy input data to temporary file with error: %w", err)
 	}
 	self.Release()
@@ -172,6 +432,54 @@ type image_frame struct {
 	number                   int
 	disposal_background      color.NRGBA
 	delay_ms                 int
+	replaces_preview         bool
+}
+
+// Frames holding shared memory or temporary files, so that they are cleaned
+// up on exit even if processing is stopped before they are transmitted
+var unreleased_frames = struct {
+	sync.Mutex
+	frames map[*image_frame]bool
+}{frames: make(map[*image_frame]bool)}
+
+func (frame *image_frame) track() {
+	if frame.shm != nil || frame.filename_is_temporary {
+		unreleased_frames.Lock()
+		unreleased_frames.frames[frame] = true
+		unreleased_frames.Unlock()
+	}
+}
+
+// Remove the temporary file and shared memory, if any, of the frame
+func (frame *image_frame) release() {
+	if frame.filename_is_temporary && frame.filename != "" {
+		os.Remove(frame.filename)
+		frame.filename = ""
+	}
+	if frame.shm != nil {
+		frame.shm.Unlink()
+		frame.shm.Close()
+		frame.shm = nil
+	}
+	frame.in_memory_bytes = nil
+	unreleased_frames.Lock()
+	delete(unreleased_frames.frames, frame)
+	unreleased_frames.Unlock()
+}
+
+func (imgd *image_data) release_frames() {
+	for _, frame := range append(imgd.frames, imgd.upgraded_frames...) {
+		frame.release()
+	}
+}
+
+func release_unreleased_frames() {
+	unreleased_frames.Lock()
+	frames := maps.Keys(unreleased_frames.frames)
+	unreleased_frames.Unlock()
+	for _, frame := range frames {
+		frame.release()
+	}
 }
 
 type image_data struct {
@@ -180,7 +488,9 @@ type image_data struct {
 	available_width, available_height int
 	needs_scaling, needs_conversion   bool
 	scaled_frac                       struct{ x, y float64 }
+	integer_scale                     int // the upscaling factor with --integer-scale
 	frames                            []*image_frame
+	upgraded_frames                   []*image_frame // sent after frames with --progressive-animation
 	image_number                      uint32
 	image_id                          uint32
 	cell_x_offset                     int
@@ -189,28 +499,207 @@ type image_data struct {
 	width_cells, height_cells         int
 	use_unicode_placeholder           bool
 	passthrough_mode                  passthrough_type
+	caption                           string
+	warning                           string
+	info                              []string // printed with --verbose
+	predecoded                        image.Image
+	levels                            *images.Levels         // with --normalize or --auto-contrast
+	crop                              *image.Rectangle       // with --center-crop-to-aspect, in the coordinates of the uncropped canvas
+	header_loops                      int                    // times to play the animation from the file header, zero if unknown
+	orientation                       int                    // the EXIF orientation, zero or one for the identity
+	padded_size                       image.Point            // with --pad-to-cells, the canvas size after padding, zero if no padding is needed
+	pad_offset                        image.Point            // the position of the canvas within the padding
+	animated_png                      bool                   // a PNG image with an acTL chunk
+	animated_webp                     bool                   // a WebP image with the animation flag set, which image/webp cannot decode
+	truncated_png                     bool                   // a PNG image with no IEND chunk, decoded to display whatever is available
+	has_icc_profile                   bool                   // an ICC color profile is embedded in the image
+	color_transform                   *images.ColorTransform // with --color-management, converts from the embedded profile to sRGB
+	rotate_from                       image.Point            // with --rotate, the size of the canvas before it is rotated
+	header_size                       image.Point            // the size of the image from its header, before EXIF orientation, zero if unknown
+	svg                               *images.SVG            // a vector image, rasterized at the size it is displayed at
+	is_montage                        bool                   // the --montage grid, composited from images that have already been transformed
 
 	// for error reporting
 	err         error
 	source_name string
+	index       int // the index of the input this image was created from
+}
+
+// The largest rectangle with the specified aspect ratio centered in a canvas of the specified size
+func center_crop_rect(width, height int, aspect float64) image.Rectangle {
+	if float64(width) > aspect*float64(height) {
+		w := utils.Max(1, int(math.Round(aspect*float64(height))))
+		x := (width - w) / 2
+		return image.Rect(x, 0, x+w, height)
+	}
+	h := utils.Max(1, int(math.Round(float64(width)/aspect)))
+	y := (height - h) / 2
+	return image.Rect(0, y, width, y+h)
+}
+
+// The size in pixels of the area in which an image is displayed
+func display_area(imgd *image_data) (width, height int) {
+	if montage != nil && !imgd.is_montage {
+		// images are scaled to fit in the cells of the grid
+		return montage.tile_width, montage.tile_height
+	}
+	width = int(screen_size.Xpixel)
+	// leave a row for the cursor so that the top of the image does not scroll off the screen
+	height = utils.Max(1, int(screen_size.Row)-1) * int(screen_size.Ypixel) / int(screen_size.Row)
+	if opts.NoFit && opts.Scale == "fit" {
+		// tall images scroll the screen, like text, instead of being scaled down
+		height = 10 * imgd.canvas_height
+	}
+	if place != nil {
+		width = place.width * int(screen_size.Xpixel) / int(screen_size.Col)
+		height = place.height * int(screen_size.Ypixel) / int(screen_size.Row)
+	} else if fraction != nil {
+		// never smaller than a single cell
+		width = utils.Max(int(screen_size.Xpixel)/int(screen_size.Col), int(fraction.x*float64(screen_size.Xpixel)))
+		height = utils.Max(int(screen_size.Ypixel)/int(screen_size.Row), int(fraction.y*float64(screen_size.Ypixel)))
+	}
+	if scroll_region_rows > 0 && place == nil {
+		// leave a row for the cursor so that the image does not scroll out of the region
+		height = utils.Min(height, utils.Max(1, scroll_region_rows-1)*int(screen_size.Ypixel)/int(screen_size.Row))
+	}
+	return
 }
 
 func set_basic_metadata(imgd *image_data) {
 	if imgd.frames == nil {
 		imgd.frames = make([]*image_frame, 0, 32)
 	}
-	imgd.available_width = int(screen_size.Xpixel)
-	imgd.available_height = 10 * imgd.canvas_height
-	if place != nil {
-		imgd.available_width = place.width * int(screen_size.Xpixel) / int(screen_size.Col)
-		imgd.available_height = place.height * int(screen_size.Ypixel) / int(screen_size.Row)
+	if (crop_rect != nil || center_crop_aspect > 0 || opts.Scale == "fill") && imgd.crop == nil && imgd.canvas_width > 0 && imgd.canvas_height > 0 {
+		r := image.Rect(0, 0, imgd.canvas_width, imgd.canvas_height)
+		if crop_rect != nil {
+			// an empty crop, entirely outside the image, is reported by crop_error()
+			r = r.Intersect(*crop_rect)
+		}
+		if center_crop_aspect > 0 && !r.Empty() {
+			r = center_crop_rect(r.Dx(), r.Dy(), center_crop_aspect).Add(r.Min)
+		}
+		if opts.Scale == "fill" && !r.Empty() {
+			// crop to the shape of the display area, so that the image
+			// covers it once scaled
+			width, height := display_area(imgd)
+			aspect := float64(width) / float64(height)
+			if sin, cos := math.Sincos(math.Pi * rotation / 180); math.Abs(sin) > math.Abs(cos) {
+				aspect = 1 / aspect
+			}
+			r = center_crop_rect(r.Dx(), r.Dy(), aspect).Add(r.Min)
+		}
+		imgd.crop = &r
+		if !r.Empty() {
+			imgd.canvas_width, imgd.canvas_height = r.Dx(), r.Dy()
+		}
+	}
+	if rotation != 0 && imgd.rotate_from.X == 0 && imgd.canvas_width > 0 && imgd.canvas_height > 0 {
+		imgd.rotate_from = image.Pt(imgd.canvas_width, imgd.canvas_height)
+		imgd.canvas_width, imgd.canvas_height = rotated_size(imgd.canvas_width, imgd.canvas_height)
 	}
-	imgd.needs_scaling = imgd.canvas_width > imgd.available_width || imgd.canvas_height > imgd.available_height || opts.ScaleUp
-	imgd.needs_conversion = imgd.needs_scaling || remove_alpha != nil || flip || flop || imgd.format_uppercase != "PNG"
+	imgd.available_width, imgd.available_height = display_area(imgd)
+	// vector images have no real size in pixels, so they fill the area they are placed in
+	imgd.needs_scaling = (!opts.NoScaleDown && (imgd.canvas_width > imgd.available_width || imgd.canvas_height > imgd.available_height)) || opts.ScaleUp || (imgd.svg != nil && place != nil) || opts.Scale != "fit"
+	imgd.integer_scale = 0
+	if opts.IntegerScale && opts.Scale == "fit" && imgd.canvas_width > 0 && imgd.canvas_height > 0 {
+		// the largest whole number multiple that fits, if even 1x does not
+		// fit, normal downscaling is used, unless it is disabled
+		factor := utils.Min(imgd.available_width/imgd.canvas_width, imgd.available_height/imgd.canvas_height)
+		if !opts.ScaleUp || place == nil {
+			factor = utils.Min(factor, 1)
+		}
+		if opts.NoScaleDown {
+			factor = utils.Max(factor, 1)
+		}
+		if factor > 0 {
+			imgd.integer_scale = factor
+			imgd.needs_scaling = factor > 1
+		}
+	}
+	imgd.needs_conversion = imgd.needs_scaling || renderer.RemoveAlpha != nil || renderer.Flip || renderer.Flop || rotation != 0 || imgd.format_uppercase != "PNG" || opts.OutputFormat == "raw" || opts.TransmitFormat == "sixel" || imgd.predecoded != nil || montage != nil ||
+		opts.Normalize != "none" || opts.AutoContrast || !tone_adjustment.IsIdentity() || imgd.crop != nil || opts.OutputBitDepth != "24" || opts.Quality < 100 || imgd.orientation > 1 || imgd.color_transform != nil || (imgd.animated_png && opts.Loop != 0) || imgd.truncated_png ||
+		((opts.PadToCells || opts.PreserveAspectInCells != "ceil") && !covers_whole_cells(imgd.canvas_width, imgd.canvas_height))
 }
 
-func report_error(source_name, msg string, err error) {
-	imgd := image_data{source_name: source_name, err: fmt.Errorf("%s: %w", msg, err)}
+func probe_color_profile(imgd *image_data, ra io.ReaderAt) {
+	profile := images.EmbeddedICCProfile(ra, imgd.format_uppercase)
+	if profile == nil {
+		return
+	}
+	imgd.has_icc_profile = true
+	var err error
+	if imgd.color_transform, err = images.NewSRGBTransform(profile); err != nil {
+		imgd.warning = fmt.Sprintf("Ignoring the embedded ICC color profile, colors may be inaccurate: %s", err)
+	} else if imgd.color_transform != nil {
+		imgd.info = append(imgd.info, "Colors converted to sRGB from the embedded ICC color profile")
+	}
+}
+
+// The error for a --crop rectangle entirely outside the image
+func crop_error(imgd *image_data) error {
+	if crop_rect != nil && imgd.crop != nil && imgd.crop.Empty() {
+		return fmt.Errorf("The --crop rectangle %s is entirely outside the image of size %dx%d", opts.Crop, imgd.canvas_width, imgd.canvas_height)
+	}
+	return nil
+}
+
+func cell_size() (width, height int) {
+	return int(screen_size.Xpixel) / int(screen_size.Col), int(screen_size.Ypixel) / int(screen_size.Row)
+}
+
+func covers_whole_cells(width, height int) bool {
+	cw, ch := cell_size()
+	return width%cw == 0 && height%ch == 0
+}
+
+// Shrink or enlarge the specified size, preserving its aspect ratio, to fit in
+// the number of cells obtained by rounding it as specified by --preserve-aspect-in-cells
+func round_to_cells(imgd *image_data, width, height int) (int, int) {
+	if opts.PreserveAspectInCells == "ceil" || imgd.integer_scale > 0 || width < 1 || height < 1 {
+		return width, height
+	}
+	cw, ch := cell_size()
+	round := math.Floor
+	if opts.PreserveAspectInCells == "round" {
+		round = math.Round
+	}
+	cols := utils.Min(utils.Max(1, int(round(float64(width)/float64(cw)))), utils.Max(1, imgd.available_width/cw))
+	rows := utils.Min(utils.Max(1, int(round(float64(height)/float64(ch)))), utils.Max(1, imgd.available_height/ch))
+	sx, sy := float64(cols*cw)/float64(width), float64(rows*ch)/float64(height)
+	if opts.NoScaleDown && math.Min(sx, sy) < 1 {
+		return width, height
+	}
+	if sx <= sy {
+		return cols * cw, utils.Max(1, int(math.Round(sx*float64(height))))
+	}
+	return utils.Max(1, int(math.Round(sy*float64(width)))), rows * ch
+}
+
+func set_padding(imgd *image_data) {
+	imgd.padded_size = image.Point{}
+	if !opts.PadToCells || covers_whole_cells(imgd.canvas_width, imgd.canvas_height) {
+		return
+	}
+	cw, ch := cell_size()
+	cols, rows := (imgd.canvas_width+cw-1)/cw, (imgd.canvas_height+ch-1)/ch
+	imgd.padded_size = image.Pt(cols*cw, rows*ch)
+	imgd.pad_offset = image.Pt(calculate_in_cell_x_offset(imgd.canvas_width, cw), 0)
+}
+
+// Make the padded size the size of the canvas, once all frames have been rendered
+func (imgd *image_data) finish_padding() {
+	if imgd.padded_size.X > 0 {
+		imgd.canvas_width, imgd.canvas_height = imgd.padded_size.X, imgd.padded_size.Y
+		imgd.padded_size = image.Point{}
+	}
+}
+
+func report_error(index int, source_name, msg string, err error) {
+	if deadline_reached.Load() {
+		// errors after the deadline are mostly from cancelled downloads
+		msg, err = "Skipped", errDeadlineReached
+	}
+	imgd := image_data{source_name: source_name, index: index, err: fmt.Errorf("%s: %w", msg, err)}
 	send_output(&imgd)
 }
 
@@ -229,101 +718,340 @@ func make_output_from_input(imgd *image_data, f *opened_input) {
 	} else {
 		frame.filename = f.file.(*os.File).Name()
 		if f.name_to_unlink != "" {
+			// the frame now owns the file
 			frame.filename_is_temporary = true
+			register_temp_file(f.name_to_unlink, false)
 			f.name_to_unlink = ""
+			frame.track()
 		}
 	}
 }
 
-func process_arg(arg input_arg) {
-	var f opened_input
+type probed_input struct {
+	file       opened_input
+	imgd       image_data
+	can_use_go bool
+	cache_key  string
+}
+
+// Open the input and read the image metadata, this is mostly IO bound. Returns
+// nil if the input could not be opened, in which case the error has already
+// been reported.
+func probe_arg(arg input_arg) *probed_input {
+	ans := probed_input{imgd: image_data{source_name: arg.value, index: arg.index}}
+	if arg.page > 0 {
+		ans.imgd.source_name = fmt.Sprintf("%s [page %d]", arg.value, arg.page)
+	}
+	f := &ans.file
 	if arg.is_http_url {
-		resp, err := http.Get(arg.value)
+		data, err := download(arg.value)
 		if err != nil {
-			report_error(arg.value, "Could not get", err)
-			return
+			if err == errDownloadCancelled {
+				report_stopped(arg.index, arg.value)
+			} else {
+				report_error(arg.index, arg.value, "Could not get", err)
+			}
+			return nil
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			report_error(arg.value, "Could not get", fmt.Errorf("bad status: %v", resp.Status))
-			return
+		f.file = &BytesBuf{data: data}
+	} else if arg.is_data_uri {
+		ans.imgd.source_name = data_uri_name(arg.value)
+		data, err := decode_data_uri(arg.value)
+		if err != nil {
+			report_error(arg.index, ans.imgd.source_name, "Could not decode", err)
+			return nil
 		}
-		dest := bytes.Buffer{}
-		dest.Grow(64 * 1024)
-		_, err = io.Copy(&dest, resp.Body)
+		f.file = &BytesBuf{data: data}
+	} else if arg.zip_entry != nil {
+		data, err := read_zip_entry(arg.zip_entry)
 		if err != nil {
-			report_error(arg.value, "Could not download", err)
-			return
+			report_error(arg.index, arg.value, "Could not extract", err)
+			return nil
+		}
+		f.file = &BytesBuf{data: data}
+	} else if arg.is_clipboard {
+		if arg.clipboard_err != nil {
+			report_error(arg.index, arg.value, "Could not read image from", arg.clipboard_err)
+			return nil
 		}
-		f.file = &BytesBuf{data: dest.Bytes()}
+		f.file = &BytesBuf{data: arg.clipboard_data}
+	} else if arg.stdin_data != nil {
+		ans.imgd.source_name = arg.stdin_name()
+		f.file = &BytesBuf{data: arg.stdin_data}
 	} else if arg.value == "" {
-		stdin, err := io.ReadAll(os.Stdin)
-		if err != nil {
-			report_error("<stdin>", "Could not read from", err)
-			return
+		if opts.StdinFormat != "auto" {
+			if !probe_stdin_with_declared_format(&ans) {
+				return nil
+			}
+			return &ans
+		}
+		if err := read_spilling(os.Stdin, f); err != nil {
+			report_error(arg.index, "<stdin>", "Could not read from", err)
+			return nil
+		}
+		if err := decode_stdin_data_uri(f); err != nil {
+			f.Release()
+			report_error(arg.index, "<stdin>", "Could not decode the data URI read from", err)
+			return nil
 		}
-		f.file = &BytesBuf{data: stdin}
 	} else {
-		q, err := os.Open(arg.value)
+		q, err := open_limited(arg.value)
 		if err != nil {
-			report_error(arg.value, "Could not open", err)
-			return
+			report_error(arg.index, arg.value, "Could not open", err)
+			return nil
+		}
+		if _, err = q.Seek(0, io.SeekCurrent); err != nil {
+			// FIFOs and pipes, such as /dev/stdin, cannot be rewound after
+			// reading the image metadata, so read them, as for STDIN
+			err = read_spilling(q, f)
+			q.Close()
+			if err != nil {
+				report_error(arg.index, arg.value, "Could not read from", err)
+				return nil
+			}
+		} else {
+			f.file = q
+			if render_cache_enabled() {
+				ans.cache_key = render_cache_key(q, arg.page)
+			}
 		}
-		f.file = q
 	}
-	defer f.Release()
-	can_use_go := false
-	var c image.Config
-	var format string
-	var err error
-	imgd := image_data{source_name: arg.value}
+	if is_raw_file(arg.value) {
+		// RAW files are TIFF based and the Go TIFF decoder would display only
+		// the tiny thumbnail in their first IFD
+		if err := probe_raw_input(&ans); err != nil {
+			f.Release()
+			report_error(arg.index, arg.value, "Could not read RAW image", err)
+			return nil
+		}
+		if ans.can_use_go || ans.imgd.warning == "" {
+			return &ans
+		}
+	}
+	if format := bilevel_format(arg.value); format != "" {
+		probe_bilevel_input(&ans, format)
+		return &ans
+	}
+	if format := heif_format(f); format != "" {
+		if err := probe_heif_input(&ans, format); err != nil {
+			f.Release()
+			report_error(arg.index, arg.value, "Could not read "+format+" image", err)
+			return nil
+		}
+		return &ans
+	}
 	if opts.Engine == "auto" || opts.Engine == "native" {
-		c, format, err = image.DecodeConfig(f.file)
+		c, format, err := image.DecodeConfig(f.file)
 		f.Rewind()
-		can_use_go = err == nil
+		if err == nil {
+			ans.can_use_go = true
+			ans.imgd.canvas_width = c.Width
+			ans.imgd.canvas_height = c.Height
+			ans.imgd.format_uppercase = strings.ToUpper(format)
+			page := arg.page
+			if page == 0 {
+				page = opts.Page
+			}
+			var err error
+			switch ans.imgd.format_uppercase {
+			case "TIFF":
+				err = select_tiff_page(&ans, page)
+			case "ICO":
+				err = select_ico_image(&ans, page)
+			}
+			if err != nil {
+				f.Release()
+				report_error(arg.index, ans.imgd.source_name, "Could not select page", err)
+				return nil
+			}
+			if ra, ok := f.file.(io.ReaderAt); ok {
+				if !opts.NoExif && ans.imgd.orientation == 0 {
+					// the orientation of RAW previews is already set from the RAW file
+					ans.imgd.orientation = images.Orientation(ra, ans.imgd.format_uppercase)
+				}
+				ans.imgd.animated_png = ans.imgd.format_uppercase == "PNG" && images.IsAPNG(ra)
+				ans.imgd.animated_webp = ans.imgd.format_uppercase == "WEBP" && images.IsAnimatedWebP(ra)
+				if opts.ColorManagement != "none" {
+					probe_color_profile(&ans.imgd, ra)
+				}
+			}
+			ans.imgd.truncated_png = ans.imgd.format_uppercase == "PNG" && images.IsTruncatedPNG(f.file)
+			if ans.imgd.format_uppercase == "TIFF" && page < 2 {
+				select_tiff_level(&ans)
+			}
+			if ans.imgd.orientation > 4 {
+				// these orientations rotate the image by 90 degrees
+				ans.imgd.canvas_width, ans.imgd.canvas_height = ans.imgd.canvas_height, ans.imgd.canvas_width
+			}
+			if opts.ShowLocation {
+				ans.imgd.caption = location_caption(f, ans.imgd.format_uppercase)
+			}
+		}
 	}
+	if !ans.can_use_go && opts.Engine != "magick" {
+		probe_svg(&ans, arg.value)
+	}
+	return &ans
+}
+
+// Decode and convert a probed input, this is mostly CPU bound
+func render_probed_input(p *probed_input) {
+	defer p.file.Release()
 	if !keep_going.Load() {
+		report_stopped(p.imgd.index, p.imgd.source_name)
 		return
 	}
-	if can_use_go {
-		imgd.canvas_width = c.Width
-		imgd.canvas_height = c.Height
-		imgd.format_uppercase = strings.ToUpper(format)
-		set_basic_metadata(&imgd)
+	imgd, f := &p.imgd, &p.file
+	if get_cached_render(p.cache_key, imgd) {
+		send_output(imgd)
+		return
+	}
+	if p.can_use_go {
+		// fax images have no header with their height, it is only known after
+		// decoding, and the first frame of a GIF can be smaller than its screen
+		if imgd.format_uppercase != "G3FAX" && imgd.format_uppercase != "G4FAX" && imgd.format_uppercase != "GIF" {
+			imgd.header_size = image.Pt(imgd.canvas_width, imgd.canvas_height)
+			if imgd.orientation > 4 {
+				imgd.header_size.X, imgd.header_size.Y = imgd.header_size.Y, imgd.header_size.X
+			}
+		}
+		set_basic_metadata(imgd)
+		if err := crop_error(imgd); err != nil {
+			report_error(imgd.index, imgd.source_name, "Could not crop image", err)
+			return
+		}
 		if !imgd.needs_conversion {
-			make_output_from_input(&imgd, &f)
-			send_output(&imgd)
+			make_output_from_input(imgd, f)
+			send_output(imgd)
 			return
 		}
-		err = render_image_with_go(&imgd, &f)
+		err := render_image_with_go(imgd, f)
 		if err != nil {
-			report_error(arg.value, "Could not render image to RGB", err)
+			imgd.release_frames()
+			report_error(imgd.index, imgd.source_name, "Could not render image to RGB", err)
 			return
 		}
 	} else {
-		err = render_image_with_magick(&imgd, &f)
+		err := render_image_with_magick(imgd, f)
 		if err != nil {
-			report_error(arg.value, "ImageMagick failed", err)
+			imgd.release_frames()
+			report_error(imgd.index, imgd.source_name, "ImageMagick failed", err)
+			return
+		}
+	}
+	// the --montage grid is encoded once it is composited
+	if opts.OutputFormat == "png" && opts.TransmitFormat != "sixel" && montage == nil {
+		if err := encode_frames_as_png(imgd); err != nil {
+			imgd.release_frames()
+			report_error(imgd.index, imgd.source_name, "Could not encode image as PNG", err)
 			return
 		}
 	}
 	if !keep_going.Load() {
+		imgd.release_frames()
+		report_stopped(imgd.index, imgd.source_name)
 		return
 	}
-	send_output(&imgd)
+	if err := put_cached_render(p.cache_key, imgd); err != nil {
+		imgd.info = append(imgd.info, fmt.Sprintf("Failed to cache rendered frames: %s", err))
+	}
+	send_output(imgd)
+}
 
+func process_arg(arg input_arg) {
+	if p := probe_arg(arg); p != nil {
+		render_probed_input(p)
+	}
 }
 
-func run_worker() {
+func run_worker(inputs <-chan input_arg) {
 	for {
+		acquire_inflight_slot()
 		select {
-		case arg := <-files_channel:
+		case arg := <-inputs:
+			if deadline_reached.Load() {
+				report_stopped(arg.index, arg.value)
+				continue
+			}
 			if !keep_going.Load() {
 				return
 			}
 			process_arg(arg)
 		default:
+			release_inflight_slot()
+			return
+		}
+	}
+}
+
+func run_probe_worker(inputs <-chan input_arg, probed chan<- *probed_input, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		acquire_inflight_slot()
+		select {
+		case arg := <-inputs:
+			if deadline_reached.Load() {
+				report_stopped(arg.index, arg.value)
+				continue
+			}
+			if !keep_going.Load() {
+				return
+			}
+			if p := probe_arg(arg); p != nil {
+				probed <- p
+			}
+		default:
+			release_inflight_slot()
 			return
 		}
 	}
 }
+
+func run_render_worker(probed <-chan *probed_input) {
+	for p := range probed {
+		render_probed_input(p)
+	}
+}
+
+// The number of images to decode simultaneously, from --concurrency
+func decode_concurrency() int {
+	if opts.Concurrency > 0 {
+		return opts.Concurrency
+	}
+	return utils.Max(1, runtime.GOMAXPROCS(0))
+}
+
+// Start the workers for the num_of_items inputs in files_channel. They exit
+// once all the inputs have been taken, so this is called for every batch of
+// inputs.
+func start_workers() {
+	inputs := files_channel
+	num_cpus := runtime.NumCPU()
+	setup_download_slots(num_cpus)
+	probe_parallelism := opts.ProbeParallelism
+	if probe_parallelism == 0 {
+		probe_parallelism = 4 * num_cpus
+	}
+	if num_of_items <= num_cpus || probe_parallelism < 0 {
+		// too few inputs for splitting into phases to be worthwhile
+		num_workers := utils.Max(1, utils.Min(num_of_items, decode_concurrency()))
+		for i := 0; i < num_workers; i++ {
+			go run_worker(inputs)
+		}
+		return
+	}
+	num_render_workers := decode_concurrency()
+	probed := make(chan *probed_input, num_render_workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < utils.Min(num_of_items, probe_parallelism); i++ {
+		wg.Add(1)
+		go run_probe_worker(inputs, probed, &wg)
+	}
+	go func() {
+		wg.Wait()
+		close(probed)
+	}()
+	for i := 0; i < num_render_workers; i++ {
+		go run_render_worker(probed)
+	}
+}
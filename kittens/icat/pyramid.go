@@ -0,0 +1,89 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"io"
+
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+type tiff_level_reader struct {
+	*io.SectionReader
+	underlying io.Closer
+}
+
+func (self *tiff_level_reader) Close() error {
+	return self.underlying.Close()
+}
+
+// For multi-resolution (pyramid) TIFF files, switch the input to the smallest
+// level that is at least as large as the size the image will be displayed
+// at, to avoid decoding the, potentially huge, full resolution level
+func select_tiff_level(p *probed_input) {
+	ra, ok := p.file.file.(io.ReaderAt)
+	if !ok || crop_rect != nil || screen_size == nil {
+		// --crop is in the pixels of the full resolution level. When images
+		// are not displayed, such as with --detect, the full size is used.
+		return
+	}
+	levels, err := images.TIFFLevels(ra)
+	if err != nil || len(levels) < 2 {
+		return
+	}
+	set_basic_metadata(&p.imgd)
+	needed_width, needed_height := images.FitImage(levels[0].Width, levels[0].Height, p.imgd.available_width, p.imgd.available_height)
+	chosen := 0
+	for i, l := range levels {
+		if l.Width >= needed_width && l.Height >= needed_height {
+			chosen = i
+		}
+	}
+	if chosen == 0 {
+		return
+	}
+	size, err := p.file.file.Seek(0, io.SeekEnd)
+	p.file.Rewind()
+	if err != nil {
+		return
+	}
+	sr, err := images.TIFFWithLevel(ra, size, levels[chosen])
+	if err != nil {
+		return
+	}
+	p.file.file = &tiff_level_reader{SectionReader: sr, underlying: p.file.file}
+	p.imgd.canvas_width, p.imgd.canvas_height = levels[chosen].Width, levels[chosen].Height
+	p.imgd.info = append(p.imgd.info, fmt.Sprintf(
+		"Using pyramid level %d of %d with size %dx%d, full size is %dx%d", chosen+1, len(levels),
+		levels[chosen].Width, levels[chosen].Height, levels[0].Width, levels[0].Height))
+}
+
+// Switch the input to the specified page of a multi-page TIFF file, from one
+func select_tiff_page(p *probed_input, page int) error {
+	ra, ok := p.file.file.(io.ReaderAt)
+	if page < 2 || !ok {
+		return nil
+	}
+	pages, err := images.TIFFPages(ra)
+	if err != nil {
+		return err
+	}
+	if page > len(pages) {
+		return fmt.Errorf("The image has only %d pages, cannot select page %d", len(pages), page)
+	}
+	size, err := p.file.file.Seek(0, io.SeekEnd)
+	p.file.Rewind()
+	if err != nil {
+		return err
+	}
+	sr, err := images.TIFFWithLevel(ra, size, pages[page-1])
+	if err != nil {
+		return err
+	}
+	p.file.file = &tiff_level_reader{SectionReader: sr, underlying: p.file.file}
+	p.imgd.canvas_width, p.imgd.canvas_height = pages[page-1].Width, pages[page-1].Height
+	return nil
+}
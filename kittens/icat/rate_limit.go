@@ -0,0 +1,88 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var _ = fmt.Print
+
+type token_bucket struct {
+	tokens      float64
+	last_refill time.Time
+}
+
+var rate_limit_lock sync.Mutex
+var rate_limit_buckets = make(map[string]*token_bucket)
+
+// The times until which no requests are made to hosts that responded with Retry-After
+var paused_hosts = make(map[string]time.Time)
+
+func url_host(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// Make no requests to host until the specified time
+func pause_requests(host string, until time.Time) {
+	rate_limit_lock.Lock()
+	defer rate_limit_lock.Unlock()
+	if until.After(paused_hosts[host]) {
+		paused_hosts[host] = until
+	}
+}
+
+func remaining_pause(host string, now time.Time) time.Duration {
+	rate_limit_lock.Lock()
+	defer rate_limit_lock.Unlock()
+	if until, found := paused_hosts[host]; found && until.After(now) {
+		return until.Sub(now)
+	}
+	return 0
+}
+
+// Take a token from the bucket for host, returning how long to wait before
+// trying again if none is available
+func take_rate_limit_token(host string, rate float64, now time.Time) time.Duration {
+	rate_limit_lock.Lock()
+	defer rate_limit_lock.Unlock()
+	// allow bursts of up to one second worth of requests
+	burst := math.Max(1, rate)
+	b := rate_limit_buckets[host]
+	if b == nil {
+		b = &token_bucket{tokens: burst, last_refill: now}
+		rate_limit_buckets[host] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last_refill).Seconds()*rate)
+	b.last_refill = now
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// Wait until --rate-limit and any pause requested by the server allow a
+// request to host. Returns false if processing was cancelled while waiting.
+func wait_for_rate_limit(host string) bool {
+	for keep_going.Load() {
+		now := time.Now()
+		wait := remaining_pause(host, now)
+		if wait == 0 && opts.RateLimit > 0 {
+			wait = take_rate_limit_token(host, opts.RateLimit, now)
+		}
+		if wait == 0 {
+			return true
+		}
+		// sleep in small increments so that cancellation is noticed promptly
+		time.Sleep(time.Duration(math.Min(float64(wait), float64(50*time.Millisecond))))
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+var raw_mime_types = map[string]bool{
+	"image/x-adobe-dng": true,
+	"image/x-canon-cr2": true,
+	"image/x-nikon-nef": true,
+}
+
+func is_raw_file(name string) bool {
+	return name != "" && raw_mime_types[utils.GuessMimeType(name)]
+}
+
+// Prepare a camera RAW file for rendering. By default the embedded JPEG
+// preview is used, as demosaicing the sensor data is slow. With --full-raw or
+// when there is no usable preview, the sensor data is decoded with libraw if
+// kitty was built with it, otherwise ImageMagick is used.
+func probe_raw_input(p *probed_input) (err error) {
+	f := &p.file
+	if !opts.FullRaw {
+		if ra, ok := f.file.(io.ReaderAt); ok {
+			if preview, perr := images.RAWPreview(ra); perr == nil {
+				if !opts.NoExif {
+					// the preview is usually stored unrotated and without
+					// EXIF data of its own, the orientation is in IFD0 of the
+					// RAW file
+					p.imgd.orientation = images.Orientation(ra, "TIFF")
+				}
+				f.Release()
+				f.file = &BytesBuf{data: preview}
+				p.imgd.warning = "Displaying the embedded preview of this RAW file, use --full-raw to decode the full image"
+				return
+			}
+		}
+	}
+	if !have_libraw || opts.Engine == "magick" {
+		// ImageMagick will use its own RAW delegate
+		return
+	}
+	data, err := io.ReadAll(f.file)
+	f.Rewind()
+	if err != nil {
+		return fmt.Errorf("Failed to read RAW file: %w", err)
+	}
+	if p.imgd.canvas_width, p.imgd.canvas_height, err = raw_image_size(data); err != nil {
+		return err
+	}
+	f.Release()
+	f.file = &BytesBuf{data: data}
+	p.imgd.format_uppercase = "RAW"
+	p.can_use_go = true
+	return
+}
+
+func load_raw_image(src *opened_input) (image.Image, error) {
+	bb, ok := src.file.(*BytesBuf)
+	if !ok {
+		return nil, fmt.Errorf("RAW image data not in memory")
+	}
+	return decode_raw_image(bb.data)
+}
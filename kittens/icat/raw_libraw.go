@@ -0,0 +1,93 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+//go:build libraw
+
+package icat
+
+/*
+#cgo pkg-config: libraw
+#include <stdlib.h>
+#include <libraw/libraw.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"unsafe"
+)
+
+var _ = fmt.Print
+
+const have_libraw = true
+
+// Open the RAW file in data, call release() to free it
+func open_raw_buffer(data []byte) (lr *C.libraw_data_t, release func(), err error) {
+	lr = C.libraw_init(0)
+	if lr == nil {
+		return nil, nil, fmt.Errorf("Failed to initialize libraw")
+	}
+	// libraw keeps using the buffer after libraw_open_buffer() returns, so it
+	// cannot be Go memory
+	buf := C.CBytes(data)
+	release = func() {
+		C.libraw_close(lr)
+		C.free(buf)
+	}
+	if ret := C.libraw_open_buffer(lr, buf, C.size_t(len(data))); ret != C.LIBRAW_SUCCESS {
+		release()
+		return nil, nil, fmt.Errorf("libraw failed to open image: %s", C.GoString(C.libraw_strerror(ret)))
+	}
+	return lr, release, nil
+}
+
+func raw_image_size(data []byte) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, fmt.Errorf("Empty RAW file")
+	}
+	lr, release, err := open_raw_buffer(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+	width, height := int(lr.sizes.iwidth), int(lr.sizes.iheight)
+	if lr.sizes.flip&4 != 0 {
+		width, height = height, width
+	}
+	return width, height, nil
+}
+
+func decode_raw_image(data []byte) (image.Image, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Empty RAW file")
+	}
+	lr, release, err := open_raw_buffer(data)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	lr.params.output_bps = 8
+	lr.params.use_camera_wb = 1
+	if ret := C.libraw_unpack(lr); ret != C.LIBRAW_SUCCESS {
+		return nil, fmt.Errorf("libraw failed to unpack image: %s", C.GoString(C.libraw_strerror(ret)))
+	}
+	if ret := C.libraw_dcraw_process(lr); ret != C.LIBRAW_SUCCESS {
+		return nil, fmt.Errorf("libraw failed to process image: %s", C.GoString(C.libraw_strerror(ret)))
+	}
+	var ret C.int
+	pi := C.libraw_dcraw_make_mem_image(lr, &ret)
+	if pi == nil {
+		return nil, fmt.Errorf("libraw failed to create image: %s", C.GoString(C.libraw_strerror(ret)))
+	}
+	defer C.libraw_dcraw_clear_mem(pi)
+	if pi._type != C.LIBRAW_IMAGE_BITMAP || pi.colors != 3 || pi.bits != 8 {
+		return nil, fmt.Errorf("libraw produced an image in an unsupported format")
+	}
+	width, height := int(pi.width), int(pi.height)
+	pix := unsafe.Slice((*byte)(unsafe.Pointer(&pi.data[0])), int(pi.data_size))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i, o := 0, 0; i+2 < len(pix) && o < len(img.Pix); i, o = i+3, o+4 {
+		img.Pix[o], img.Pix[o+1], img.Pix[o+2], img.Pix[o+3] = pix[i], pix[i+1], pix[i+2], 255
+	}
+	return img, nil
+}
@@ -0,0 +1,22 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+//go:build !libraw
+
+package icat
+
+import (
+	"fmt"
+	"image"
+)
+
+var _ = fmt.Print
+
+const have_libraw = false
+
+func raw_image_size(data []byte) (int, int, error) {
+	return 0, 0, fmt.Errorf("Not built with libraw support")
+}
+
+func decode_raw_image(data []byte) (image.Image, error) {
+	return nil, fmt.Errorf("Not built with libraw support")
+}
@@ -0,0 +1,274 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"image/color"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"kitty/tools/tui/graphics"
+)
+
+var _ = fmt.Print
+
+// The rendered frames of an image, stored independently of the shared memory
+// and temporary files that are consumed when the image is transmitted
+type cached_frame struct {
+	Data                     []byte
+	Width, Height, Left, Top int
+	Format                   graphics.GRT_f
+	ComposeOnto, Number      int
+	DisposalBackground       color.NRGBA
+	DelayMs                  int
+	ReplacesPreview          bool
+}
+
+type cached_render struct {
+	CanvasWidth, CanvasHeight int
+	Format                    string
+	Frames, UpgradedFrames    []cached_frame
+	HeaderLoops               int
+}
+
+func (self *cached_render) size() (ans int) {
+	for _, f := range append(self.Frames, self.UpgradedFrames...) {
+		ans += len(f.Data)
+	}
+	return
+}
+
+var render_cache_lock sync.Mutex
+var memory_render_cache = make(map[string]*cached_render)
+var memory_render_cache_order []string // least recently used first
+var memory_render_cache_size int
+
+func render_cache_enabled() bool {
+	return !opts.NoRenderCache && (opts.HoldOpen || opts.RenderCacheDir != "")
+}
+
+func render_cache_limit() int {
+	return int(opts.RenderCacheSize * 1024 * 1024)
+}
+
+// Identify a rendering of the local file f, or of the specified page of a
+// multi-page TIFF file. The key changes when the file is
+// modified or when anything that affects rendering, such as the options or
+// the size of the screen, changes.
+func render_cache_key(f *os.File, page int) string {
+	s, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	path, err := filepath.Abs(f.Name())
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	// the background color is included as it can come from the terminal with --background=terminal
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%+v\x00%+v\x00%d\x00%+v\x00%d", path, s.Size(), s.ModTime().UnixNano(), *opts, screen_size, scroll_region_rows, renderer.RemoveAlpha, page)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func cache_frames(frames []*image_frame) (ans []cached_frame, err error) {
+	ans = make([]cached_frame, len(frames))
+	for i, f := range frames {
+		data := f.in_memory_bytes
+		if data == nil {
+			if data, err = os.ReadFile(f.filename); err != nil {
+				return nil, err
+			}
+		} else {
+			// in_memory_bytes can be shared memory that is unmapped after transmission
+			data = bytes.Clone(data)
+		}
+		ans[i] = cached_frame{
+			Data: data, Width: f.width, Height: f.height, Left: f.left, Top: f.top, Format: f.transmission_format,
+			ComposeOnto: f.compose_onto, Number: f.number, DisposalBackground: f.disposal_background, DelayMs: f.delay_ms,
+			ReplacesPreview: f.replaces_preview,
+		}
+	}
+	return
+}
+
+func uncache_frames(frames []cached_frame) (ans []*image_frame) {
+	if frames == nil {
+		return nil
+	}
+	ans = make([]*image_frame, len(frames))
+	for i, f := range frames {
+		ans[i] = &image_frame{
+			in_memory_bytes: f.Data, width: f.Width, height: f.Height, left: f.Left, top: f.Top, transmission_format: f.Format,
+			compose_onto: f.ComposeOnto, number: f.Number, disposal_background: f.DisposalBackground, delay_ms: f.DelayMs,
+			replaces_preview: f.ReplacesPreview,
+		}
+	}
+	return
+}
+
+func add_to_memory_render_cache(key string, c *cached_render) {
+	render_cache_lock.Lock()
+	defer render_cache_lock.Unlock()
+	if _, found := memory_render_cache[key]; found {
+		return
+	}
+	memory_render_cache[key] = c
+	memory_render_cache_order = append(memory_render_cache_order, key)
+	memory_render_cache_size += c.size()
+	// evict the least recently used renders
+	for memory_render_cache_size > render_cache_limit() && len(memory_render_cache_order) > 0 {
+		k := memory_render_cache_order[0]
+		memory_render_cache_order = memory_render_cache_order[1:]
+		memory_render_cache_size -= memory_render_cache[k].size()
+		delete(memory_render_cache, k)
+	}
+}
+
+// Move key to the end of memory_render_cache_order, as it has just been used.
+// Must be called with render_cache_lock held.
+func touch_memory_render_cache(key string) {
+	for i, k := range memory_render_cache_order {
+		if k == key {
+			memory_render_cache_order = append(memory_render_cache_order[:i], memory_render_cache_order[i+1:]...)
+			memory_render_cache_order = append(memory_render_cache_order, key)
+			break
+		}
+	}
+}
+
+func disk_render_cache_path(key string) string {
+	return filepath.Join(opts.RenderCacheDir, key+".gob")
+}
+
+func read_disk_render_cache(key string) *cached_render {
+	path := disk_render_cache_path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var ans cached_render
+	if gob.NewDecoder(bytes.NewReader(data)).Decode(&ans) != nil {
+		os.Remove(path)
+		return nil
+	}
+	// the modification time is used to evict the least recently used renders
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return &ans
+}
+
+func write_disk_render_cache(key string, c *cached_render) (err error) {
+	if err = os.MkdirAll(opts.RenderCacheDir, 0o700); err != nil {
+		return
+	}
+	f, err := os.CreateTemp(opts.RenderCacheDir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	err = gob.NewEncoder(f).Encode(c)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(f.Name(), disk_render_cache_path(key)); err != nil {
+		return
+	}
+	render_cache_lock.Lock()
+	defer render_cache_lock.Unlock()
+	return trim_cache_dir(opts.RenderCacheDir, ".gob")
+}
+
+// Remove the least recently used files with the specified extension from dir
+// until their total size is within --render-cache-size
+func trim_cache_dir(dir, ext string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type item struct {
+		path  string
+		size  int
+		mtime time.Time
+	}
+	items := make([]item, 0, len(entries))
+	total := 0
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ext {
+			continue
+		}
+		if s, err := e.Info(); err == nil {
+			items = append(items, item{filepath.Join(dir, e.Name()), int(s.Size()), s.ModTime()})
+			total += int(s.Size())
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].mtime.Before(items[j].mtime) })
+	for _, x := range items {
+		if total <= render_cache_limit() {
+			break
+		}
+		if os.Remove(x.path) == nil {
+			total -= x.size
+		}
+	}
+	return nil
+}
+
+// Fill in imgd from a cached rendering, returning false if there is none
+func get_cached_render(key string, imgd *image_data) bool {
+	if key == "" {
+		return false
+	}
+	render_cache_lock.Lock()
+	c := memory_render_cache[key]
+	if c != nil {
+		touch_memory_render_cache(key)
+	}
+	render_cache_lock.Unlock()
+	if c == nil && opts.RenderCacheDir != "" {
+		if c = read_disk_render_cache(key); c != nil && opts.HoldOpen {
+			add_to_memory_render_cache(key, c)
+		}
+	}
+	if c == nil {
+		return false
+	}
+	imgd.canvas_width, imgd.canvas_height, imgd.format_uppercase = c.CanvasWidth, c.CanvasHeight, c.Format
+	imgd.frames, imgd.upgraded_frames = uncache_frames(c.Frames), uncache_frames(c.UpgradedFrames)
+	imgd.header_loops = c.HeaderLoops
+	imgd.info = append(imgd.info, "Rendered frames read from the cache")
+	return true
+}
+
+func put_cached_render(key string, imgd *image_data) (err error) {
+	if key == "" {
+		return
+	}
+	c := cached_render{CanvasWidth: imgd.canvas_width, CanvasHeight: imgd.canvas_height, Format: imgd.format_uppercase, HeaderLoops: imgd.header_loops}
+	if c.Frames, err = cache_frames(imgd.frames); err != nil {
+		return
+	}
+	if c.UpgradedFrames, err = cache_frames(imgd.upgraded_frames); err != nil {
+		return
+	}
+	if c.size() > render_cache_limit() {
+		return
+	}
+	if opts.HoldOpen {
+		add_to_memory_render_cache(key, &c)
+	}
+	if opts.RenderCacheDir != "" {
+		err = write_disk_render_cache(key, &c)
+	}
+	return
+}
@@ -0,0 +1,79 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"kitty/tools/tui/loop"
+)
+
+var _ = fmt.Print
+
+// The number of rows in the scroll region, zero if images are not fitted to it
+var scroll_region_rows int
+
+// Parse a region of the form TOP:BOTTOM with 1-based, inclusive line numbers,
+// as used by DECSTBM, returning the number of rows in it
+func parse_region_rows(spec string) (int, error) {
+	t, b, found := strings.Cut(spec, ":")
+	if !found {
+		t, b, found = strings.Cut(spec, ";")
+	}
+	if !found {
+		return 0, fmt.Errorf("Invalid scroll region: %#v must be of the form TOP:BOTTOM", spec)
+	}
+	top, err := strconv.Atoi(strings.TrimSpace(t))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid scroll region: %#v top is not a number", spec)
+	}
+	bottom, err := strconv.Atoi(strings.TrimSpace(b))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid scroll region: %#v bottom is not a number", spec)
+	}
+	if top < 1 || bottom < top {
+		return 0, fmt.Errorf("Invalid scroll region: %#v must have 1 <= TOP <= BOTTOM", spec)
+	}
+	return bottom - top + 1, nil
+}
+
+func warn_no_scroll_region() {
+	print_error("\x1b[33mWarning\x1b[39m: could not query the scroll region from the terminal, use --scroll-region to specify it\r\n")
+}
+
+// Set scroll_region_rows from --scroll-region or, if can_query, return a
+// query that asks the terminal for the current scroll region using DECRQSS.
+// Must be done before the workers start as they use the scroll region.
+func setup_scroll_region(can_query bool) (q *terminal_query, err error) {
+	if !opts.FitWithinScrollregion {
+		return
+	}
+	if opts.ScrollRegion != "" {
+		scroll_region_rows, err = parse_region_rows(opts.ScrollRegion)
+		return
+	}
+	if !can_query {
+		warn_no_scroll_region()
+		return
+	}
+	return &terminal_query{
+		write: func(lp *loop.Loop) { lp.QueueWriteString("\x1bP$qr\x1b\\") },
+		on_escape_code: func(etype loop.EscapeCodeType, payload []byte) {
+			if etype != loop.DCS {
+				return
+			}
+			if q, found := strings.CutPrefix(string(payload), "1$r"); found && strings.HasSuffix(q, "r") {
+				if n, perr := parse_region_rows(strings.TrimSuffix(q, "r")); perr == nil {
+					scroll_region_rows = n
+				}
+			}
+		},
+		finish: func(err error) {
+			if err == nil && scroll_region_rows == 0 {
+				warn_no_scroll_region()
+			}
+		},
+	}, nil
+}
@@ -0,0 +1,43 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils/images"
+	"kitty/tools/wcswidth"
+)
+
+var _ = fmt.Print
+
+// Display the first frame of an image using sixel graphics, for terminals
+// that do not support the kitty graphics protocol. Sixel has no animation,
+// so animated images are displayed as still images.
+func transmit_sixel(imgd *image_data) {
+	defer imgd.release_frames()
+	img, err := imgd.frames[0].image()
+	if err != nil {
+		imgd.err = err
+		return
+	}
+	place_cursor(imgd)
+	fmt.Print("\r")
+	if imgd.move_x_by > 0 {
+		fmt.Printf("\x1b[%dC", imgd.move_x_by)
+	}
+	if imgd.move_to.x > 0 {
+		fmt.Printf(loop.MoveCursorToTemplate, imgd.move_to.y, imgd.move_to.x)
+	}
+	if imgd.err = images.EncodeSixel(os.Stdout, img, images.MaxSixelColors, dither_method, dither_strength); imgd.err != nil {
+		return
+	}
+	// terminals move the cursor to the line below the image, after sixel graphics
+	if imgd.move_to.x == 0 && imgd.caption != "" {
+		fmt.Print("\r" + strings.Repeat(" ", imgd.move_x_by))
+		fmt.Println(wcswidth.TruncateToVisualLength(imgd.caption, int(screen_size.Col)-imgd.move_x_by))
+	}
+}
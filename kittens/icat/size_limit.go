@@ -0,0 +1,162 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"kitty/tools/utils/humanize"
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+type size_limit_error struct {
+	size  int64 // zero if unknown
+	limit int64
+}
+
+func (self *size_limit_error) Error() string {
+	if self.size > 0 {
+		return fmt.Sprintf("size of %s exceeds the limit of %s set by --max-bytes", humanize.IBytes(uint64(self.size)), humanize.IBytes(uint64(self.limit)))
+	}
+	return fmt.Sprintf("size exceeds the limit of %s set by --max-bytes", humanize.IBytes(uint64(self.limit)))
+}
+
+// The maximum number of bytes to read from a single input, zero for no limit
+func max_bytes() int64 {
+	if opts.MaxBytes <= 0 {
+		return 0
+	}
+	return int64(opts.MaxBytes * 1024 * 1024)
+}
+
+// Return an error if size, which is negative if unknown, exceeds --max-bytes
+func check_size_limit(size int64) error {
+	if limit := max_bytes(); limit > 0 && size > limit {
+		return &size_limit_error{size: size, limit: limit}
+	}
+	return nil
+}
+
+// Like io.ReadAll, but fails without reading everything if r contains
+// more than --max-bytes
+func read_all_limited(r io.Reader) ([]byte, error) {
+	limit := max_bytes()
+	if limit == 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, &size_limit_error{limit: limit}
+	}
+	return data, nil
+}
+
+// The maximum number of bytes of a piped input to keep in memory, zero for no
+// limit
+func stdin_memory_limit() int64 {
+	if opts.StdinMemoryLimit <= 0 {
+		return 0
+	}
+	return int64(opts.StdinMemoryLimit * 1024 * 1024)
+}
+
+// Read all of r, which cannot be rewound, such as STDIN, into f. Data larger
+// than --stdin-memory-limit is written to a temporary file instead of being
+// kept in memory, so that large piped images can still be rewound after their
+// metadata is read. Fails if r contains more than --max-bytes.
+func read_spilling(r io.Reader, f *opened_input) error {
+	limit, threshold := max_bytes(), stdin_memory_limit()
+	if threshold == 0 || (limit > 0 && threshold >= limit) {
+		data, err := read_all_limited(r)
+		if err != nil {
+			return err
+		}
+		f.file = &BytesBuf{data: data}
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r, threshold+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) <= threshold {
+		f.file = &BytesBuf{data: data}
+		return nil
+	}
+	tf, err := images.CreateTemp()
+	if err != nil {
+		return fmt.Errorf("Failed to create a temporary file to store input data with error: %w", err)
+	}
+	register_temp_file(tf.Name(), true)
+	f.file, f.name_to_unlink = tf, tf.Name()
+	rest := r
+	if limit > 0 {
+		rest = io.LimitReader(r, limit-int64(len(data))+1)
+	}
+	total := int64(len(data))
+	if _, err = tf.Write(data); err == nil {
+		var n int64
+		n, err = io.Copy(tf, rest)
+		total += n
+	}
+	if err == nil && limit > 0 && total > limit {
+		err = &size_limit_error{limit: limit}
+	}
+	if err == nil {
+		_, err = tf.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Release()
+		return err
+	}
+	return nil
+}
+
+// A reader that fails once more than --max-bytes have been read from it, for
+// decoders that read their input incrementally
+type limited_reader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (self *limited_reader) Read(p []byte) (n int, err error) {
+	if self.remaining < 0 {
+		return 0, &size_limit_error{limit: self.limit}
+	}
+	n, err = self.r.Read(p)
+	self.remaining -= int64(n)
+	if self.remaining < 0 {
+		return n, &size_limit_error{limit: self.limit}
+	}
+	return
+}
+
+func new_limited_reader(r io.Reader) io.Reader {
+	limit := max_bytes()
+	if limit == 0 {
+		return r
+	}
+	return &limited_reader{r: r, remaining: limit, limit: limit}
+}
+
+// Open a local file, failing if it is a regular file larger than --max-bytes
+func open_limited(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if st, err := f.Stat(); err == nil && st.Mode().IsRegular() {
+		if err = check_size_limit(st.Size()); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
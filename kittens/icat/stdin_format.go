@@ -0,0 +1,106 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+
+	"kitty/tools/utils/images"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+var _ = fmt.Print
+
+type declared_format struct {
+	decode        func(io.Reader) (image.Image, error)
+	decode_config func(io.Reader) (image.Config, error)
+	// streaming formats are decoded directly from STDIN without first
+	// reading all of it into memory
+	streaming bool
+}
+
+var declared_formats = map[string]declared_format{
+	"png":  {png.Decode, png.DecodeConfig, true},
+	"jpeg": {jpeg.Decode, jpeg.DecodeConfig, true},
+	"bmp":  {bmp.Decode, bmp.DecodeConfig, true},
+	// GIF is not streamed as it might be an animation
+	"gif":  {gif.Decode, gif.DecodeConfig, false},
+	"tiff": {tiff.Decode, tiff.DecodeConfig, false},
+	"webp": {webp.Decode, webp.DecodeConfig, false},
+}
+
+// JPEG EXIF data is at most 64KB and is at the start of the file
+const jpeg_exif_peek_size = 128 * 1024
+
+// Read STDIN as the format specified by --stdin-format, without sniffing.
+// Returns false if an error occurred, in which case it has already been
+// reported.
+func probe_stdin_with_declared_format(p *probed_input) bool {
+	format := opts.StdinFormat
+	fail := func(err error) bool {
+		report_error(p.imgd.index, "<stdin>", fmt.Sprintf("Could not read data declared as %s from", format), err)
+		return false
+	}
+	if format == "g3fax" || format == "g4fax" {
+		data, err := read_all_limited(os.Stdin)
+		if err != nil {
+			return fail(err)
+		}
+		p.file.file = &BytesBuf{data: data}
+		probe_bilevel_input(p, strings.ToUpper(format))
+		return true
+	}
+	df := declared_formats[format]
+	if df.streaming {
+		r := bufio.NewReaderSize(new_limited_reader(os.Stdin), jpeg_exif_peek_size)
+		orientation := 1
+		if format == "jpeg" && !opts.NoExif {
+			head, _ := r.Peek(jpeg_exif_peek_size)
+			orientation = images.Orientation(bytes.NewReader(head), "JPEG")
+		}
+		img, err := df.decode(r)
+		if err != nil {
+			return fail(err)
+		}
+		img = images.ApplyOrientation(img, orientation)
+		p.file.file = &BytesBuf{}
+		p.imgd.predecoded = img
+	} else {
+		data, err := read_all_limited(os.Stdin)
+		if err != nil {
+			return fail(err)
+		}
+		c, err := df.decode_config(bytes.NewReader(data))
+		if err != nil {
+			return fail(err)
+		}
+		p.file.file = &BytesBuf{data: data}
+		p.imgd.canvas_width, p.imgd.canvas_height = c.Width, c.Height
+		if !opts.NoExif {
+			p.imgd.orientation = images.Orientation(bytes.NewReader(data), strings.ToUpper(format))
+		}
+		if p.imgd.orientation > 4 {
+			// these orientations rotate the image by 90 degrees
+			p.imgd.canvas_width, p.imgd.canvas_height = p.imgd.canvas_height, p.imgd.canvas_width
+		}
+	}
+	if p.imgd.predecoded != nil {
+		b := p.imgd.predecoded.Bounds()
+		p.imgd.canvas_width, p.imgd.canvas_height = b.Dx(), b.Dy()
+	}
+	p.imgd.format_uppercase = strings.ToUpper(format)
+	p.can_use_go = true
+	return true
+}
@@ -0,0 +1,125 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"kitty/tools/tui/graphics"
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+// Images with at least this many pixels are decoded and scaled a few rows at
+// a time, when possible, so that huge images such as gigapixel scans do not
+// need to be held in memory
+const streaming_threshold = 1 << 26
+
+// Whether the image can be rendered by add_streamed_frame, which cannot do
+// anything that needs the whole image at once
+func can_stream(imgd *image_data) bool {
+	if imgd.canvas_width*imgd.canvas_height < streaming_threshold || !images.CanDecodeRows(imgd.format_uppercase) {
+		return false
+	}
+	return imgd.predecoded == nil && !imgd.animated_png && !imgd.truncated_png && imgd.orientation <= 1 && imgd.crop == nil &&
+		rotation == 0 && imgd.color_transform == nil && opts.Normalize == "none" && !opts.AutoContrast &&
+		// huge images are only ever scaled down, with area averaging
+		!opts.ScaleUp && !opts.IntegerScale && (opts.Interpolation == "auto" || opts.Interpolation == "area") &&
+		(opts.Scale != "stretch" || (imgd.canvas_width >= imgd.available_width && imgd.canvas_height >= imgd.available_height))
+}
+
+// Decode the image a row at a time, scaling the rows into the pixels of the
+// frame as they are decoded, so that memory is needed only for the scaled
+// image. Returns false if the image turns out to need decoding in full.
+func add_streamed_frame(ctx *images.Context, imgd *image_data, src *opened_input) (bool, error) {
+	defer src.Rewind()
+	d, err := images.NewRowDecoder(src.file, imgd.format_uppercase)
+	if err != nil {
+		if errors.Is(err, images.ErrRowDecodingUnsupported) {
+			return false, nil
+		}
+		return true, err
+	}
+	src_width, src_height := d.Size()
+	scale_image(imgd)
+	width, height := imgd.canvas_width, imgd.canvas_height
+	f := image_frame{width: width, height: height, number: len(imgd.frames) + 1}
+	var paste_at image.Point
+	if imgd.padded_size.X > 0 {
+		paste_at = imgd.pad_offset
+		// the padded frame is flipped as a whole, so paste at the mirrored position
+		if renderer.Flip {
+			paste_at.Y = imgd.padded_size.Y - paste_at.Y - height
+		}
+		if renderer.Flop {
+			paste_at.X = imgd.padded_size.X - paste_at.X - width
+		}
+		f.width, f.height = imgd.padded_size.X, imgd.padded_size.Y
+	}
+	is_opaque := d.IsOpaque() && (imgd.padded_size.X == 0 || renderer.RemoveAlpha != nil)
+	dest_rect := image.Rect(0, 0, f.width, f.height)
+	bytes_per_pixel := 4
+	if is_opaque || renderer.RemoveAlpha != nil {
+		bytes_per_pixel = 3
+	}
+	m, err := create_frame_shm(f.width * f.height * bytes_per_pixel)
+	shm_failed := err != nil
+	if shm_failed {
+		f.in_memory_bytes = make([]byte, f.width*f.height*bytes_per_pixel)
+	} else {
+		f.shm, f.in_memory_bytes = m, m.Slice()
+	}
+	var final_img image.Image
+	if bytes_per_pixel == 3 {
+		rgb := &images.NRGB{Pix: f.in_memory_bytes, Stride: bytes_per_pixel * f.width, Rect: dest_rect}
+		f.transmission_format, final_img = graphics.GRT_format_rgb, rgb
+		if imgd.padded_size.X > 0 {
+			for i := 0; i+2 < len(rgb.Pix); i += 3 {
+				rgb.Pix[i], rgb.Pix[i+1], rgb.Pix[i+2] = renderer.RemoveAlpha.R, renderer.RemoveAlpha.G, renderer.RemoveAlpha.B
+			}
+		}
+	} else {
+		f.transmission_format, final_img = graphics.GRT_format_rgba, &image.NRGBA{Pix: f.in_memory_bytes, Stride: bytes_per_pixel * f.width, Rect: dest_rect}
+	}
+	var tone_map *[256]uint8
+	if !tone_adjustment.IsIdentity() {
+		m := tone_adjustment.Map()
+		tone_map = &m
+	}
+	write_row := func(y int, row []uint8) error {
+		if tone_map != nil {
+			for i := 0; i+3 < len(row); i += 4 {
+				row[i], row[i+1], row[i+2] = tone_map[row[i]], tone_map[row[i+1]], tone_map[row[i+2]]
+			}
+		}
+		renderer.Paste(ctx, final_img, &image.NRGBA{Pix: row, Stride: len(row), Rect: image.Rect(0, 0, width, 1)}, image.Pt(paste_at.X, paste_at.Y+y))
+		return nil
+	}
+	scaler := images.NewAreaScaler(src_width, src_height, width, height)
+	row := make([]uint8, 4*src_width)
+	for y := 0; y < src_height; y++ {
+		if y%1024 == 0 && !keep_going.Load() {
+			f.release()
+			return true, errDeadlineReached
+		}
+		if err = d.NextRow(row); err == nil {
+			err = scaler.AddRow(row, write_row)
+		}
+		if err != nil {
+			f.release()
+			return true, err
+		}
+	}
+	reduce_rendered_frame_bit_depth(imgd, &f)
+	renderer.Mirror(ctx, bytes_per_pixel, f.width, f.height, f.in_memory_bytes)
+	if shm_failed {
+		spill_frame_to_file(&f)
+	}
+	f.track()
+	imgd.frames = append(imgd.frames, &f)
+	imgd.info = append(imgd.info, fmt.Sprintf("Decoded a row at a time to limit memory use, as the image has %d pixels", src_width*src_height))
+	return true, nil
+}
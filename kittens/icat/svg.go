@@ -0,0 +1,91 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"compress/gzip"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+
+	"kitty/tools/utils"
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+// The size in pixels of an SVG image before scaling
+func svg_canvas_size(s *images.SVG) (int, int) {
+	return utils.Max(1, int(math.Round(s.Width))), utils.Max(1, int(math.Round(s.Height)))
+}
+
+// Recognize SVG images by their name or contents and parse them, so that they
+// can be rasterized natively. SVG images that cannot be parsed, or that use
+// features that are not supported, are left to ImageMagick, if it is installed.
+func probe_svg(p *probed_input, name string) {
+	f := &p.file
+	header := make([]byte, images.SniffLength)
+	n, _ := io.ReadFull(f.file, header)
+	f.Rewind()
+	is_svgz := strings.HasSuffix(strings.ToLower(name), ".svgz")
+	if !is_svgz && !images.IsSVG(header[:n]) && utils.GuessMimeType(name) != "image/svg+xml" {
+		return
+	}
+	var r io.Reader = f.file
+	if is_svgz {
+		gz, err := gzip.NewReader(f.file)
+		if err != nil {
+			f.Rewind()
+			return
+		}
+		defer gz.Close()
+		r = new_limited_reader(gz)
+	}
+	s, err := images.ParseSVG(r)
+	f.Rewind()
+	if err != nil {
+		return
+	}
+	if len(s.Unsupported) > 0 {
+		if opts.Engine == "auto" && images.HaveMagick() {
+			p.imgd.info = append(p.imgd.info, "Using ImageMagick as the SVG image uses unsupported features: "+strings.Join(s.Unsupported, ", "))
+			return
+		}
+		p.imgd.info = append(p.imgd.info, "Ignored unsupported SVG features: "+strings.Join(s.Unsupported, ", "))
+	}
+	p.imgd.svg = s
+	p.imgd.format_uppercase = "SVG"
+	p.imgd.canvas_width, p.imgd.canvas_height = svg_canvas_size(s)
+	p.can_use_go = true
+}
+
+// Rasterize an SVG image at the size it is displayed at, instead of resizing
+// a rasterization at its intrinsic size, so that it is crisp at any size
+func add_svg_frame(ctx *images.Context, imgd *image_data) error {
+	scale_image(imgd)
+	fx, fy := imgd.scaled_frac.x, imgd.scaled_frac.y
+	if fx == 0 {
+		fx, fy = 1, 1
+	}
+	// the image is rasterized uncropped and unrotated, so the crop and the
+	// size it is rotated from are scaled instead
+	width, height := svg_canvas_size(imgd.svg)
+	img, err := imgd.svg.Rasterize(int(fx*float64(width)), int(fy*float64(height)))
+	if err != nil {
+		return err
+	}
+	if imgd.crop != nil {
+		c := *imgd.crop
+		scaled := image.Rect(int(fx*float64(c.Min.X)), int(fy*float64(c.Min.Y)), int(fx*float64(c.Max.X)), int(fy*float64(c.Max.Y)))
+		imgd.crop = &scaled
+	}
+	if imgd.rotate_from.X > 0 {
+		imgd.rotate_from = image.Pt(int(fx*float64(imgd.rotate_from.X)), int(fy*float64(imgd.rotate_from.Y)))
+	}
+	// the rasterized image is already at its final size
+	imgd.scaled_frac.x, imgd.scaled_frac.y = 0, 0
+	add_frame(ctx, imgd, img)
+	return nil
+}
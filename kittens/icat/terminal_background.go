@@ -0,0 +1,72 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"kitty/tools/tui/loop"
+	"kitty/tools/utils/images"
+)
+
+var _ = fmt.Print
+
+// Parse a color of the form rgb:R/G/B, as used in OSC 11 responses, where
+// each component has one to four hex digits, as described in XParseColor(3)
+func parse_x11_rgb(spec string) (*images.NRGBColor, error) {
+	q, found := strings.CutPrefix(strings.ToLower(spec), "rgb:")
+	parts := strings.Split(q, "/")
+	if !found || len(parts) != 3 {
+		return nil, fmt.Errorf("Not a valid X11 RGB color: %#v", spec)
+	}
+	var vals [3]uint8
+	for i, p := range parts {
+		if len(p) < 1 || len(p) > 4 {
+			return nil, fmt.Errorf("Not a valid X11 RGB color: %#v", spec)
+		}
+		v, err := strconv.ParseUint(p, 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Not a valid X11 RGB color: %#v", spec)
+		}
+		// scale to eight bits
+		max_val := uint64(1)<<(4*len(p)) - 1
+		vals[i] = uint8((v*255 + max_val/2) / max_val)
+	}
+	return &images.NRGBColor{R: vals[0], G: vals[1], B: vals[2]}, nil
+}
+
+func warn_no_terminal_background() {
+	print_error("\x1b[33mWarning\x1b[39m: could not query the background color from the terminal, transparent images will be displayed as is\r\n")
+}
+
+// With --background=terminal, return a query that sets renderer.RemoveAlpha to the
+// default background color of the terminal, using OSC 11
+func setup_terminal_background(can_query bool) *terminal_query {
+	if opts.Background != "terminal" {
+		return nil
+	}
+	if !can_query {
+		warn_no_terminal_background()
+		return nil
+	}
+	return &terminal_query{
+		write: func(lp *loop.Loop) { lp.QueueWriteString("\x1b]11;?\x1b\\") },
+		on_escape_code: func(etype loop.EscapeCodeType, payload []byte) {
+			if etype != loop.OSC {
+				return
+			}
+			if q, found := strings.CutPrefix(string(payload), "11;"); found {
+				if col, perr := parse_x11_rgb(q); perr == nil {
+					renderer.RemoveAlpha = col
+				}
+			}
+		},
+		finish: func(err error) {
+			if err == nil && renderer.RemoveAlpha == nil {
+				warn_no_terminal_background()
+			}
+		},
+	}
+}
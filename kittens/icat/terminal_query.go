@@ -0,0 +1,88 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package icat
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"kitty/tools/tui/loop"
+)
+
+var _ = fmt.Print
+
+// A query sent to the terminal at startup. All queries are sent together, so
+// that there is only a single round trip to the terminal.
+type terminal_query struct {
+	// write the query to the terminal
+	write func(lp *loop.Loop)
+	// called with every escape code received from the terminal
+	on_escape_code func(etype loop.EscapeCodeType, payload []byte)
+	// called once the terminal has responded, or failed to, with the error, if any
+	finish func(err error)
+}
+
+// Send the queries to the terminal and wait for its responses
+func query_terminal(timeout time.Duration, queries ...*terminal_query) (err error) {
+	if len(queries) == 0 {
+		return
+	}
+	finished := false
+	finish := func(err error) {
+		if !finished {
+			finished = true
+			for _, q := range queries {
+				if q.finish != nil {
+					q.finish(err)
+				}
+			}
+		}
+	}
+	defer func() { finish(err) }()
+	lp, err := loop.New(loop.NoAlternateScreen, loop.NoRestoreColors, loop.NoMouseTracking)
+	if err != nil {
+		return
+	}
+	lp.OnInitialize = func() (string, error) {
+		lp.AddTimer(timeout, false, func(loop.IdType) error {
+			return fmt.Errorf("Timed out waiting for a response from the terminal: %w", os.ErrDeadlineExceeded)
+		})
+		for _, q := range queries {
+			q.write(lp)
+		}
+		// The primary device attributes response acts as a sentinel for
+		// terminals that ignore some of the queries
+		lp.QueueWriteString("\x1b[c")
+		return "", nil
+	}
+	lp.OnEscapeCode = func(etype loop.EscapeCodeType, payload []byte) error {
+		if etype == loop.CSI && len(payload) > 3 && payload[0] == '?' && payload[len(payload)-1] == 'c' {
+			lp.Quit(0)
+			return nil
+		}
+		for _, q := range queries {
+			q.on_escape_code(etype, payload)
+		}
+		return nil
+	}
+	lp.OnKeyEvent = func(event *loop.KeyEvent) error {
+		if event.MatchesPressOrRepeat("ctrl+c") {
+			event.Handled = true
+			lp.Println("Waiting for response from terminal, aborting now could lead to corruption")
+		}
+		if event.MatchesPressOrRepeat("ctrl+z") {
+			event.Handled = true
+		}
+		return nil
+	}
+	if err = lp.Run(); err != nil {
+		return
+	}
+	if ds := lp.DeathSignalName(); ds != "" {
+		// deferred functions are not run when killed by the signal
+		finish(fmt.Errorf("Killed by signal: %s", ds))
+		lp.KillIfSignalled()
+	}
+	return
+}
@@ -22,6 +22,7 @@ import (
 	"kitty/tools/utils"
 	"kitty/tools/utils/images"
 	"kitty/tools/utils/shm"
+	"kitty/tools/wcswidth"
 )
 
 var _ = fmt.Print
@@ -55,6 +56,11 @@ func gc_for_image(imgd *image_data, frame_num int, frame *image_frame) *graphics
 	if imgd.image_id != 0 {
 		gc.SetImageId(imgd.image_id)
 	}
+	if frame.replaces_preview {
+		// overwrite the pixels of the already transmitted frame, keeping its gap
+		gc.SetAction(graphics.GRT_action_frame).SetTargetFrame(uint64(frame.number)).SetBlendMode(graphics.Overwrite)
+		return gc
+	}
 	if frame_num == 0 {
 		gc.SetAction(graphics.GRT_action_transmit_and_display)
 		if imgd.use_unicode_placeholder {
@@ -98,7 +104,8 @@ func transmit_shm(imgd *image_data, frame_num int, frame *image_frame) (err erro
 		f.Seek(0, io.SeekStart)
 		mmap, err = shm.CreateTemp("icat-*", uint64(data_size))
 		if err != nil {
-			return fmt.Errorf("Failed to create a SHM file for transmission: %w", err)
+			f.Close()
+			return transmit_file(imgd, frame_num, frame)
 		}
 		dest := mmap.Slice()
 		for len(dest) > 0 {
@@ -117,7 +124,8 @@ func transmit_shm(imgd *image_data, frame_num int, frame *image_frame) (err erro
 			data_size = int64(len(frame.in_memory_bytes))
 			mmap, err = shm.CreateTemp("icat-*", uint64(data_size))
 			if err != nil {
-				return fmt.Errorf("Failed to create a SHM file for transmission: %w", err)
+				// shared memory is full or unavailable, fall back to a temporary file
+				return transmit_file(imgd, frame_num, frame)
 			}
 			copy(mmap.Slice(), frame.in_memory_bytes)
 		} else {
@@ -278,26 +286,30 @@ func write_unicode_placeholder(imgd *image_data) {
 	}
 }
 
+// Delete the image and free its data in the terminal
+func delete_image(imgd *image_data) {
+	gc := new_graphics_command(imgd)
+	gc.SetAction(graphics.GRT_action_delete)
+	if imgd.image_id != 0 {
+		gc.SetDelete(graphics.GRT_free_by_id).SetImageId(imgd.image_id)
+	} else {
+		gc.SetDelete(graphics.GRT_free_by_number).SetImageNumber(imgd.image_number)
+	}
+	gc.SetQuiet(graphics.GRT_quiet_silent)
+	gc.WriteWithPayloadTo(os.Stdout, nil)
+}
+
 var seen_image_ids *utils.Set[uint32]
 
 func transmit_image(imgd *image_data) {
+	if opts.TransmitFormat == "sixel" {
+		transmit_sixel(imgd)
+		return
+	}
 	if seen_image_ids == nil {
 		seen_image_ids = utils.NewSet[uint32](32)
 	}
-	defer func() {
-		for _, frame := range imgd.frames {
-			if frame.filename_is_temporary && frame.filename != "" {
-				os.Remove(frame.filename)
-				frame.filename = ""
-			}
-			if frame.shm != nil {
-				frame.shm.Unlink()
-				frame.shm.Close()
-				frame.shm = nil
-			}
-			frame.in_memory_bytes = nil
-		}
-	}()
+	defer imgd.release_frames()
 	var f func(*image_data, int, *image_frame) error
 	if opts.TransferMode != "detect" {
 		switch opts.TransferMode {
@@ -371,6 +383,11 @@ func transmit_image(imgd *image_data) {
 		err := f(imgd, frame_num, frame)
 		if err != nil {
 			imgd.err = err
+			if opts.ScrollbackSafe {
+				// dont leave a partially transmitted image around in the terminal
+				// as nothing will ever reference it
+				delete_image(imgd)
+			}
 			return
 		}
 		if is_animated {
@@ -381,10 +398,10 @@ func transmit_image(imgd *image_data) {
 				c.SetTargetFrame(uint64(frame.number))
 				c.SetGap(int32(frame.delay_ms))
 				switch {
-				case opts.Loop < 0:
+				case imgd.loops() < 0:
 					c.SetNumberOfLoops(1)
-				case opts.Loop > 0:
-					c.SetNumberOfLoops(uint64(opts.Loop) + 1)
+				case imgd.loops() > 0:
+					c.SetNumberOfLoops(uint64(imgd.loops()) + 1)
 				}
 				c.WriteWithPayloadTo(os.Stdout, nil)
 			case 1:
@@ -404,5 +421,16 @@ func transmit_image(imgd *image_data) {
 	}
 	if imgd.move_to.x == 0 {
 		fmt.Println() // ensure cursor is on new line
+		if imgd.caption != "" {
+			fmt.Print(strings.Repeat(" ", imgd.move_x_by))
+			fmt.Println(wcswidth.TruncateToVisualLength(imgd.caption, int(screen_size.Col)-imgd.move_x_by))
+		}
+	}
+	for frame_num, frame := range imgd.upgraded_frames {
+		if err := f(imgd, frame_num, frame); err != nil {
+			// the low quality frames are still displayed
+			imgd.err = err
+			return
+		}
 	}
 }
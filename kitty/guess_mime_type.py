@@ -18,6 +18,17 @@
     'yaml': 'text/yaml',
     'js': 'text/javascript',
     'json': 'text/json',
+    'dng': 'image/x-adobe-dng',
+    'cr2': 'image/x-canon-cr2',
+    'nef': 'image/x-nikon-nef',
+    'g3': 'image/g3fax',
+    'g4': 'image/x-g4fax',
+    'jb2': 'image/x-jbig2',
+    'jbig2': 'image/x-jbig2',
+    'ff': 'image/x-farbfeld',
+    'heic': 'image/heic',
+    'heif': 'image/heif',
+    'avif': 'image/avif',
 }
 
 
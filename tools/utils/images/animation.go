@@ -0,0 +1,288 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"time"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Limit on the number of frames, to avoid huge allocations for corrupt files
+const max_animation_frames = 1 << 16
+
+// Limit on the total number of pixels in all the composited frames of an
+// animation, as each frame is a complete copy of the canvas
+const max_animation_pixels = farbfeld_max_pixels
+
+// Return an error if an animation with the specified number of frames of the
+// specified size is too large to decode
+func check_animation_size(canvas image.Rectangle, num_frames int) error {
+	w, h := int64(canvas.Dx()), int64(canvas.Dy())
+	if w*h*int64(utils.Max(1, num_frames)) > max_animation_pixels {
+		return fmt.Errorf("Animation with %d frames of %dx%d pixels is too large", num_frames, w, h)
+	}
+	return nil
+}
+
+// An animation, such as an animated PNG or WebP image, with its frames
+// composited so that each is a complete image
+type Animation struct {
+	Frames []*image.NRGBA
+	// The delay after each frame in hundredths of a second, as for GIF
+	Delays []int
+	// The number of times to play the animation, zero means forever
+	LoopCount int
+}
+
+func clone_nrgba(img *image.NRGBA) *image.NRGBA {
+	ans := image.NewNRGBA(img.Rect)
+	copy(ans.Pix, img.Pix)
+	return ans
+}
+
+// Render every frame of a GIF animation onto a full sized canvas, taking into
+// account the disposal method of each frame, the way it would be displayed.
+// Fails if the canvas is too large to make a copy of it for every frame.
+func CoalesceGIFFrames(g *gif.GIF) ([]*image.NRGBA, error) {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+	if err := check_animation_size(bounds, len(g.Image)); err != nil {
+		return nil, err
+	}
+	canvas := image.NewNRGBA(bounds)
+	ans := make([]*image.NRGBA, 0, len(g.Image))
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = clone_nrgba(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		ans = append(ans, clone_nrgba(canvas))
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return ans, nil
+}
+
+// Blend the specified frames, which must all be the same size, into a single
+// image. mode is one of average, max or min. The average is alpha weighted so
+// that transparent pixels do not darken the result.
+func FlattenFrames(frames []*image.NRGBA, mode string) (*image.NRGBA, error) {
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("No frames to flatten")
+	}
+	ans := clone_nrgba(frames[0])
+	if len(frames) == 1 {
+		return ans, nil
+	}
+	switch mode {
+	case "average":
+		n := uint64(len(frames))
+		for i := 0; i+3 < len(ans.Pix); i += 4 {
+			var r, g, b, a uint64
+			for _, f := range frames {
+				fa := uint64(f.Pix[i+3])
+				r += uint64(f.Pix[i]) * fa
+				g += uint64(f.Pix[i+1]) * fa
+				b += uint64(f.Pix[i+2]) * fa
+				a += fa
+			}
+			if a == 0 {
+				ans.Pix[i], ans.Pix[i+1], ans.Pix[i+2], ans.Pix[i+3] = 0, 0, 0, 0
+			} else {
+				ans.Pix[i], ans.Pix[i+1], ans.Pix[i+2], ans.Pix[i+3] = uint8(r/a), uint8(g/a), uint8(b/a), uint8(a/n)
+			}
+		}
+	case "max", "min":
+		is_max := mode == "max"
+		for _, f := range frames[1:] {
+			for i, x := range f.Pix {
+				if (x > ans.Pix[i]) == is_max && x != ans.Pix[i] {
+					ans.Pix[i] = x
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown mode for flattening frames: %s", mode)
+	}
+	return ans, nil
+}
+
+// Return a frame that is a crossfade between a and b, which must be the same
+// size. t is the fraction of b in the result, from 0 to 1. Blending is done
+// with premultiplied alpha so that transparent pixels fade correctly.
+func BlendFrames(a, b *image.NRGBA, t float64) *image.NRGBA {
+	ans := image.NewNRGBA(a.Rect)
+	for i := 0; i+3 < len(ans.Pix) && i+3 < len(b.Pix); i += 4 {
+		aa, ba := float64(a.Pix[i+3])*(1-t), float64(b.Pix[i+3])*t
+		alpha := aa + ba
+		if alpha == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			ans.Pix[i+c] = uint8((float64(a.Pix[i+c])*aa+float64(b.Pix[i+c])*ba)/alpha + 0.5)
+		}
+		ans.Pix[i+3] = uint8(alpha + 0.5)
+	}
+	return ans
+}
+
+// Return the number of leading frames of an animation that start before max
+// has elapsed, given the delays of the frames in hundredths of a second. At
+// least one frame is always kept. A max of zero means no limit.
+func FramesWithinDuration(delays []int, max time.Duration) int {
+	if max <= 0 {
+		return len(delays)
+	}
+	min_gap := CalcMinimumGIFGap(delays)
+	var elapsed time.Duration
+	for i, delay := range delays {
+		if i > 0 && elapsed >= max {
+			return i
+		}
+		elapsed += time.Duration(utils.Max(min_gap, delay)) * 10 * time.Millisecond
+	}
+	return len(delays)
+}
+
+// Drop all but the first n frames of the specified GIF animation
+func TruncateGIF(g *gif.GIF, n int) {
+	if n < len(g.Image) {
+		g.Image, g.Delay = g.Image[:n], g.Delay[:n]
+		if n < len(g.Disposal) {
+			g.Disposal = g.Disposal[:n]
+		}
+	}
+}
+
+// Return the loop count from the ANIM chunk of an animated WebP image, which
+// is the number of times the animation is played, with zero meaning forever.
+// found is false if the image has no ANIM chunk.
+func WebPLoopCount(r io.ReaderAt) (count int, found bool) {
+	iterate_riff_chunks(r, func(fourcc string, data *io.SectionReader) bool {
+		if fourcc == "ANIM" {
+			// the background color followed by the loop count
+			var buf [6]byte
+			if _, err := data.ReadAt(buf[:], 0); err == nil {
+				count, found = int(binary.LittleEndian.Uint16(buf[4:])), true
+			}
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// Return the number of frames in a GIF image, found by walking its blocks
+// without decoding them
+func gif_frame_count(r io.ReaderAt) (count int) {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, 1<<62))
+	skip_sub_blocks := func() error {
+		for {
+			n, err := br.ReadByte()
+			if err != nil || n == 0 {
+				return err
+			}
+			if _, err = br.Discard(int(n)); err != nil {
+				return err
+			}
+		}
+	}
+	color_table_size := func(flags byte) int {
+		if flags&0x80 == 0 {
+			return 0
+		}
+		return 3 << ((flags & 7) + 1)
+	}
+	var header [13]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return
+	}
+	if _, err := br.Discard(color_table_size(header[10])); err != nil {
+		return
+	}
+	for count < max_animation_frames {
+		b, err := br.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case 0x21:
+			if _, err = br.ReadByte(); err == nil {
+				err = skip_sub_blocks()
+			}
+		case 0x2c:
+			// image descriptor, color table and the LZW minimum code size
+			var desc [9]byte
+			if _, err = io.ReadFull(br, desc[:]); err == nil {
+				count++
+				if _, err = br.Discard(color_table_size(desc[8]) + 1); err == nil {
+					err = skip_sub_blocks()
+				}
+			}
+		default:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Return the number of frames in an image of the specified format, which is
+// one for images that are not animated. Only the headers of the image are
+// read, so this is much faster than decoding it.
+func FrameCount(r io.ReaderAt, format_uppercase string) int {
+	count := 0
+	switch format_uppercase {
+	case "GIF":
+		count = gif_frame_count(r)
+	case "PNG":
+		var b [12]byte
+		if _, err := r.ReadAt(b[:8], 0); err != nil || string(b[:8]) != png_signature {
+			break
+		}
+		for pos := int64(len(png_signature)); ; {
+			if _, err := r.ReadAt(b[:], pos); err != nil || string(b[4:8]) == "IDAT" || string(b[4:8]) == "IEND" {
+				break
+			}
+			if string(b[4:8]) == "acTL" {
+				// the number of frames followed by the number of plays
+				count = int(binary.BigEndian.Uint32(b[8:]))
+				break
+			}
+			pos += 12 + int64(binary.BigEndian.Uint32(b[:4]))
+		}
+	case "WEBP":
+		if IsAnimatedWebP(r) {
+			iterate_riff_chunks(r, func(fourcc string, data *io.SectionReader) bool {
+				if fourcc == "ANMF" {
+					count++
+				}
+				return true
+			})
+		}
+	}
+	return utils.Max(1, count)
+}
@@ -0,0 +1,132 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+	"time"
+)
+
+var _ = fmt.Print
+
+func TestFlattenAnimation(t *testing.T) {
+	palette := color.Palette{color.NRGBA{0, 0, 0, 0}, color.NRGBA{200, 0, 0, 255}, color.NRGBA{0, 0, 100, 255}}
+	full := image.NewPaletted(image.Rect(0, 0, 2, 1), palette)
+	full.SetColorIndex(0, 0, 1)
+	full.SetColorIndex(1, 0, 1)
+	// second frame covers only the right pixel and is disposed to the background
+	partial := image.NewPaletted(image.Rect(1, 0, 2, 1), palette)
+	partial.SetColorIndex(1, 0, 2)
+	g := gif.GIF{
+		Image: []*image.Paletted{full, partial, partial}, Delay: []int{0, 0, 0},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		Config:   image.Config{Width: 2, Height: 1},
+	}
+	var encoded bytes.Buffer
+	if err := gif.EncodeAll(&encoded, &g); err != nil {
+		t.Fatal(err)
+	}
+	if n := FrameCount(bytes.NewReader(encoded.Bytes()), "GIF"); n != 3 {
+		t.Fatalf("Incorrect GIF frame count: %d", n)
+	}
+	frames, err := CoalesceGIFFrames(&g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("Incorrect number of coalesced frames: %d", len(frames))
+	}
+	if c := frames[2].NRGBAAt(0, 0); c != (color.NRGBA{200, 0, 0, 255}) {
+		t.Fatalf("Incorrect pixel in coalesced frame: %v", c)
+	}
+	for mode, expected := range map[string][2]color.NRGBA{
+		"average": {{200, 0, 0, 255}, {66, 0, 66, 255}},
+		"max":     {{200, 0, 0, 255}, {200, 0, 100, 255}},
+		"min":     {{200, 0, 0, 255}, {0, 0, 0, 255}},
+	} {
+		img, err := FlattenFrames(frames, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a, b := img.NRGBAAt(0, 0), img.NRGBAAt(1, 0); a != expected[0] || b != expected[1] {
+			t.Fatalf("Incorrect pixels for %s: %v %v != %v", mode, a, b, expected)
+		}
+	}
+	// a huge logical screen with many tiny frames is rejected before any
+	// canvas is allocated
+	huge := gif.GIF{Config: image.Config{Width: 1 << 14, Height: 1 << 13}}
+	for i := 0; i < 3; i++ {
+		huge.Image = append(huge.Image, partial)
+	}
+	if _, err = CoalesceGIFFrames(&huge); err == nil {
+		t.Fatalf("No error for a GIF animation with too many frames for its size")
+	}
+}
+
+func TestBlendFrames(t *testing.T) {
+	a, b := image.NewNRGBA(image.Rect(0, 0, 2, 1)), image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	a.SetNRGBA(0, 0, color.NRGBA{200, 0, 0, 255})
+	b.SetNRGBA(0, 0, color.NRGBA{0, 0, 100, 255})
+	// a fully transparent pixel must not darken the other frame
+	b.SetNRGBA(1, 0, color.NRGBA{0, 255, 0, 255})
+	q := BlendFrames(a, b, 0.25)
+	if c := q.NRGBAAt(0, 0); c != (color.NRGBA{150, 0, 25, 255}) {
+		t.Fatalf("Incorrect blended pixel: %v", c)
+	}
+	if c := q.NRGBAAt(1, 0); c != (color.NRGBA{0, 255, 0, 64}) {
+		t.Fatalf("Incorrect blended pixel with transparency: %v", c)
+	}
+}
+
+func TestFramesWithinDuration(t *testing.T) {
+	delays := []int{50, 50, 50, 50}
+	for max, expected := range map[time.Duration]int{
+		0: 4, time.Millisecond: 1, 500 * time.Millisecond: 1, 501 * time.Millisecond: 2, time.Second + 1: 3, time.Hour: 4,
+	} {
+		if actual := FramesWithinDuration(delays, max); actual != expected {
+			t.Fatalf("Incorrect number of frames within %s: %d != %d", max, expected, actual)
+		}
+	}
+	// all zero delays are treated as 100ms
+	if actual := FramesWithinDuration([]int{0, 0, 0}, 150*time.Millisecond); actual != 2 {
+		t.Fatalf("Incorrect number of frames with zero delays: %d", actual)
+	}
+	g := gif.GIF{Image: make([]*image.Paletted, 3), Delay: delays[:3], Disposal: make([]byte, 3)}
+	TruncateGIF(&g, 2)
+	if len(g.Image) != 2 || len(g.Delay) != 2 || len(g.Disposal) != 2 {
+		t.Fatalf("TruncateGIF() did not truncate all fields: %d %d %d", len(g.Image), len(g.Delay), len(g.Disposal))
+	}
+}
+
+func TestWebPLoopCount(t *testing.T) {
+	webp := func(chunks ...string) []byte {
+		body := bytes.Buffer{}
+		body.WriteString("WEBP")
+		for _, c := range chunks {
+			body.WriteString(c[:4])
+			binary.Write(&body, binary.LittleEndian, uint32(len(c)-4))
+			body.WriteString(c[4:])
+		}
+		ans := bytes.Buffer{}
+		ans.WriteString("RIFF")
+		binary.Write(&ans, binary.LittleEndian, uint32(body.Len()))
+		ans.Write(body.Bytes())
+		return ans.Bytes()
+	}
+	vp8x := "VP8X" + string([]byte{0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	if count, found := WebPLoopCount(bytes.NewReader(webp(vp8x, "ANIM\xff\xff\xff\xff\x03\x00"))); !found || count != 3 {
+		t.Fatalf("Incorrect loop count: %d %v", count, found)
+	}
+	if count, found := WebPLoopCount(bytes.NewReader(webp(vp8x, "ANIM\x00\x00\x00\x00\x00\x00"))); !found || count != 0 {
+		t.Fatalf("Incorrect infinite loop count: %d %v", count, found)
+	}
+	if _, found := WebPLoopCount(bytes.NewReader(webp(vp8x, "VP8L\x2f\x00\x00\x00"))); found {
+		t.Fatalf("Loop count found in a still image")
+	}
+}
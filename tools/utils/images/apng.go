@@ -0,0 +1,207 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+var _ = fmt.Print
+
+const png_signature = "\x89PNG\r\n\x1a\n"
+
+type png_chunk struct {
+	chunk_type string
+	data       []byte
+}
+
+func read_png_chunks(data []byte) (ans []png_chunk, err error) {
+	if !bytes.HasPrefix(data, []byte(png_signature)) {
+		return nil, fmt.Errorf("Not a PNG image")
+	}
+	pos := len(png_signature)
+	for pos+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		if size < 0 || pos+12+size > len(data) {
+			return nil, fmt.Errorf("PNG chunk at offset %d is truncated", pos)
+		}
+		c := png_chunk{chunk_type: string(data[pos+4 : pos+8]), data: data[pos+8 : pos+8+size]}
+		ans = append(ans, c)
+		pos += 12 + size
+		if c.chunk_type == "IEND" {
+			break
+		}
+	}
+	return
+}
+
+// Return true if the PNG image has an acTL chunk before its image data,
+// making it an animated PNG
+func IsAPNG(r io.ReaderAt) bool {
+	var b [8]byte
+	if _, err := r.ReadAt(b[:], 0); err != nil || string(b[:]) != png_signature {
+		return false
+	}
+	pos := int64(len(png_signature))
+	for {
+		if _, err := r.ReadAt(b[:], pos); err != nil {
+			return false
+		}
+		switch string(b[4:8]) {
+		case "acTL":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+		pos += 12 + int64(binary.BigEndian.Uint32(b[:4]))
+	}
+}
+
+func write_png_chunk(w *bytes.Buffer, chunk_type string, data []byte) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(data)))
+	w.Write(b[:])
+	w.WriteString(chunk_type)
+	w.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunk_type))
+	crc.Write(data)
+	binary.BigEndian.PutUint32(b[:], crc.Sum32())
+	w.Write(b[:])
+}
+
+type apng_frame_control struct {
+	bounds               image.Rectangle
+	delay                int
+	dispose_op, blend_op byte
+	data                 [][]byte
+}
+
+// Decode every frame of an animated PNG, compositing them according to their
+// dispose and blend operations
+func DecodeAPNG(r io.Reader) (ans *Animation, err error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := read_png_chunks(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].chunk_type != "IHDR" || len(chunks[0].data) != 13 {
+		return nil, fmt.Errorf("PNG image has no valid IHDR chunk")
+	}
+	ihdr := chunks[0].data
+	canvas := image.Rect(0, 0, int(binary.BigEndian.Uint32(ihdr)), int(binary.BigEndian.Uint32(ihdr[4:])))
+	if err = check_animation_size(canvas, 1); err != nil {
+		return nil, err
+	}
+	ans = &Animation{}
+	// chunks such as the palette and transparency, which are shared by all frames
+	var shared []png_chunk
+	var frames []*apng_frame_control
+	var current *apng_frame_control
+	seen_idat := false
+	for _, c := range chunks[1:] {
+		switch c.chunk_type {
+		case "acTL":
+			if len(c.data) != 8 {
+				return nil, fmt.Errorf("Invalid acTL chunk in animated PNG")
+			}
+			ans.LoopCount = int(binary.BigEndian.Uint32(c.data[4:]))
+		case "fcTL":
+			if len(c.data) != 26 {
+				return nil, fmt.Errorf("Invalid fcTL chunk in animated PNG")
+			}
+			if len(frames) >= max_animation_frames {
+				return nil, fmt.Errorf("Animated PNG has too many frames")
+			}
+			if err = check_animation_size(canvas, len(frames)+1); err != nil {
+				return nil, err
+			}
+			d := c.data
+			w, h := int(binary.BigEndian.Uint32(d[4:])), int(binary.BigEndian.Uint32(d[8:]))
+			x, y := int(binary.BigEndian.Uint32(d[12:])), int(binary.BigEndian.Uint32(d[16:]))
+			current = &apng_frame_control{bounds: image.Rect(x, y, x+w, y+h), dispose_op: d[24], blend_op: d[25]}
+			if current.bounds.Empty() || !current.bounds.In(canvas) {
+				return nil, fmt.Errorf("Frame %d of animated PNG is outside the image", len(frames)+1)
+			}
+			num, den := int(binary.BigEndian.Uint16(d[20:])), int(binary.BigEndian.Uint16(d[22:]))
+			if den == 0 {
+				den = 100
+			}
+			current.delay = (num*100 + den/2) / den
+			frames = append(frames, current)
+		case "IDAT":
+			seen_idat = true
+			// the default image is only part of the animation if an fcTL precedes it
+			if current != nil {
+				current.data = append(current.data, c.data)
+			}
+		case "fdAT":
+			if current == nil || len(c.data) < 4 {
+				return nil, fmt.Errorf("Invalid fdAT chunk in animated PNG")
+			}
+			current.data = append(current.data, c.data[4:])
+		case "IEND":
+		default:
+			if !seen_idat {
+				shared = append(shared, c)
+			}
+		}
+	}
+	img := image.NewNRGBA(canvas)
+	for i, f := range frames {
+		if len(f.data) == 0 {
+			return nil, fmt.Errorf("Frame %d of animated PNG has no image data", i+1)
+		}
+		buf := bytes.Buffer{}
+		buf.WriteString(png_signature)
+		header := bytes.Clone(ihdr)
+		binary.BigEndian.PutUint32(header, uint32(f.bounds.Dx()))
+		binary.BigEndian.PutUint32(header[4:], uint32(f.bounds.Dy()))
+		write_png_chunk(&buf, "IHDR", header)
+		for _, c := range shared {
+			write_png_chunk(&buf, c.chunk_type, c.data)
+		}
+		write_png_chunk(&buf, "IDAT", bytes.Join(f.data, nil))
+		write_png_chunk(&buf, "IEND", nil)
+		frame_img, err := png.Decode(&buf)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode frame %d of animated PNG: %w", i+1, err)
+		}
+		dispose_op := f.dispose_op
+		if i == 0 && dispose_op == 2 {
+			// there is no previous image for the first frame
+			dispose_op = 1
+		}
+		var previous *image.NRGBA
+		if dispose_op == 2 {
+			previous = clone_nrgba(img)
+		}
+		op := draw.Over
+		if f.blend_op == 0 {
+			op = draw.Src
+		}
+		draw.Draw(img, f.bounds, frame_img, frame_img.Bounds().Min, op)
+		ans.Frames = append(ans.Frames, clone_nrgba(img))
+		ans.Delays = append(ans.Delays, f.delay)
+		switch dispose_op {
+		case 1:
+			draw.Draw(img, f.bounds, image.Transparent, image.Point{}, draw.Src)
+		case 2:
+			img = previous
+		}
+	}
+	if len(ans.Frames) == 0 {
+		return nil, fmt.Errorf("Animated PNG has no frames")
+	}
+	return ans, nil
+}
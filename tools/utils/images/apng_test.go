@@ -0,0 +1,125 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestAPNG(t *testing.T) {
+	encode := func(img image.Image) []png_chunk {
+		buf := bytes.Buffer{}
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		chunks, err := read_png_chunks(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chunks
+	}
+	idat := func(chunks []png_chunk) (ans []byte) {
+		for _, c := range chunks {
+			if c.chunk_type == "IDAT" {
+				ans = append(ans, c.data...)
+			}
+		}
+		return
+	}
+	u32 := func(vals ...uint32) (ans []byte) {
+		for _, v := range vals {
+			ans = binary.BigEndian.AppendUint32(ans, v)
+		}
+		return
+	}
+	fctl := func(seq, w, h, x, y uint32, num, den uint16, dispose, blend byte) []byte {
+		ans := u32(seq, w, h, x, y)
+		ans = binary.BigEndian.AppendUint16(ans, num)
+		ans = binary.BigEndian.AppendUint16(ans, den)
+		return append(ans, dispose, blend)
+	}
+	red, green := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 255, 0, 128}
+	first := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(first.Pix); i += 4 {
+		copy(first.Pix[i:], []byte{red.R, red.G, red.B, red.A})
+	}
+	first.SetNRGBA(0, 0, color.NRGBA{})
+	second := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for i := 0; i < len(second.Pix); i += 4 {
+		copy(second.Pix[i:], []byte{green.R, green.G, green.B, green.A})
+	}
+	first_chunks := encode(first)
+
+	buf := bytes.Buffer{}
+	buf.WriteString(png_signature)
+	write_png_chunk(&buf, "IHDR", first_chunks[0].data)
+	write_png_chunk(&buf, "acTL", u32(2, 3))
+	write_png_chunk(&buf, "fcTL", fctl(0, 4, 4, 0, 0, 1, 10, 1, 0))
+	write_png_chunk(&buf, "IDAT", idat(first_chunks))
+	write_png_chunk(&buf, "fcTL", fctl(1, 2, 2, 2, 2, 20, 0, 0, 1))
+	write_png_chunk(&buf, "fdAT", append(u32(2), idat(encode(second))...))
+	write_png_chunk(&buf, "IEND", nil)
+	data := buf.Bytes()
+
+	if !IsAPNG(bytes.NewReader(data)) {
+		t.Fatalf("Animated PNG not recognized")
+	}
+	if n := FrameCount(bytes.NewReader(data), "PNG"); n != 2 {
+		t.Fatalf("Incorrect frame count: %d", n)
+	}
+	plain := bytes.Buffer{}
+	if err := png.Encode(&plain, first); err != nil {
+		t.Fatal(err)
+	}
+	if IsAPNG(bytes.NewReader(plain.Bytes())) || FrameCount(bytes.NewReader(plain.Bytes()), "PNG") != 1 {
+		t.Fatalf("PNG recognized as animated")
+	}
+	a, err := DecodeAPNG(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Frames) != 2 || a.LoopCount != 3 || a.Delays[0] != 10 || a.Delays[1] != 20 {
+		t.Fatalf("Incorrect animation: %d frames, loop count: %d delays: %v", len(a.Frames), a.LoopCount, a.Delays)
+	}
+	if c := a.Frames[0].NRGBAAt(1, 1); c != red {
+		t.Fatalf("Incorrect pixel in first frame: %v", c)
+	}
+	// the first frame is disposed to the background before the second is drawn
+	if c := a.Frames[1].NRGBAAt(1, 1); c.A != 0 {
+		t.Fatalf("First frame not disposed: %v", c)
+	}
+	if c := a.Frames[1].NRGBAAt(3, 3); c != green {
+		t.Fatalf("Incorrect pixel in second frame: %v", c)
+	}
+	// huge canvases and canvases with many frames are rejected before
+	// anything is allocated
+	huge := func(width, height uint32, num_frames int) []byte {
+		buf := bytes.Buffer{}
+		buf.WriteString(png_signature)
+		header := bytes.Clone(first_chunks[0].data)
+		binary.BigEndian.PutUint32(header, width)
+		binary.BigEndian.PutUint32(header[4:], height)
+		write_png_chunk(&buf, "IHDR", header)
+		write_png_chunk(&buf, "acTL", u32(uint32(num_frames), 0))
+		for i := 0; i < num_frames; i++ {
+			write_png_chunk(&buf, "fcTL", fctl(uint32(2*i), 1, 1, 0, 0, 1, 10, 0, 0))
+			write_png_chunk(&buf, "fdAT", append(u32(uint32(2*i+1)), idat(encode(second))...))
+		}
+		write_png_chunk(&buf, "IEND", nil)
+		return buf.Bytes()
+	}
+	if _, err = DecodeAPNG(bytes.NewReader(huge(1<<15, 1<<15, 1))); err == nil {
+		t.Fatalf("No error for a huge animated PNG")
+	}
+	if _, err = DecodeAPNG(bytes.NewReader(huge(4096, 4096, 17))); err == nil {
+		t.Fatalf("No error for an animated PNG with too many frames for its size")
+	}
+}
@@ -0,0 +1,80 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"kitty/tools/utils"
+
+	"golang.org/x/image/ccitt"
+)
+
+var _ = fmt.Print
+
+// Decode raw CCITT Group 3 or Group 4 fax data, as found in .g3 and .g4
+// files, which has no header, so the width of the image must be known. CCITT
+// data in TIFF files is handled by the TIFF decoder.
+func DecodeFax(r io.Reader, group4 bool, width int) (*image.Gray, error) {
+	sf := ccitt.Group3
+	if group4 {
+		sf = ccitt.Group4
+	}
+	data, err := io.ReadAll(ccitt.NewReader(r, ccitt.MSB, sf, width, ccitt.AutoDetectHeight, nil))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode fax data: %w", err)
+	}
+	stride := (width + 7) / 8
+	height := len(data) / stride
+	if height == 0 {
+		return nil, fmt.Errorf("No rows in fax data")
+	}
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := data[y*stride : (y+1)*stride]
+		for x := 0; x < width; x++ {
+			// a one bit is white
+			if row[x/8]&(0x80>>(x%8)) != 0 {
+				img.Pix[y*img.Stride+x] = 255
+			}
+		}
+	}
+	return img, nil
+}
+
+var Jbig2decExe = (&utils.Once[string]{Run: func() string {
+	return utils.FindExe("jbig2dec")
+}}).Get
+
+// Decode the first page of a JBIG2 file using the jbig2dec program, as there
+// is no pure Go JBIG2 decoder
+func DecodeJBIG2WithJbig2dec(path string) (image.Image, error) {
+	out, err := CreateTempInRAM()
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+	cmd := []string{Jbig2decExe(), "--format", "png", "--output", out.Name(), path}
+	c := exec.Command(cmd[0], cmd[1:]...)
+	if _, err = c.Output(); err != nil {
+		var exit_err *exec.ExitError
+		if errors.As(err, &exit_err) {
+			return nil, fmt.Errorf("Running the command: %s\nFailed with error:\n%s", strings.Join(cmd, " "), string(exit_err.Stderr))
+		}
+		return nil, fmt.Errorf("Could not find the program: %#v. Is jbig2dec installed and in your PATH?", cmd[0])
+	}
+	f, err := os.Open(out.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
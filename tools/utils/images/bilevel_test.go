@@ -0,0 +1,55 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestDecodeFax(t *testing.T) {
+	// two rows, each of three white, four black and three white pixels. The
+	// width is not a multiple of eight, so the rows are padded when decoded.
+	const w, b = 255, 0
+	row := []uint8{w, w, w, b, b, b, b, w, w, w}
+	expected := append(append([]uint8{}, row...), row...)
+	for _, tc := range []struct {
+		name, data string
+		group4     bool
+	}{
+		// 2D coded: horizontal mode then V0 for the first row, three V0 for
+		// the second, then End-of-Facsimile-Block
+		{"group4", "\x30\xfc\x00\x40\x04", true},
+		// 1D coded: an End-of-Line then the white, black and white runs for
+		// each row, then Return-to-Control
+		{"group3", "\x00\x18\x70\x00\x30\xe0\x00\x40\x04\x00\x40\x04\x00\x40\x04", false},
+	} {
+		img, err := DecodeFax(strings.NewReader(tc.data), tc.group4, len(row))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if img.Rect.Dx() != len(row) || img.Rect.Dy() != 2 {
+			t.Fatalf("%s: incorrect size: %v", tc.name, img.Rect)
+		}
+		// the decoder uses a one bit for white, which must not be inverted
+		if diff := cmp.Diff(expected, img.Pix); diff != "" {
+			t.Fatalf("%s: incorrect pixels:\n%s", tc.name, diff)
+		}
+	}
+	for _, tc := range []struct {
+		name, data string
+		group4     bool
+	}{
+		{"empty", "", true},
+		{"group3 without End-of-Line", "\x87\x10\xe0", false},
+	} {
+		if _, err := DecodeFax(strings.NewReader(tc.data), tc.group4, len(row)); err == nil {
+			t.Fatalf("%s: decoding did not fail", tc.name)
+		}
+	}
+}
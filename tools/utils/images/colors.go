@@ -0,0 +1,168 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"image"
+
+	"kitty/tools/utils"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+type PaletteEntry struct {
+	Color NRGBColor
+	// The fraction of the (alpha weighted) pixels of the image that are
+	// represented by this entry
+	Weight float64
+}
+
+type weighted_color struct {
+	c      [3]uint8
+	weight uint32
+}
+
+type color_box []weighted_color
+
+func (self color_box) weight() (ans uint64) {
+	for _, p := range self {
+		ans += uint64(p.weight)
+	}
+	return
+}
+
+func (self color_box) average() NRGBColor {
+	var sums [3]uint64
+	var total uint64
+	for _, p := range self {
+		for i := range sums {
+			sums[i] += uint64(p.c[i]) * uint64(p.weight)
+		}
+		total += uint64(p.weight)
+	}
+	if total == 0 {
+		return NRGBColor{}
+	}
+	return NRGBColor{uint8(sums[0] / total), uint8(sums[1] / total), uint8(sums[2] / total)}
+}
+
+// Return the channel with the widest range of values and the size of the range
+func (self color_box) widest_channel() (channel, span int) {
+	var lo, hi [3]uint8
+	lo = [3]uint8{255, 255, 255}
+	for _, p := range self {
+		for i, x := range p.c {
+			lo[i], hi[i] = utils.Min(lo[i], x), utils.Max(hi[i], x)
+		}
+	}
+	for i := range lo {
+		if s := int(hi[i]) - int(lo[i]); s > span {
+			channel, span = i, s
+		}
+	}
+	return
+}
+
+func weighted_pixels(img image.Image, include func(x, y int) bool) color_box {
+	n := imaging.Clone(img)
+	b := n.Bounds()
+	ans := make(color_box, 0, b.Dx()*b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			if include != nil && !include(x, y) {
+				continue
+			}
+			p := n.Pix[y*n.Stride+4*x : y*n.Stride+4*x+4]
+			if p[3] > 0 {
+				ans = append(ans, weighted_color{c: [3]uint8{p[0], p[1], p[2]}, weight: uint32(p[3])})
+			}
+		}
+	}
+	return ans
+}
+
+// Reduce the colors in img to at most num_colors using the median cut
+// algorithm, weighting pixels by their alpha. The returned palette is sorted
+// by decreasing weight. Downsample large images before calling this for speed.
+func Quantize(img image.Image, num_colors int) []PaletteEntry {
+	pixels := weighted_pixels(img, nil)
+	total := pixels.weight()
+	if total == 0 || num_colors < 1 {
+		return nil
+	}
+	boxes := []color_box{pixels}
+	for len(boxes) < num_colors {
+		// split the box with the widest range of colors
+		idx, channel, best_span := -1, 0, 0
+		for i, b := range boxes {
+			if len(b) < 2 {
+				continue
+			}
+			if c, s := b.widest_channel(); s > best_span {
+				idx, channel, best_span = i, c, s
+			}
+		}
+		if idx < 0 {
+			break
+		}
+		b := boxes[idx]
+		slices.SortFunc(b, func(a, b weighted_color) bool { return a.c[channel] < b.c[channel] })
+		half, acc, split := b.weight()/2, uint64(0), 1
+		for i, p := range b[:len(b)-1] {
+			acc += uint64(p.weight)
+			if acc >= half {
+				split = i + 1
+				break
+			}
+		}
+		// do not split runs of the same value, so that identical colors end
+		// up in the same box
+		lo, hi := split, split
+		for lo > 0 && b[lo-1].c[channel] == b[lo].c[channel] {
+			lo--
+		}
+		for hi < len(b) && b[hi-1].c[channel] == b[hi].c[channel] {
+			hi++
+		}
+		if lo == 0 || (hi < len(b) && hi-split < split-lo) {
+			split = hi
+		} else {
+			split = lo
+		}
+		boxes[idx] = b[:split]
+		boxes = append(boxes, b[split:])
+	}
+	ans := make([]PaletteEntry, len(boxes))
+	for i, b := range boxes {
+		ans[i] = PaletteEntry{Color: b.average(), Weight: float64(b.weight()) / float64(total)}
+	}
+	slices.SortStableFunc(ans, func(a, b PaletteEntry) bool { return a.Weight > b.Weight })
+	return ans
+}
+
+// Return the alpha weighted average color of img
+func AverageColor(img image.Image) NRGBColor {
+	return weighted_pixels(img, nil).average()
+}
+
+// Return the most common color in img, as found by quantizing it
+func DominantColor(img image.Image) NRGBColor {
+	if p := Quantize(img, 8); len(p) > 0 {
+		return p[0].Color
+	}
+	return NRGBColor{}
+}
+
+// Return the alpha weighted average color of the pixels along the edges of
+// img, in a band five percent of the size of the image wide
+func EdgeAverageColor(img image.Image) NRGBColor {
+	b := img.Bounds()
+	bx, by := utils.Max(1, b.Dx()/20), utils.Max(1, b.Dy()/20)
+	return weighted_pixels(img, func(x, y int) bool {
+		return x < bx || y < by || x >= b.Dx()-bx || y >= b.Dy()-by
+	}).average()
+}
@@ -0,0 +1,45 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestImageColors(t *testing.T) {
+	red, blue := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}
+	// a blue border of width 1 around a red center
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if x == 0 || y == 0 || x == 3 || y == 3 {
+				img.SetNRGBA(x, y, blue)
+			} else {
+				img.SetNRGBA(x, y, red)
+			}
+		}
+	}
+	if c := AverageColor(img); c != (NRGBColor{63, 0, 191}) {
+		t.Fatalf("Incorrect average color: %s", c.AsSharp())
+	}
+	if c := DominantColor(img); c != (NRGBColor{0, 0, 255}) {
+		t.Fatalf("Incorrect dominant color: %s", c.AsSharp())
+	}
+	if c := EdgeAverageColor(img); c != (NRGBColor{0, 0, 255}) {
+		t.Fatalf("Incorrect edge color: %s", c.AsSharp())
+	}
+	p := Quantize(img, 4)
+	if len(p) != 2 || p[0].Weight != 0.75 || p[1].Color != (NRGBColor{255, 0, 0}) {
+		t.Fatalf("Incorrect palette: %v", p)
+	}
+	// transparent pixels must be ignored
+	img.SetNRGBA(1, 1, color.NRGBA{0, 255, 0, 0})
+	if c := AverageColor(img); c.G != 0 {
+		t.Fatalf("Transparent pixel affected average color: %s", c.AsSharp())
+	}
+}
@@ -0,0 +1,147 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+var _ = fmt.Print
+
+var ErrTruncatedImage = fmt.Errorf("Image data is truncated")
+
+func png_length(data []byte) (int, error) {
+	pos := 8
+	for pos+12 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		ctype := string(data[pos+4 : pos+8])
+		pos += 12 + size
+		if ctype == "IEND" {
+			if pos > len(data) {
+				break
+			}
+			return pos, nil
+		}
+	}
+	return 0, ErrTruncatedImage
+}
+
+func jpeg_length(data []byte) (int, error) {
+	pos := 2
+	for pos+1 < len(data) {
+		if data[pos] != 0xff {
+			return 0, fmt.Errorf("Invalid JPEG marker at offset: %d", pos)
+		}
+		marker := data[pos+1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			pos++
+			continue
+		case marker == 0xd9:
+			return pos + 2, nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			pos += 2
+			continue
+		}
+		if pos+4 > len(data) {
+			break
+		}
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xda {
+			// skip the entropy coded data that follows the start of scan
+			// segment, in which 0xff bytes are followed by zero or a restart marker
+			for pos+1 < len(data) && !(data[pos] == 0xff && data[pos+1] != 0 && (data[pos+1] < 0xd0 || data[pos+1] > 0xd7)) {
+				pos++
+			}
+		}
+	}
+	return 0, ErrTruncatedImage
+}
+
+func gif_length(data []byte) (int, error) {
+	skip_sub_blocks := func(pos int) int {
+		for pos < len(data) && data[pos] != 0 {
+			pos += 1 + int(data[pos])
+		}
+		return pos + 1
+	}
+	color_table_size := func(flags byte) int {
+		if flags&0x80 == 0 {
+			return 0
+		}
+		return 3 << ((flags & 7) + 1)
+	}
+	if len(data) < 13 {
+		return 0, ErrTruncatedImage
+	}
+	pos := 13 + color_table_size(data[10])
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x3b:
+			return pos + 1, nil
+		case 0x21:
+			pos = skip_sub_blocks(pos + 2)
+		case 0x2c:
+			if pos+10 > len(data) {
+				return 0, ErrTruncatedImage
+			}
+			// image descriptor, color table and the LZW minimum code size
+			pos = skip_sub_blocks(pos + 10 + color_table_size(data[pos+9]) + 1)
+		default:
+			return 0, fmt.Errorf("Invalid GIF block at offset: %d", pos)
+		}
+	}
+	return 0, ErrTruncatedImage
+}
+
+func sized_length(n, available int) (int, error) {
+	if n > available {
+		return 0, ErrTruncatedImage
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("Invalid image size in header: %d", n)
+	}
+	return n, nil
+}
+
+// Return the number of bytes used by the image at the start of data. Works
+// for PNG, JPEG, GIF, BMP, WebP and Farbfeld images, whose end can be found
+// without decoding them.
+func EncodedImageLength(data []byte) (int, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return png_length(data)
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return jpeg_length(data)
+	case bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a")):
+		return gif_length(data)
+	case bytes.HasPrefix(data, []byte("BM")) && len(data) >= 6:
+		return sized_length(int(binary.LittleEndian.Uint32(data[2:])), len(data))
+	case bytes.HasPrefix(data, []byte("RIFF")) && len(data) >= 12 && string(data[8:12]) == "WEBP":
+		return sized_length(8+int(binary.LittleEndian.Uint32(data[4:])), len(data))
+	case bytes.HasPrefix(data, []byte(farbfeld_magic)) && len(data) >= 16:
+		w, h := int(binary.BigEndian.Uint32(data[8:])), int(binary.BigEndian.Uint32(data[12:]))
+		if w > 0 && h > farbfeld_max_pixels/w {
+			return 0, fmt.Errorf("Farbfeld image too large: %dx%d", w, h)
+		}
+		return sized_length(16+w*h*8, len(data))
+	}
+	return 0, fmt.Errorf("Unknown image format, cannot find the end of the image")
+}
+
+// Split data containing several images concatenated together. If the end of
+// an image cannot be found, the rest of the data is returned as trailing.
+func SplitConcatenatedImages(data []byte) (ans [][]byte, trailing []byte, err error) {
+	for len(data) > 0 {
+		n, err := EncodedImageLength(data)
+		if err != nil {
+			return ans, data, err
+		}
+		ans = append(ans, data[:n])
+		data = data[n:]
+	}
+	return
+}
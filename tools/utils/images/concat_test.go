@@ -0,0 +1,63 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+var _ = fmt.Print
+
+func TestSplitConcatenatedImages(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 17, 9))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	var encoded [][]byte
+	for _, enc := range []func(*bytes.Buffer) error{
+		func(b *bytes.Buffer) error { return png.Encode(b, img) },
+		func(b *bytes.Buffer) error { return jpeg.Encode(b, img, &jpeg.Options{Quality: 95}) },
+		func(b *bytes.Buffer) error {
+			p := image.NewPaletted(img.Rect, color.Palette{color.Black, color.White})
+			return gif.EncodeAll(b, &gif.GIF{Image: []*image.Paletted{p, p}, Delay: []int{1, 1}})
+		},
+		func(b *bytes.Buffer) error { return bmp.Encode(b, img) },
+		func(b *bytes.Buffer) error { return EncodeFarbfeld(b, img) },
+	} {
+		b := bytes.Buffer{}
+		if err := enc(&b); err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, b.Bytes())
+	}
+	data := bytes.Join(encoded, nil)
+	parts, trailing, err := SplitConcatenatedImages(data)
+	if err != nil || len(trailing) != 0 {
+		t.Fatalf("Failed to split images: %v with %d trailing bytes", err, len(trailing))
+	}
+	if len(parts) != len(encoded) {
+		t.Fatalf("Incorrect number of images: %d != %d", len(parts), len(encoded))
+	}
+	for i, p := range parts {
+		if !bytes.Equal(p, encoded[i]) {
+			t.Fatalf("Image %d was not split correctly, lengths: %d != %d", i, len(p), len(encoded[i]))
+		}
+	}
+	parts, trailing, err = SplitConcatenatedImages(append(bytes.Clone(data), "garbage"...))
+	if err == nil || len(parts) != len(encoded) || string(trailing) != "garbage" {
+		t.Fatalf("Trailing garbage not detected: %v %d %#v", err, len(parts), string(trailing))
+	}
+	parts, trailing, err = SplitConcatenatedImages(data[:len(encoded[0])+10])
+	if err != ErrTruncatedImage || len(parts) != 1 || len(trailing) != 10 {
+		t.Fatalf("Truncated image not detected: %v %d %d", err, len(parts), len(trailing))
+	}
+}
@@ -0,0 +1,95 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"math"
+)
+
+var _ = fmt.Print
+
+func quantize_channel(v float32, levels float32) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	q := float32(math.Round(float64(v * (levels - 1) / 255)))
+	return uint8(math.Round(float64(q * 255 / (levels - 1))))
+}
+
+type DitherMethod int
+
+const (
+	NoDither DitherMethod = iota
+	// Error diffusion, best for photos and gradients
+	FloydSteinbergDither
+	// A fixed Bayer threshold pattern, which looks regular and, unlike error
+	// diffusion, does not change from frame to frame in animations
+	OrderedDither
+)
+
+var bayer_matrix = [8][8]float32{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// Reduce the number of bits per color channel of the pixels in pix, which has
+// bytes_per_pixel of 3 for RGB or 4 for RGBA data, in which case alpha is left
+// unchanged. bits is the number of bits to keep for the red, green and blue
+// channels, the reduced values are scaled back to the full 8 bit range.
+// dither is used to reduce banding, with strength from 0 (none) to 1 scaling
+// the diffused error or the threshold pattern.
+func ReduceBitDepth(pix []byte, stride, width, height, bytes_per_pixel int, bits [3]uint, dither DitherMethod, strength float32) {
+	var levels, steps [3]float32
+	for c, b := range bits {
+		levels[c] = float32(uint(1) << b)
+		steps[c] = 255 / (levels[c] - 1)
+	}
+	if strength <= 0 {
+		dither = NoDither
+	}
+	var current, next []float32
+	if dither == FloydSteinbergDither {
+		// errors for the current and next rows, with a pixel of padding at each end
+		current, next = make([]float32, (width+2)*3), make([]float32, (width+2)*3)
+	}
+	for y := 0; y < height; y++ {
+		row := pix[y*stride:]
+		for x := 0; x < width; x++ {
+			p := row[x*bytes_per_pixel:]
+			for c := 0; c < 3; c++ {
+				switch dither {
+				case NoDither:
+					p[c] = quantize_channel(float32(p[c]), levels[c])
+				case OrderedDither:
+					threshold := (bayer_matrix[y&7][x&7]+0.5)/64 - 0.5
+					p[c] = quantize_channel(float32(p[c])+threshold*steps[c]*strength, levels[c])
+				case FloydSteinbergDither:
+					e := (x+1)*3 + c
+					v := float32(p[c]) + current[e]
+					p[c] = quantize_channel(v, levels[c])
+					err := (v - float32(p[c])) * strength
+					current[e+3] += err * 7 / 16
+					next[e-3] += err * 3 / 16
+					next[e] += err * 5 / 16
+					next[e+3] += err * 1 / 16
+				}
+			}
+		}
+		if dither == FloydSteinbergDither {
+			current, next = next, current
+			for i := range next {
+				next[i] = 0
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestReduceBitDepth(t *testing.T) {
+	allowed := func(bits uint) map[uint8]bool {
+		ans := make(map[uint8]bool)
+		for q := 0; q < 1<<bits; q++ {
+			ans[quantize_channel(float32(q*255)/float32(int(1)<<bits-1), float32(int(1)<<bits))] = true
+		}
+		return ans
+	}
+	bits := [3]uint{5, 6, 5}
+	levels := [3]map[uint8]bool{allowed(5), allowed(6), allowed(5)}
+	const width, height = 16, 4
+	for _, dither := range []DitherMethod{NoDither, FloydSteinbergDither, OrderedDither} {
+		// an RGBA gradient with a constant alpha
+		pix := make([]byte, width*height*4)
+		for i := 0; i < len(pix); i += 4 {
+			v := byte(i / 4 * 255 / (width*height - 1))
+			pix[i], pix[i+1], pix[i+2], pix[i+3] = v, 255-v, v/2, 77
+		}
+		ReduceBitDepth(pix, width*4, width, height, 4, bits, dither, 1)
+		for i := 0; i < len(pix); i += 4 {
+			for c := 0; c < 3; c++ {
+				if !levels[c][pix[i+c]] {
+					t.Fatalf("Value %d of channel %d is not a %d bit level with dither=%d", pix[i+c], c, bits[c], dither)
+				}
+			}
+			if pix[i+3] != 77 {
+				t.Fatalf("Alpha was changed to: %d", pix[i+3])
+			}
+		}
+	}
+	if actual := quantize_channel(130, 16); actual != 136 {
+		t.Fatalf("Incorrect quantized value: %d", actual)
+	}
+	// dithering a flat color preserves its average value
+	const gray = 100
+	for _, dither := range []DitherMethod{FloydSteinbergDither, OrderedDither} {
+		pix := make([]byte, 64*64*3)
+		for i := range pix {
+			pix[i] = gray
+		}
+		ReduceBitDepth(pix, 64*3, 64, 64, 3, [3]uint{2, 2, 2}, dither, 1)
+		sum, distinct := 0, make(map[byte]bool)
+		for i := 0; i < len(pix); i += 3 {
+			sum += int(pix[i])
+			distinct[pix[i]] = true
+		}
+		if avg := float64(sum) / (64 * 64); avg < gray-2 || avg > gray+2 {
+			t.Fatalf("Dithering with %d changed the average value from %d to %f", dither, gray, avg)
+		}
+		if len(distinct) != 2 {
+			t.Fatalf("Dithering with %d did not mix the two nearest levels: %v", dither, distinct)
+		}
+	}
+	// with no strength there is no dithering
+	pix := []byte{gray, gray, gray}
+	ReduceBitDepth(pix, 3, 1, 1, 3, [3]uint{2, 2, 2}, OrderedDither, 0)
+	if pix[0] != quantize_channel(gray, 4) {
+		t.Fatalf("Dithering with zero strength changed the value to: %d", pix[0])
+	}
+}
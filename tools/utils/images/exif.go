@@ -0,0 +1,418 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+var _ = fmt.Print
+
+const (
+	tiff_byte      = 1
+	tiff_ascii     = 2
+	tiff_short     = 3
+	tiff_long      = 4
+	tiff_rational  = 5
+	tiff_undefined = 7
+	tiff_slong     = 9
+	tiff_srational = 10
+	tiff_ifd       = 13
+
+	exif_orientation_tag = 0x0112
+	exif_gps_ifd_tag     = 0x8825
+	max_ifd_value_size   = 16 * 1024 * 1024
+)
+
+var tiff_type_sizes = map[uint16]int64{
+	tiff_byte: 1, tiff_ascii: 1, tiff_short: 2, tiff_long: 4, tiff_rational: 8, tiff_undefined: 1,
+	tiff_slong: 4, tiff_srational: 8, tiff_ifd: 4,
+}
+
+type ifd_entry struct {
+	tag, typ uint16
+	count    uint32
+	raw      [4]byte
+}
+
+type ifd struct {
+	offset  int64
+	entries map[uint16]ifd_entry
+	next    int64
+}
+
+// A minimal reader for the IFD based structure used by TIFF and EXIF data
+type tiff_structure struct {
+	r         io.ReaderAt
+	order     binary.ByteOrder
+	first_ifd int64
+}
+
+func parse_tiff_structure(r io.ReaderAt) (*tiff_structure, error) {
+	var header [8]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, fmt.Errorf("Failed to read TIFF header: %w", err)
+	}
+	ans := tiff_structure{r: r}
+	switch string(header[:4]) {
+	case "II*\x00":
+		ans.order = binary.LittleEndian
+	case "MM\x00*":
+		ans.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("Not a valid TIFF header")
+	}
+	ans.first_ifd = int64(ans.order.Uint32(header[4:]))
+	return &ans, nil
+}
+
+func (self *tiff_structure) read_ifd(offset int64) (*ifd, error) {
+	var b [12]byte
+	if _, err := self.r.ReadAt(b[:2], offset); err != nil {
+		return nil, fmt.Errorf("Failed to read IFD at offset %d: %w", offset, err)
+	}
+	num := int(self.order.Uint16(b[:2]))
+	ans := ifd{offset: offset, entries: make(map[uint16]ifd_entry, num)}
+	pos := offset + 2
+	for i := 0; i < num; i++ {
+		if _, err := self.r.ReadAt(b[:], pos); err != nil {
+			return nil, fmt.Errorf("Failed to read IFD entry at offset %d: %w", pos, err)
+		}
+		e := ifd_entry{tag: self.order.Uint16(b[:2]), typ: self.order.Uint16(b[2:4]), count: self.order.Uint32(b[4:8])}
+		copy(e.raw[:], b[8:])
+		ans.entries[e.tag] = e
+		pos += 12
+	}
+	if _, err := self.r.ReadAt(b[:4], pos); err == nil {
+		ans.next = int64(self.order.Uint32(b[:4]))
+	}
+	return &ans, nil
+}
+
+func (self *tiff_structure) value_bytes(e ifd_entry) ([]byte, error) {
+	sz, ok := tiff_type_sizes[e.typ]
+	if !ok {
+		return nil, fmt.Errorf("Unknown IFD entry type: %d", e.typ)
+	}
+	total := sz * int64(e.count)
+	if total <= 4 {
+		return e.raw[:total], nil
+	}
+	if total > max_ifd_value_size {
+		return nil, fmt.Errorf("IFD entry too large: %d bytes", total)
+	}
+	ans := make([]byte, total)
+	if _, err := self.r.ReadAt(ans, int64(self.order.Uint32(e.raw[:]))); err != nil {
+		return nil, fmt.Errorf("Failed to read IFD entry value: %w", err)
+	}
+	return ans, nil
+}
+
+func (self *tiff_structure) uints(e ifd_entry) (ans []uint64, err error) {
+	data, err := self.value_bytes(e)
+	if err != nil {
+		return nil, err
+	}
+	ans = make([]uint64, e.count)
+	for i := range ans {
+		switch e.typ {
+		case tiff_byte, tiff_undefined:
+			ans[i] = uint64(data[i])
+		case tiff_short:
+			ans[i] = uint64(self.order.Uint16(data[2*i:]))
+		case tiff_long, tiff_ifd:
+			ans[i] = uint64(self.order.Uint32(data[4*i:]))
+		default:
+			return nil, fmt.Errorf("IFD entry of type %d is not an unsigned integer", e.typ)
+		}
+	}
+	return
+}
+
+func (self *tiff_structure) uint(e ifd_entry) (uint64, bool) {
+	vals, err := self.uints(e)
+	if err != nil || len(vals) == 0 {
+		return 0, false
+	}
+	return vals[0], true
+}
+
+func (self *tiff_structure) rationals(e ifd_entry) (ans []float64, err error) {
+	if e.typ != tiff_rational && e.typ != tiff_srational {
+		return nil, fmt.Errorf("IFD entry of type %d is not a rational", e.typ)
+	}
+	data, err := self.value_bytes(e)
+	if err != nil {
+		return nil, err
+	}
+	ans = make([]float64, e.count)
+	for i := range ans {
+		var num, den float64
+		if e.typ == tiff_rational {
+			num, den = float64(self.order.Uint32(data[8*i:])), float64(self.order.Uint32(data[8*i+4:]))
+		} else {
+			num, den = float64(int32(self.order.Uint32(data[8*i:]))), float64(int32(self.order.Uint32(data[8*i+4:])))
+		}
+		if den != 0 {
+			ans[i] = num / den
+		}
+	}
+	return
+}
+
+func (self *tiff_structure) ascii(e ifd_entry) string {
+	data, err := self.value_bytes(e)
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimRight(data, "\x00"))
+}
+
+func orientation_from_tiff_structure(t *tiff_structure) int {
+	d, err := t.read_ifd(t.first_ifd)
+	if err != nil {
+		return 1
+	}
+	if e, found := d.entries[exif_orientation_tag]; found {
+		if val, ok := t.uint(e); ok && val > 0 && val < 9 {
+			return int(val)
+		}
+	}
+	return 1
+}
+
+// Return the orientation from the specified EXIF data, which must start with
+// a TIFF header, optionally preceded by the Exif\0\0 APP1 marker. Returns 1
+// (the identity orientation) if no orientation is present.
+func OrientationFromEXIF(data []byte) int {
+	data = bytes.TrimPrefix(data, []byte("Exif\x00\x00"))
+	t, err := parse_tiff_structure(bytes.NewReader(data))
+	if err != nil {
+		return 1
+	}
+	return orientation_from_tiff_structure(t)
+}
+
+// Return a reader for the EXIF data (starting with the TIFF header) embedded
+// in an image of the specified format or nil if there is none
+func exif_reader(r io.ReaderAt, format_uppercase string) io.ReaderAt {
+	var b [8]byte
+	switch format_uppercase {
+	case "TIFF":
+		return r
+	case "JPEG", "JPG":
+		pos := int64(2)
+		for {
+			if _, err := r.ReadAt(b[:4], pos); err != nil || b[0] != 0xff {
+				return nil
+			}
+			marker, sz := b[1], int64(binary.BigEndian.Uint16(b[2:4]))
+			if marker == 0xda || marker == 0xd9 {
+				return nil
+			}
+			if marker == 0xe1 && sz > 8 {
+				if _, err := r.ReadAt(b[:6], pos+4); err == nil && string(b[:6]) == "Exif\x00\x00" {
+					return io.NewSectionReader(r, pos+10, sz-8)
+				}
+			}
+			pos += 2 + sz
+		}
+	case "PNG":
+		pos := int64(8)
+		for {
+			if _, err := r.ReadAt(b[:8], pos); err != nil {
+				return nil
+			}
+			sz, chunk_type := int64(binary.BigEndian.Uint32(b[:4])), string(b[4:8])
+			switch chunk_type {
+			case "eXIf":
+				return io.NewSectionReader(r, pos+8, sz)
+			case "IDAT", "IEND":
+				return nil
+			}
+			pos += 12 + sz
+		}
+	case "WEBP":
+		var ans io.ReaderAt
+		iterate_riff_chunks(r, func(fourcc string, data *io.SectionReader) bool {
+			if fourcc == "EXIF" {
+				var prefix [6]byte
+				if _, err := data.ReadAt(prefix[:], 0); err == nil && string(prefix[:]) == "Exif\x00\x00" {
+					ans = io.NewSectionReader(data, 6, data.Size()-6)
+				} else {
+					ans = data
+				}
+				return false
+			}
+			return true
+		})
+		return ans
+	case "HEIF", "AVIF":
+		if h, err := ParseHEIF(r); err == nil {
+			return h.exif
+		}
+	}
+	return nil
+}
+
+// Return the EXIF orientation of an image of the specified format, or 1 (the
+// identity orientation) if it has none
+func Orientation(r io.ReaderAt, format_uppercase string) int {
+	if format_uppercase == "HEIF" || format_uppercase == "AVIF" {
+		// the EXIF orientation of these images is informational, it is the
+		// transformative properties of the image item that are applied
+		if h, err := ParseHEIF(r); err == nil {
+			return h.Orientation
+		}
+		return 1
+	}
+	if er := exif_reader(r, format_uppercase); er != nil {
+		if t, err := parse_tiff_structure(er); err == nil {
+			return orientation_from_tiff_structure(t)
+		}
+	}
+	return 1
+}
+
+type GPSLocation struct {
+	Latitude, Longitude float64 // in degrees, negative for South and West
+	Altitude            float64 // in meters, negative for below sea level
+	HasAltitude         bool
+}
+
+// Return the GPS location from the EXIF data embedded in an image of the
+// specified format, or nil if the image has no GPS location
+func GPSFromEXIF(r io.ReaderAt, format_uppercase string) *GPSLocation {
+	er := exif_reader(r, format_uppercase)
+	if er == nil {
+		return nil
+	}
+	t, err := parse_tiff_structure(er)
+	if err != nil {
+		return nil
+	}
+	d, err := t.read_ifd(t.first_ifd)
+	if err != nil {
+		return nil
+	}
+	e, found := d.entries[exif_gps_ifd_tag]
+	if !found {
+		return nil
+	}
+	offset, ok := t.uint(e)
+	if !ok {
+		return nil
+	}
+	if d, err = t.read_ifd(int64(offset)); err != nil {
+		return nil
+	}
+	coordinate := func(ref_tag, tag uint16, negative_ref string) (float64, bool) {
+		e, found := d.entries[tag]
+		if !found {
+			return 0, false
+		}
+		parts, err := t.rationals(e)
+		if err != nil || len(parts) == 0 {
+			return 0, false
+		}
+		ans := parts[0]
+		if len(parts) > 1 {
+			ans += parts[1] / 60
+		}
+		if len(parts) > 2 {
+			ans += parts[2] / 3600
+		}
+		if ref, found := d.entries[ref_tag]; found && t.ascii(ref) == negative_ref {
+			ans = -ans
+		}
+		return ans, true
+	}
+	ans := GPSLocation{}
+	if ans.Latitude, ok = coordinate(1, 2, "S"); !ok {
+		return nil
+	}
+	if ans.Longitude, ok = coordinate(3, 4, "W"); !ok {
+		return nil
+	}
+	if e, found := d.entries[6]; found {
+		if vals, err := t.rationals(e); err == nil && len(vals) > 0 {
+			ans.Altitude, ans.HasAltitude = vals[0], true
+			if ref, found := d.entries[5]; found {
+				if q, ok := t.uint(ref); ok && q == 1 {
+					ans.Altitude = -ans.Altitude
+				}
+			}
+		}
+	}
+	return &ans
+}
+
+// Iterate over the chunks in a RIFF container such as WebP, calling callback
+// with the FourCC of each chunk and a reader for its data. Iteration stops if
+// callback returns false.
+func iterate_riff_chunks(r io.ReaderAt, callback func(fourcc string, data *io.SectionReader) bool) error {
+	var header [12]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return err
+	}
+	if string(header[:4]) != "RIFF" {
+		return fmt.Errorf("Not a RIFF file")
+	}
+	end := int64(binary.LittleEndian.Uint32(header[4:8])) + 8
+	pos := int64(12)
+	for pos+8 <= end {
+		if _, err := r.ReadAt(header[:8], pos); err != nil {
+			return err
+		}
+		sz := int64(binary.LittleEndian.Uint32(header[4:8]))
+		if !callback(string(header[:4]), io.NewSectionReader(r, pos+8, sz)) {
+			break
+		}
+		pos += 8 + sz + sz&1
+	}
+	return nil
+}
+
+// Return the EXIF orientation of a WebP image, or 1 if it has none
+func WebPOrientation(r io.ReaderAt) (ans int) {
+	ans = 1
+	iterate_riff_chunks(r, func(fourcc string, data *io.SectionReader) bool {
+		if fourcc == "EXIF" && data.Size() <= max_ifd_value_size {
+			buf := make([]byte, data.Size())
+			if _, err := data.ReadAt(buf, 0); err == nil {
+				ans = OrientationFromEXIF(buf)
+			}
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// Transform an image as specified by its EXIF orientation so that it is
+// displayed upright
+func ApplyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
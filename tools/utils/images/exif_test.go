@@ -0,0 +1,162 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func exif_with_orientation(order binary.ByteOrder, orientation uint16) []byte {
+	b := bytes.Buffer{}
+	if order == binary.LittleEndian {
+		b.WriteString("II*\x00")
+	} else {
+		b.WriteString("MM\x00*")
+	}
+	binary.Write(&b, order, uint32(8))
+	binary.Write(&b, order, uint16(1))
+	binary.Write(&b, order, uint16(exif_orientation_tag))
+	binary.Write(&b, order, uint16(tiff_short))
+	binary.Write(&b, order, uint32(1))
+	binary.Write(&b, order, orientation)
+	binary.Write(&b, order, uint16(0))
+	binary.Write(&b, order, uint32(0))
+	return b.Bytes()
+}
+
+func webp_with_exif(exif []byte) []byte {
+	chunk := func(b *bytes.Buffer, fourcc string, data []byte) {
+		b.WriteString(fourcc)
+		binary.Write(b, binary.LittleEndian, uint32(len(data)))
+		b.Write(data)
+		if len(data)&1 == 1 {
+			b.WriteByte(0)
+		}
+	}
+	body := bytes.Buffer{}
+	body.WriteString("WEBP")
+	chunk(&body, "VP8X", []byte{0x08, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	chunk(&body, "VP8L", []byte{0x2f, 0, 0, 0, 0})
+	chunk(&body, "EXIF", exif)
+	ans := bytes.Buffer{}
+	ans.WriteString("RIFF")
+	binary.Write(&ans, binary.LittleEndian, uint32(body.Len()))
+	ans.Write(body.Bytes())
+	return ans.Bytes()
+}
+
+func TestEXIFOrientation(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		exif := exif_with_orientation(order, 6)
+		if q := OrientationFromEXIF(exif); q != 6 {
+			t.Fatalf("Incorrect orientation from EXIF with byte order %s: %d", order, q)
+		}
+		if q := OrientationFromEXIF(append([]byte("Exif\x00\x00"), exif...)); q != 6 {
+			t.Fatalf("Incorrect orientation from EXIF with APP1 prefix and byte order %s: %d", order, q)
+		}
+		jpeg := append([]byte{0xff, 0xd8, 0xff, 0xe1, byte((len(exif) + 8) >> 8), byte(len(exif) + 8)}, "Exif\x00\x00"...)
+		jpeg = append(append(jpeg, exif...), 0xff, 0xda, 0, 2)
+		if q := Orientation(bytes.NewReader(jpeg), "JPEG"); q != 6 {
+			t.Fatalf("Incorrect orientation from JPEG with byte order %s: %d", order, q)
+		}
+		if q := WebPOrientation(bytes.NewReader(webp_with_exif(exif))); q != 6 {
+			t.Fatalf("Incorrect orientation from WebP with byte order %s: %d", order, q)
+		}
+	}
+	if q := OrientationFromEXIF([]byte("not exif")); q != 1 {
+		t.Fatalf("Incorrect orientation from invalid EXIF: %d", q)
+	}
+	if q := WebPOrientation(bytes.NewReader(webp_with_exif(nil))); q != 1 {
+		t.Fatalf("Incorrect orientation from WebP with empty EXIF: %d", q)
+	}
+}
+
+func exif_with_gps(order binary.ByteOrder) []byte {
+	b := bytes.Buffer{}
+	w := func(x any) { binary.Write(&b, order, x) }
+	entry := func(tag, typ uint16, count, val uint32) { w(tag); w(typ); w(count); w(val) }
+	if order == binary.LittleEndian {
+		b.WriteString("II*\x00")
+	} else {
+		b.WriteString("MM\x00*")
+	}
+	// IFD0 at 8 with a single entry pointing to the GPS IFD at 26
+	w(uint32(8))
+	w(uint16(1))
+	entry(exif_gps_ifd_tag, tiff_long, 1, 26)
+	w(uint32(0))
+	// GPS IFD with 6 entries, its values start at 26 + 2 + 6*12 + 4 = 104
+	w(uint16(6))
+	ascii := func(tag uint16, val byte) {
+		w(tag)
+		w(uint16(tiff_ascii))
+		w(uint32(2))
+		b.Write([]byte{val, 0, 0, 0})
+	}
+	ascii(1, 'S')
+	entry(2, tiff_rational, 3, 104)
+	ascii(3, 'W')
+	entry(4, tiff_rational, 3, 128)
+	w(uint16(5))
+	w(uint16(tiff_byte))
+	w(uint32(1))
+	b.Write([]byte{1, 0, 0, 0})
+	entry(6, tiff_rational, 1, 152)
+	w(uint32(0))
+	for _, x := range []uint32{33, 1, 52, 1, 1800, 100, 151, 1, 12, 1, 36, 1, 5, 1} {
+		w(x)
+	}
+	return b.Bytes()
+}
+
+func TestEXIFGPS(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		exif := exif_with_gps(order)
+		check := func(loc *GPSLocation, container string) {
+			if loc == nil {
+				t.Fatalf("No GPS location in %s with byte order %s", container, order)
+			}
+			if math.Abs(loc.Latitude-(-33.8716667)) > 1e-6 || math.Abs(loc.Longitude-(-151.21)) > 1e-6 || !loc.HasAltitude || loc.Altitude != -5 {
+				t.Fatalf("Incorrect GPS location in %s with byte order %s: %#v", container, order, *loc)
+			}
+		}
+		check(GPSFromEXIF(bytes.NewReader(exif), "TIFF"), "TIFF")
+		check(GPSFromEXIF(bytes.NewReader(webp_with_exif(append([]byte("Exif\x00\x00"), exif...))), "WEBP"), "WebP")
+		jpeg := bytes.Buffer{}
+		jpeg.Write([]byte{0xff, 0xd8, 0xff, 0xe1})
+		binary.Write(&jpeg, binary.BigEndian, uint16(len(exif)+8))
+		jpeg.WriteString("Exif\x00\x00")
+		jpeg.Write(exif)
+		jpeg.Write([]byte{0xff, 0xda, 0, 2})
+		check(GPSFromEXIF(bytes.NewReader(jpeg.Bytes()), "JPEG"), "JPEG")
+	}
+	if loc := GPSFromEXIF(bytes.NewReader(exif_with_orientation(binary.LittleEndian, 1)), "TIFF"); loc != nil {
+		t.Fatalf("Got GPS location from EXIF without GPS data: %#v", *loc)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	a, b := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, a)
+	img.SetNRGBA(1, 0, b)
+	// orientation 6 means the image must be rotated 90 degrees clockwise to be upright
+	q := ApplyOrientation(img, 6)
+	if q.Bounds().Dx() != 1 || q.Bounds().Dy() != 2 {
+		t.Fatalf("Incorrect size after orientation: %v", q.Bounds())
+	}
+	if q.At(0, 0) != a || q.At(0, 1) != b {
+		t.Fatalf("Incorrect pixels after orientation: %v %v", q.At(0, 0), q.At(0, 1))
+	}
+	if ApplyOrientation(img, 1) != image.Image(img) {
+		t.Fatalf("Identity orientation modified the image")
+	}
+}
@@ -0,0 +1,81 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+var _ = fmt.Print
+
+// Farbfeld is a lossless format consisting of a magic number, the width and
+// height as 32-bit big endian integers and then non-premultiplied 16-bit big
+// endian RGBA pixels, row by row. See https://tools.suckless.org/farbfeld/
+const farbfeld_magic = "farbfeld"
+
+// Limit on the size of Farbfeld images, to avoid huge allocations for corrupt headers
+const farbfeld_max_pixels = 1 << 28
+
+func DecodeFarbfeldConfig(r io.Reader) (ans image.Config, err error) {
+	var header [16]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return ans, fmt.Errorf("Failed to read Farbfeld header: %w", err)
+	}
+	if string(header[:8]) != farbfeld_magic {
+		return ans, fmt.Errorf("Not a Farbfeld image")
+	}
+	ans.Width, ans.Height = int(binary.BigEndian.Uint32(header[8:])), int(binary.BigEndian.Uint32(header[12:]))
+	if ans.Width < 0 || ans.Height < 0 || (ans.Width > 0 && ans.Height > farbfeld_max_pixels/ans.Width) {
+		return ans, fmt.Errorf("Farbfeld image too large: %dx%d", ans.Width, ans.Height)
+	}
+	ans.ColorModel = color.NRGBA64Model
+	return
+}
+
+func DecodeFarbfeld(r io.Reader) (image.Image, error) {
+	c, err := DecodeFarbfeldConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA64(image.Rect(0, 0, c.Width, c.Height))
+	// the pixels are in the same byte order as used by image.NRGBA64
+	if _, err = io.ReadFull(r, img.Pix); err != nil {
+		return nil, fmt.Errorf("Failed to read Farbfeld pixel data: %w", err)
+	}
+	return img, nil
+}
+
+func EncodeFarbfeld(w io.Writer, img image.Image) (err error) {
+	b := img.Bounds()
+	bw := bufio.NewWriter(w)
+	var header [16]byte
+	copy(header[:], farbfeld_magic)
+	binary.BigEndian.PutUint32(header[8:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(header[12:], uint32(b.Dy()))
+	if _, err = bw.Write(header[:]); err != nil {
+		return
+	}
+	var px [8]byte
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			binary.BigEndian.PutUint16(px[0:], c.R)
+			binary.BigEndian.PutUint16(px[2:], c.G)
+			binary.BigEndian.PutUint16(px[4:], c.B)
+			binary.BigEndian.PutUint16(px[6:], c.A)
+			if _, err = bw.Write(px[:]); err != nil {
+				return
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func init() {
+	image.RegisterFormat("farbfeld", farbfeld_magic, DecodeFarbfeld, DecodeFarbfeldConfig)
+}
@@ -0,0 +1,48 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestFarbfeld(t *testing.T) {
+	img := image.NewNRGBA64(image.Rect(0, 0, 3, 2))
+	img.SetNRGBA64(0, 0, color.NRGBA64{0xffff, 0, 0x1234, 0xffff})
+	img.SetNRGBA64(2, 1, color.NRGBA64{1, 0xfedc, 2, 0x8000})
+	buf := bytes.Buffer{}
+	if err := Encode(&buf, img, "image/x-farbfeld"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 16+3*2*8 {
+		t.Fatalf("Incorrect encoded size: %d", buf.Len())
+	}
+	c, format, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "farbfeld" || c.Width != 3 || c.Height != 2 {
+		t.Fatalf("Incorrect config: %s %dx%d", format, c.Width, c.Height)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(img, decoded); diff != "" {
+		t.Fatalf("Round trip changed the image:\n%s", diff)
+	}
+	if IsOpaque(decoded) {
+		t.Fatalf("Image with transparent pixels reported as opaque")
+	}
+	if _, err = DecodeFarbfeld(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Fatalf("No error for truncated data")
+	}
+}
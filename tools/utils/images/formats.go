@@ -3,6 +3,8 @@
 package images
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"image"
 	"image/gif"
@@ -19,10 +21,12 @@ var _ = fmt.Print
 
 var DecodableImageTypes = map[string]bool{
 	"image/jpeg": true, "image/png": true, "image/bmp": true, "image/tiff": true, "image/webp": true, "image/gif": true,
+	"image/x-farbfeld": true,
 }
 
 var EncodableImageTypes = map[string]bool{
 	"image/jpeg": true, "image/png": true, "image/bmp": true, "image/tiff": true, "image/gif": true,
+	"image/x-farbfeld": true,
 }
 
 func Encode(output io.Writer, img image.Image, format_mime string) (err error) {
@@ -37,8 +41,67 @@ func Encode(output io.Writer, img image.Image, format_mime string) (err error) {
 		return gif.Encode(output, img, nil)
 	case "image/tiff":
 		return tiff.Encode(output, img, nil)
+	case "image/x-farbfeld":
+		return EncodeFarbfeld(output, img)
 	}
 	err = fmt.Errorf("Unsupported output image MIME type %s", format_mime)
 	return
 
 }
+
+// The number of bytes at the start of a file needed by SniffImageType
+const SniffLength = 512
+
+var image_signatures = []struct {
+	prefix, mime string
+}{
+	{"\x89PNG\r\n\x1a\n", "image/png"},
+	{"\xff\xd8\xff", "image/jpeg"},
+	{"GIF87a", "image/gif"},
+	{"GIF89a", "image/gif"},
+	{"II*\x00", "image/tiff"},
+	{"MM\x00*", "image/tiff"},
+	{farbfeld_magic, "image/x-farbfeld"},
+	{ico_magic, "image/x-icon"},
+	{cur_magic, "image/x-icon"},
+}
+
+// BM is too short a signature on its own, so also require the size of the DIB
+// header following the 14 byte file header to be that of a known version
+func is_bmp(header []byte) bool {
+	if len(header) < 18 || string(header[:2]) != "BM" {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(header[14:]) {
+	case 12, 40, 56, 108, 124:
+		return true
+	}
+	return false
+}
+
+// Return the MIME type of the image whose first bytes are header, based on
+// the magic numbers of the formats that can be decoded, or the empty string
+// if the header does not match any of them
+func SniffImageType(header []byte) string {
+	for _, s := range image_signatures {
+		if bytes.HasPrefix(header, []byte(s.prefix)) {
+			return s.mime
+		}
+	}
+	if is_bmp(header) {
+		return "image/bmp"
+	}
+	if len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP" {
+		return "image/webp"
+	}
+	switch HEIFFormat(header) {
+	case "HEIF":
+		return "image/heif"
+	case "AVIF":
+		return "image/avif"
+	}
+	if IsSVG(header) {
+		return "image/svg+xml"
+	}
+	return ""
+}
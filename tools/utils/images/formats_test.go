@@ -0,0 +1,44 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestSniffImageType(t *testing.T) {
+	zeros := func(n int) string { return strings.Repeat("\x00", n) }
+	for header, expected := range map[string]string{
+		"\x89PNG\r\n\x1a\n\x00\x00":                            "image/png",
+		"\xff\xd8\xff\xe0":                                     "image/jpeg",
+		"GIF89a":                                               "image/gif",
+		"BM\x00\x00":                                           "",
+		"BM" + zeros(12) + "(\x00\x00\x00":                     "image/bmp",
+		"BM" + zeros(12) + "|\x00\x00\x00":                     "image/bmp",
+		"BM" + zeros(12) + "\x0c\x00\x00\x00":                  "image/bmp",
+		"BM" + zeros(12) + "\x10\x00\x00\x00":                  "",
+		"BM" + zeros(12) + "(\x00":                             "",
+		"BMW is a car":                                         "",
+		"II*\x00\x08":                                          "image/tiff",
+		"MM\x00*\x00":                                          "image/tiff",
+		"RIFF\x00\x00\x00\x00WEBPVP8":                          "image/webp",
+		"RIFF\x00\x00\x00\x00WAVE":                             "",
+		"farbfeld\x00":                                         "image/x-farbfeld",
+		"\x00\x00\x01\x00\x01\x00":                             "image/x-icon",
+		"<?xml version='1.0'?><svg>":                           "image/svg+xml",
+		"%PDF-1.4":                                             "",
+		"\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic":     "image/heif",
+		"\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf": "image/avif",
+		"\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1avif":     "image/avif",
+		"\x00\x00\x00\x14ftypisom\x00\x00\x02\x00mp41":         "",
+		"": "",
+	} {
+		if actual := SniffImageType([]byte(header)); actual != expected {
+			t.Fatalf("Incorrect type for %#v: %#v != %#v", header, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// The ftyp brands of HEIF (HEIC) and AVIF images. AVIF files often also
+// declare the generic mif1 brand, so the AVIF brands are checked first.
+var avif_brands = map[string]bool{"avif": true, "avis": true}
+var heif_brands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true, "hevc": true, "hevx": true, "mif1": true, "msf1": true,
+}
+
+// Return HEIF or AVIF if the header is the start of a file with an ftyp box
+// declaring one of their brands, otherwise the empty string
+func HEIFFormat(header []byte) string {
+	if len(header) < 16 || string(header[4:8]) != "ftyp" {
+		return ""
+	}
+	size := int(binary.BigEndian.Uint32(header))
+	if size < 16 || size > len(header) {
+		size = len(header)
+	}
+	// the major brand, the minor version and then the compatible brands
+	brands := []string{string(header[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(header[i:i+4]))
+	}
+	for _, b := range brands {
+		if avif_brands[b] {
+			return "AVIF"
+		}
+	}
+	for _, b := range brands {
+		if heif_brands[b] {
+			return "HEIF"
+		}
+	}
+	return ""
+}
+
+const max_heif_meta_size = 16 * 1024 * 1024
+
+// The structure of a HEIF or AVIF file, as read from its meta box
+type HEIF struct {
+	Format        string // HEIF or AVIF
+	PrimaryType   string // the item type of the primary image, such as hvc1, av01 or grid
+	Width, Height int    // the size of the primary image, before the orientation is applied
+	Orientation   int    // the EXIF orientation equivalent to the rotation and mirroring of the primary image
+	NumImages     int    // the number of top level images, excluding thumbnails, tiles and auxiliary images
+	exif          io.ReaderAt
+}
+
+type heif_extent struct {
+	offset, length uint64
+}
+
+type heif_location struct {
+	construction_method uint16
+	extents             []heif_extent
+}
+
+type heif_box struct {
+	typ  string
+	body *io.SectionReader
+}
+
+// Read the boxes in r, the size of a box can be zero meaning it extends to the end of r
+func read_heif_boxes(r *io.SectionReader) (ans []heif_box, err error) {
+	var b [16]byte
+	pos, end := int64(0), r.Size()
+	for pos+8 <= end {
+		if n, err := r.ReadAt(b[:8], pos); err != nil {
+			if n == 0 && pos > 0 && errors.Is(err, io.EOF) {
+				// the end of a file whose size is not known
+				break
+			}
+			return nil, fmt.Errorf("Failed to read box header at offset %d: %w", pos, err)
+		}
+		size, header_size := int64(binary.BigEndian.Uint32(b[:4])), int64(8)
+		typ := string(b[4:8])
+		switch size {
+		case 0:
+			size = end - pos
+		case 1:
+			if _, err = r.ReadAt(b[8:16], pos+8); err != nil {
+				return nil, fmt.Errorf("Failed to read box size at offset %d: %w", pos, err)
+			}
+			if s := binary.BigEndian.Uint64(b[8:16]); s > math.MaxInt64 {
+				return nil, fmt.Errorf("The %s box has an invalid size", typ)
+			} else {
+				size, header_size = int64(s), 16
+			}
+		}
+		if size < header_size || size > end-pos {
+			return nil, fmt.Errorf("The %s box at offset %d has an invalid size: %d", typ, pos, size)
+		}
+		ans = append(ans, heif_box{typ: typ, body: io.NewSectionReader(r, pos+header_size, size-header_size)})
+		pos += size
+	}
+	return
+}
+
+// A reader for the fields of a box, that are all big endian
+type heif_fields struct {
+	data []byte
+	err  error
+}
+
+func new_heif_fields(r *io.SectionReader) *heif_fields {
+	if r.Size() > max_heif_meta_size {
+		return &heif_fields{err: fmt.Errorf("Box too large: %d bytes", r.Size())}
+	}
+	data := make([]byte, r.Size())
+	_, err := r.ReadAt(data, 0)
+	return &heif_fields{data: data, err: err}
+}
+
+func (self *heif_fields) take(n int) []byte {
+	if self.err != nil {
+		return nil
+	}
+	if n > len(self.data) {
+		self.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	ans := self.data[:n]
+	self.data = self.data[n:]
+	return ans
+}
+
+// Read an unsigned integer of the specified size in bytes, which can be zero
+func (self *heif_fields) uint(n int) (ans uint64) {
+	for _, x := range self.take(n) {
+		ans = ans<<8 | uint64(x)
+	}
+	return
+}
+
+// Read the version and flags of a full box
+func (self *heif_fields) full_box() (version uint8, flags uint32) {
+	v := self.uint(4)
+	return uint8(v >> 24), uint32(v & 0xffffff)
+}
+
+func (self *heif_fields) item_id(wide bool) uint32 {
+	if wide {
+		return uint32(self.uint(4))
+	}
+	return uint32(self.uint(2))
+}
+
+func (self *heif_fields) fourcc() string {
+	return string(self.take(4))
+}
+
+// The 2x2 matrices that map source to destination coordinates, with y
+// pointing down, for each EXIF orientation
+var orientation_matrices = [9][4]int{
+	{1, 0, 0, 1}, {1, 0, 0, 1}, {-1, 0, 0, 1}, {-1, 0, 0, -1}, {1, 0, 0, -1},
+	{0, 1, 1, 0}, {0, -1, 1, 0}, {0, -1, -1, 0}, {0, 1, -1, 0},
+}
+
+// Return the orientation equivalent to applying the orientation first and
+// then the orientation then
+func compose_orientations(first, then int) int {
+	a, b := orientation_matrices[then], orientation_matrices[first]
+	m := [4]int{a[0]*b[0] + a[1]*b[2], a[0]*b[1] + a[1]*b[3], a[2]*b[0] + a[3]*b[2], a[2]*b[1] + a[3]*b[3]}
+	for i := 1; i < len(orientation_matrices); i++ {
+		if orientation_matrices[i] == m {
+			return i
+		}
+	}
+	return 1
+}
+
+// The EXIF orientations equivalent to the anti-clockwise rotations of the
+// irot property and to the imir property, whose axis 0 means a top to bottom
+// flip, as in libheif
+var irot_orientations = [4]int{1, 8, 3, 6}
+var imir_orientations = [2]int{4, 2}
+
+// Parse the meta box of a HEIF or AVIF file to find its primary image
+func ParseHEIF(r io.ReaderAt) (ans *HEIF, err error) {
+	top, err := read_heif_boxes(io.NewSectionReader(r, 0, math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+	if len(top) == 0 || top[0].typ != "ftyp" {
+		return nil, fmt.Errorf("Not a HEIF file, it does not start with an ftyp box")
+	}
+	header := make([]byte, utils.Min(top[0].body.Size()+8, SniffLength))
+	if _, err = r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("Failed to read ftyp box: %w", err)
+	}
+	ans = &HEIF{Format: HEIFFormat(header), Orientation: 1}
+	if ans.Format == "" {
+		return nil, fmt.Errorf("Not a HEIF file, it has no HEIF or AVIF brand")
+	}
+	var meta *io.SectionReader
+	for _, b := range top {
+		if b.typ == "meta" {
+			meta = b.body
+			break
+		}
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("HEIF file has no meta box")
+	}
+	if meta.Size() < 4 {
+		return nil, fmt.Errorf("HEIF file has an invalid meta box")
+	}
+	children, err := read_heif_boxes(io.NewSectionReader(meta, 4, meta.Size()-4))
+	if err != nil {
+		return nil, err
+	}
+	primary, have_primary := uint32(0), false
+	item_types := map[uint32]string{}
+	item_order := []uint32{}
+	locations := map[uint32]heif_location{}
+	refs := map[string]map[uint32][]uint32{}
+	var properties []heif_box
+	associations := map[uint32][]int{}
+	var idat *io.SectionReader
+	for _, b := range children {
+		switch b.typ {
+		case "pitm":
+			f := new_heif_fields(b.body)
+			v, _ := f.full_box()
+			primary, have_primary = f.item_id(v > 0), f.err == nil
+		case "iinf":
+			f := new_heif_fields(b.body)
+			v, _ := f.full_box()
+			if v > 0 {
+				f.uint(4)
+			} else {
+				f.uint(2)
+			}
+			if f.err != nil {
+				return nil, fmt.Errorf("HEIF file has an invalid iinf box: %w", f.err)
+			}
+			entries, err := read_heif_boxes(io.NewSectionReader(b.body, b.body.Size()-int64(len(f.data)), int64(len(f.data))))
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.typ != "infe" {
+					continue
+				}
+				f := new_heif_fields(e.body)
+				if v, _ := f.full_box(); v >= 2 {
+					id := f.item_id(v > 2)
+					f.uint(2) // item_protection_index
+					if typ := f.fourcc(); f.err == nil {
+						item_types[id] = typ
+						item_order = append(item_order, id)
+					}
+				}
+			}
+		case "iloc":
+			if err = parse_iloc(b.body, locations); err != nil {
+				return nil, err
+			}
+		case "iref":
+			f := new_heif_fields(b.body)
+			v, _ := f.full_box()
+			if f.err != nil || b.body.Size() < 4 {
+				break
+			}
+			entries, err := read_heif_boxes(io.NewSectionReader(b.body, 4, b.body.Size()-4))
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				f := new_heif_fields(e.body)
+				from := f.item_id(v > 0)
+				count := int(f.uint(2))
+				for i := 0; i < count && f.err == nil; i++ {
+					to := f.item_id(v > 0)
+					if f.err == nil {
+						if refs[e.typ] == nil {
+							refs[e.typ] = map[uint32][]uint32{}
+						}
+						refs[e.typ][from] = append(refs[e.typ][from], to)
+					}
+				}
+			}
+		case "iprp":
+			entries, err := read_heif_boxes(b.body)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				switch e.typ {
+				case "ipco":
+					if properties, err = read_heif_boxes(e.body); err != nil {
+						return nil, err
+					}
+				case "ipma":
+					parse_ipma(e.body, associations)
+				}
+			}
+		case "idat":
+			idat = b.body
+		}
+	}
+	if !have_primary {
+		return nil, fmt.Errorf("HEIF file has no primary image")
+	}
+	if ans.PrimaryType = item_types[primary]; ans.PrimaryType == "" {
+		return nil, fmt.Errorf("The primary image of the HEIF file has no item information")
+	}
+	// the properties are applied in the order in which they are associated
+	for _, idx := range associations[primary] {
+		if idx < 1 || idx > len(properties) {
+			continue
+		}
+		p := properties[idx-1]
+		f := new_heif_fields(p.body)
+		switch p.typ {
+		case "ispe":
+			f.full_box()
+			w, h := f.uint(4), f.uint(4)
+			if f.err == nil {
+				ans.Width, ans.Height = int(w), int(h)
+			}
+		case "irot":
+			if x := f.uint(1); f.err == nil {
+				ans.Orientation = compose_orientations(ans.Orientation, irot_orientations[x&3])
+			}
+		case "imir":
+			if x := f.uint(1); f.err == nil {
+				ans.Orientation = compose_orientations(ans.Orientation, imir_orientations[x&1])
+			}
+		}
+	}
+	if ans.Width == 0 || ans.Height == 0 {
+		return nil, fmt.Errorf("The primary image of the HEIF file has no size")
+	}
+	// thumbnails, alpha and depth maps and the tiles of grid images are not
+	// top level images
+	hidden := map[uint32]bool{}
+	for _, typ := range []string{"thmb", "auxl"} {
+		for from := range refs[typ] {
+			hidden[from] = true
+		}
+	}
+	for _, tiles := range refs["dimg"] {
+		for _, to := range tiles {
+			hidden[to] = true
+		}
+	}
+	for _, id := range item_order {
+		switch item_types[id] {
+		case "hvc1", "av01", "grid", "iden", "iovl", "jpeg", "unci":
+			if !hidden[id] {
+				ans.NumImages++
+			}
+		}
+	}
+	for from, to := range refs["cdsc"] {
+		if item_types[from] != "Exif" || len(to) == 0 || to[0] != primary {
+			continue
+		}
+		if data, err := item_data(r, idat, locations[from]); err == nil && len(data) > 4 {
+			// the TIFF header is preceded by its offset from the end of this field
+			if offset := uint64(binary.BigEndian.Uint32(data)); offset < uint64(len(data)-4) {
+				ans.exif = bytes.NewReader(data[4+offset:])
+			}
+		}
+		break
+	}
+	return ans, nil
+}
+
+func parse_iloc(r *io.SectionReader, locations map[uint32]heif_location) error {
+	f := new_heif_fields(r)
+	v, _ := f.full_box()
+	sizes := f.uint(2)
+	offset_size, length_size, base_offset_size, index_size := int(sizes>>12), int(sizes>>8&0xf), int(sizes>>4&0xf), 0
+	if v == 1 || v == 2 {
+		index_size = int(sizes & 0xf)
+	}
+	count := 0
+	if v < 2 {
+		count = int(f.uint(2))
+	} else {
+		count = int(f.uint(4))
+	}
+	for i := 0; i < count && f.err == nil; i++ {
+		id := f.item_id(v >= 2)
+		var loc heif_location
+		if v == 1 || v == 2 {
+			loc.construction_method = uint16(f.uint(2) & 0xf)
+		}
+		f.uint(2) // data_reference_index
+		base := f.uint(base_offset_size)
+		num := int(f.uint(2))
+		for j := 0; j < num && f.err == nil; j++ {
+			f.uint(index_size)
+			e := heif_extent{offset: base + f.uint(offset_size), length: f.uint(length_size)}
+			loc.extents = append(loc.extents, e)
+		}
+		locations[id] = loc
+	}
+	if f.err != nil {
+		return fmt.Errorf("HEIF file has an invalid iloc box: %w", f.err)
+	}
+	return nil
+}
+
+func parse_ipma(r *io.SectionReader, associations map[uint32][]int) {
+	f := new_heif_fields(r)
+	v, flags := f.full_box()
+	count := int(f.uint(4))
+	for i := 0; i < count && f.err == nil; i++ {
+		id := f.item_id(v > 0)
+		n := int(f.uint(1))
+		for j := 0; j < n && f.err == nil; j++ {
+			// the top bit marks the property as essential
+			if flags&1 != 0 {
+				associations[id] = append(associations[id], int(f.uint(2)&0x7fff))
+			} else {
+				associations[id] = append(associations[id], int(f.uint(1)&0x7f))
+			}
+		}
+	}
+}
+
+// Read the data of an item stored in the file or in the idat box
+func item_data(r io.ReaderAt, idat *io.SectionReader, loc heif_location) (ans []byte, err error) {
+	var src io.ReaderAt
+	switch loc.construction_method {
+	case 0:
+		src = r
+	case 1:
+		if idat == nil {
+			return nil, fmt.Errorf("HEIF item stored in a missing idat box")
+		}
+		src = idat
+	default:
+		return nil, fmt.Errorf("Unsupported HEIF item construction method: %d", loc.construction_method)
+	}
+	for _, e := range loc.extents {
+		if e.length > max_heif_meta_size || uint64(len(ans))+e.length > max_heif_meta_size {
+			return nil, fmt.Errorf("HEIF item too large")
+		}
+		b := make([]byte, e.length)
+		if _, err = src.ReadAt(b, int64(e.offset)); err != nil {
+			return nil, err
+		}
+		ans = append(ans, b...)
+	}
+	if len(ans) == 0 {
+		return nil, errors.New("HEIF item has no data")
+	}
+	return
+}
@@ -0,0 +1,115 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func heif_box_bytes(typ string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	ans := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(ans, typ...), body...)
+}
+
+func be(vals ...any) (ans []byte) {
+	for _, v := range vals {
+		switch x := v.(type) {
+		case uint8:
+			ans = append(ans, x)
+		case uint16:
+			ans = binary.BigEndian.AppendUint16(ans, x)
+		case uint32:
+			ans = binary.BigEndian.AppendUint32(ans, x)
+		case string:
+			ans = append(ans, x...)
+		}
+	}
+	return
+}
+
+// A HEIF file with a primary image (item 1), a thumbnail (item 2) and EXIF
+// data (item 3) stored in the idat box
+func make_heif(brand string, exif []byte, transforms ...[]byte) []byte {
+	infe := func(id uint16, typ string) []byte {
+		return heif_box_bytes("infe", be(uint32(2<<24), id, uint16(0), typ, "\x00"))
+	}
+	properties := [][]byte{heif_box_bytes("ispe", be(uint32(0), uint32(40), uint32(30))), heif_box_bytes("ispe", be(uint32(0), uint32(4), uint32(3)))}
+	properties = append(properties, transforms...)
+	assoc := []byte{1}
+	for i := range transforms {
+		assoc = append(assoc, uint8(0x80|(3+i)))
+	}
+	exif_item := append(be(uint32(6), "Exif\x00\x00"), exif...)
+	meta := heif_box_bytes("meta", be(uint32(0)),
+		heif_box_bytes("hdlr", be(uint32(0), uint32(0), "pict", uint32(0), uint32(0), uint32(0), "\x00")),
+		heif_box_bytes("pitm", be(uint32(0), uint16(1))),
+		heif_box_bytes("iinf", be(uint32(0), uint16(3)), infe(1, "hvc1"), infe(2, "hvc1"), infe(3, "Exif")),
+		heif_box_bytes("iref", be(uint32(0)), heif_box_bytes("thmb", be(uint16(2), uint16(1), uint16(1))), heif_box_bytes("cdsc", be(uint16(3), uint16(1), uint16(1)))),
+		heif_box_bytes("iprp",
+			heif_box_bytes("ipco", properties...),
+			heif_box_bytes("ipma", be(uint32(0), uint32(2), uint16(1), uint8(len(assoc))), assoc, be(uint16(2), uint8(1), uint8(2)))),
+		// version 1 of iloc has the construction method, 1 being the idat box
+		heif_box_bytes("iloc", be(uint32(1<<24), uint8(0x44), uint8(0), uint16(1), uint16(3), uint16(1), uint16(0), uint16(1), uint32(0), uint32(len(exif_item)))),
+		heif_box_bytes("idat", exif_item),
+	)
+	return bytes.Join([][]byte{heif_box_bytes("ftyp", be(brand, uint32(0), "mif1", brand)), meta, heif_box_bytes("mdat", be("pixels"))}, nil)
+}
+
+func TestHEIF(t *testing.T) {
+	exif := exif_with_orientation(binary.LittleEndian, 6)
+	irot := func(x uint8) []byte { return heif_box_bytes("irot", []byte{x}) }
+	imir := func(x uint8) []byte { return heif_box_bytes("imir", []byte{x}) }
+	for _, tc := range []struct {
+		transforms  [][]byte
+		orientation int
+	}{
+		{nil, 1},
+		{[][]byte{irot(1)}, 8},
+		{[][]byte{irot(2)}, 3},
+		{[][]byte{irot(3)}, 6},
+		{[][]byte{imir(0)}, 4},
+		{[][]byte{imir(1)}, 2},
+		{[][]byte{irot(1), imir(1)}, 7},
+		{[][]byte{irot(1), imir(0)}, 5},
+		{[][]byte{imir(1), irot(1)}, 5},
+	} {
+		data := make_heif("heic", exif, tc.transforms...)
+		h, err := ParseHEIF(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Format != "HEIF" || h.PrimaryType != "hvc1" || h.Width != 40 || h.Height != 30 || h.NumImages != 1 {
+			t.Fatalf("Incorrect HEIF structure: %+v", h)
+		}
+		if h.Orientation != tc.orientation {
+			t.Fatalf("Incorrect orientation for %d transforms: %d != %d", len(tc.transforms), h.Orientation, tc.orientation)
+		}
+		// the orientation in the EXIF data is ignored
+		if o := Orientation(bytes.NewReader(data), "HEIF"); o != tc.orientation {
+			t.Fatalf("Incorrect orientation: %d != %d", o, tc.orientation)
+		}
+	}
+	data := make_heif("avif", exif)
+	if h, err := ParseHEIF(bytes.NewReader(data)); err != nil || h.Format != "AVIF" {
+		t.Fatalf("AVIF not recognized: %v %v", h, err)
+	}
+	er := exif_reader(bytes.NewReader(data), "AVIF")
+	if er == nil {
+		t.Fatalf("EXIF data not found")
+	}
+	if ts, err := parse_tiff_structure(er); err != nil || orientation_from_tiff_structure(ts) != 6 {
+		t.Fatalf("Incorrect EXIF data: %v", err)
+	}
+	if _, err := ParseHEIF(bytes.NewReader(data[:len(data)/2])); err == nil {
+		t.Fatalf("Truncated HEIF file not rejected")
+	}
+	if _, err := ParseHEIF(bytes.NewReader([]byte("\x00\x00\x00\x10ftypisom\x00\x00\x00\x00"))); err == nil {
+		t.Fatalf("MP4 file not rejected")
+	}
+}
@@ -0,0 +1,349 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+
+	"kitty/tools/utils"
+
+	"github.com/disintegration/imaging"
+)
+
+var _ = fmt.Print
+
+const (
+	icc_profile_tiff_tag = 34675
+	max_icc_profile_size = 4 * 1024 * 1024
+	jpeg_icc_marker      = "ICC_PROFILE\x00"
+)
+
+// Return the ICC color profile embedded in an image of the specified format
+// or nil if it has none
+func EmbeddedICCProfile(r io.ReaderAt, format_uppercase string) []byte {
+	read_section := func(s *io.SectionReader) []byte {
+		if s.Size() > max_icc_profile_size {
+			return nil
+		}
+		ans := make([]byte, s.Size())
+		if _, err := s.ReadAt(ans, 0); err != nil {
+			return nil
+		}
+		return ans
+	}
+	var b [16]byte
+	switch format_uppercase {
+	case "JPEG", "JPG":
+		// large profiles are split over several APP2 segments, with sequence numbers starting at 1
+		var parts [][]byte
+		pos := int64(2)
+		for {
+			if _, err := r.ReadAt(b[:4], pos); err != nil || b[0] != 0xff {
+				break
+			}
+			marker, sz := b[1], int64(binary.BigEndian.Uint16(b[2:4]))
+			if marker == 0xda || marker == 0xd9 {
+				break
+			}
+			if marker == 0xe2 && sz > 16 {
+				if _, err := r.ReadAt(b[:14], pos+4); err == nil && string(b[:12]) == jpeg_icc_marker && b[12] > 0 {
+					seq, count := int(b[12]), int(b[13])
+					if parts == nil {
+						parts = make([][]byte, count)
+					}
+					if seq <= len(parts) {
+						parts[seq-1] = read_section(io.NewSectionReader(r, pos+18, sz-16))
+					}
+				}
+			}
+			pos += 2 + sz
+		}
+		var ans []byte
+		for _, p := range parts {
+			if p == nil {
+				return nil
+			}
+			ans = append(ans, p...)
+		}
+		return ans
+	case "PNG":
+		pos := int64(8)
+		for {
+			if _, err := r.ReadAt(b[:8], pos); err != nil {
+				return nil
+			}
+			sz, chunk_type := int64(binary.BigEndian.Uint32(b[:4])), string(b[4:8])
+			switch chunk_type {
+			case "iCCP":
+				// the profile name, a compression method byte and the zlib compressed profile
+				data := read_section(io.NewSectionReader(r, pos+8, sz))
+				idx := bytes.IndexByte(data, 0)
+				if idx < 0 || idx+2 > len(data) {
+					return nil
+				}
+				zr, err := zlib.NewReader(bytes.NewReader(data[idx+2:]))
+				if err != nil {
+					return nil
+				}
+				defer zr.Close()
+				ans, err := io.ReadAll(io.LimitReader(zr, max_icc_profile_size))
+				if err != nil {
+					return nil
+				}
+				return ans
+			case "IDAT", "IEND":
+				return nil
+			}
+			pos += 12 + sz
+		}
+	case "WEBP":
+		var ans []byte
+		iterate_riff_chunks(r, func(fourcc string, data *io.SectionReader) bool {
+			if fourcc == "ICCP" {
+				ans = read_section(data)
+				return false
+			}
+			return true
+		})
+		return ans
+	case "TIFF":
+		t, err := parse_tiff_structure(r)
+		if err != nil {
+			return nil
+		}
+		d, err := t.read_ifd(t.first_ifd)
+		if err != nil {
+			return nil
+		}
+		if e, found := d.entries[icc_profile_tiff_tag]; found {
+			if ans, err := t.value_bytes(e); err == nil {
+				return ans
+			}
+		}
+	}
+	return nil
+}
+
+// A tone reproduction curve, mapping encoded values in [0, 1] to linear light
+type icc_curve func(float64) float64
+
+func linear_to_srgb(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func s15_fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parse_icc_curve(data []byte) (icc_curve, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("Tone curve too short")
+	}
+	switch string(data[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(data[8:]))
+		if len(data) < 12+2*count {
+			return nil, fmt.Errorf("Tone curve too short")
+		}
+		switch count {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(data[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		}
+		table := make([]float64, count)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(data[12+2*i:])) / 65535
+		}
+		return func(v float64) float64 {
+			pos := v * float64(count-1)
+			i := utils.Min(int(pos), count-2)
+			frac := pos - float64(i)
+			return table[i]*(1-frac) + table[i+1]*frac
+		}, nil
+	case "para":
+		num_params := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+		typ := binary.BigEndian.Uint16(data[8:])
+		n, found := num_params[typ]
+		if !found || len(data) < 12+4*n {
+			return nil, fmt.Errorf("Unsupported parametric tone curve of type: %d", typ)
+		}
+		// g, a, b, c, d, e, f as in the ICC specification
+		var p [7]float64
+		for i := 0; i < n; i++ {
+			p[i] = s15_fixed16(data[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		pow := func(x float64) float64 { return math.Pow(math.Max(0, x), g) }
+		switch typ {
+		case 0:
+			return func(v float64) float64 { return pow(v) }, nil
+		case 1:
+			return func(v float64) float64 {
+				if v >= -b/a {
+					return pow(a*v + b)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(v float64) float64 {
+				if v >= -b/a {
+					return pow(a*v+b) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(v float64) float64 {
+				if v >= d {
+					return pow(a*v + b)
+				}
+				return c * v
+			}, nil
+		default:
+			return func(v float64) float64 {
+				if v >= d {
+					return pow(a*v+b) + e
+				}
+				return c*v + f
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("Unsupported tone curve type: %#v", string(data[:4]))
+}
+
+// Convert from the D50 XYZ profile connection space to linear sRGB, with
+// Bradford chromatic adaptation to D65
+var xyz_d50_to_linear_srgb = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// A conversion of colors to sRGB from the color space described by an
+// embedded ICC profile
+type ColorTransform struct {
+	to_linear   [3][256]float32
+	matrix      [3][3]float32
+	from_linear [4096]uint8
+}
+
+// Create a transform to sRGB from the color space of the specified ICC
+// profile. Only matrix/TRC based RGB profiles and gray profiles, the kinds
+// commonly embedded in images, are supported. Returns nil if the profile
+// describes sRGB, in which case no conversion is needed.
+func NewSRGBTransform(profile []byte) (*ColorTransform, error) {
+	if len(profile) < 132 {
+		return nil, fmt.Errorf("ICC profile too short")
+	}
+	color_space, pcs := string(profile[16:20]), string(profile[20:24])
+	if pcs != "XYZ " {
+		return nil, fmt.Errorf("ICC profiles with the %#v connection space are not supported", pcs)
+	}
+	tags := make(map[string][]byte)
+	num_tags := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < num_tags && 132+12*(i+1) <= len(profile); i++ {
+		e := profile[132+12*i:]
+		offset, size := int64(binary.BigEndian.Uint32(e[4:])), int64(binary.BigEndian.Uint32(e[8:]))
+		if offset+size <= int64(len(profile)) {
+			tags[string(e[:4])] = profile[offset : offset+size]
+		}
+	}
+	var curves [3]icc_curve
+	var matrix [3][3]float64
+	switch color_space {
+	case "RGB ":
+		for c, name := range []string{"r", "g", "b"} {
+			trc, xyz := tags[name+"TRC"], tags[name+"XYZ"]
+			if trc == nil || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+				return nil, fmt.Errorf("Only matrix based RGB ICC profiles are supported")
+			}
+			var err error
+			if curves[c], err = parse_icc_curve(trc); err != nil {
+				return nil, err
+			}
+			// the XYZ of each primary is a column of the matrix to the connection space
+			var col [3]float64
+			for i := range col {
+				col[i] = s15_fixed16(xyz[8+4*i:])
+			}
+			for r := 0; r < 3; r++ {
+				for i := 0; i < 3; i++ {
+					matrix[r][c] += xyz_d50_to_linear_srgb[r][i] * col[i]
+				}
+			}
+		}
+	case "GRAY":
+		trc, err := parse_icc_curve(tags["kTRC"])
+		if err != nil {
+			return nil, err
+		}
+		curves = [3]icc_curve{trc, trc, trc}
+		// the gray axis is the same in all color spaces
+		for r := 0; r < 3; r++ {
+			matrix[r][r] = 1
+		}
+	default:
+		return nil, fmt.Errorf("ICC profiles for the %#v color space are not supported", color_space)
+	}
+	is_srgb := true
+	ans := ColorTransform{}
+	for c := 0; c < 3; c++ {
+		for v := 0; v < 256; v++ {
+			l := curves[c](float64(v) / 255)
+			ans.to_linear[c][v] = float32(l)
+			is_srgb = is_srgb && math.Abs(linear_to_srgb(math.Max(0, l))-float64(v)/255) < 1./255
+		}
+		for i := 0; i < 3; i++ {
+			ans.matrix[c][i] = float32(matrix[c][i])
+			expected := 0.
+			if i == c {
+				expected = 1
+			}
+			// allow for the limited precision of the numbers in profiles
+			is_srgb = is_srgb && math.Abs(matrix[c][i]-expected) < 0.005
+		}
+	}
+	if is_srgb {
+		return nil, nil
+	}
+	for i := range ans.from_linear {
+		ans.from_linear[i] = uint8(math.Round(linear_to_srgb(float64(i)/float64(len(ans.from_linear)-1)) * 255))
+	}
+	return &ans, nil
+}
+
+// Return a copy of img with its colors converted to sRGB
+func (self *ColorTransform) Apply(img image.Image) *image.NRGBA {
+	ans := imaging.Clone(img)
+	last := float32(len(self.from_linear) - 1)
+	var lin [3]float32
+	for i := 0; i+3 < len(ans.Pix); i += 4 {
+		p := ans.Pix[i : i+3 : i+3]
+		for c := 0; c < 3; c++ {
+			lin[c] = self.to_linear[c][p[c]]
+		}
+		for c := 0; c < 3; c++ {
+			m := &self.matrix[c]
+			v := m[0]*lin[0] + m[1]*lin[1] + m[2]*lin[2]
+			switch {
+			case v <= 0:
+				p[c] = self.from_linear[0]
+			case v >= 1:
+				p[c] = 255
+			default:
+				p[c] = self.from_linear[int(v*last+0.5)]
+			}
+		}
+	}
+	return ans
+}
@@ -0,0 +1,130 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+)
+
+var _ = fmt.Print
+
+// A matrix/TRC RGB profile with the D50 adapted primaries as the columns of
+// primaries and the specified tone curve for all channels
+func icc_rgb_profile(primaries [3][3]float64, trc []byte) []byte {
+	var tags bytes.Buffer
+	var table bytes.Buffer
+	type tag struct {
+		name string
+		data []byte
+	}
+	var all []tag
+	for c, name := range []string{"r", "g", "b"} {
+		xyz := []byte("XYZ \x00\x00\x00\x00")
+		for i := 0; i < 3; i++ {
+			xyz = binary.BigEndian.AppendUint32(xyz, uint32(int32(primaries[i][c]*65536+0.5)))
+		}
+		all = append(all, tag{name + "XYZ", xyz}, tag{name + "TRC", trc})
+	}
+	offset := 132 + 12*len(all)
+	for _, t := range all {
+		table.WriteString(t.name)
+		binary.Write(&table, binary.BigEndian, uint32(offset+tags.Len()))
+		binary.Write(&table, binary.BigEndian, uint32(len(t.data)))
+		tags.Write(t.data)
+	}
+	header := make([]byte, 132)
+	binary.BigEndian.PutUint32(header, uint32(offset+tags.Len()))
+	copy(header[12:], "mntrRGB XYZ ")
+	copy(header[36:], "acsp")
+	binary.BigEndian.PutUint32(header[128:], uint32(len(all)))
+	return append(append(header, table.Bytes()...), tags.Bytes()...)
+}
+
+var srgb_primaries = [3][3]float64{
+	{0.4361, 0.3851, 0.1431},
+	{0.2225, 0.7169, 0.0606},
+	{0.0139, 0.0971, 0.7141},
+}
+
+var adobe_rgb_primaries = [3][3]float64{
+	{0.6097, 0.2053, 0.1492},
+	{0.3111, 0.6257, 0.0632},
+	{0.0195, 0.0609, 0.7446},
+}
+
+func TestICCProfiles(t *testing.T) {
+	srgb_trc := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, p := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		srgb_trc = binary.BigEndian.AppendUint32(srgb_trc, uint32(int32(p*65536+0.5)))
+	}
+	if tr, err := NewSRGBTransform(icc_rgb_profile(srgb_primaries, srgb_trc)); err != nil || tr != nil {
+		t.Fatalf("sRGB profile not recognized: %v %v", tr, err)
+	}
+	// Adobe RGB uses a gamma of 563/256
+	adobe := icc_rgb_profile(adobe_rgb_primaries, []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x02\x33"))
+	tr, err := NewSRGBTransform(adobe)
+	if err != nil || tr == nil {
+		t.Fatalf("Adobe RGB profile not converted: %v", err)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{128, 128, 128, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{100, 160, 100, 77})
+	out := tr.Apply(img)
+	gray, c := out.NRGBAAt(0, 0), out.NRGBAAt(1, 0)
+	expected := uint8(linear_to_srgb(math.Pow(128./255, 563./256))*255 + 0.5)
+	if gray.R != gray.G || gray.G != gray.B || gray.R < expected-1 || gray.R > expected+1 {
+		t.Fatalf("Gray not preserved: %v expected: %d", gray, expected)
+	}
+	// colors in the wider gamut of Adobe RGB are more saturated in sRGB
+	if int(c.G)-int(c.R) <= 60 || c.A != 77 {
+		t.Fatalf("Color not converted from Adobe RGB: %v", c)
+	}
+	if _, err = NewSRGBTransform(adobe[:200]); err == nil {
+		t.Fatalf("Truncated profile did not fail")
+	}
+
+	// embedded profiles
+	var b bytes.Buffer
+	png.Encode(&b, img)
+	data := b.Bytes()
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(adobe)
+	zw.Close()
+	var iccp bytes.Buffer
+	write_png_chunk(&iccp, "iCCP", append([]byte("Adobe RGB\x00\x00"), z.Bytes()...))
+	data = append(append(append([]byte{}, data[:33]...), iccp.Bytes()...), data[33:]...)
+	if p := EmbeddedICCProfile(bytes.NewReader(data), "PNG"); !bytes.Equal(p, adobe) {
+		t.Fatalf("ICC profile not found in PNG image")
+	}
+	if EmbeddedICCProfile(bytes.NewReader(b.Bytes()), "PNG") != nil {
+		t.Fatalf("ICC profile found in PNG image without one")
+	}
+
+	b.Reset()
+	jpeg.Encode(&b, img, nil)
+	data = b.Bytes()
+	var app2 bytes.Buffer
+	half := len(adobe) / 2
+	for i, part := range [][]byte{adobe[half:], adobe[:half]} {
+		// out of order to check that the sequence numbers are used
+		app2.Write([]byte{0xff, 0xe2})
+		binary.Write(&app2, binary.BigEndian, uint16(2+len(jpeg_icc_marker)+2+len(part)))
+		app2.WriteString(jpeg_icc_marker)
+		app2.Write([]byte{byte(2 - i), 2})
+		app2.Write(part)
+	}
+	data = append(append(append([]byte{}, data[:2]...), app2.Bytes()...), data[2:]...)
+	if p := EmbeddedICCProfile(bytes.NewReader(data), "JPEG"); !bytes.Equal(p, adobe) {
+		t.Fatalf("ICC profile not found in JPEG image")
+	}
+}
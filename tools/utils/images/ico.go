@@ -0,0 +1,231 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+var _ = fmt.Print
+
+const (
+	ico_magic     = "\x00\x00\x01\x00"
+	cur_magic     = "\x00\x00\x02\x00"
+	max_ico_size  = 64 * 1024 * 1024
+	dib_info_size = 40
+)
+
+// A single image in an ICO or CUR file, which usually contain the same icon
+// at several sizes
+type ICOEntry struct {
+	Width, Height int
+	BitsPerPixel  int
+	offset, size  int64
+}
+
+// Return the images in an ICO or CUR file, in the order they are stored
+func ICOEntries(r io.ReaderAt) (ans []ICOEntry, err error) {
+	var header [6]byte
+	if _, err = r.ReadAt(header[:], 0); err != nil {
+		return nil, fmt.Errorf("Failed to read ICO header: %w", err)
+	}
+	if string(header[:4]) != ico_magic && string(header[:4]) != cur_magic {
+		return nil, fmt.Errorf("Not an ICO image")
+	}
+	count := int(binary.LittleEndian.Uint16(header[4:]))
+	if count == 0 {
+		return nil, fmt.Errorf("ICO image has no images")
+	}
+	dir := make([]byte, 16*count)
+	if _, err = r.ReadAt(dir, 6); err != nil {
+		return nil, fmt.Errorf("Failed to read ICO directory: %w", err)
+	}
+	for i := 0; i < count; i++ {
+		d := dir[16*i:]
+		e := ICOEntry{Width: int(d[0]), Height: int(d[1]), BitsPerPixel: int(binary.LittleEndian.Uint16(d[6:])),
+			size: int64(binary.LittleEndian.Uint32(d[8:])), offset: int64(binary.LittleEndian.Uint32(d[12:]))}
+		if e.size > max_ico_size {
+			return nil, fmt.Errorf("Image %d in ICO image is too large", i+1)
+		}
+		// the directory uses zero for 256, the actual size is in the image data
+		var b [24]byte
+		if n, _ := r.ReadAt(b[:], e.offset); n == len(b) {
+			if string(b[:8]) == png_signature {
+				e.Width, e.Height = int(binary.BigEndian.Uint32(b[16:])), int(binary.BigEndian.Uint32(b[20:]))
+			} else if binary.LittleEndian.Uint32(b[:]) >= dib_info_size {
+				e.Width, e.Height = int(int32(binary.LittleEndian.Uint32(b[4:]))), int(int32(binary.LittleEndian.Uint32(b[8:])))/2
+				e.BitsPerPixel = int(binary.LittleEndian.Uint16(b[14:]))
+			}
+		}
+		if e.Width <= 0 || e.Height <= 0 {
+			return nil, fmt.Errorf("Image %d in ICO image has an invalid size", i+1)
+		}
+		ans = append(ans, e)
+	}
+	return
+}
+
+// Return the largest, and for equal sizes the deepest, image in an ICO file
+func largest_ico_entry(entries []ICOEntry) ICOEntry {
+	ans := entries[0]
+	for _, e := range entries[1:] {
+		if e.Width*e.Height > ans.Width*ans.Height || (e.Width*e.Height == ans.Width*ans.Height && e.BitsPerPixel > ans.BitsPerPixel) {
+			ans = e
+		}
+	}
+	return ans
+}
+
+// Return an ICO file containing only the specified image from r, so that
+// decoders, which decode the largest image, decode that image
+func ICOWithEntry(r io.ReaderAt, e ICOEntry) ([]byte, error) {
+	data := make([]byte, e.size)
+	if _, err := r.ReadAt(data, e.offset); err != nil {
+		return nil, fmt.Errorf("Failed to read image from ICO image: %w", err)
+	}
+	var b bytes.Buffer
+	b.WriteString(ico_magic)
+	binary.Write(&b, binary.LittleEndian, uint16(1))
+	b.Write([]byte{byte(e.Width), byte(e.Height), 0, 0})
+	binary.Write(&b, binary.LittleEndian, uint16(1))
+	binary.Write(&b, binary.LittleEndian, uint16(e.BitsPerPixel))
+	binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	binary.Write(&b, binary.LittleEndian, uint32(6+16))
+	b.Write(data)
+	return b.Bytes(), nil
+}
+
+func decode_dib(data []byte) (image.Image, error) {
+	if len(data) < dib_info_size {
+		return nil, fmt.Errorf("ICO bitmap header is truncated")
+	}
+	header_size := int(binary.LittleEndian.Uint32(data))
+	width, height := int(int32(binary.LittleEndian.Uint32(data[4:]))), int(int32(binary.LittleEndian.Uint32(data[8:])))/2
+	bpp, compression := int(binary.LittleEndian.Uint16(data[14:])), binary.LittleEndian.Uint32(data[16:])
+	num_colors := int(binary.LittleEndian.Uint32(data[32:]))
+	if width <= 0 || height <= 0 || width > 1<<16 || height > 1<<16 {
+		return nil, fmt.Errorf("ICO bitmap has invalid size: %dx%d", width, height)
+	}
+	// BI_BITFIELDS is used with the standard masks by some 32 bit icons
+	if compression != 0 && !(compression == 3 && bpp == 32) {
+		return nil, fmt.Errorf("Compressed ICO bitmaps are not supported")
+	}
+	var palette []color.NRGBA
+	pos := header_size
+	if compression == 3 && header_size == dib_info_size {
+		pos += 12
+	}
+	switch bpp {
+	case 1, 4, 8:
+		if num_colors == 0 || num_colors > 1<<bpp {
+			num_colors = 1 << bpp
+		}
+		if pos+4*num_colors > len(data) {
+			return nil, fmt.Errorf("ICO bitmap palette is truncated")
+		}
+		palette = make([]color.NRGBA, num_colors)
+		for i := range palette {
+			p := data[pos+4*i:]
+			palette[i] = color.NRGBA{p[2], p[1], p[0], 255}
+		}
+		pos += 4 * num_colors
+	case 24, 32:
+	default:
+		return nil, fmt.Errorf("ICO bitmaps with %d bits per pixel are not supported", bpp)
+	}
+	stride := (width*bpp + 31) / 32 * 4
+	mask_stride := (width + 31) / 32 * 4
+	if pos+stride*height > len(data) {
+		return nil, fmt.Errorf("ICO bitmap data is truncated")
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	has_alpha := false
+	// rows are stored bottom up
+	for y := 0; y < height; y++ {
+		row := data[pos+(height-1-y)*stride:]
+		out := img.Pix[y*img.Stride:]
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			switch bpp {
+			case 24, 32:
+				p := row[x*bpp/8:]
+				c = color.NRGBA{p[2], p[1], p[0], 255}
+				if bpp == 32 {
+					c.A = p[3]
+					has_alpha = has_alpha || c.A != 0
+				}
+			default:
+				idx := int(row[x*bpp/8]>>(8-bpp-(x*bpp)%8)) & (1<<bpp - 1)
+				if idx < len(palette) {
+					c = palette[idx]
+				}
+			}
+			out[4*x], out[4*x+1], out[4*x+2], out[4*x+3] = c.R, c.G, c.B, c.A
+		}
+	}
+	// the AND mask specifies transparency unless there is an alpha channel,
+	// it is sometimes missing in icons with an alpha channel
+	mask_pos := pos + stride*height
+	if !has_alpha && mask_pos+mask_stride*height <= len(data) {
+		for y := 0; y < height; y++ {
+			row := data[mask_pos+(height-1-y)*mask_stride:]
+			for x := 0; x < width; x++ {
+				if row[x/8]&(0x80>>(x%8)) != 0 {
+					img.Pix[y*img.Stride+4*x+3] = 0
+				}
+			}
+		}
+	}
+	return img, nil
+}
+
+func read_ico(r io.Reader) (io.ReaderAt, ICOEntry, error) {
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(io.LimitReader(r, max_ico_size))
+		if err != nil {
+			return nil, ICOEntry{}, err
+		}
+		ra = bytes.NewReader(data)
+	}
+	entries, err := ICOEntries(ra)
+	if err != nil {
+		return nil, ICOEntry{}, err
+	}
+	return ra, largest_ico_entry(entries), nil
+}
+
+// Decode the largest image in an ICO or CUR file
+func DecodeICO(r io.Reader) (image.Image, error) {
+	ra, e, err := read_ico(r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, e.size)
+	if _, err := ra.ReadAt(data, e.offset); err != nil {
+		return nil, fmt.Errorf("Failed to read image from ICO image: %w", err)
+	}
+	if bytes.HasPrefix(data, []byte(png_signature)) {
+		return png.Decode(bytes.NewReader(data))
+	}
+	return decode_dib(data)
+}
+
+func DecodeICOConfig(r io.Reader) (image.Config, error) {
+	_, e, err := read_ico(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: e.Width, Height: e.Height}, nil
+}
+
+func init() {
+	image.RegisterFormat("ico", ico_magic, DecodeICO, DecodeICOConfig)
+	image.RegisterFormat("ico", cur_magic, DecodeICO, DecodeICOConfig)
+}
@@ -0,0 +1,113 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+var _ = fmt.Print
+
+// An 8 bit paletted bitmap with a two color palette, using the first color
+// on the left half and the second on the right half, with the bottom row
+// transparent in the AND mask
+func ico_dib(size int, c0, c1 color.NRGBA) []byte {
+	var b bytes.Buffer
+	w := func(x any) { binary.Write(&b, binary.LittleEndian, x) }
+	w(uint32(dib_info_size))
+	w(int32(size))
+	w(int32(2 * size))
+	w(uint16(1))
+	w(uint16(8))
+	w(uint32(0))
+	b.Write(make([]byte, 12))
+	w(uint32(2))
+	w(uint32(0))
+	for _, c := range []color.NRGBA{c0, c1} {
+		b.Write([]byte{c.B, c.G, c.R, 0})
+	}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if x < size/2 {
+				b.WriteByte(0)
+			} else {
+				b.WriteByte(1)
+			}
+		}
+	}
+	mask_stride := (size + 31) / 32 * 4
+	// rows are bottom up, so the first row of the mask is the bottom row
+	b.Write(bytes.Repeat([]byte{0xff}, mask_stride))
+	b.Write(make([]byte, mask_stride*(size-1)))
+	return b.Bytes()
+}
+
+func ico_file(images ...[]byte) []byte {
+	var b bytes.Buffer
+	w := func(x any) { binary.Write(&b, binary.LittleEndian, x) }
+	b.WriteString(ico_magic)
+	w(uint16(len(images)))
+	offset := 6 + 16*len(images)
+	for _, data := range images {
+		// the sizes in the directory are deliberately wrong, they are read from the image data
+		b.Write([]byte{0, 0, 0, 0})
+		w(uint16(1))
+		w(uint16(32))
+		w(uint32(len(data)))
+		w(uint32(offset))
+		offset += len(data)
+	}
+	for _, data := range images {
+		b.Write(data)
+	}
+	return b.Bytes()
+}
+
+func TestICO(t *testing.T) {
+	red, blue := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}
+	large := image.NewNRGBA(image.Rect(0, 0, 48, 48))
+	large.SetNRGBA(3, 3, blue)
+	var p bytes.Buffer
+	png.Encode(&p, large)
+	data := ico_file(ico_dib(16, red, blue), p.Bytes(), ico_dib(32, blue, red))
+
+	entries, err := ICOEntries(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Width != 16 || entries[1].Height != 48 || entries[2].Width != 32 || entries[2].BitsPerPixel != 8 {
+		t.Fatalf("Incorrect ICO entries: %#v", entries)
+	}
+	c, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != "ico" || c.Width != 48 {
+		t.Fatalf("Incorrect config for ICO image: %v %s %v", c, format, err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := color.NRGBAModel.Convert(img.At(3, 3)); c != blue {
+		t.Fatalf("Largest image in ICO image not decoded: %v", c)
+	}
+	single, err := ICOWithEntry(bytes.NewReader(data), entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = DecodeICO(bytes.NewReader(single))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := img.(*image.NRGBA)
+	if n.Bounds().Dx() != 16 || n.NRGBAAt(0, 0) != red || n.NRGBAAt(15, 0) != blue {
+		t.Fatalf("Incorrect pixels in ICO bitmap: %v %v %v", n.Bounds(), n.NRGBAAt(0, 0), n.NRGBAAt(15, 0))
+	}
+	if n.NRGBAAt(0, 15).A != 0 || n.NRGBAAt(0, 14).A != 255 {
+		t.Fatalf("AND mask of ICO bitmap not applied")
+	}
+}
@@ -0,0 +1,107 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+var _ = fmt.Print
+
+// The input range of the red, green and blue channels that is stretched to
+// the full range from 0 to 255
+type Levels struct {
+	Low, High [3]uint8
+}
+
+func luminance(r, g, b uint8) uint8 {
+	return uint8((299*uint32(r) + 587*uint32(g) + 114*uint32(b) + 500) / 1000)
+}
+
+// Return the value below which the clip fraction of the values in the
+// histogram lie, counting from the bottom if low is true else from the top
+func histogram_bound(hist *[256]uint64, total uint64, clip float64, low bool) uint8 {
+	limit := uint64(clip * float64(total))
+	var seen uint64
+	for i := 0; i < 256; i++ {
+		idx := i
+		if !low {
+			idx = 255 - i
+		}
+		seen += hist[idx]
+		if seen > limit {
+			return uint8(idx)
+		}
+	}
+	if low {
+		return 0
+	}
+	return 255
+}
+
+// Find the levels that stretch the histogram of img so that its darkest
+// pixels become black and its brightest white, ignoring fully transparent
+// pixels. clip is the fraction of pixels at each end of the histogram to
+// ignore, which makes the result less sensitive to outliers. When per_channel
+// is true, each color channel is stretched independently, which can change
+// the colors of the image, otherwise the luminance is used for all channels.
+func ComputeLevels(img image.Image, per_channel bool, clip float64) (ans Levels) {
+	n := imaging.Clone(img)
+	var hists [3][256]uint64
+	var total uint64
+	for i := 0; i+3 < len(n.Pix); i += 4 {
+		if n.Pix[i+3] == 0 {
+			continue
+		}
+		total++
+		if per_channel {
+			for c := 0; c < 3; c++ {
+				hists[c][n.Pix[i+c]]++
+			}
+		} else {
+			hists[0][luminance(n.Pix[i], n.Pix[i+1], n.Pix[i+2])]++
+		}
+	}
+	for c := 0; c < 3; c++ {
+		h := &hists[c]
+		if !per_channel {
+			h = &hists[0]
+		}
+		ans.Low[c], ans.High[c] = 0, 255
+		if total > 0 {
+			ans.Low[c], ans.High[c] = histogram_bound(h, total, clip, true), histogram_bound(h, total, clip, false)
+		}
+	}
+	return
+}
+
+// Return a copy of img with its levels stretched. Channels whose range is
+// empty are left unchanged.
+func (self Levels) Apply(img image.Image) *image.NRGBA {
+	ans := imaging.Clone(img)
+	var maps [3][256]uint8
+	for c := 0; c < 3; c++ {
+		lo, hi := int(self.Low[c]), int(self.High[c])
+		for v := 0; v < 256; v++ {
+			switch {
+			case hi <= lo:
+				maps[c][v] = uint8(v)
+			case v <= lo:
+				maps[c][v] = 0
+			case v >= hi:
+				maps[c][v] = 255
+			default:
+				maps[c][v] = uint8(((v-lo)*255 + (hi-lo)/2) / (hi - lo))
+			}
+		}
+	}
+	for i := 0; i+3 < len(ans.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			ans.Pix[i+c] = maps[c][ans.Pix[i+c]]
+		}
+	}
+	return ans
+}
@@ -0,0 +1,51 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestLevels(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 1))
+	for x := 0; x < 100; x++ {
+		v := uint8(50 + x)
+		img.SetNRGBA(x, 0, color.NRGBA{v, v / 2, v, 255})
+	}
+	// an outlier that is ignored when clipping and a transparent pixel that is always ignored
+	img.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0, 0, 0})
+
+	l := ComputeLevels(img, true, 0)
+	if l.Low != [3]uint8{52, 26, 52} || l.High != [3]uint8{255, 255, 255} {
+		t.Fatalf("Incorrect per channel levels: %v", l)
+	}
+	l = ComputeLevels(img, true, 0.02)
+	if l.Low != [3]uint8{53, 26, 53} || l.High != [3]uint8{149, 74, 149} {
+		t.Fatalf("Incorrect clipped per channel levels: %v", l)
+	}
+	s := l.Apply(img)
+	if c := s.NRGBAAt(2, 0); c.R != 0 || c.G != 0 || c.A != 255 {
+		t.Fatalf("Darkest pixel not stretched to black: %v", c)
+	}
+	if c := s.NRGBAAt(99, 0); c.R != 255 || c.G != 255 || c.B != 255 {
+		t.Fatalf("Brightest pixel not stretched to white: %v", c)
+	}
+	l = ComputeLevels(img, false, 0.02)
+	if l.Low[0] != l.Low[1] || l.Low[1] != l.Low[2] || l.High[0] != l.High[2] {
+		t.Fatalf("Luminance levels are not the same for all channels: %v", l)
+	}
+	// a flat image is unchanged
+	flat := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for i := range flat.Pix {
+		flat.Pix[i] = 100
+	}
+	if s := ComputeLevels(flat, false, 0).Apply(flat); s.Pix[0] != 100 {
+		t.Fatalf("Flat image was changed: %v", s.Pix[:4])
+	}
+}
@@ -4,6 +4,7 @@ package images
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,11 +12,13 @@ import (
 	"image/color"
 	"image/gif"
 	"io"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"kitty/tools/utils"
 	"kitty/tools/utils/shm"
@@ -28,12 +31,17 @@ var _ = fmt.Print
 
 const TempTemplate = "kitty-tty-graphics-protocol-*"
 
+// The directory in which to create temporary files. When empty, files that
+// benefit from being in RAM are created in the shared memory directory, if
+// any, and others in the default temporary directory.
+var TempDir string
+
 func CreateTemp() (*os.File, error) {
-	return os.CreateTemp("", TempTemplate)
+	return os.CreateTemp(TempDir, TempTemplate)
 }
 
 func CreateTempInRAM() (*os.File, error) {
-	if shm.SHM_DIR != "" {
+	if shm.SHM_DIR != "" && TempDir == "" {
 		f, err := os.CreateTemp(shm.SHM_DIR, TempTemplate)
 		if err == nil {
 			return f, err
@@ -183,13 +191,13 @@ func MakeTempDir(template string) (ans string, err error) {
 	if template == "" {
 		template = "kitty-img-*"
 	}
-	if shm.SHM_DIR != "" {
+	if shm.SHM_DIR != "" && TempDir == "" {
 		ans, err = os.MkdirTemp(shm.SHM_DIR, template)
 		if err == nil {
 			return
 		}
 	}
-	return os.MkdirTemp("", template)
+	return os.MkdirTemp(TempDir, template)
 }
 
 func check_resize(frame *ImageFrame, filename string) error {
@@ -268,11 +276,20 @@ var MagickExe = (&utils.Once[string]{Run: func() string {
 	return utils.FindExe("magick")
 }}).Get
 
+// Return true if ImageMagick is installed, either version 7, with the magick
+// command, or version 6, with its separate commands
+var HaveMagick = (&utils.Once[bool]{Run: func() bool {
+	return MagickExe() != "magick" || utils.Which("identify") != ""
+}}).Get
+
+// ImageMagick is killed when this context is cancelled
+var MagickContext = context.Background()
+
 func RunMagick(path string, cmd []string) ([]byte, error) {
 	if MagickExe() != "magick" {
 		cmd = append([]string{MagickExe()}, cmd...)
 	}
-	c := exec.Command(cmd[0], cmd[1:]...)
+	c := exec.CommandContext(MagickContext, cmd[0], cmd[1:]...)
 	output, err := c.Output()
 	if err != nil {
 		var exit_err *exec.ExitError
@@ -428,6 +445,28 @@ type RenderOptions struct {
 	ResizeTo             image.Point
 	OnlyFirstFrame       bool
 	TempfilenameTemplate string
+	// One of average, max or min to blend all frames into a single image
+	FlattenAnimation string
+	// The ImageMagick filter to use when resizing, uses the ImageMagick default if empty
+	ResizeFilter string
+	// Only render the frames of an animation that start before this much time has elapsed, zero for no limit
+	MaxDuration time.Duration
+	// Stretch the levels of the image, one of luminance or per-channel, or empty to leave them unchanged
+	Normalize string
+	// The percentage of the darkest and brightest pixels to ignore when stretching the levels
+	NormalizeClip float64
+	// Adjust the tones of the image after stretching the levels, if not nil
+	Tone *ToneAdjustment
+	// Crop the image to this rectangle before resizing, if not empty
+	Crop image.Rectangle
+	// Rotate the image clockwise by this many degrees after cropping, filling
+	// the corners with the background
+	Rotate float64
+	// Pad the image to this size after resizing, if non-zero, with the image
+	// placed at PadOffset. The padding uses the RemoveAlpha color or is transparent.
+	PadTo, PadOffset image.Point
+	// Do not rotate the image as specified by its EXIF orientation
+	IgnoreOrientation bool
 }
 
 func RenderWithMagick(path string, ro *RenderOptions, frames []IdentifyRecord) (ans []*ImageFrame, fmap map[int]string, err error) {
@@ -448,28 +487,82 @@ func RenderWithMagick(path string, ro *RenderOptions, frames []IdentifyRecord) (
 	} else {
 		cmd = append(cmd, "-background", "none")
 	}
-	if ro.Flip {
-		cmd = append(cmd, "-flip")
-	}
-	if ro.Flop {
-		cmd = append(cmd, "-flop")
-	}
 	cpath := path
 	if ro.OnlyFirstFrame {
 		cpath += "[0]"
+	} else if len(frames) > 1 && ro.MaxDuration > 0 {
+		gaps := make([]int, len(frames))
+		for i, frame := range frames {
+			gaps[i] = frame.Gap
+		}
+		if n := FramesWithinDuration(gaps, ro.MaxDuration); n < len(frames) {
+			cpath += fmt.Sprintf("[0-%d]", n-1)
+			frames = frames[:n]
+		}
 	}
 	has_multiple_frames := len(frames) > 1
 	get_multiple_frames := has_multiple_frames && !ro.OnlyFirstFrame
-	cmd = append(cmd, "--", cpath, "-auto-orient")
-	if ro.ResizeTo.X > 0 {
-		rcmd := []string{"-resize", fmt.Sprintf("%dx%d!", ro.ResizeTo.X, ro.ResizeTo.Y)}
-		if get_multiple_frames {
-			cmd = append(cmd, "-coalesce")
-			cmd = append(cmd, rcmd...)
-			cmd = append(cmd, "-deconstruct")
+	cmd = append(cmd, "--", cpath)
+	if !ro.IgnoreOrientation {
+		cmd = append(cmd, "-auto-orient")
+	}
+	if ro.Normalize != "" {
+		stretch := []string{"-contrast-stretch", fmt.Sprintf("%g%%x%g%%", ro.NormalizeClip, ro.NormalizeClip)}
+		if ro.Normalize == "per-channel" {
+			for _, c := range []string{"R", "G", "B"} {
+				cmd = append(cmd, "-channel", c)
+				cmd = append(cmd, stretch...)
+			}
+			cmd = append(cmd, "+channel")
 		} else {
-			cmd = append(cmd, rcmd...)
+			cmd = append(cmd, stretch...)
+		}
+	}
+	if ro.Tone != nil {
+		// gamma and brightness in linear light, then contrast in sRGB
+		slope := ro.Tone.ContrastSlope()
+		cmd = append(cmd, "-colorspace", "RGB", "-gamma", fmt.Sprintf("%g", ro.Tone.Gamma), "-evaluate", "multiply", fmt.Sprintf("%g", 1+ro.Tone.Brightness/100),
+			"-colorspace", "sRGB", "-function", "polynomial", fmt.Sprintf("%g,%g", slope, 0.5-slope/2))
+	}
+	if get_multiple_frames && ro.FlattenAnimation != "" {
+		op := map[string]string{"average": "mean", "max": "max", "min": "min"}[ro.FlattenAnimation]
+		if op == "" {
+			err = fmt.Errorf("Unknown mode for flattening frames: %s", ro.FlattenAnimation)
+			return
+		}
+		cmd = append(cmd, "-coalesce", "-evaluate-sequence", op)
+		frames, get_multiple_frames = frames[:1], false
+	}
+	// crop and resize complete frames, then recreate the minimal frames
+	coalesce := get_multiple_frames && (!ro.Crop.Empty() || ro.Rotate != 0 || ro.ResizeTo.X > 0 || ro.PadTo.X > 0)
+	if coalesce {
+		cmd = append(cmd, "-coalesce")
+	}
+	if !ro.Crop.Empty() {
+		cmd = append(cmd, "-crop", fmt.Sprintf("%dx%d+%d+%d", ro.Crop.Dx(), ro.Crop.Dy(), ro.Crop.Min.X, ro.Crop.Min.Y), "+repage")
+	}
+	if ro.Rotate != 0 {
+		cmd = append(cmd, "-rotate", fmt.Sprintf("%g", ro.Rotate), "+repage")
+	}
+	// mirror after cropping and rotating, as the crop is in the coordinates of the unmirrored image
+	if ro.Flip {
+		cmd = append(cmd, "-flip")
+	}
+	if ro.Flop {
+		cmd = append(cmd, "-flop")
+	}
+	if ro.ResizeTo.X > 0 {
+		if ro.ResizeFilter != "" {
+			cmd = append(cmd, "-filter", ro.ResizeFilter)
 		}
+		cmd = append(cmd, "-resize", fmt.Sprintf("%dx%d!", ro.ResizeTo.X, ro.ResizeTo.Y))
+	}
+	if ro.PadTo.X > 0 {
+		// a negative offset moves the image right and down within the extended area
+		cmd = append(cmd, "-extent", fmt.Sprintf("%dx%d-%d-%d", ro.PadTo.X, ro.PadTo.Y, ro.PadOffset.X, ro.PadOffset.Y))
+	}
+	if coalesce {
+		cmd = append(cmd, "-deconstruct")
 	}
 	cmd = append(cmd, "-depth", "8", "-set", "filename:f", "%w-%h-%g-%p")
 	if get_multiple_frames {
@@ -481,8 +574,10 @@ func RenderWithMagick(path string, ro *RenderOptions, frames []IdentifyRecord) (
 		return
 	}
 	defer os.RemoveAll(tdir)
+	// padding and the corners of images rotated by angles other than right angles are transparent
+	transparent_padding := (ro.PadTo.X > 0 || math.Mod(ro.Rotate, 90) != 0) && ro.RemoveAlpha == nil
 	mode := "rgba"
-	if frames[0].Is_opaque {
+	if frames[0].Is_opaque && !transparent_padding {
 		mode = "rgb"
 	}
 	cmd = append(cmd, filepath.Join(tdir, "im-%[filename:f]."+mode))
@@ -550,7 +645,7 @@ func RenderWithMagick(path string, ro *RenderOptions, frames []IdentifyRecord) (
 		df.Close()
 		fmap[index+1] = df.Name()
 		frame := ImageFrame{
-			Number: index + 1, Width: width, Height: height, Left: x, Top: y, Is_opaque: identify_data.Is_opaque,
+			Number: index + 1, Width: width, Height: height, Left: x, Top: y, Is_opaque: identify_data.Is_opaque && !transparent_padding,
 		}
 		frame.set_delay(min_gap, identify_data.Gap)
 		err = check_resize(&frame, df.Name())
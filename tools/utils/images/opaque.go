@@ -18,7 +18,7 @@ func IsOpaque(img image.Image) bool {
 	case *image.NRGBA:
 		return img.(*image.NRGBA).Opaque()
 	case *image.NRGBA64:
-		return img.(*image.NRGBA).Opaque()
+		return img.(*image.NRGBA64).Opaque()
 	case *image.Alpha:
 		return img.(*image.Alpha).Opaque()
 	case *image.Alpha16:
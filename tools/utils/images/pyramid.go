@@ -0,0 +1,159 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"io"
+
+	"kitty/tools/utils"
+
+	"golang.org/x/exp/slices"
+)
+
+var _ = fmt.Print
+
+const (
+	tiff_new_subfile_type_tag = 0xfe
+	tiff_image_width_tag      = 0x100
+	tiff_image_length_tag     = 0x101
+	// NewSubfileType bits indicating the IFD is a reduced resolution
+	// version of another image or a transparency mask
+	tiff_subfile_reduced = 1
+	tiff_subfile_mask    = 4
+)
+
+// A single resolution level in a multi-resolution (pyramid) TIFF
+type TIFFLevel struct {
+	Width, Height int
+	ifd_offset    int64
+}
+
+// Return the resolution levels in a TIFF file, largest first. Levels are
+// either stored as a chain of IFDs or as SubIFDs of the first IFD. A TIFF
+// that is not a pyramid has only a single level.
+func TIFFLevels(r io.ReaderAt) (ans []TIFFLevel, err error) {
+	t, err := parse_tiff_structure(r)
+	if err != nil {
+		return nil, err
+	}
+	visited := make(map[int64]bool)
+	add := func(offset int64) *ifd {
+		if visited[offset] || len(visited) > 256 {
+			return nil
+		}
+		visited[offset] = true
+		d, err := t.read_ifd(offset)
+		if err != nil {
+			return nil
+		}
+		if e, found := d.entries[tiff_new_subfile_type_tag]; found {
+			if v, ok := t.uint(e); ok && v&tiff_subfile_mask != 0 {
+				return d
+			}
+		}
+		w, ok1 := t.uint(d.entries[tiff_image_width_tag])
+		h, ok2 := t.uint(d.entries[tiff_image_length_tag])
+		if ok1 && ok2 && w > 0 && h > 0 {
+			ans = append(ans, TIFFLevel{Width: int(w), Height: int(h), ifd_offset: offset})
+		}
+		return d
+	}
+	first := add(t.first_ifd)
+	if first == nil {
+		return nil, fmt.Errorf("Failed to read the first IFD of the TIFF file")
+	}
+	if e, found := first.entries[tiff_sub_ifds_tag]; found {
+		if subs, err := t.uints(e); err == nil {
+			for _, s := range subs {
+				add(int64(s))
+			}
+		}
+	}
+	for next := first.next; next > 0; {
+		d := add(next)
+		if d == nil {
+			break
+		}
+		next = d.next
+	}
+	if len(ans) == 0 {
+		return nil, fmt.Errorf("The TIFF file contains no images with valid sizes")
+	}
+	// only levels with the same aspect ratio as the full resolution image
+	// are part of the pyramid, other IFDs are thumbnails, labels, etc.
+	full := ans[0]
+	levels := ans[:1]
+	for _, l := range ans[1:] {
+		skew := l.Width*full.Height - l.Height*full.Width
+		if skew < 0 {
+			skew = -skew
+		}
+		if l.Width < full.Width && l.Height < full.Height && skew <= utils.Max(full.Width, full.Height) {
+			levels = append(levels, l)
+		}
+	}
+	slices.SortStableFunc(levels, func(a, b TIFFLevel) bool { return a.Width > b.Width })
+	return levels, nil
+}
+
+// Return the pages of a multi-page TIFF file, the images in its chain of IFDs
+// that are neither reduced resolution versions of other images nor masks.
+// Pages can be passed to TIFFWithLevel like levels.
+func TIFFPages(r io.ReaderAt) (ans []TIFFLevel, err error) {
+	t, err := parse_tiff_structure(r)
+	if err != nil {
+		return nil, err
+	}
+	visited := make(map[int64]bool)
+	for offset := t.first_ifd; offset > 0 && !visited[offset] && len(visited) < 4096; {
+		visited[offset] = true
+		d, err := t.read_ifd(offset)
+		if err != nil {
+			if len(ans) == 0 {
+				return nil, err
+			}
+			break
+		}
+		subfile_type := uint64(0)
+		if e, found := d.entries[tiff_new_subfile_type_tag]; found {
+			subfile_type, _ = t.uint(e)
+		}
+		w, ok1 := t.uint(d.entries[tiff_image_width_tag])
+		h, ok2 := t.uint(d.entries[tiff_image_length_tag])
+		if ok1 && ok2 && w > 0 && h > 0 && subfile_type&(tiff_subfile_reduced|tiff_subfile_mask) == 0 {
+			ans = append(ans, TIFFLevel{Width: int(w), Height: int(h), ifd_offset: offset})
+		}
+		offset = d.next
+	}
+	return
+}
+
+type tiff_with_first_ifd struct {
+	r      io.ReaderAt
+	header [8]byte
+}
+
+func (self *tiff_with_first_ifd) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = self.r.ReadAt(p, off)
+	if off < int64(len(self.header)) && n > 0 {
+		copy(p[:n], self.header[off:])
+	}
+	return
+}
+
+// Return a reader for a TIFF file of the specified size that has the
+// specified level as its first image, so that decoders, which only decode
+// the first image, decode that level
+func TIFFWithLevel(r io.ReaderAt, size int64, level TIFFLevel) (*io.SectionReader, error) {
+	t, err := parse_tiff_structure(r)
+	if err != nil {
+		return nil, err
+	}
+	ans := tiff_with_first_ifd{r: r}
+	if _, err = r.ReadAt(ans.header[:], 0); err != nil {
+		return nil, err
+	}
+	t.order.PutUint32(ans.header[4:], uint32(level.ifd_offset))
+	return io.NewSectionReader(&ans, 0, size), nil
+}
@@ -0,0 +1,117 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+var _ = fmt.Print
+
+// Create a TIFF with uncompressed grayscale levels of the specified sizes,
+// stored as a chain of IFDs, each filled with the value 10 * (level + 1)
+func pyramid_tiff(sizes ...image.Point) []byte {
+	order := binary.LittleEndian
+	const num_entries = 9
+	ifd_size := 2 + num_entries*12 + 4
+	data_offsets := make([]int, len(sizes))
+	pos := 8
+	for i, sz := range sizes {
+		data_offsets[i] = pos
+		pos += sz.X * sz.Y
+	}
+	ifd_start := pos
+	b := bytes.Buffer{}
+	w := func(x any) { binary.Write(&b, order, x) }
+	b.WriteString("II*\x00")
+	w(uint32(ifd_start))
+	for i, sz := range sizes {
+		b.Write(bytes.Repeat([]byte{byte(10 * (i + 1))}, sz.X*sz.Y))
+	}
+	for i, sz := range sizes {
+		w(uint16(num_entries))
+		for _, e := range [][3]uint32{
+			{tiff_image_width_tag, tiff_long, uint32(sz.X)}, {tiff_image_length_tag, tiff_long, uint32(sz.Y)},
+			{0x102, tiff_short, 8}, {tiff_compression_tag, tiff_short, 1}, {0x106, tiff_short, 1},
+			{tiff_strip_offsets_tag, tiff_long, uint32(data_offsets[i])}, {0x115, tiff_short, 1},
+			{0x116, tiff_long, uint32(sz.Y)}, {tiff_strip_byte_counts_tag, tiff_long, uint32(sz.X * sz.Y)},
+		} {
+			w(uint16(e[0]))
+			w(uint16(e[1]))
+			w(uint32(1))
+			if e[1] == tiff_short {
+				w(uint16(e[2]))
+				w(uint16(0))
+			} else {
+				w(e[2])
+			}
+		}
+		next := 0
+		if i < len(sizes)-1 {
+			next = ifd_start + (i+1)*ifd_size
+		}
+		w(uint32(next))
+	}
+	return b.Bytes()
+}
+
+func TestTIFFPyramid(t *testing.T) {
+	// the last IFD is a thumbnail with a different aspect ratio
+	data := pyramid_tiff(image.Pt(16, 8), image.Pt(8, 4), image.Pt(4, 2), image.Pt(3, 3))
+	levels, err := TIFFLevels(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 3 || levels[0].Width != 16 || levels[1].Width != 8 || levels[2].Height != 2 {
+		t.Fatalf("Incorrect pyramid levels: %#v", levels)
+	}
+	r, err := TIFFWithLevel(bytes.NewReader(data), int64(len(data)), levels[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := tiff.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 8 || img.Bounds().Dy() != 4 {
+		t.Fatalf("Decoded the wrong level: %v", img.Bounds())
+	}
+	if g := img.(*image.Gray).GrayAt(1, 1).Y; g != 20 {
+		t.Fatalf("Incorrect pixel value in decoded level: %d", g)
+	}
+}
+
+func TestTIFFLevelsWithoutImages(t *testing.T) {
+	if _, err := TIFFLevels(bytes.NewReader(pyramid_tiff(image.Pt(0, 0)))); err == nil {
+		t.Fatal("No error for a TIFF file with no images with valid sizes")
+	}
+}
+
+func TestTIFFPages(t *testing.T) {
+	// without NewSubfileType tags every image in the chain is a page
+	data := pyramid_tiff(image.Pt(16, 8), image.Pt(8, 4), image.Pt(3, 3))
+	pages, err := TIFFPages(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 3 || pages[2].Width != 3 {
+		t.Fatalf("Incorrect pages: %#v", pages)
+	}
+	r, err := TIFFWithLevel(bytes.NewReader(data), int64(len(data)), pages[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := tiff.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := img.(*image.Gray).GrayAt(1, 1).Y; g != 30 {
+		t.Fatalf("Incorrect pixel value in decoded page: %d", g)
+	}
+}
@@ -0,0 +1,90 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"image/jpeg"
+	"io"
+)
+
+var _ = fmt.Print
+
+const (
+	tiff_compression_tag                = 0x103
+	tiff_strip_offsets_tag              = 0x111
+	tiff_strip_byte_counts_tag          = 0x117
+	tiff_sub_ifds_tag                   = 0x14a
+	tiff_jpeg_interchange_format_tag    = 0x201
+	tiff_jpeg_interchange_format_length = 0x202
+	max_raw_preview_size                = 256 * 1024 * 1024
+)
+
+// Return the largest JPEG preview embedded in a TIFF based camera RAW file
+// such as DNG, CR2 or NEF. Losslessly compressed raw sensor data, which is
+// also stored as JPEG in some of these formats, is ignored.
+func RAWPreview(r io.ReaderAt) ([]byte, error) {
+	t, err := parse_tiff_structure(r)
+	if err != nil {
+		return nil, err
+	}
+	var best *io.SectionReader
+	best_area := 0
+	consider := func(offset, size uint64) {
+		if size < 4 || size > max_raw_preview_size {
+			return
+		}
+		sr := io.NewSectionReader(r, int64(offset), int64(size))
+		if c, err := jpeg.DecodeConfig(sr); err == nil && c.Width*c.Height > best_area {
+			best, best_area = sr, c.Width*c.Height
+		}
+	}
+	visited := make(map[int64]bool)
+	var walk func(offset int64, depth int)
+	walk = func(offset int64, depth int) {
+		for offset > 0 && depth < 4 && !visited[offset] && len(visited) < 64 {
+			visited[offset] = true
+			d, err := t.read_ifd(offset)
+			if err != nil {
+				return
+			}
+			if e, found := d.entries[tiff_jpeg_interchange_format_tag]; found {
+				if l, found := d.entries[tiff_jpeg_interchange_format_length]; found {
+					start, ok1 := t.uint(e)
+					size, ok2 := t.uint(l)
+					if ok1 && ok2 {
+						consider(start, size)
+					}
+				}
+			}
+			if e, found := d.entries[tiff_compression_tag]; found {
+				// old style (6) and new style (7) JPEG compression with the
+				// whole image in a single strip
+				if c, ok := t.uint(e); ok && (c == 6 || c == 7) {
+					offsets, err1 := t.uints(d.entries[tiff_strip_offsets_tag])
+					counts, err2 := t.uints(d.entries[tiff_strip_byte_counts_tag])
+					if err1 == nil && err2 == nil && len(offsets) == 1 && len(counts) == 1 {
+						consider(offsets[0], counts[0])
+					}
+				}
+			}
+			if e, found := d.entries[tiff_sub_ifds_tag]; found {
+				if subs, err := t.uints(e); err == nil {
+					for _, s := range subs {
+						walk(int64(s), depth+1)
+					}
+				}
+			}
+			offset = d.next
+		}
+	}
+	walk(t.first_ifd, 0)
+	if best == nil {
+		return nil, fmt.Errorf("No embedded JPEG preview found")
+	}
+	ans := make([]byte, best.Size())
+	if _, err = best.ReadAt(ans, 0); err != nil {
+		return nil, fmt.Errorf("Failed to read embedded JPEG preview: %w", err)
+	}
+	return ans, nil
+}
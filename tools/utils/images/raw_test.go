@@ -0,0 +1,61 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestRAWPreview(t *testing.T) {
+	encode := func(width, height int) []byte {
+		b := bytes.Buffer{}
+		jpeg.Encode(&b, image.NewGray(image.Rect(0, 0, width, height)), nil)
+		return b.Bytes()
+	}
+	small, large := encode(16, 8), encode(64, 32)
+	order := binary.LittleEndian
+	b := bytes.Buffer{}
+	w := func(x any) { binary.Write(&b, order, x) }
+	entry := func(tag, typ uint16, val uint32) {
+		w(tag)
+		w(typ)
+		w(uint32(1))
+		w(val)
+	}
+	// IFD0 at 8 with a thumbnail and a SubIFD at 46 that has the larger
+	// preview stored as a single JPEG compressed strip
+	ifd0_size, sub_ifd_size := uint32(2+3*12+4), uint32(2+3*12+4)
+	small_offset := 8 + ifd0_size + sub_ifd_size
+	large_offset := small_offset + uint32(len(small))
+	b.WriteString("II*\x00")
+	w(uint32(8))
+	w(uint16(3))
+	entry(tiff_sub_ifds_tag, tiff_long, 8+ifd0_size)
+	entry(tiff_jpeg_interchange_format_tag, tiff_long, small_offset)
+	entry(tiff_jpeg_interchange_format_length, tiff_long, uint32(len(small)))
+	w(uint32(0))
+	w(uint16(3))
+	entry(tiff_compression_tag, tiff_short, 7)
+	entry(tiff_strip_offsets_tag, tiff_long, large_offset)
+	entry(tiff_strip_byte_counts_tag, tiff_long, uint32(len(large)))
+	w(uint32(0))
+	b.Write(small)
+	b.Write(large)
+	preview, err := RAWPreview(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(preview, large) {
+		t.Fatalf("Did not get the largest preview, got %d bytes instead of %d", len(preview), len(large))
+	}
+	if _, err = RAWPreview(bytes.NewReader(b.Bytes()[:8+ifd0_size])); err == nil {
+		t.Fatalf("Got a preview from a file without preview data")
+	}
+}
@@ -0,0 +1,183 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+
+	"kitty/tools/utils"
+
+	"github.com/disintegration/imaging"
+)
+
+var _ = fmt.Print
+
+// A Renderer decodes images and prepares them for display, scaling them to
+// fit in the available area and converting their frames to RGB or RGBA pixel
+// data suitable for transmission with the graphics protocol. It does not
+// depend on the terminal, so programs can use it to display images
+// themselves. Only the formats supported natively by Go are rendered. icat
+// uses the methods of a Renderer configured from its command line options for
+// the individual steps of its own, more elaborate, rendering.
+type Renderer struct {
+	// The size of the area available to display images in, in pixels.
+	// Images larger than this are scaled down to fit. Zero means no limit.
+	AvailableWidth, AvailableHeight int
+	// Scale images smaller than the available area up to fill it
+	ScaleUp bool
+	// Never scale images down, images larger than the available area are
+	// displayed at their full size. Combined with ScaleUp, images are only
+	// scaled up if that makes them larger.
+	NoScaleDown bool
+	// Composite transparent images onto this color, nil to keep the transparency
+	RemoveAlpha *NRGBColor
+	// Mirror images about the horizontal axis (Flip) or the vertical axis (Flop)
+	Flip, Flop bool
+	// Do not rotate images as specified by their EXIF orientation
+	IgnoreOrientation bool
+	// Only render the first frame of animated images
+	OnlyFirstFrame bool
+}
+
+// Return the size at which an image of the specified size is displayed
+func (self *Renderer) ScaledSize(width, height int) (int, int) {
+	if width < 1 || height < 1 {
+		return width, height
+	}
+	orig_width, orig_height := width, height
+	aw, ah := self.AvailableWidth, self.AvailableHeight
+	if aw <= 0 {
+		aw = math.MaxInt32
+	}
+	if ah <= 0 {
+		ah = math.MaxInt32
+	}
+	if self.ScaleUp && self.AvailableWidth > 0 && width < aw {
+		r := float64(aw) / float64(width)
+		width, height = aw, int(r*float64(height))
+	}
+	width, height = FitImage(width, height, aw, ah)
+	if self.NoScaleDown && (width < orig_width || height < orig_height) {
+		return orig_width, orig_height
+	}
+	return width, height
+}
+
+// Decode a single frame image, the first frame of animated images
+func (self *Renderer) Decode(r io.Reader) (image.Image, error) {
+	return imaging.Decode(r)
+}
+
+// Rotate and mirror img as specified by its EXIF orientation, unless
+// IgnoreOrientation is set
+func (self *Renderer) ApplyOrientation(img image.Image, orientation int) image.Image {
+	if self.IgnoreOrientation {
+		return img
+	}
+	return ApplyOrientation(img, orientation)
+}
+
+// Paste img into dest, which must be an *image.NRGBA or an *NRGB, at pos,
+// compositing it onto RemoveAlpha, if set
+func (self *Renderer) Paste(ctx *Context, dest, img image.Image, pos image.Point) {
+	ctx.Paste(dest, img, pos, self.RemoveAlpha)
+}
+
+// Paste img into the center of dest, as for Paste()
+func (self *Renderer) PasteCenter(ctx *Context, dest, img image.Image) {
+	ctx.PasteCenter(dest, img, self.RemoveAlpha)
+}
+
+// Mirror the RGB or RGBA pixel data of a frame in place, as specified by
+// Flip and Flop
+func (self *Renderer) Mirror(ctx *Context, bytes_per_pixel, width, height int, pix []byte) {
+	if self.Flip {
+		ctx.FlipPixelsV(bytes_per_pixel, width, height, pix)
+	}
+	if self.Flop {
+		ctx.FlipPixelsH(bytes_per_pixel, width, height, pix)
+	}
+}
+
+// Convert a frame to RGB or RGBA pixel data, compositing it onto
+// RemoveAlpha and mirroring it as needed
+func (self *Renderer) finalize_frame(ctx *Context, f *ImageFrame, canvas_width, canvas_height int) {
+	dest_rect := image.Rect(0, 0, f.Width, f.Height)
+	bytes_per_pixel := 4
+	var pix []byte
+	if f.Is_opaque || self.RemoveAlpha != nil {
+		bytes_per_pixel = 3
+		rgb := NewNRGB(dest_rect)
+		self.PasteCenter(ctx, rgb, f.Img)
+		f.Img, pix, f.Is_opaque = rgb, rgb.Pix, true
+	} else {
+		rgba := image.NewNRGBA(dest_rect)
+		self.PasteCenter(ctx, rgba, f.Img)
+		f.Img, pix = rgba, rgba.Pix
+	}
+	self.Mirror(ctx, bytes_per_pixel, f.Width, f.Height, pix)
+	if self.Flip {
+		f.Top = utils.Max(0, canvas_height-f.Height-f.Top)
+	}
+	if self.Flop {
+		f.Left = utils.Max(0, canvas_width-f.Width-f.Left)
+	}
+}
+
+// Decode the image read from r and render its frames. The Width and Height
+// of the result are the size at which the image is displayed. Frames are
+// positioned within that area by their Left and Top and their pixel data is
+// available from ImageFrame.Data().
+func (self *Renderer) Render(r io.ReadSeeker) (ans *ImageData, err error) {
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		// needed to read the EXIF orientation
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		br := bytes.NewReader(data)
+		r, ra = br, br
+	}
+	c, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to identify image: %w", err)
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	ans = &ImageData{Format_uppercase: strings.ToUpper(format)}
+	if ans.Format_uppercase == "GIF" && !self.OnlyFirstFrame {
+		if err = open_native_gif(r, ans); err != nil {
+			return nil, fmt.Errorf("Failed to decode GIF image: %w", err)
+		}
+		ans.Width, ans.Height = c.Width, c.Height
+	} else {
+		img, err := self.Decode(r)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode image: %w", err)
+		}
+		img = self.ApplyOrientation(img, Orientation(ra, ans.Format_uppercase))
+		b := img.Bounds()
+		ans.Width, ans.Height = b.Dx(), b.Dy()
+		ans.Frames = []*ImageFrame{{Img: img, Width: b.Dx(), Height: b.Dy(), Number: 1, Is_opaque: IsOpaque(img)}}
+	}
+	if len(ans.Frames) == 0 {
+		return nil, fmt.Errorf("Image has no frames")
+	}
+	if neww, newh := self.ScaledSize(ans.Width, ans.Height); neww != ans.Width || newh != ans.Height {
+		x_frac, y_frac := float64(neww)/float64(ans.Width), float64(newh)/float64(ans.Height)
+		ans.Frames = utils.Map(func(f *ImageFrame) *ImageFrame { return f.Resize(x_frac, y_frac) }, ans.Frames)
+		ans.Width, ans.Height = neww, newh
+	}
+	ctx := Context{}
+	for _, f := range ans.Frames {
+		self.finalize_frame(&ctx, f, ans.Width, ans.Height)
+	}
+	return ans, nil
+}
@@ -0,0 +1,154 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestScaledSize(t *testing.T) {
+	// the image is 20x10
+	for _, tc := range []struct {
+		r                      Renderer
+		expected_w, expected_h int
+	}{
+		{Renderer{}, 20, 10},
+		{Renderer{AvailableWidth: 10, AvailableHeight: 100}, 10, 5},
+		{Renderer{AvailableWidth: 40, AvailableHeight: 100, ScaleUp: true}, 40, 20},
+		{Renderer{AvailableWidth: 40, AvailableHeight: 15, ScaleUp: true}, 30, 15},
+		{Renderer{AvailableWidth: 10, AvailableHeight: 100, NoScaleDown: true}, 20, 10},
+		{Renderer{AvailableWidth: 100, AvailableHeight: 5, NoScaleDown: true}, 20, 10},
+		{Renderer{AvailableWidth: 40, AvailableHeight: 100, NoScaleDown: true}, 20, 10},
+		// scaled up as far as the area allows
+		{Renderer{AvailableWidth: 40, AvailableHeight: 100, ScaleUp: true, NoScaleDown: true}, 40, 20},
+		{Renderer{AvailableWidth: 40, AvailableHeight: 15, ScaleUp: true, NoScaleDown: true}, 30, 15},
+		// fitting the area would shrink the image, so it is not scaled
+		{Renderer{AvailableWidth: 40, AvailableHeight: 5, ScaleUp: true, NoScaleDown: true}, 20, 10},
+		{Renderer{AvailableWidth: 10, AvailableHeight: 100, ScaleUp: true, NoScaleDown: true}, 20, 10},
+	} {
+		if w, h := tc.r.ScaledSize(20, 10); w != tc.expected_w || h != tc.expected_h {
+			t.Fatalf("Incorrect scaled size with %+v: %dx%d != %dx%d", tc.r, w, h, tc.expected_w, tc.expected_h)
+		}
+	}
+}
+
+func TestRenderer(t *testing.T) {
+	// opaque red on the left, transparent on the right
+	img := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	render := func(r Renderer) *ImageData {
+		ans, err := r.Render(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ans
+	}
+
+	d := render(Renderer{})
+	if d.Width != 20 || d.Height != 10 || d.Format_uppercase != "PNG" || len(d.Frames) != 1 || d.Frames[0].Is_opaque {
+		t.Fatalf("Incorrect rendering: %dx%d %s opaque: %v", d.Width, d.Height, d.Format_uppercase, d.Frames[0].Is_opaque)
+	}
+	if len(d.Frames[0].Data()) != 20*10*4 {
+		t.Fatalf("Incorrect amount of RGBA data: %d", len(d.Frames[0].Data()))
+	}
+
+	d = render(Renderer{AvailableWidth: 10, AvailableHeight: 100})
+	if d.Width != 10 || d.Height != 5 || d.Frames[0].Width != 10 || d.Frames[0].Height != 5 {
+		t.Fatalf("Image not scaled down to fit: %dx%d", d.Width, d.Height)
+	}
+	d = render(Renderer{AvailableWidth: 40, AvailableHeight: 100, ScaleUp: true})
+	if d.Width != 40 || d.Height != 20 {
+		t.Fatalf("Image not scaled up to fill: %dx%d", d.Width, d.Height)
+	}
+
+	d = render(Renderer{RemoveAlpha: &NRGBColor{0, 0, 255}, Flop: true})
+	f := d.Frames[0]
+	if !f.Is_opaque {
+		t.Fatalf("Frame with alpha removed is not opaque")
+	}
+	pix := f.Data()
+	if len(pix) != 20*10*3 {
+		t.Fatalf("Incorrect amount of RGB data: %d", len(pix))
+	}
+	if left, right := pix[:3], pix[len(pix)-3:]; !bytes.Equal(left, []byte{0, 0, 255}) || !bytes.Equal(right, []byte{255, 0, 0}) {
+		t.Fatalf("Incorrect pixels after removing alpha and mirroring: %v %v", left, right)
+	}
+
+	// an animation with a smaller second frame
+	p := color.Palette{color.Black, color.White}
+	g := gif.GIF{
+		Image:    []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 8, 8), p), image.NewPaletted(image.Rect(4, 4, 8, 8), p)},
+		Delay:    []int{5, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone},
+	}
+	buf.Reset()
+	if err := gif.EncodeAll(&buf, &g); err != nil {
+		t.Fatal(err)
+	}
+	d = render(Renderer{AvailableWidth: 4, Flip: true})
+	if d.Width != 4 || d.Height != 4 || len(d.Frames) != 2 {
+		t.Fatalf("Incorrect animation rendering: %dx%d with %d frames", d.Width, d.Height, len(d.Frames))
+	}
+	if f := d.Frames[1]; f.Width != 2 || f.Left != 2 || f.Top != 0 || f.Delay_ms != 100 || f.Compose_onto != 1 {
+		t.Fatalf("Incorrect second frame: %+v", *f)
+	}
+	if d = render(Renderer{OnlyFirstFrame: true}); len(d.Frames) != 1 {
+		t.Fatalf("Incorrect number of frames: %d", len(d.Frames))
+	}
+
+	// mirroring a non-square animation moves a frame in the top right corner
+	// to the bottom left
+	g = gif.GIF{
+		Image:    []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 8, 4), p), image.NewPaletted(image.Rect(6, 0, 8, 2), p)},
+		Delay:    []int{5, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone},
+	}
+	g.Image[1].SetColorIndex(7, 0, 1)
+	buf.Reset()
+	if err := gif.EncodeAll(&buf, &g); err != nil {
+		t.Fatal(err)
+	}
+	d = render(Renderer{Flip: true, Flop: true})
+	f = d.Frames[1]
+	if d.Width != 8 || d.Height != 4 || f.Width != 2 || f.Height != 2 || f.Left != 0 || f.Top != 2 {
+		t.Fatalf("Incorrect mirrored frame: %+v", *f)
+	}
+	// the white pixel in the top right corner of the frame is now in its bottom left corner
+	pix = f.Data()
+	if bpp := len(pix) / 4; pix[2*bpp] != 255 || pix[0] != 0 {
+		t.Fatalf("Incorrect pixels in mirrored frame: %v", pix)
+	}
+}
+
+func TestRendererSteps(t *testing.T) {
+	ctx := Context{}
+	r := Renderer{RemoveAlpha: &NRGBColor{0, 0, 255}, Flop: true, IgnoreOrientation: true}
+	// transparent on the left, opaque red on the right
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(1, 0, color.NRGBA{255, 0, 0, 255})
+	if r.ApplyOrientation(img, 6) != image.Image(img) {
+		t.Fatalf("The orientation was applied despite IgnoreOrientation")
+	}
+	dest := NewNRGB(image.Rect(0, 0, 2, 1))
+	r.PasteCenter(&ctx, dest, img)
+	r.Mirror(&ctx, 3, 2, 1, dest.Pix)
+	if expected := []uint8{255, 0, 0, 0, 0, 255}; !bytes.Equal(dest.Pix, expected) {
+		t.Fatalf("Incorrect pixels after compositing and mirroring: %v != %v", dest.Pix, expected)
+	}
+}
@@ -0,0 +1,219 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+
+	"kitty/tools/utils"
+
+	"github.com/disintegration/imaging"
+)
+
+var _ = fmt.Print
+
+// The maximum number of colors in a sixel palette supported by most terminals
+const MaxSixelColors = 256
+
+// Images are downsampled to fit within this size to compute the palette, for speed
+const sixel_palette_sample_size = 256
+
+// Maps colors to the nearest entry in a palette, caching the results for
+// colors with the same five most significant bits per channel
+type palette_mapper struct {
+	palette []NRGBColor
+	cache   [1 << 15]int16
+}
+
+func new_palette_mapper(palette []NRGBColor) *palette_mapper {
+	ans := palette_mapper{palette: palette}
+	for i := range ans.cache {
+		ans.cache[i] = -1
+	}
+	return &ans
+}
+
+func (self *palette_mapper) nearest(r, g, b uint8) int {
+	key := int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+	if ans := self.cache[key]; ans > -1 {
+		return int(ans)
+	}
+	ans, best := 0, -1
+	for i, c := range self.palette {
+		dr, dg, db := int(c.R)-int(r), int(c.G)-int(g), int(c.B)-int(b)
+		// weighted for the sensitivity of the eye to each primary
+		if d := 2*dr*dr + 4*dg*dg + 3*db*db; best < 0 || d < best {
+			ans, best = i, d
+		}
+	}
+	self.cache[key] = int16(ans)
+	return ans
+}
+
+func clamp_to_uint8(v float32) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// Map the pixels of img to the palette, returning the palette index of each
+// pixel, with -1 for transparent pixels
+func map_to_palette(img *image.NRGBA, palette []NRGBColor, dither DitherMethod, strength float32) []int16 {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	ans := make([]int16, width*height)
+	m := new_palette_mapper(palette)
+	if strength <= 0 {
+		dither = NoDither
+	}
+	var current, next []float32
+	if dither == FloydSteinbergDither {
+		// errors for the current and next rows, with a pixel of padding at each end
+		current, next = make([]float32, (width+2)*3), make([]float32, (width+2)*3)
+	}
+	// the spread of the ordered dither threshold, the typical distance between palette colors
+	const ordered_spread = 48
+	var v [3]float32
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < width; x++ {
+			p := row[x*4 : x*4+4]
+			if p[3] < 128 {
+				ans[y*width+x] = -1
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				v[c] = float32(p[c])
+				switch dither {
+				case OrderedDither:
+					v[c] += ((bayer_matrix[y&7][x&7]+0.5)/64 - 0.5) * ordered_spread * strength
+				case FloydSteinbergDither:
+					v[c] += current[(x+1)*3+c]
+				}
+			}
+			idx := m.nearest(clamp_to_uint8(v[0]), clamp_to_uint8(v[1]), clamp_to_uint8(v[2]))
+			ans[y*width+x] = int16(idx)
+			if dither == FloydSteinbergDither {
+				chosen := [3]uint8{palette[idx].R, palette[idx].G, palette[idx].B}
+				for c := 0; c < 3; c++ {
+					e := (x+1)*3 + c
+					err := (v[c] - float32(chosen[c])) * strength
+					current[e+3] += err * 7 / 16
+					next[e-3] += err * 3 / 16
+					next[e] += err * 5 / 16
+					next[e+3] += err * 1 / 16
+				}
+			}
+		}
+		if dither == FloydSteinbergDither {
+			current, next = next, current
+			for i := range next {
+				next[i] = 0
+			}
+		}
+	}
+	return ans
+}
+
+// Write a run of the same sixel character, using the repeat introducer for
+// long runs
+func write_sixel_run(w *bufio.Writer, ch byte, count int) {
+	if count > 3 {
+		w.WriteByte('!')
+		w.WriteString(strconv.Itoa(count))
+		w.WriteByte(ch)
+		return
+	}
+	for ; count > 0; count-- {
+		w.WriteByte(ch)
+	}
+}
+
+// Encode img as a sixel graphics escape code, reducing it to at most
+// num_colors colors, which are dithered as specified. Pixels that are less
+// than half opaque are left transparent.
+func EncodeSixel(output io.Writer, img image.Image, num_colors int, dither DitherMethod, strength float32) error {
+	n := imaging.Clone(img)
+	width, height := n.Rect.Dx(), n.Rect.Dy()
+	if width == 0 || height == 0 {
+		return fmt.Errorf("Cannot encode an empty image as sixel")
+	}
+	sample := image.Image(n)
+	if width > sixel_palette_sample_size || height > sixel_palette_sample_size {
+		sample = imaging.Fit(n, sixel_palette_sample_size, sixel_palette_sample_size, imaging.Box)
+	}
+	var palette []NRGBColor
+	for _, e := range Quantize(sample, num_colors) {
+		palette = append(palette, e.Color)
+	}
+	if len(palette) == 0 {
+		palette = append(palette, NRGBColor{})
+	}
+	indices := map_to_palette(n, palette, dither, strength)
+
+	w := bufio.NewWriter(output)
+	// the second parameter of one means that pixels that are not set remain
+	// transparent, the raster attributes specify a 1:1 aspect ratio and the size
+	fmt.Fprintf(w, "\x1bP0;1;0q\"1;1;%d;%d", width, height)
+	for i, c := range palette {
+		// colors are specified as RGB percentages
+		fmt.Fprintf(w, "#%d;2;%d;%d;%d", i, (int(c.R)*100+127)/255, (int(c.G)*100+127)/255, (int(c.B)*100+127)/255)
+	}
+	// the sixels of each color in the current band of six rows, and the last
+	// column in which each color is present
+	bands := make([][]byte, len(palette))
+	last_column := make([]int, len(palette))
+	var used []int
+	for top := 0; top < height; top += 6 {
+		used = used[:0]
+		for y := top; y < top+6 && y < height; y++ {
+			bit := byte(1) << (y - top)
+			for x, idx := range indices[y*width : (y+1)*width] {
+				if idx < 0 {
+					continue
+				}
+				if bands[idx] == nil {
+					bands[idx] = make([]byte, width)
+				}
+				if last_column[idx] == 0 {
+					used = append(used, int(idx))
+				}
+				bands[idx][x] |= bit
+				last_column[idx] = utils.Max(last_column[idx], x+1)
+			}
+		}
+		for i, idx := range used {
+			if i > 0 {
+				// return to the start of the band to overlay the next color
+				w.WriteByte('$')
+			}
+			w.WriteByte('#')
+			w.WriteString(strconv.Itoa(idx))
+			row := bands[idx][:last_column[idx]]
+			for x := 0; x < len(row); {
+				run := 1
+				for x+run < len(row) && row[x+run] == row[x] {
+					run++
+				}
+				write_sixel_run(w, '?'+row[x], run)
+				x += run
+			}
+			for x := range row {
+				row[x] = 0
+			}
+			last_column[idx] = 0
+		}
+		if top+6 < height {
+			w.WriteByte('-')
+		}
+	}
+	w.WriteString("\x1b\\")
+	return w.Flush()
+}
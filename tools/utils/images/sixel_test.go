@@ -0,0 +1,148 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var _ = fmt.Print
+
+// Decode the output of EncodeSixel, returning the palette index of each
+// pixel, with -1 for transparent pixels, and the palette
+func decode_sixel(t *testing.T, data string) (indices [][]int, palette map[int][3]int) {
+	body, found := strings.CutPrefix(data, "\x1bP0;1;0q")
+	if !found || !strings.HasSuffix(body, "\x1b\\") {
+		t.Fatalf("Invalid sixel escape code: %#v", data)
+	}
+	body = strings.TrimSuffix(body, "\x1b\\")
+	m := regexp.MustCompile(`^"1;1;(\d+);(\d+)`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("No raster attributes in: %#v", body)
+	}
+	width, _ := strconv.Atoi(m[1])
+	height, _ := strconv.Atoi(m[2])
+	body = body[len(m[0]):]
+	indices = make([][]int, height)
+	for y := range indices {
+		indices[y] = make([]int, width)
+		for x := range indices[y] {
+			indices[y][x] = -1
+		}
+	}
+	palette = make(map[int][3]int)
+	color_re := regexp.MustCompile(`^#(\d+)(;2;(\d+);(\d+);(\d+))?`)
+	repeat_re := regexp.MustCompile(`^!(\d+)`)
+	current, x, top := 0, 0, 0
+	for len(body) > 0 {
+		if m := color_re.FindStringSubmatch(body); m != nil {
+			current, _ = strconv.Atoi(m[1])
+			if m[2] != "" {
+				r, _ := strconv.Atoi(m[3])
+				g, _ := strconv.Atoi(m[4])
+				b, _ := strconv.Atoi(m[5])
+				palette[current] = [3]int{r, g, b}
+			}
+			body = body[len(m[0]):]
+			continue
+		}
+		count := 1
+		if m := repeat_re.FindStringSubmatch(body); m != nil {
+			count, _ = strconv.Atoi(m[1])
+			body = body[len(m[0]):]
+		}
+		switch ch := body[0]; ch {
+		case '$':
+			x = 0
+		case '-':
+			x, top = 0, top+6
+		default:
+			bits := ch - '?'
+			for ; count > 0; count-- {
+				for i := 0; i < 6; i++ {
+					if bits&(1<<i) != 0 {
+						indices[top+i][x] = current
+					}
+				}
+				x++
+			}
+		}
+		body = body[1:]
+	}
+	return
+}
+
+func TestSixel(t *testing.T) {
+	red, blue := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}
+	img := image.NewNRGBA(image.Rect(0, 0, 9, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			switch {
+			case x == 8 && y == 7:
+				// transparent
+			case x < 5:
+				img.SetNRGBA(x, y, red)
+			default:
+				img.SetNRGBA(x, y, blue)
+			}
+		}
+	}
+	var b bytes.Buffer
+	if err := EncodeSixel(&b, img, MaxSixelColors, NoDither, 1); err != nil {
+		t.Fatal(err)
+	}
+	indices, palette := decode_sixel(t, b.String())
+	if len(palette) != 2 {
+		t.Fatalf("Incorrect palette: %v", palette)
+	}
+	for y, row := range indices {
+		for x, idx := range row {
+			expected := [3]int{100, 0, 0}
+			if x >= 5 {
+				expected = [3]int{0, 0, 100}
+			}
+			if x == 8 && y == 7 {
+				if idx != -1 {
+					t.Fatalf("Transparent pixel set to: %d", idx)
+				}
+			} else if idx < 0 || palette[idx] != expected {
+				t.Fatalf("Incorrect pixel at %d, %d: %d in %v", x, y, idx, palette)
+			}
+		}
+	}
+	// runs of the same sixel use the repeat introducer
+	if !strings.Contains(b.String(), "!5~") {
+		t.Fatalf("Runs not compressed: %#v", b.String())
+	}
+
+	// a gradient reduced to two colors is dithered
+	gradient := image.NewNRGBA(image.Rect(0, 0, 64, 6))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 6; y++ {
+			gradient.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(x * 4), uint8(x * 4), 255})
+		}
+	}
+	for _, dither := range []DitherMethod{NoDither, FloydSteinbergDither, OrderedDither} {
+		b.Reset()
+		if err := EncodeSixel(&b, gradient, 2, dither, 1); err != nil {
+			t.Fatal(err)
+		}
+		indices, _ := decode_sixel(t, b.String())
+		changes := 0
+		for x := 1; x < 64; x++ {
+			if indices[0][x] != indices[0][x-1] {
+				changes++
+			}
+		}
+		if (dither == NoDither) != (changes == 1) {
+			t.Fatalf("Incorrect number of color changes with dither %d: %d", dither, changes)
+		}
+	}
+}
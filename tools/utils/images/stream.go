@@ -0,0 +1,463 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Returned by NewRowDecoder for images that cannot be decoded a row at a
+// time, such as interlaced PNG images, which must be fully decoded instead
+var ErrRowDecodingUnsupported = errors.New("The image cannot be decoded a row at a time")
+
+// Decodes an image a row at a time, so that huge images can be processed
+// without holding all their pixels in memory
+type RowDecoder interface {
+	Size() (width, height int)
+	// Whether every pixel of the image is known to be opaque from its header
+	IsOpaque() bool
+	// Decode the next row into dest as non-premultiplied RGBA with eight
+	// bits per channel, dest must be at least four times the width in size
+	NextRow(dest []uint8) error
+}
+
+// Whether images in the specified format can be decoded by NewRowDecoder
+func CanDecodeRows(format_uppercase string) bool {
+	return format_uppercase == "PNG" || format_uppercase == "FARBFELD"
+}
+
+func NewRowDecoder(r io.Reader, format_uppercase string) (RowDecoder, error) {
+	switch format_uppercase {
+	case "PNG":
+		return new_png_row_decoder(r)
+	case "FARBFELD":
+		return new_farbfeld_row_decoder(r)
+	}
+	return nil, ErrRowDecodingUnsupported
+}
+
+type farbfeld_row_decoder struct {
+	r             io.Reader
+	width, height int
+	row           []byte
+}
+
+func new_farbfeld_row_decoder(r io.Reader) (*farbfeld_row_decoder, error) {
+	br := bufio.NewReader(r)
+	c, err := DecodeFarbfeldConfig(br)
+	if err != nil {
+		return nil, err
+	}
+	return &farbfeld_row_decoder{r: br, width: c.Width, height: c.Height, row: make([]byte, 8*c.Width)}, nil
+}
+
+func (self *farbfeld_row_decoder) Size() (int, int) { return self.width, self.height }
+func (self *farbfeld_row_decoder) IsOpaque() bool   { return false }
+
+func (self *farbfeld_row_decoder) NextRow(dest []uint8) error {
+	if _, err := io.ReadFull(self.r, self.row); err != nil {
+		return fmt.Errorf("Failed to read Farbfeld pixel data: %w", err)
+	}
+	for i := range dest[:4*self.width] {
+		dest[i] = self.row[2*i]
+	}
+	return nil
+}
+
+// Reads the concatenated data of consecutive IDAT chunks
+type png_idat_reader struct {
+	r         *bufio.Reader
+	remaining uint32
+	done      bool
+}
+
+func (self *png_idat_reader) Read(p []byte) (n int, err error) {
+	for self.remaining == 0 {
+		if self.done {
+			return 0, io.EOF
+		}
+		// the CRC of the previous chunk and the header of the next one
+		var b [12]byte
+		if _, err = io.ReadFull(self.r, b[:]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if string(b[8:]) != "IDAT" {
+			self.done = true
+			return 0, io.EOF
+		}
+		self.remaining = binary.BigEndian.Uint32(b[4:8])
+	}
+	if uint32(len(p)) > self.remaining {
+		p = p[:self.remaining]
+	}
+	n, err = self.r.Read(p)
+	self.remaining -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+type png_row_decoder struct {
+	width, height int
+	depth, ctype  uint8
+	palette       []color.NRGBA
+	has_trns      bool
+	trns          [3]uint16
+	z             io.Reader
+	// the number of bytes per complete pixel, used by the filters
+	filter_bpp int
+	cur, prev  []byte
+}
+
+func new_png_row_decoder(r io.Reader) (ans *png_row_decoder, err error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var sig [8]byte
+	if _, err = io.ReadFull(br, sig[:]); err != nil || string(sig[:]) != "\x89PNG\r\n\x1a\n" {
+		return nil, fmt.Errorf("Not a PNG image")
+	}
+	ans = &png_row_decoder{}
+	seen_header := false
+	var idat_size uint32
+	for {
+		var b [8]byte
+		if _, err = io.ReadFull(br, b[:]); err != nil {
+			return nil, fmt.Errorf("Failed to read PNG chunk: %w", err)
+		}
+		size, ctype := binary.BigEndian.Uint32(b[:4]), string(b[4:])
+		if ctype == "IDAT" {
+			if !seen_header {
+				return nil, fmt.Errorf("PNG image has no IHDR chunk")
+			}
+			idat_size = size
+			break
+		}
+		if size > 1<<24 {
+			return nil, fmt.Errorf("PNG chunk too large: %d", size)
+		}
+		// the data and the CRC, which is not checked
+		data := make([]byte, size+4)
+		if _, err = io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("Failed to read PNG chunk: %w", err)
+		}
+		data = data[:size]
+		switch ctype {
+		case "IHDR":
+			if size < 13 {
+				return nil, fmt.Errorf("PNG IHDR chunk too short")
+			}
+			ans.width, ans.height = int(binary.BigEndian.Uint32(data)), int(binary.BigEndian.Uint32(data[4:]))
+			ans.depth, ans.ctype = data[8], data[9]
+			if data[12] != 0 {
+				// interlaced images have their rows spread over the whole file
+				return nil, ErrRowDecodingUnsupported
+			}
+			seen_header = true
+		case "PLTE":
+			for i := 0; i+2 < len(data); i += 3 {
+				ans.palette = append(ans.palette, color.NRGBA{data[i], data[i+1], data[i+2], 255})
+			}
+		case "tRNS":
+			ans.has_trns = true
+			switch ans.ctype {
+			case 0:
+				if len(data) >= 2 {
+					ans.trns[0] = binary.BigEndian.Uint16(data)
+				}
+			case 2:
+				if len(data) >= 6 {
+					ans.trns = [3]uint16{binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:]), binary.BigEndian.Uint16(data[4:])}
+				}
+			case 3:
+				for i, a := range data {
+					if i < len(ans.palette) {
+						ans.palette[i].A = a
+					}
+				}
+			}
+		}
+	}
+	channels := map[uint8]int{0: 1, 2: 3, 3: 1, 4: 2, 6: 4}[ans.ctype]
+	valid_depth := ans.depth == 8 || (ans.depth == 16 && ans.ctype != 3) || ((ans.depth == 1 || ans.depth == 2 || ans.depth == 4) && (ans.ctype == 0 || ans.ctype == 3))
+	if channels == 0 || !valid_depth {
+		return nil, fmt.Errorf("Invalid PNG color type and bit depth: %d, %d", ans.ctype, ans.depth)
+	}
+	if ans.width <= 0 || ans.height <= 0 || ans.width > math.MaxInt32/(channels*2) {
+		return nil, fmt.Errorf("Invalid PNG image size: %dx%d", ans.width, ans.height)
+	}
+	row_size := 1 + (ans.width*channels*int(ans.depth)+7)/8
+	ans.filter_bpp = (channels*int(ans.depth) + 7) / 8
+	ans.cur, ans.prev = make([]byte, row_size), make([]byte, row_size)
+	if ans.z, err = zlib.NewReader(&png_idat_reader{r: br, remaining: idat_size}); err != nil {
+		return nil, fmt.Errorf("Failed to read PNG image data: %w", err)
+	}
+	return ans, nil
+}
+
+func (self *png_row_decoder) Size() (int, int) { return self.width, self.height }
+
+func (self *png_row_decoder) IsOpaque() bool {
+	switch self.ctype {
+	case 0, 2:
+		return !self.has_trns
+	case 3:
+		for _, c := range self.palette {
+			if c.A != 255 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func (self *png_row_decoder) unfilter() error {
+	cur, prev, bpp := self.cur[1:], self.prev[1:], self.filter_bpp
+	switch self.cur[0] {
+	case 0:
+	case 1:
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case 2:
+		for i, p := range prev {
+			cur[i] += p
+		}
+	case 3:
+		for i := range cur {
+			left := 0
+			if i >= bpp {
+				left = int(cur[i-bpp])
+			}
+			cur[i] += uint8((left + int(prev[i])) / 2)
+		}
+	case 4:
+		for i := range cur {
+			a, b, c := 0, int(prev[i]), 0
+			if i >= bpp {
+				a, c = int(cur[i-bpp]), int(prev[i-bpp])
+			}
+			p := a + b - c
+			pa, pb, pc := abs(p-a), abs(p-b), abs(p-c)
+			switch {
+			case pa <= pb && pa <= pc:
+				cur[i] += uint8(a)
+			case pb <= pc:
+				cur[i] += uint8(b)
+			default:
+				cur[i] += uint8(c)
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid PNG filter type: %d", self.cur[0])
+	}
+	return nil
+}
+
+func (self *png_row_decoder) NextRow(dest []uint8) error {
+	self.cur, self.prev = self.prev, self.cur
+	if _, err := io.ReadFull(self.z, self.cur); err != nil {
+		return fmt.Errorf("Failed to read PNG image data: %w", err)
+	}
+	if err := self.unfilter(); err != nil {
+		return err
+	}
+	row := self.cur[1:]
+	dest = dest[:4*self.width]
+	// the value of a sample as a 16-bit number for comparison with tRNS
+	sample := func(i int) uint16 {
+		if self.depth == 16 {
+			return binary.BigEndian.Uint16(row[2*i:])
+		}
+		return uint16(row[i])
+	}
+	switch self.ctype {
+	case 0, 3:
+		depth := int(self.depth)
+		mask := 1<<depth - 1
+		for x := 0; x < self.width; x++ {
+			var s int
+			if depth == 16 {
+				s = int(sample(x))
+			} else {
+				bit := x * depth
+				s = int(row[bit/8]>>(8-depth-bit%8)) & mask
+			}
+			d := dest[4*x : 4*x+4]
+			if self.ctype == 3 {
+				c := color.NRGBA{A: 255}
+				if s < len(self.palette) {
+					c = self.palette[s]
+				}
+				d[0], d[1], d[2], d[3] = c.R, c.G, c.B, c.A
+				continue
+			}
+			v := uint8(s * 255 / mask)
+			if depth == 16 {
+				v = uint8(s >> 8)
+			}
+			d[0], d[1], d[2], d[3] = v, v, v, 255
+			if self.has_trns && uint16(s) == self.trns[0] {
+				d[3] = 0
+			}
+		}
+	case 2:
+		for x := 0; x < self.width; x++ {
+			d := dest[4*x : 4*x+4]
+			r, g, b := sample(3*x), sample(3*x+1), sample(3*x+2)
+			d[3] = 255
+			if self.has_trns && r == self.trns[0] && g == self.trns[1] && b == self.trns[2] {
+				d[3] = 0
+			}
+			if self.depth == 16 {
+				r, g, b = r>>8, g>>8, b>>8
+			}
+			d[0], d[1], d[2] = uint8(r), uint8(g), uint8(b)
+		}
+	case 4, 6:
+		channels := 4
+		if self.ctype == 4 {
+			channels = 2
+		}
+		step := int(self.depth) / 8
+		for x := 0; x < self.width; x++ {
+			d := dest[4*x : 4*x+4]
+			s := row[x*channels*step:]
+			// the most significant byte of each sample
+			if channels == 2 {
+				d[0], d[3] = s[0], s[step]
+				d[1], d[2] = d[0], d[0]
+			} else {
+				d[0], d[1], d[2], d[3] = s[0], s[step], s[2*step], s[3*step]
+			}
+		}
+	}
+	return nil
+}
+
+// The destination pixel a source pixel starts in and the fractions of the
+// source pixel in it and in the next destination pixel
+type area_span struct {
+	dest          int
+	first, second float32
+}
+
+func area_spans(src_size, size int) []area_span {
+	ans := make([]area_span, src_size)
+	scale := float64(size) / float64(src_size)
+	for i := range ans {
+		start, end := float64(i)*scale, float64(i+1)*scale
+		dest := utils.Min(int(start), size-1)
+		first := math.Min(end, float64(dest+1)) - start
+		ans[i] = area_span{dest: dest, first: float32(first), second: float32(scale - first)}
+		if dest+1 >= size {
+			// rounding errors at the end
+			ans[i].first, ans[i].second = float32(scale), 0
+		}
+	}
+	return ans
+}
+
+// Downscales an image a row at a time by averaging the source pixels that
+// cover each destination pixel, needing memory for only two destination rows
+type AreaScaler struct {
+	width, height int
+	cols, rows    []area_span
+	// premultiplied RGBA of the source row being added, scaled horizontally
+	scaled_row []float32
+	// premultiplied RGBA of the current and next destination rows
+	current, next []float32
+	src_y, y      int
+	output        []uint8
+}
+
+// Create a scaler from an image of size src_width x src_height to one of size
+// width x height, which must not be larger
+func NewAreaScaler(src_width, src_height, width, height int) *AreaScaler {
+	return &AreaScaler{
+		width: width, height: height, cols: area_spans(src_width, width), rows: area_spans(src_height, height),
+		scaled_row: make([]float32, 4*width), current: make([]float32, 4*width), next: make([]float32, 4*width), output: make([]uint8, 4*width),
+	}
+}
+
+func (self *AreaScaler) emit(output func(y int, row []uint8) error) error {
+	for x := 0; x < self.width; x++ {
+		p := self.current[4*x : 4*x+4]
+		d := self.output[4*x : 4*x+4]
+		// the fractions of the source pixels covering each destination pixel add up to one
+		d[0], d[1], d[2], d[3] = 0, 0, 0, clamp_to_uint8(p[3])
+		if p[3] > 0 {
+			d[0], d[1], d[2] = clamp_to_uint8(p[0]*255/p[3]), clamp_to_uint8(p[1]*255/p[3]), clamp_to_uint8(p[2]*255/p[3])
+		}
+	}
+	err := output(self.y, self.output)
+	self.current, self.next = self.next, self.current
+	for i := range self.next {
+		self.next[i] = 0
+	}
+	self.y++
+	return err
+}
+
+// Add the next row of the source image, as non-premultiplied RGBA, calling
+// output for each destination row that is complete. The row passed to output
+// is only valid until it returns.
+func (self *AreaScaler) AddRow(src []uint8, output func(y int, row []uint8) error) error {
+	if self.src_y >= len(self.rows) {
+		return fmt.Errorf("Too many rows added to scaler")
+	}
+	r := self.rows[self.src_y]
+	self.src_y++
+	for r.dest > self.y {
+		if err := self.emit(output); err != nil {
+			return err
+		}
+	}
+	for i := range self.scaled_row {
+		self.scaled_row[i] = 0
+	}
+	for x, c := range self.cols {
+		p := src[4*x : 4*x+4]
+		a := float32(p[3])
+		d := self.scaled_row[4*c.dest:]
+		v := [4]float32{float32(p[0]) * a / 255, float32(p[1]) * a / 255, float32(p[2]) * a / 255, a}
+		for i, q := range v {
+			d[i] += q * c.first
+		}
+		if c.second > 0 {
+			for i, q := range v {
+				d[4+i] += q * c.second
+			}
+		}
+	}
+	for i, q := range self.scaled_row {
+		self.current[i] += q * r.first
+		self.next[i] += q * r.second
+	}
+	if self.src_y == len(self.rows) {
+		for self.y < self.height {
+			if err := self.emit(output); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
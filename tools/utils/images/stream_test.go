@@ -0,0 +1,159 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+var _ = fmt.Print
+
+func decode_rows(t *testing.T, data []byte, format string) *image.NRGBA {
+	d, err := NewRowDecoder(bytes.NewReader(data), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h := d.Size()
+	ans := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		if err = d.NextRow(ans.Pix[y*ans.Stride:]); err != nil {
+			t.Fatalf("Failed to decode row %d: %s", y, err)
+		}
+	}
+	return ans
+}
+
+func TestRowDecoder(t *testing.T) {
+	const w, h = 37, 23
+	pixel := func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(x * 7), uint8(y * 11), uint8(x*y + 3), uint8(255 - x - y)}
+	}
+	nrgba, rgba, nrgba64 := image.NewNRGBA(image.Rect(0, 0, w, h)), image.NewRGBA(image.Rect(0, 0, w, h)), image.NewNRGBA64(image.Rect(0, 0, w, h))
+	gray, gray16 := image.NewGray(image.Rect(0, 0, w, h)), image.NewGray16(image.Rect(0, 0, w, h))
+	bilevel := image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.NRGBA{0, 0, 0, 255}, color.NRGBA{200, 100, 0, 128}})
+	pal := image.NewPaletted(image.Rect(0, 0, w, h), nil)
+	for i := 0; i < 100; i++ {
+		pal.Palette = append(pal.Palette, color.NRGBA{uint8(i), uint8(2 * i), 50, 255})
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := pixel(x, y)
+			nrgba.SetNRGBA(x, y, c)
+			nrgba64.Set(x, y, c)
+			rgba.Set(x, y, color.RGBA{c.R, c.G, c.B, 255})
+			gray.SetGray(x, y, color.Gray{c.R})
+			gray16.SetGray16(x, y, color.Gray16{uint16(c.G) << 8})
+			bilevel.SetColorIndex(x, y, uint8((x+y)%2))
+			pal.SetColorIndex(x, y, uint8((x*y)%100))
+		}
+	}
+	for _, img := range []image.Image{nrgba, rgba, nrgba64, gray, gray16, bilevel, pal} {
+		var b bytes.Buffer
+		if err := png.Encode(&b, img); err != nil {
+			t.Fatal(err)
+		}
+		expected, actual := imaging.Clone(img), decode_rows(t, b.Bytes(), "PNG")
+		if !bytes.Equal(expected.Pix, actual.Pix) {
+			t.Fatalf("Incorrect pixels for %T: %v != %v", img, actual.Pix[:16], expected.Pix[:16])
+		}
+		d, _ := NewRowDecoder(bytes.NewReader(b.Bytes()), "PNG")
+		if opaque := d.IsOpaque(); opaque != IsOpaque(img) {
+			t.Fatalf("Incorrect opacity for %T: %v", img, opaque)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := EncodeFarbfeld(&b, nrgba); err != nil {
+		t.Fatal(err)
+	}
+	if actual := decode_rows(t, b.Bytes(), "FARBFELD"); !bytes.Equal(actual.Pix, nrgba.Pix) {
+		t.Fatalf("Incorrect pixels for Farbfeld")
+	}
+
+	b.Reset()
+	png.Encode(&b, nrgba)
+	data := b.Bytes()
+	// the interlace method in the IHDR chunk
+	data[28] = 1
+	if _, err := NewRowDecoder(bytes.NewReader(data), "PNG"); !errors.Is(err, ErrRowDecodingUnsupported) {
+		t.Fatalf("Interlaced PNG not rejected: %v", err)
+	}
+	if _, err := NewRowDecoder(bytes.NewReader(data), "JPEG"); !errors.Is(err, ErrRowDecodingUnsupported) {
+		t.Fatalf("JPEG not rejected: %v", err)
+	}
+}
+
+func scale_rows(t *testing.T, img *image.NRGBA, width, height int) *image.NRGBA {
+	ans := image.NewNRGBA(image.Rect(0, 0, width, height))
+	s := NewAreaScaler(img.Rect.Dx(), img.Rect.Dy(), width, height)
+	seen := 0
+	for y := 0; y < img.Rect.Dy(); y++ {
+		err := s.AddRow(img.Pix[y*img.Stride:], func(y int, row []uint8) error {
+			if y != seen {
+				t.Fatalf("Row %d output out of order", y)
+			}
+			seen++
+			copy(ans.Pix[y*ans.Stride:], row)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seen != height {
+		t.Fatalf("Only %d of %d rows output", seen, height)
+	}
+	return ans
+}
+
+func TestAreaScaler(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(40 * (x + y)), 100, 200, 255})
+		}
+	}
+	s := scale_rows(t, img, 2, 2)
+	for _, tc := range []struct {
+		x, y int
+		r    uint8
+	}{{0, 0, 40}, {1, 0, 120}, {0, 1, 120}, {1, 1, 200}} {
+		if c := s.NRGBAAt(tc.x, tc.y); c.R != tc.r || c.G != 100 || c.B != 200 || c.A != 255 {
+			t.Fatalf("Incorrect average at %d, %d: %v", tc.x, tc.y, c)
+		}
+	}
+	if s := scale_rows(t, img, 4, 4); !bytes.Equal(s.Pix, img.Pix) {
+		t.Fatalf("Scaling to the same size changed the image")
+	}
+
+	// transparent pixels do not darken the average
+	img = image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{200, 0, 0, 255})
+	img.SetNRGBA(2, 0, color.NRGBA{100, 0, 0, 255})
+	s = scale_rows(t, img, 2, 1)
+	if c := s.NRGBAAt(0, 0); c.R != 200 || c.A != 170 {
+		t.Fatalf("Incorrect average with transparency: %v", c)
+	}
+	if c := s.NRGBAAt(1, 0); c.R != 100 || c.A != 170 {
+		t.Fatalf("Incorrect average with transparency: %v", c)
+	}
+	// a large reduction in size keeps the average
+	img = image.NewNRGBA(image.Rect(0, 0, 301, 173))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(90 + (i/4)%3)
+	}
+	s = scale_rows(t, img, 7, 3)
+	for i, v := range s.Pix {
+		if v < 90 || v > 92 {
+			t.Fatalf("Incorrect average at %d: %d", i, v)
+		}
+	}
+}
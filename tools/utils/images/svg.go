@@ -0,0 +1,1213 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"kitty/tools/utils"
+
+	"golang.org/x/image/colornames"
+	"golang.org/x/image/vector"
+)
+
+var _ = fmt.Print
+
+// Return true if the data, usually the first SniffLength bytes of a file, is
+// the start of an SVG image
+func IsSVG(header []byte) bool {
+	s := bytes.TrimPrefix(header, []byte("\xef\xbb\xbf"))
+	for {
+		s = bytes.TrimLeft(s, " \t\r\n")
+		var end string
+		switch {
+		case bytes.HasPrefix(s, []byte("<?")):
+			end = "?>"
+		case bytes.HasPrefix(s, []byte("<!--")):
+			end = "-->"
+		case bytes.HasPrefix(s, []byte("<!")):
+			end = ">"
+		default:
+			return bytes.HasPrefix(s, []byte("<svg")) && len(s) > 4 && bytes.IndexByte([]byte(" \t\r\n>/"), s[4]) > -1
+		}
+		idx := bytes.Index(s, []byte(end))
+		if idx < 0 {
+			return false
+		}
+		s = s[idx+len(end):]
+	}
+}
+
+type svg_point struct{ x, y float64 }
+
+// An affine transform, mapping (x, y) to (a*x + c*y + e, b*x + d*y + f)
+type svg_affine [6]float64
+
+var svg_identity = svg_affine{1, 0, 0, 1, 0, 0}
+
+// The transform that applies n and then m
+func (m svg_affine) mul(n svg_affine) svg_affine {
+	return svg_affine{
+		m[0]*n[0] + m[2]*n[1], m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3], m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4], m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+func (m svg_affine) apply(p svg_point) svg_point {
+	return svg_point{m[0]*p.x + m[2]*p.y + m[4], m[1]*p.x + m[3]*p.y + m[5]}
+}
+
+// The factor by which the transform scales lengths, on average
+func (m svg_affine) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+type svg_segment struct {
+	// One of M, L, C or Z, quadratic curves and arcs are converted to cubic curves
+	op  byte
+	pts [3]svg_point
+}
+
+type svg_shape struct {
+	// in the coordinates of the viewBox
+	path                []svg_segment
+	fill, stroke        color.NRGBA
+	stroke_width        float64
+	line_cap, line_join string
+	miter_limit         float64
+}
+
+// An SVG image that can be rasterized at any size. Only the basic shapes and
+// paths with solid fills and strokes are supported, gradients are drawn with
+// the average color of their stops and elements such as text are ignored.
+// Filling uses the non-zero rule.
+type SVG struct {
+	// The intrinsic size of the image in pixels
+	Width, Height   float64
+	view_box        [4]float64
+	preserve_aspect bool
+	shapes          []svg_shape
+	// The elements and properties that were ignored, or approximated, as they
+	// are not supported
+	Unsupported []string
+}
+
+type svg_node struct {
+	name     string
+	attrs    map[string]string
+	children []*svg_node
+}
+
+func parse_svg_tree(r io.Reader) (root *svg_node, err error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	var stack []*svg_node
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SVG image: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &svg_node{name: t.Name.Local, attrs: make(map[string]string, len(t.Attr))}
+			for _, a := range t.Attr {
+				n.attrs[a.Name.Local] = a.Value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	if root == nil || root.name != "svg" {
+		return nil, fmt.Errorf("Not an SVG image")
+	}
+	return root, nil
+}
+
+// A scanner for the numbers and commands in path data and lists of numbers
+type svg_scanner struct {
+	s   string
+	pos int
+}
+
+func (self *svg_scanner) skip_separators() {
+	for self.pos < len(self.s) && strings.IndexByte(" \t\r\n,", self.s[self.pos]) > -1 {
+		self.pos++
+	}
+}
+
+func (self *svg_scanner) at_end() bool {
+	self.skip_separators()
+	return self.pos >= len(self.s)
+}
+
+func (self *svg_scanner) command() (byte, bool) {
+	self.skip_separators()
+	if self.pos < len(self.s) {
+		if c := self.s[self.pos]; strings.IndexByte("MmLlHhVvCcSsQqTtAaZz", c) > -1 {
+			self.pos++
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+func (self *svg_scanner) number() (float64, bool) {
+	self.skip_separators()
+	start, i := self.pos, self.pos
+	if i < len(self.s) && (self.s[i] == '+' || self.s[i] == '-') {
+		i++
+	}
+	seen_dot, seen_digit := false, false
+	for ; i < len(self.s); i++ {
+		c := self.s[i]
+		if c >= '0' && c <= '9' {
+			seen_digit = true
+		} else if c == '.' && !seen_dot {
+			seen_dot = true
+		} else {
+			break
+		}
+	}
+	if !seen_digit {
+		return 0, false
+	}
+	if i < len(self.s) && (self.s[i] == 'e' || self.s[i] == 'E') {
+		j := i + 1
+		if j < len(self.s) && (self.s[j] == '+' || self.s[j] == '-') {
+			j++
+		}
+		if j < len(self.s) && self.s[j] >= '0' && self.s[j] <= '9' {
+			for i = j; i < len(self.s) && self.s[i] >= '0' && self.s[i] <= '9'; i++ {
+			}
+		}
+	}
+	v, err := strconv.ParseFloat(self.s[start:i], 64)
+	if err != nil {
+		return 0, false
+	}
+	self.pos = i
+	return v, true
+}
+
+// The flags of arcs are single digits that need not be separated
+func (self *svg_scanner) flag() (bool, bool) {
+	self.skip_separators()
+	if self.pos < len(self.s) && (self.s[self.pos] == '0' || self.s[self.pos] == '1') {
+		self.pos++
+		return self.s[self.pos-1] == '1', true
+	}
+	return false, false
+}
+
+func (self *svg_scanner) numbers(dest ...*float64) bool {
+	for _, d := range dest {
+		v, ok := self.number()
+		if !ok {
+			return false
+		}
+		*d = v
+	}
+	return true
+}
+
+func svg_numbers(s string) (ans []float64) {
+	sc := svg_scanner{s: s}
+	for {
+		v, ok := sc.number()
+		if !ok {
+			return
+		}
+		ans = append(ans, v)
+	}
+}
+
+func lerp_point(a, b svg_point, t float64) svg_point {
+	return svg_point{a.x + (b.x-a.x)*t, a.y + (b.y-a.y)*t}
+}
+
+// Convert an elliptical arc to cubic curves as described in the SVG
+// implementation notes
+func svg_arc(p0 svg_point, rx, ry, phi float64, large, sweep bool, p svg_point) (ans []svg_segment) {
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 || p0 == p {
+		return []svg_segment{{op: 'L', pts: [3]svg_point{p}}}
+	}
+	sin, cos := math.Sincos(phi * math.Pi / 180)
+	dx2, dy2 := (p0.x-p.x)/2, (p0.y-p.y)/2
+	x1, y1 := cos*dx2+sin*dy2, -sin*dx2+cos*dy2
+	if lambda := x1*x1/(rx*rx) + y1*y1/(ry*ry); lambda > 1 {
+		rx, ry = rx*math.Sqrt(lambda), ry*math.Sqrt(lambda)
+	}
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := math.Sqrt(math.Max(0, num/den))
+	if large == sweep {
+		coef = -coef
+	}
+	cxp, cyp := coef*rx*y1/ry, -coef*ry*x1/rx
+	cx, cy := cos*cxp-sin*cyp+(p0.x+p.x)/2, sin*cxp+cos*cyp+(p0.y+p.y)/2
+	angle := func(ux, uy, vx, vy float64) float64 { return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy) }
+	ux, uy := (x1-cxp)/rx, (y1-cyp)/ry
+	theta := angle(1, 0, ux, uy)
+	delta := angle(ux, uy, (-x1-cxp)/rx, (-y1-cyp)/ry)
+	if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	} else if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	}
+	n := int(math.Ceil(math.Abs(delta) / (math.Pi / 2)))
+	step := delta / float64(n)
+	t := 4.0 / 3.0 * math.Tan(step/4)
+	on_ellipse := func(u, v float64) svg_point {
+		return svg_point{cx + rx*u*cos - ry*v*sin, cy + rx*u*sin + ry*v*cos}
+	}
+	for i := 0; i < n; i++ {
+		a1, a2 := theta+float64(i)*step, theta+float64(i+1)*step
+		s1, c1 := math.Sincos(a1)
+		s2, c2 := math.Sincos(a2)
+		end := on_ellipse(c2, s2)
+		if i == n-1 {
+			end = p
+		}
+		ans = append(ans, svg_segment{op: 'C', pts: [3]svg_point{on_ellipse(c1-t*s1, s1+t*c1), on_ellipse(c2+t*s2, s2-t*c2), end}})
+	}
+	return
+}
+
+// Parse SVG path data into absolute segments. As per the specification, the
+// segments before an error are still rendered.
+func parse_svg_path(d string) (ans []svg_segment) {
+	sc := svg_scanner{s: d}
+	var cur, start, last_control svg_point
+	var prev byte
+	cmd, ok := sc.command()
+	if !ok || (cmd != 'M' && cmd != 'm') {
+		return
+	}
+	for {
+		rel := cmd >= 'a'
+		offset := func(x, y float64) svg_point {
+			if rel {
+				return svg_point{cur.x + x, cur.y + y}
+			}
+			return svg_point{x, y}
+		}
+		var x, y, x1, y1, x2, y2 float64
+		upper := cmd &^ 0x20
+		switch upper {
+		case 'M':
+			if !sc.numbers(&x, &y) {
+				return
+			}
+			cur = offset(x, y)
+			start = cur
+			ans = append(ans, svg_segment{op: 'M', pts: [3]svg_point{cur}})
+			// subsequent pairs of coordinates are lines
+			cmd = 'L' | (cmd & 0x20)
+			prev = upper
+			if _, is_num := (&svg_scanner{s: sc.s, pos: sc.pos}).number(); !is_num {
+				break
+			}
+			continue
+		case 'L', 'H', 'V':
+			switch upper {
+			case 'L':
+				if !sc.numbers(&x, &y) {
+					return
+				}
+				cur = offset(x, y)
+			case 'H':
+				if !sc.numbers(&x) {
+					return
+				}
+				if rel {
+					x += cur.x
+				}
+				cur.x = x
+			case 'V':
+				if !sc.numbers(&y) {
+					return
+				}
+				if rel {
+					y += cur.y
+				}
+				cur.y = y
+			}
+			ans = append(ans, svg_segment{op: 'L', pts: [3]svg_point{cur}})
+		case 'C', 'S':
+			var c1 svg_point
+			if upper == 'C' {
+				if !sc.numbers(&x1, &y1, &x2, &y2, &x, &y) {
+					return
+				}
+				c1 = offset(x1, y1)
+			} else {
+				if !sc.numbers(&x2, &y2, &x, &y) {
+					return
+				}
+				c1 = cur
+				if prev == 'C' || prev == 'S' {
+					// the reflection of the previous second control point
+					c1 = svg_point{2*cur.x - last_control.x, 2*cur.y - last_control.y}
+				}
+			}
+			c2, p := offset(x2, y2), offset(x, y)
+			ans = append(ans, svg_segment{op: 'C', pts: [3]svg_point{c1, c2, p}})
+			cur, last_control = p, c2
+		case 'Q', 'T':
+			var q svg_point
+			if upper == 'Q' {
+				if !sc.numbers(&x1, &y1, &x, &y) {
+					return
+				}
+				q = offset(x1, y1)
+			} else {
+				if !sc.numbers(&x, &y) {
+					return
+				}
+				q = cur
+				if prev == 'Q' || prev == 'T' {
+					q = svg_point{2*cur.x - last_control.x, 2*cur.y - last_control.y}
+				}
+			}
+			p := offset(x, y)
+			ans = append(ans, svg_segment{op: 'C', pts: [3]svg_point{lerp_point(cur, q, 2.0/3), lerp_point(p, q, 2.0/3), p}})
+			cur, last_control = p, q
+		case 'A':
+			var rx, ry, phi float64
+			if !sc.numbers(&rx, &ry, &phi) {
+				return
+			}
+			large, ok1 := sc.flag()
+			sweep, ok2 := sc.flag()
+			if !ok1 || !ok2 || !sc.numbers(&x, &y) {
+				return
+			}
+			p := offset(x, y)
+			ans = append(ans, svg_arc(cur, rx, ry, phi, large, sweep, p)...)
+			cur = p
+		case 'Z':
+			ans = append(ans, svg_segment{op: 'Z'})
+			cur = start
+		}
+		prev = upper
+		if sc.at_end() {
+			return
+		}
+		if c, found := sc.command(); found {
+			cmd = c
+		} else if upper == 'Z' {
+			return
+		}
+	}
+}
+
+func parse_svg_transform(s string) svg_affine {
+	ans := svg_identity
+	for {
+		s = strings.TrimLeft(s, " \t\r\n,")
+		name, rest, found := strings.Cut(s, "(")
+		if !found {
+			return ans
+		}
+		args, remaining, found := strings.Cut(rest, ")")
+		if !found {
+			return ans
+		}
+		s = remaining
+		a := svg_numbers(args)
+		arg := func(i int, def float64) float64 {
+			if i < len(a) {
+				return a[i]
+			}
+			return def
+		}
+		var t svg_affine
+		switch strings.TrimSpace(name) {
+		case "matrix":
+			if len(a) != 6 {
+				return ans
+			}
+			copy(t[:], a)
+		case "translate":
+			t = svg_affine{1, 0, 0, 1, arg(0, 0), arg(1, 0)}
+		case "scale":
+			sx := arg(0, 1)
+			t = svg_affine{sx, 0, 0, arg(1, sx), 0, 0}
+		case "rotate":
+			sin, cos := math.Sincos(arg(0, 0) * math.Pi / 180)
+			cx, cy := arg(1, 0), arg(2, 0)
+			t = svg_affine{1, 0, 0, 1, cx, cy}.mul(svg_affine{cos, sin, -sin, cos, 0, 0}).mul(svg_affine{1, 0, 0, 1, -cx, -cy})
+		case "skewX":
+			t = svg_affine{1, 0, math.Tan(arg(0, 0) * math.Pi / 180), 1, 0, 0}
+		case "skewY":
+			t = svg_affine{1, math.Tan(arg(0, 0) * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			return ans
+		}
+		ans = ans.mul(t)
+	}
+}
+
+// Parse a length, percentages are relative to ref
+func parse_svg_length(s string, ref float64) (float64, bool) {
+	s = strings.TrimSpace(s)
+	units := map[string]float64{"px": 1, "pt": 4.0 / 3, "pc": 16, "mm": 96 / 25.4, "cm": 96 / 2.54, "in": 96, "em": 16, "ex": 8}
+	factor := 1.0
+	if strings.HasSuffix(s, "%") {
+		s, factor = s[:len(s)-1], ref/100
+	} else if len(s) > 2 {
+		if f, ok := units[s[len(s)-2:]]; ok {
+			s, factor = s[:len(s)-2], f
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v * factor, true
+}
+
+func parse_svg_color(s string) (color.NRGBA, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "transparent" {
+		return color.NRGBA{}, true
+	}
+	if c, ok := colornames.Map[s]; ok {
+		return color.NRGBA{c.R, c.G, c.B, c.A}, true
+	}
+	if hex, found := strings.CutPrefix(s, "#"); found {
+		if len(hex) == 3 || len(hex) == 4 {
+			expanded := make([]byte, 0, 2*len(hex))
+			for i := 0; i < len(hex); i++ {
+				expanded = append(expanded, hex[i], hex[i])
+			}
+			hex = string(expanded)
+		}
+		if len(hex) == 6 {
+			hex += "ff"
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 8 {
+			return color.NRGBA{}, false
+		}
+		return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, true
+	}
+	args, found := strings.CutPrefix(s, "rgb(")
+	if !found {
+		args, found = strings.CutPrefix(s, "rgba(")
+	}
+	if found {
+		parts := strings.FieldsFunc(strings.TrimSuffix(args, ")"), func(r rune) bool { return r == ',' || r == ' ' || r == '/' })
+		if len(parts) < 3 || len(parts) > 4 {
+			return color.NRGBA{}, false
+		}
+		var vals [4]float64
+		vals[3] = 255
+		for i, p := range parts {
+			ref := 255.0
+			if i == 3 {
+				ref = 1
+			}
+			v, ok := parse_svg_length(p, ref)
+			if !ok {
+				return color.NRGBA{}, false
+			}
+			if i == 3 {
+				v *= 255
+			}
+			vals[i] = math.Max(0, math.Min(255, math.Round(v)))
+		}
+		return color.NRGBA{uint8(vals[0]), uint8(vals[1]), uint8(vals[2]), uint8(vals[3])}, true
+	}
+	return color.NRGBA{}, false
+}
+
+type svg_paint struct {
+	color         color.NRGBA
+	none          bool
+	current_color bool
+}
+
+// The inherited properties that control how shapes are drawn
+type svg_style struct {
+	fill, stroke                 svg_paint
+	fill_opacity, stroke_opacity float64
+	stroke_width, miter_limit    float64
+	line_cap, line_join          string
+	color                        color.NRGBA
+	// from the visibility property, which unlike display, children can override
+	hidden bool
+}
+
+type svg_parser struct {
+	ans      *SVG
+	ids      map[string]*svg_node
+	viewport svg_point
+	// the elements being walked, to detect use elements that reference
+	// themselves or their ancestors
+	active map[*svg_node]bool
+	// the number of elements walked, including each expansion of a use element
+	num_walked int
+	err        error
+}
+
+func (self *svg_parser) unsupported(name string) {
+	for _, x := range self.ans.Unsupported {
+		if x == name {
+			return
+		}
+	}
+	self.ans.Unsupported = append(self.ans.Unsupported, name)
+}
+
+func (self *svg_parser) index_ids(n *svg_node) {
+	if id := n.attrs["id"]; id != "" {
+		self.ids[id] = n
+	}
+	for _, c := range n.children {
+		self.index_ids(c)
+	}
+}
+
+// The average color of the stops of a gradient, used instead of the gradient
+func (self *svg_parser) gradient_color(n *svg_node) (color.NRGBA, bool) {
+	stops := n.children
+	if len(stops) == 0 {
+		// stops can be inherited from another gradient
+		if ref := self.ids[strings.TrimPrefix(n.attrs["href"], "#")]; ref != nil && ref != n {
+			stops = ref.children
+		}
+	}
+	var r, g, b, a, count float64
+	for _, s := range stops {
+		if s.name != "stop" {
+			continue
+		}
+		props := parse_svg_style_attribute(s.attrs["style"])
+		get := func(name, def string) string {
+			if v, ok := props[name]; ok {
+				return v
+			}
+			if v, ok := s.attrs[name]; ok {
+				return v
+			}
+			return def
+		}
+		c, ok := parse_svg_color(get("stop-color", "black"))
+		if !ok {
+			continue
+		}
+		alpha := float64(c.A)
+		if v, err := strconv.ParseFloat(strings.TrimSpace(get("stop-opacity", "1")), 64); err == nil {
+			alpha *= math.Max(0, math.Min(v, 1))
+		}
+		r, g, b, a, count = r+float64(c.R), g+float64(c.G), b+float64(c.B), a+alpha, count+1
+	}
+	if count == 0 {
+		return color.NRGBA{}, false
+	}
+	return color.NRGBA{uint8(r / count), uint8(g / count), uint8(b / count), uint8(a / count)}, true
+}
+
+func (self *svg_parser) parse_paint(s string) (svg_paint, bool) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "none":
+		return svg_paint{none: true}, true
+	case "currentColor":
+		return svg_paint{current_color: true}, true
+	}
+	if rest, found := strings.CutPrefix(s, "url("); found {
+		ref, fallback, _ := strings.Cut(rest, ")")
+		ref = strings.Trim(strings.TrimSpace(ref), `'"`)
+		if n := self.ids[strings.TrimPrefix(ref, "#")]; n != nil {
+			// gradients and patterns are approximated by a single color
+			self.unsupported(n.name)
+			if c, ok := self.gradient_color(n); ok {
+				return svg_paint{color: c}, true
+			}
+		}
+		if fallback = strings.TrimSpace(fallback); fallback != "" {
+			return self.parse_paint(fallback)
+		}
+		return svg_paint{none: true}, true
+	}
+	c, ok := parse_svg_color(s)
+	return svg_paint{color: c}, ok
+}
+
+func parse_svg_style_attribute(s string) map[string]string {
+	ans := make(map[string]string)
+	for _, decl := range strings.Split(s, ";") {
+		if k, v, found := strings.Cut(decl, ":"); found {
+			ans[strings.TrimSpace(k)] = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "!important"))
+		}
+	}
+	return ans
+}
+
+func parse_svg_opacity(s string) float64 {
+	v, ok := parse_svg_length(s, 1)
+	if !ok {
+		return 1
+	}
+	return math.Max(0, math.Min(v, 1))
+}
+
+// Apply the presentation attributes and style properties of an element,
+// returning its opacity and display, which are not inherited
+func (self *svg_parser) apply_properties(n *svg_node, st *svg_style) (opacity float64, display_none bool) {
+	opacity = 1
+	apply := func(name, val string) {
+		val = strings.TrimSpace(val)
+		if val == "inherit" {
+			return
+		}
+		switch name {
+		case "fill":
+			if p, ok := self.parse_paint(val); ok {
+				st.fill = p
+			}
+		case "stroke":
+			if p, ok := self.parse_paint(val); ok {
+				st.stroke = p
+			}
+		case "color":
+			if c, ok := parse_svg_color(val); ok {
+				st.color = c
+			}
+		case "fill-opacity":
+			st.fill_opacity = parse_svg_opacity(val)
+		case "stroke-opacity":
+			st.stroke_opacity = parse_svg_opacity(val)
+		case "opacity":
+			opacity = parse_svg_opacity(val)
+		case "stroke-width":
+			if v, ok := parse_svg_length(val, math.Hypot(self.viewport.x, self.viewport.y)/math.Sqrt2); ok && v >= 0 {
+				st.stroke_width = v
+			}
+		case "stroke-linecap":
+			st.line_cap = val
+		case "stroke-linejoin":
+			st.line_join = val
+		case "stroke-miterlimit":
+			if v, err := strconv.ParseFloat(val, 64); err == nil && v >= 1 {
+				st.miter_limit = v
+			}
+		case "fill-rule":
+			if val == "evenodd" {
+				self.unsupported("fill-rule=evenodd")
+			}
+		case "clip-path", "mask", "filter":
+			if val != "none" {
+				self.unsupported(name)
+			}
+		case "display":
+			display_none = val == "none"
+		case "visibility":
+			st.hidden = val == "hidden" || val == "collapse"
+		}
+	}
+	for k, v := range n.attrs {
+		apply(k, v)
+	}
+	// style properties override presentation attributes
+	for k, v := range parse_svg_style_attribute(n.attrs["style"]) {
+		apply(k, v)
+	}
+	return
+}
+
+func (self *svg_parser) length(n *svg_node, name string, ref float64) float64 {
+	v, _ := parse_svg_length(n.attrs[name], ref)
+	return v
+}
+
+func svg_ellipse(cx, cy, rx, ry float64) []svg_segment {
+	p := func(x, y float64) svg_point { return svg_point{cx + x*rx, cy + y*ry} }
+	// the distance of the control points for approximating a quarter circle
+	const k = 0.5522847498
+	return []svg_segment{
+		{op: 'M', pts: [3]svg_point{p(1, 0)}},
+		{op: 'C', pts: [3]svg_point{p(1, k), p(k, 1), p(0, 1)}},
+		{op: 'C', pts: [3]svg_point{p(-k, 1), p(-1, k), p(-1, 0)}},
+		{op: 'C', pts: [3]svg_point{p(-1, -k), p(-k, -1), p(0, -1)}},
+		{op: 'C', pts: [3]svg_point{p(k, -1), p(1, -k), p(1, 0)}},
+		{op: 'Z'},
+	}
+}
+
+func (self *svg_parser) shape_path(n *svg_node) (path []svg_segment) {
+	vw, vh := self.viewport.x, self.viewport.y
+	diag := math.Hypot(vw, vh) / math.Sqrt2
+	switch n.name {
+	case "path":
+		return parse_svg_path(n.attrs["d"])
+	case "rect":
+		x, y := self.length(n, "x", vw), self.length(n, "y", vh)
+		w, h := self.length(n, "width", vw), self.length(n, "height", vh)
+		if w <= 0 || h <= 0 {
+			return nil
+		}
+		rx, has_rx := parse_svg_length(n.attrs["rx"], vw)
+		ry, has_ry := parse_svg_length(n.attrs["ry"], vh)
+		if !has_rx {
+			rx = ry
+		}
+		if !has_ry {
+			ry = rx
+		}
+		rx, ry = math.Max(0, math.Min(rx, w/2)), math.Max(0, math.Min(ry, h/2))
+		if rx == 0 || ry == 0 {
+			return []svg_segment{
+				{op: 'M', pts: [3]svg_point{{x, y}}}, {op: 'L', pts: [3]svg_point{{x + w, y}}},
+				{op: 'L', pts: [3]svg_point{{x + w, y + h}}}, {op: 'L', pts: [3]svg_point{{x, y + h}}}, {op: 'Z'},
+			}
+		}
+		path = append(path, svg_segment{op: 'M', pts: [3]svg_point{{x + rx, y}}})
+		corner := func(from, to svg_point) {
+			path = append(path, svg_arc(from, rx, ry, 0, false, true, to)...)
+		}
+		path = append(path, svg_segment{op: 'L', pts: [3]svg_point{{x + w - rx, y}}})
+		corner(svg_point{x + w - rx, y}, svg_point{x + w, y + ry})
+		path = append(path, svg_segment{op: 'L', pts: [3]svg_point{{x + w, y + h - ry}}})
+		corner(svg_point{x + w, y + h - ry}, svg_point{x + w - rx, y + h})
+		path = append(path, svg_segment{op: 'L', pts: [3]svg_point{{x + rx, y + h}}})
+		corner(svg_point{x + rx, y + h}, svg_point{x, y + h - ry})
+		path = append(path, svg_segment{op: 'L', pts: [3]svg_point{{x, y + ry}}})
+		corner(svg_point{x, y + ry}, svg_point{x + rx, y})
+		return append(path, svg_segment{op: 'Z'})
+	case "circle":
+		r := self.length(n, "r", diag)
+		if r <= 0 {
+			return nil
+		}
+		return svg_ellipse(self.length(n, "cx", vw), self.length(n, "cy", vh), r, r)
+	case "ellipse":
+		rx, ry := self.length(n, "rx", vw), self.length(n, "ry", vh)
+		if rx <= 0 || ry <= 0 {
+			return nil
+		}
+		return svg_ellipse(self.length(n, "cx", vw), self.length(n, "cy", vh), rx, ry)
+	case "line":
+		return []svg_segment{
+			{op: 'M', pts: [3]svg_point{{self.length(n, "x1", vw), self.length(n, "y1", vh)}}},
+			{op: 'L', pts: [3]svg_point{{self.length(n, "x2", vw), self.length(n, "y2", vh)}}},
+		}
+	case "polyline", "polygon":
+		nums := svg_numbers(n.attrs["points"])
+		for i := 0; i+1 < len(nums); i += 2 {
+			op := byte('L')
+			if i == 0 {
+				op = 'M'
+			}
+			path = append(path, svg_segment{op: op, pts: [3]svg_point{{nums[i], nums[i+1]}}})
+		}
+		if n.name == "polygon" && len(path) > 0 {
+			path = append(path, svg_segment{op: 'Z'})
+		}
+		return path
+	}
+	return nil
+}
+
+// Elements that are not rendered directly
+var svg_non_rendered_elements = map[string]bool{
+	"defs": true, "symbol": true, "clipPath": true, "mask": true, "linearGradient": true, "radialGradient": true,
+	"pattern": true, "marker": true, "title": true, "desc": true, "metadata": true, "style": true, "script": true,
+}
+
+const svg_max_depth = 64
+
+// The maximum number of elements rendered, as use elements that reference
+// groups containing use elements can expand exponentially
+const svg_max_walked = 100000
+
+func (self *svg_parser) walk(n *svg_node, st svg_style, m svg_affine, alpha float64, depth int) {
+	if depth > svg_max_depth || self.err != nil {
+		return
+	}
+	if self.num_walked++; self.num_walked > svg_max_walked {
+		self.err = fmt.Errorf("The SVG image has more than %d elements, after expanding use elements", svg_max_walked)
+		return
+	}
+	self.active[n] = true
+	defer delete(self.active, n)
+	opacity, display_none := self.apply_properties(n, &st)
+	if display_none {
+		return
+	}
+	// group opacity is approximated by applying it to every shape in the group
+	alpha *= opacity
+	if t, ok := n.attrs["transform"]; ok {
+		m = m.mul(parse_svg_transform(t))
+	}
+	switch n.name {
+	case "svg", "g", "a", "switch":
+		if n.name == "svg" && depth > 0 {
+			m = m.mul(svg_affine{1, 0, 0, 1, self.length(n, "x", self.viewport.x), self.length(n, "y", self.viewport.y)})
+		}
+		for _, c := range n.children {
+			self.walk(c, st, m, alpha, depth+1)
+			if n.name == "switch" {
+				// only the first child of a switch is rendered, ignoring conditions
+				break
+			}
+		}
+	case "use":
+		ref := self.ids[strings.TrimPrefix(n.attrs["href"], "#")]
+		if ref == nil {
+			return
+		}
+		if self.active[ref] {
+			self.err = fmt.Errorf("The SVG image has a use element that references itself or one of its ancestors")
+			return
+		}
+		m = m.mul(svg_affine{1, 0, 0, 1, self.length(n, "x", self.viewport.x), self.length(n, "y", self.viewport.y)})
+		if ref.name == "symbol" {
+			for _, c := range ref.children {
+				self.walk(c, st, m, alpha, depth+1)
+			}
+		} else {
+			self.walk(ref, st, m, alpha, depth+1)
+		}
+	case "path", "rect", "circle", "ellipse", "line", "polyline", "polygon":
+		path := self.shape_path(n)
+		if len(path) == 0 || st.hidden {
+			return
+		}
+		for i := range path {
+			for j := range path[i].pts {
+				path[i].pts[j] = m.apply(path[i].pts[j])
+			}
+		}
+		resolve := func(p svg_paint, opacity float64) color.NRGBA {
+			if p.none {
+				return color.NRGBA{}
+			}
+			c := p.color
+			if p.current_color {
+				c = st.color
+			}
+			c.A = uint8(math.Round(float64(c.A) * opacity * alpha))
+			return c
+		}
+		s := svg_shape{
+			path: path, stroke: resolve(st.stroke, st.stroke_opacity), stroke_width: st.stroke_width * m.scale(),
+			line_cap: st.line_cap, line_join: st.line_join, miter_limit: st.miter_limit,
+		}
+		if n.name != "line" {
+			s.fill = resolve(st.fill, st.fill_opacity)
+		}
+		if s.fill.A > 0 || (s.stroke.A > 0 && s.stroke_width > 0) {
+			self.ans.shapes = append(self.ans.shapes, s)
+		}
+	default:
+		if !svg_non_rendered_elements[n.name] {
+			self.unsupported(n.name)
+		}
+	}
+}
+
+// Parse an SVG image
+func ParseSVG(r io.Reader) (*SVG, error) {
+	root, err := parse_svg_tree(r)
+	if err != nil {
+		return nil, err
+	}
+	ans := &SVG{preserve_aspect: strings.TrimSpace(root.attrs["preserveAspectRatio"]) != "none"}
+	vb := svg_numbers(root.attrs["viewBox"])
+	has_view_box := len(vb) == 4 && vb[2] > 0 && vb[3] > 0
+	if has_view_box {
+		copy(ans.view_box[:], vb)
+	}
+	// percentages are relative to the size browsers use for images without one
+	w, has_w := parse_svg_length(root.attrs["width"], 300)
+	h, has_h := parse_svg_length(root.attrs["height"], 150)
+	has_w, has_h = has_w && w > 0, has_h && h > 0
+	switch {
+	case has_w && has_h:
+	case has_view_box && has_w:
+		h = w * vb[3] / vb[2]
+	case has_view_box && has_h:
+		w = h * vb[2] / vb[3]
+	case has_view_box:
+		w, h = vb[2], vb[3]
+	default:
+		if !has_w {
+			w = 300
+		}
+		if !has_h {
+			h = 150
+		}
+	}
+	ans.Width, ans.Height = w, h
+	if !has_view_box {
+		ans.view_box = [4]float64{0, 0, w, h}
+	}
+	p := svg_parser{ans: ans, ids: make(map[string]*svg_node), active: make(map[*svg_node]bool), viewport: svg_point{ans.view_box[2], ans.view_box[3]}}
+	p.index_ids(root)
+	st := svg_style{
+		fill: svg_paint{color: color.NRGBA{0, 0, 0, 255}}, stroke: svg_paint{none: true}, fill_opacity: 1, stroke_opacity: 1,
+		stroke_width: 1, miter_limit: 4, line_cap: "butt", line_join: "miter", color: color.NRGBA{0, 0, 0, 255},
+	}
+	p.walk(root, st, svg_identity, 1, 0)
+	if p.err != nil {
+		return nil, p.err
+	}
+	return ans, nil
+}
+
+// Flatten a path into polylines, with curves approximated by line segments
+// short enough to be smooth after the transform m
+func flatten_svg_path(path []svg_segment, m svg_affine) (polylines [][]svg_point, closed []bool) {
+	var cur []svg_point
+	finish := func(is_closed bool) {
+		if len(cur) > 0 {
+			polylines, closed = append(polylines, cur), append(closed, is_closed)
+		}
+		cur = nil
+	}
+	for _, s := range path {
+		switch s.op {
+		case 'M':
+			if len(cur) > 1 {
+				finish(false)
+			}
+			cur = []svg_point{m.apply(s.pts[0])}
+		case 'L':
+			if cur == nil {
+				continue
+			}
+			cur = append(cur, m.apply(s.pts[0]))
+		case 'C':
+			if cur == nil {
+				continue
+			}
+			p0 := cur[len(cur)-1]
+			c1, c2, p := m.apply(s.pts[0]), m.apply(s.pts[1]), m.apply(s.pts[2])
+			length := math.Hypot(c1.x-p0.x, c1.y-p0.y) + math.Hypot(c2.x-c1.x, c2.y-c1.y) + math.Hypot(p.x-c2.x, p.y-c2.y)
+			n := int(math.Max(1, math.Min(256, math.Ceil(length/2))))
+			for i := 1; i <= n; i++ {
+				t := float64(i) / float64(n)
+				u := 1 - t
+				cur = append(cur, svg_point{
+					u*u*u*p0.x + 3*u*u*t*c1.x + 3*u*t*t*c2.x + t*t*t*p.x,
+					u*u*u*p0.y + 3*u*u*t*c1.y + 3*u*t*t*c2.y + t*t*t*p.y,
+				})
+			}
+		case 'Z':
+			if len(cur) > 1 {
+				start := cur[0]
+				finish(true)
+				// a path can continue from the start of a closed subpath without a move
+				cur = []svg_point{start}
+			}
+		}
+	}
+	if len(cur) > 1 {
+		finish(false)
+	}
+	return
+}
+
+// Add a polygon to the rasterizer, oriented counter-clockwise so that
+// overlapping polygons add up instead of cancelling out
+func add_svg_polygon(z *vector.Rasterizer, pts []svg_point) {
+	if len(pts) < 3 {
+		return
+	}
+	area := 0.0
+	for i, p := range pts {
+		q := pts[(i+1)%len(pts)]
+		area += p.x*q.y - q.x*p.y
+	}
+	if area < 0 {
+		reversed := make([]svg_point, len(pts))
+		for i, p := range pts {
+			reversed[len(pts)-1-i] = p
+		}
+		pts = reversed
+	}
+	z.MoveTo(float32(pts[0].x), float32(pts[0].y))
+	for _, p := range pts[1:] {
+		z.LineTo(float32(p.x), float32(p.y))
+	}
+	z.ClosePath()
+}
+
+func svg_circle_polygon(c svg_point, r float64) []svg_point {
+	n := int(math.Max(8, math.Min(128, math.Ceil(2*math.Pi*r/2))))
+	ans := make([]svg_point, n)
+	for i := range ans {
+		sin, cos := math.Sincos(2 * math.Pi * float64(i) / float64(n))
+		ans[i] = svg_point{c.x + r*cos, c.y + r*sin}
+	}
+	return ans
+}
+
+// Add the outline of a stroked polyline to the rasterizer as the union of a
+// rectangle for every segment and polygons for the joins and caps
+func add_svg_stroke(z *vector.Rasterizer, pts []svg_point, closed bool, s *svg_shape, width float64) {
+	hw := width / 2
+	// remove repeated points as they have no direction
+	dedup := pts[:0:0]
+	for _, p := range pts {
+		if len(dedup) == 0 || p != dedup[len(dedup)-1] {
+			dedup = append(dedup, p)
+		}
+	}
+	pts = dedup
+	if closed && len(pts) > 1 && pts[0] == pts[len(pts)-1] {
+		pts = pts[:len(pts)-1]
+	}
+	if len(pts) == 1 {
+		// zero length subpaths are only drawn with round or square caps
+		switch s.line_cap {
+		case "round":
+			add_svg_polygon(z, svg_circle_polygon(pts[0], hw))
+		case "square":
+			p := pts[0]
+			add_svg_polygon(z, []svg_point{{p.x - hw, p.y - hw}, {p.x + hw, p.y - hw}, {p.x + hw, p.y + hw}, {p.x - hw, p.y + hw}})
+		}
+		return
+	}
+	num_segments := len(pts) - 1
+	if closed {
+		num_segments = len(pts)
+	}
+	normal := func(i int) (nx, ny, dx, dy float64) {
+		a, b := pts[i], pts[(i+1)%len(pts)]
+		l := math.Hypot(b.x-a.x, b.y-a.y)
+		dx, dy = (b.x-a.x)/l, (b.y-a.y)/l
+		return -dy * hw, dx * hw, dx, dy
+	}
+	for i := 0; i < num_segments; i++ {
+		a, b := pts[i], pts[(i+1)%len(pts)]
+		nx, ny, dx, dy := normal(i)
+		var sa, sb float64
+		if !closed && s.line_cap == "square" {
+			if i == 0 {
+				sa = hw
+			}
+			if i == num_segments-1 {
+				sb = hw
+			}
+		}
+		a = svg_point{a.x - dx*sa, a.y - dy*sa}
+		b = svg_point{b.x + dx*sb, b.y + dy*sb}
+		add_svg_polygon(z, []svg_point{{a.x + nx, a.y + ny}, {b.x + nx, b.y + ny}, {b.x - nx, b.y - ny}, {a.x - nx, a.y - ny}})
+	}
+	// joins between consecutive segments
+	for i := 0; i < num_segments; i++ {
+		if !closed && i == num_segments-1 {
+			break
+		}
+		v := pts[(i+1)%len(pts)]
+		if s.line_join == "round" {
+			add_svg_polygon(z, svg_circle_polygon(v, hw))
+			continue
+		}
+		n1x, n1y, d1x, d1y := normal(i)
+		n2x, n2y, d2x, d2y := normal((i + 1) % len(pts))
+		// the outer side of the turn
+		if d1x*d2y-d1y*d2x > 0 {
+			n1x, n1y, n2x, n2y = -n1x, -n1y, -n2x, -n2y
+		}
+		p1, p2 := svg_point{v.x + n1x, v.y + n1y}, svg_point{v.x + n2x, v.y + n2y}
+		poly := []svg_point{v, p1, p2}
+		if s.line_join != "bevel" {
+			// the miter is where the outer edges meet
+			cos_theta := -(d1x*d2x + d1y*d2y)
+			if ratio := 1 / math.Sqrt(math.Max(1e-12, (1-cos_theta)/2)); ratio <= s.miter_limit {
+				bx, by := n1x+n2x, n1y+n2y
+				if bl := math.Hypot(bx, by); bl > 0 {
+					ml := hw * ratio
+					poly = []svg_point{v, p1, {v.x + bx/bl*ml, v.y + by/bl*ml}, p2}
+				}
+			}
+		}
+		add_svg_polygon(z, poly)
+	}
+	if !closed && s.line_cap == "round" {
+		add_svg_polygon(z, svg_circle_polygon(pts[0], hw))
+		add_svg_polygon(z, svg_circle_polygon(pts[len(pts)-1], hw))
+	}
+}
+
+// The maximum number of pixels in a rasterized SVG image
+const SVGMaxPixels = 1 << 26
+
+// Render the image at the specified size in pixels. Unless the image sets
+// preserveAspectRatio to none, it is scaled uniformly and centered if the
+// aspect ratio of the size is different from its own.
+func (self *SVG) Rasterize(width, height int) (*image.NRGBA, error) {
+	width, height = utils.Max(1, width), utils.Max(1, height)
+	if int64(width)*int64(height) > SVGMaxPixels {
+		return nil, fmt.Errorf("Cannot rasterize SVG image at %dx%d as it is larger than the maximum of %d pixels", width, height, SVGMaxPixels)
+	}
+	vb := self.view_box
+	sx, sy := float64(width)/vb[2], float64(height)/vb[3]
+	tx, ty := 0.0, 0.0
+	if self.preserve_aspect && sx != sy {
+		s := math.Min(sx, sy)
+		tx, ty = (float64(width)-vb[2]*s)/2, (float64(height)-vb[3]*s)/2
+		sx, sy = s, s
+	}
+	to_pixels := svg_affine{sx, 0, 0, sy, tx - vb[0]*sx, ty - vb[1]*sy}
+	scale := to_pixels.scale()
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	z := vector.NewRasterizer(width, height)
+	for i := range self.shapes {
+		s := &self.shapes[i]
+		polylines, closed := flatten_svg_path(s.path, to_pixels)
+		if s.fill.A > 0 {
+			z.Reset(width, height)
+			for _, pl := range polylines {
+				if len(pl) < 3 {
+					continue
+				}
+				z.MoveTo(float32(pl[0].x), float32(pl[0].y))
+				for _, p := range pl[1:] {
+					z.LineTo(float32(p.x), float32(p.y))
+				}
+				z.ClosePath()
+			}
+			z.Draw(canvas, canvas.Bounds(), image.NewUniform(s.fill), image.Point{})
+		}
+		if s.stroke.A > 0 && s.stroke_width > 0 {
+			z.Reset(width, height)
+			for j, pl := range polylines {
+				add_svg_stroke(z, pl, closed[j], s, s.stroke_width*scale)
+			}
+			z.Draw(canvas, canvas.Bounds(), image.NewUniform(s.stroke), image.Point{})
+		}
+	}
+	ans := image.NewNRGBA(canvas.Bounds())
+	draw.Draw(ans, ans.Bounds(), canvas, image.Point{}, draw.Src)
+	return ans, nil
+}
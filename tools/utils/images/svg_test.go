@@ -0,0 +1,147 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var _ = fmt.Print
+
+func TestSVGPathParsing(t *testing.T) {
+	points := func(d string) (ans []string) {
+		for _, s := range parse_svg_path(d) {
+			switch s.op {
+			case 'Z':
+				ans = append(ans, "Z")
+			case 'C':
+				p := s.pts[2]
+				ans = append(ans, fmt.Sprintf("C%g,%g", math.Round(p.x*1000)/1000, math.Round(p.y*1000)/1000))
+			default:
+				ans = append(ans, fmt.Sprintf("%c%g,%g", s.op, s.pts[0].x, s.pts[0].y))
+			}
+		}
+		return
+	}
+	for d, expected := range map[string]string{
+		"M1 2L3 4":                  "M1,2 L3,4",
+		"m1,2 3,4 h5 v-1 z l1 1":    "M1,2 L4,6 L9,6 L9,5 Z L2,3",
+		"M0-1.5.5e1 1":              "M0,-1.5 L5,1",
+		"M0 0Q5 5 10 0T20 0":        "M0,0 C10,0 C20,0",
+		"M0 0 C1 1 2 2 3 0 s 1 1 2": "M0,0 C3,0",
+		"M0 0a5 5 0 1010 0":         "M0,0 C5,5 C10,0",
+		"M0 0 L 1":                  "M0,0",
+		"L1 1":                      "",
+	} {
+		if diff := cmp.Diff(expected, strings.Join(points(d), " ")); diff != "" {
+			t.Fatalf("Failed to parse path: %#v\n%s", d, diff)
+		}
+	}
+}
+
+func TestSVG(t *testing.T) {
+	for header, expected := range map[string]bool{
+		`<svg xmlns="http://www.w3.org/2000/svg">`:                         true,
+		"\xef\xbb\xbf<?xml version='1.0'?>\n<!-- x --><!DOCTYPE svg><svg>": true,
+		`<svgx>`:                false,
+		`<html><svg></svg>`:     false,
+		`<?xml version='1.0'?>`: false,
+	} {
+		if IsSVG([]byte(header)) != expected {
+			t.Fatalf("IsSVG(%#v) != %v", header, expected)
+		}
+	}
+
+	s, err := ParseSVG(strings.NewReader(`<?xml version="1.0"?>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="20pt" viewBox="0 0 20 10">
+<defs><linearGradient id="g"><stop offset="0" stop-color="#00f"/><stop offset="1" style="stop-color: blue"/></linearGradient>
+<rect id="r" width="5" height="10"/></defs>
+<rect width="10" height="10" fill="red"/>
+<g transform="translate(10 0)" style="fill: url(#g)"><use xlink:href="#r" x="5"/></g>
+<circle cx="12.5" cy="5" r="2" fill="none" stroke="#0f0" stroke-width="1"/>
+<text>ignored</text>
+</svg>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(s.Width-20*4.0/3) > 1e-9 || math.Abs(s.Height-10*4.0/3) > 1e-9 {
+		t.Fatalf("Incorrect intrinsic size: %gx%g", s.Width, s.Height)
+	}
+	if diff := cmp.Diff([]string{"linearGradient", "text"}, s.Unsupported); diff != "" {
+		t.Fatalf("Incorrect unsupported elements:\n%s", diff)
+	}
+	img, err := s.Rasterize(40, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 40 || b.Dy() != 20 {
+		t.Fatalf("Incorrect size: %v", b)
+	}
+	for _, x := range []struct {
+		x, y     int
+		expected color.NRGBA
+	}{
+		{5, 10, color.NRGBA{255, 0, 0, 255}},
+		{35, 10, color.NRGBA{0, 0, 255, 255}},
+		{25, 2, color.NRGBA{}},
+		// on the stroke of the circle and inside it
+		{24, 13, color.NRGBA{0, 255, 0, 255}},
+		{25, 10, color.NRGBA{}},
+	} {
+		if c := img.NRGBAAt(x.x, x.y); c != x.expected {
+			t.Fatalf("Incorrect pixel at (%d, %d): %v != %v", x.x, x.y, c, x.expected)
+		}
+	}
+	// the aspect ratio is preserved, centering the image
+	if img, err = s.Rasterize(20, 20); err != nil {
+		t.Fatal(err)
+	}
+	if c := img.NRGBAAt(2, 2); c.A != 0 {
+		t.Fatalf("Area outside the image is not transparent: %v", c)
+	}
+	if c := img.NRGBAAt(2, 10); c != (color.NRGBA{255, 0, 0, 255}) {
+		t.Fatalf("Incorrect pixel in centered image: %v", c)
+	}
+}
+
+func TestSVGLimits(t *testing.T) {
+	// each group uses the previous one eight times, so expanding them all
+	// would take forever
+	b := strings.Builder{}
+	b.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><defs><rect id="g0" width="1" height="1"/>`)
+	for i := 1; i <= 12; i++ {
+		fmt.Fprintf(&b, `<g id="g%d">`, i)
+		for j := 0; j < 8; j++ {
+			fmt.Fprintf(&b, `<use href="#g%d"/>`, i-1)
+		}
+		b.WriteString(`</g>`)
+	}
+	b.WriteString(`</defs><use href="#g12"/></svg>`)
+	if _, err := ParseSVG(strings.NewReader(b.String())); err == nil {
+		t.Fatal("No error for an SVG image with too many elements")
+	}
+	for _, svg := range []string{
+		`<svg xmlns="http://www.w3.org/2000/svg"><g id="a"><use href="#a"/></g></svg>`,
+		`<svg xmlns="http://www.w3.org/2000/svg"><defs><g id="a"><use href="#b"/></g><g id="b"><use href="#a"/></g></defs><use href="#a"/></svg>`,
+	} {
+		if _, err := ParseSVG(strings.NewReader(svg)); err == nil {
+			t.Fatalf("No error for an SVG image with a cycle of use elements: %s", svg)
+		}
+	}
+	s, err := ParseSVG(strings.NewReader(`<svg xmlns="http://www.w3.org/2000/svg"><path d="M0 0h5v5z" fill-rule="evenodd"/></svg>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"fill-rule=evenodd"}, s.Unsupported); diff != "" {
+		t.Fatalf("Incorrect unsupported features:\n%s", diff)
+	}
+	if _, err = s.Rasterize(100000, 100000); err == nil {
+		t.Fatal("No error for rasterizing an SVG image at a huge size")
+	}
+}
@@ -25,7 +25,7 @@ func (c NRGBColor) RGBA() (r, g, b, a uint32) {
 	g |= g << 8
 	b = uint32(c.B)
 	b |= b << 8
-	a = 65280 // ( 255 << 8 )
+	a = 0xffff
 	return
 }
 
@@ -73,14 +73,14 @@ func (p *NRGB) NRGBAt(x, y int) NRGBColor {
 		return NRGBColor{}
 	}
 	i := p.PixOffset(x, y)
-	s := p.Pix[i : i+4 : i+4] // Small cap improves performance, see https://golang.org/issue/27857
+	s := p.Pix[i : i+3 : i+3] // Small cap improves performance, see https://golang.org/issue/27857
 	return NRGBColor{s[0], s[1], s[2]}
 }
 
 // PixOffset returns the index of the first element of Pix that corresponds to
 // the pixel at (x, y).
 func (p *NRGB) PixOffset(x, y int) int {
-	return (y-p.Rect.Min.Y)*p.Stride + (x-p.Rect.Min.X)*4
+	return (y-p.Rect.Min.Y)*p.Stride + (x-p.Rect.Min.X)*3
 }
 
 func (p *NRGB) Set(x, y int, c color.Color) {
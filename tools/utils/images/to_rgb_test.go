@@ -0,0 +1,42 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestNRGB(t *testing.T) {
+	img := NewNRGB(image.Rect(0, 0, 3, 2))
+	img.SetNRGBA(2, 1, color.NRGBA{1, 2, 3, 255})
+	if c := img.NRGBAt(2, 1); c != (NRGBColor{1, 2, 3}) {
+		t.Fatalf("Incorrect pixel: %v", c)
+	}
+	if !bytes.Equal(img.Pix[len(img.Pix)-3:], []byte{1, 2, 3}) {
+		t.Fatalf("Pixel stored at the wrong offset: %v", img.Pix)
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, bl, a := decoded.At(2, 1).RGBA(); r>>8 != 1 || g>>8 != 2 || bl>>8 != 3 || a != 0xffff {
+		t.Fatalf("Incorrect pixel after PNG round trip: %v", decoded.At(2, 1))
+	}
+	// pixels are fully opaque, so the brightest ones do not overflow when
+	// converted to other color models
+	img.SetNRGBA(0, 0, color.NRGBA{255, 128, 0, 255})
+	if c := color.NRGBAModel.Convert(img.At(0, 0)); c != (color.NRGBA{255, 128, 0, 255}) {
+		t.Fatalf("Incorrect conversion of a bright pixel: %v", c)
+	}
+}
@@ -0,0 +1,65 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+var _ = fmt.Print
+
+// Adjustments to the tones of an image. Gamma and Brightness are applied in
+// linear light, Contrast is applied around mid gray in sRGB, where the
+// change looks the same in the shadows and highlights.
+type ToneAdjustment struct {
+	// Values greater than one brighten the mid tones, less than one darken them
+	Gamma float64
+	// A percentage from -100 to 100 by which to change the amount of light
+	Brightness float64
+	// A percentage from -100 to 100, -100 makes the image flat gray and 100
+	// makes every pixel either black or white
+	Contrast float64
+}
+
+func srgb_to_linear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func (self ToneAdjustment) IsIdentity() bool {
+	return self.Gamma == 1 && self.Brightness == 0 && self.Contrast == 0
+}
+
+// The factor by which Contrast multiplies the distance of values from mid
+// gray, the same as used by the ImageMagick -brightness-contrast operator
+func (self ToneAdjustment) ContrastSlope() float64 {
+	return math.Tan((self.Contrast + 100) * math.Pi / 400)
+}
+
+// The map from the values of a channel before adjustment to after. The same
+// map is used for all channels, so gray pixels remain gray.
+func (self ToneAdjustment) Map() (ans [256]uint8) {
+	slope := self.ContrastSlope()
+	for v := range ans {
+		l := math.Pow(srgb_to_linear(float64(v)/255), 1/self.Gamma) * (1 + self.Brightness/100)
+		s := (linear_to_srgb(math.Min(1, l))-0.5)*slope + 0.5
+		ans[v] = uint8(math.Round(math.Max(0, math.Min(1, s)) * 255))
+	}
+	return
+}
+
+// Return a copy of img with its tones adjusted, the alpha channel is unchanged
+func (self ToneAdjustment) Apply(img image.Image) *image.NRGBA {
+	ans := imaging.Clone(img)
+	m := self.Map()
+	for i := 0; i+3 < len(ans.Pix); i += 4 {
+		ans.Pix[i], ans.Pix[i+1], ans.Pix[i+2] = m[ans.Pix[i]], m[ans.Pix[i+1]], m[ans.Pix[i+2]]
+	}
+	return ans
+}
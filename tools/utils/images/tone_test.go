@@ -0,0 +1,76 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestToneAdjustment(t *testing.T) {
+	identity := ToneAdjustment{Gamma: 1}
+	if !identity.IsIdentity() {
+		t.Fatalf("Default adjustment is not the identity")
+	}
+	for v, x := range identity.Map() {
+		if int(x) != v {
+			t.Fatalf("Identity maps %d to %d", v, x)
+		}
+	}
+	for _, tc := range []struct {
+		adj      ToneAdjustment
+		brighter bool
+	}{
+		{ToneAdjustment{Gamma: 2}, true},
+		{ToneAdjustment{Gamma: 0.5}, false},
+		{ToneAdjustment{Gamma: 1, Brightness: 50}, true},
+		{ToneAdjustment{Gamma: 1, Brightness: -50}, false},
+	} {
+		m := tc.adj.Map()
+		if m[0] != 0 {
+			t.Fatalf("%+v does not keep black: %d", tc.adj, m[0])
+		}
+		if (m[128] > 128) != tc.brighter || m[128] == 128 {
+			t.Fatalf("%+v maps mid gray to %d", tc.adj, m[128])
+		}
+		for v := 1; v < 256; v++ {
+			if m[v] < m[v-1] {
+				t.Fatalf("%+v is not monotonic at %d", tc.adj, v)
+			}
+		}
+	}
+	// values are clamped rather than overflowing
+	if m := (ToneAdjustment{Gamma: 1, Brightness: 100}).Map(); m[255] != 255 || m[250] != 255 {
+		t.Fatalf("Bright values not clamped: %v", m[250:])
+	}
+	m := ToneAdjustment{Gamma: 1, Contrast: 50}.Map()
+	if m[64] >= 64 || m[192] <= 192 || m[0] != 0 || m[255] != 255 {
+		t.Fatalf("Contrast not increased: %d %d", m[64], m[192])
+	}
+	m = ToneAdjustment{Gamma: 1, Contrast: -100}.Map()
+	if m[0] != 128 || m[255] != 128 {
+		t.Fatalf("Minimum contrast is not flat gray: %d %d", m[0], m[255])
+	}
+	m = ToneAdjustment{Gamma: 1, Contrast: 100}.Map()
+	if m[100] != 0 || m[200] != 255 {
+		t.Fatalf("Maximum contrast is not black and white: %d %d", m[100], m[200])
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{90, 90, 90, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{10, 200, 30, 100})
+	a := ToneAdjustment{Gamma: 1.8, Brightness: 20, Contrast: 30}.Apply(img)
+	if c := a.NRGBAAt(0, 0); c.R != c.G || c.G != c.B || c.R == 90 {
+		t.Fatalf("Gray pixel was colorized or unchanged: %v", c)
+	}
+	if c := a.NRGBAAt(1, 0); c.A != 100 {
+		t.Fatalf("Alpha was changed: %v", c)
+	}
+	if img.NRGBAAt(0, 0).R != 90 {
+		t.Fatalf("The original image was modified")
+	}
+}
@@ -0,0 +1,65 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"fmt"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func TestFlipPixels(t *testing.T) {
+	// a non-square image with an odd number of rows, so that the middle row
+	// stays in place, and every pixel distinct
+	const width, height = 5, 3
+	for _, bytes_per_pixel := range []int{3, 4} {
+		pixel := func(pix []uint8, x, y int) []uint8 {
+			i := (y*width + x) * bytes_per_pixel
+			return pix[i : i+bytes_per_pixel]
+		}
+		make_image := func() []uint8 {
+			pix := make([]uint8, width*height*bytes_per_pixel)
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					p := pixel(pix, x, y)
+					for c := range p {
+						p[c] = uint8(10*y + x + 100*c)
+					}
+				}
+			}
+			return pix
+		}
+		orig := make_image()
+		ctx := Context{}
+		for _, tc := range []struct {
+			name string
+			flip func([]uint8)
+			// the source of the pixel that ends up at x, y
+			src func(x, y int) (int, int)
+		}{
+			{"vertical", func(p []uint8) { ctx.FlipPixelsV(bytes_per_pixel, width, height, p) }, func(x, y int) (int, int) { return x, height - 1 - y }},
+			{"horizontal", func(p []uint8) { ctx.FlipPixelsH(bytes_per_pixel, width, height, p) }, func(x, y int) (int, int) { return width - 1 - x, y }},
+			{"both", func(p []uint8) {
+				ctx.FlipPixelsV(bytes_per_pixel, width, height, p)
+				ctx.FlipPixelsH(bytes_per_pixel, width, height, p)
+			}, func(x, y int) (int, int) { return width - 1 - x, height - 1 - y }},
+		} {
+			pix := make_image()
+			tc.flip(pix)
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					sx, sy := tc.src(x, y)
+					if actual, expected := pixel(pix, x, y), pixel(orig, sx, sy); string(actual) != string(expected) {
+						t.Fatalf("Incorrect %s flip with %d bytes per pixel at %d, %d: %v != %v", tc.name, bytes_per_pixel, x, y, actual, expected)
+					}
+				}
+			}
+			// flipping twice restores the image
+			tc.flip(pix)
+			if string(pix) != string(orig) {
+				t.Fatalf("Flipping twice with %s did not restore the image", tc.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,449 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"kitty/tools/utils"
+)
+
+var _ = fmt.Print
+
+// Decode as much as possible of a PNG or JPEG image that is truncated or
+// whose image data is corrupt. The parts of the image that could not be
+// decoded are transparent for PNG and filled with a flat color for JPEG.
+// Fails if no image data at all could be recovered.
+func DecodeTruncated(data []byte) (image.Image, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte(png_signature)):
+		return decode_truncated_png(data)
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return decode_truncated_jpeg(data)
+	}
+	return nil, fmt.Errorf("Recovering damaged images is only supported for PNG and JPEG")
+}
+
+// PNG {{{
+
+// Return true if the chunks of the PNG image end before an IEND chunk, which
+// almost always means it is truncated. Data after the IEND chunk is ignored.
+// Leaves r at the start of the image.
+func IsTruncatedPNG(r io.ReadSeeker) bool {
+	defer r.Seek(0, io.SeekStart)
+	if _, err := r.Seek(int64(len(png_signature)), io.SeekStart); err != nil {
+		return true
+	}
+	var b [8]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return true
+		}
+		size := int64(binary.BigEndian.Uint32(b[:]))
+		if string(b[4:8]) == "IEND" {
+			// the CRC must be present as well
+			_, err := io.ReadFull(r, b[:4])
+			return err != nil
+		}
+		if _, err := r.Seek(size+4, io.SeekCurrent); err != nil {
+			return true
+		}
+	}
+}
+
+// The starting offsets, steps and the size of the area each pixel covers
+// until the next pass fills it in, for the seven Adam7 interlacing passes
+var adam7_passes = [7]struct{ x, y, dx, dy, bw, bh int }{
+	{0, 0, 8, 8, 8, 8},
+	{4, 0, 8, 8, 4, 8},
+	{0, 4, 4, 8, 4, 4},
+	{2, 0, 4, 4, 2, 4},
+	{0, 2, 2, 4, 2, 2},
+	{1, 0, 2, 2, 1, 2},
+	{0, 1, 1, 2, 1, 1},
+}
+
+func decode_truncated_png(data []byte) (image.Image, error) {
+	var ihdr []byte
+	var ancillary, idat bytes.Buffer
+	pos := len(png_signature)
+	for pos+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		chunk_type := string(data[pos+4 : pos+8])
+		end := pos + 8 + size
+		truncated := size < 0 || end > len(data)
+		if truncated {
+			end = len(data)
+		}
+		chunk := data[pos+8 : end]
+		switch chunk_type {
+		case "IHDR":
+			if truncated || len(chunk) != 13 {
+				return nil, fmt.Errorf("PNG image header is truncated")
+			}
+			ihdr = chunk
+		case "PLTE", "tRNS":
+			if !truncated {
+				write_png_chunk(&ancillary, chunk_type, chunk)
+			}
+		case "IDAT":
+			idat.Write(chunk)
+		}
+		if truncated || chunk_type == "IEND" {
+			break
+		}
+		pos = end + 4 // skip the CRC, corrupt chunks are used as is
+	}
+	if ihdr == nil {
+		return nil, fmt.Errorf("PNG image has no header")
+	}
+	width, height := int(binary.BigEndian.Uint32(ihdr)), int(binary.BigEndian.Uint32(ihdr[4:]))
+	depth, interlaced := int(ihdr[8]), ihdr[12] != 0
+	channels := map[byte]int{0: 1, 2: 3, 3: 1, 4: 2, 6: 4}[ihdr[9]]
+	if width <= 0 || height <= 0 || channels == 0 || depth == 0 {
+		return nil, fmt.Errorf("PNG image has an invalid header")
+	}
+	row_size := func(w int) int { return 1 + (w*channels*depth+7)/8 }
+	expected := 0
+	if interlaced {
+		for _, p := range adam7_passes {
+			if pw, ph := (width-p.x+p.dx-1)/p.dx, (height-p.y+p.dy-1)/p.dy; pw > 0 && ph > 0 {
+				expected += ph * row_size(pw)
+			}
+		}
+	} else {
+		expected = height * row_size(width)
+	}
+	// read as much of the compressed image data as can be decompressed,
+	// ignoring the error at the point where it is truncated or corrupt
+	var raw []byte
+	if zr, err := zlib.NewReader(bytes.NewReader(idat.Bytes())); err == nil {
+		raw, _ = io.ReadAll(io.LimitReader(zr, int64(expected)))
+	}
+	// decode rows of filtered scanlines as a PNG image of the specified size
+	decode_rows := func(w, h int, rows []byte) (image.Image, error) {
+		var b bytes.Buffer
+		b.WriteString(png_signature)
+		hdr := bytes.Clone(ihdr)
+		binary.BigEndian.PutUint32(hdr, uint32(w))
+		binary.BigEndian.PutUint32(hdr[4:], uint32(h))
+		hdr[12] = 0
+		write_png_chunk(&b, "IHDR", hdr)
+		b.Write(ancillary.Bytes())
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(rows)
+		zw.Close()
+		write_png_chunk(&b, "IDAT", z.Bytes())
+		write_png_chunk(&b, "IEND", nil)
+		return png.Decode(&b)
+	}
+	if !interlaced {
+		rs := row_size(width)
+		num_rows := utils.Min(len(raw)/rs, height)
+		if num_rows == 0 {
+			return nil, fmt.Errorf("PNG image has no recoverable image data")
+		}
+		img, err := decode_rows(width, num_rows, raw[:num_rows*rs])
+		if err != nil || num_rows == height {
+			return img, err
+		}
+		ans := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(ans, img.Bounds(), img, image.Point{}, draw.Src)
+		return ans, nil
+	}
+	// Draw each pixel of the interlacing passes that are available as a block
+	// covering the pixels that later passes would have filled in, the way
+	// browsers display interlaced images while they are loading
+	ans := image.NewNRGBA(image.Rect(0, 0, width, height))
+	found_data := false
+	for _, p := range adam7_passes {
+		pw, ph := (width-p.x+p.dx-1)/p.dx, (height-p.y+p.dy-1)/p.dy
+		if pw <= 0 || ph <= 0 {
+			continue
+		}
+		rs := row_size(pw)
+		num_rows := utils.Min(len(raw)/rs, ph)
+		if num_rows == 0 {
+			break
+		}
+		img, err := decode_rows(pw, num_rows, raw[:num_rows*rs])
+		if err != nil {
+			break
+		}
+		raw = raw[num_rows*rs:]
+		found_data = true
+		pass := image.NewNRGBA(img.Bounds())
+		draw.Draw(pass, pass.Bounds(), img, image.Point{}, draw.Src)
+		for r := 0; r < num_rows; r++ {
+			y := p.y + r*p.dy
+			for c := 0; c < pw; c++ {
+				x := p.x + c*p.dx
+				px := pass.Pix[pass.PixOffset(c, r):][:4]
+				for by := y; by < utils.Min(y+p.bh, height); by++ {
+					for bx := x; bx < utils.Min(x+p.bw, width); bx++ {
+						copy(ans.Pix[ans.PixOffset(bx, by):], px)
+					}
+				}
+			}
+		}
+		if num_rows < ph {
+			break
+		}
+	}
+	if !found_data {
+		return nil, fmt.Errorf("PNG image has no recoverable image data")
+	}
+	return ans, nil
+}
+
+// }}}
+
+// JPEG {{{
+
+type huffman_code struct {
+	code   uint32
+	length int
+}
+
+// Find the code for the specified symbol in a DHT table definition
+func find_huffman_code(counts []byte, symbols []byte, symbol byte) (ans huffman_code, found bool) {
+	code, idx := uint32(0), 0
+	for l, count := range counts {
+		for i := 0; i < int(count) && idx < len(symbols); i++ {
+			if symbols[idx] == symbol {
+				return huffman_code{code: code, length: l + 1}, true
+			}
+			code++
+			idx++
+		}
+		code <<= 1
+	}
+	return
+}
+
+type jpeg_bit_writer struct {
+	buf     bytes.Buffer
+	pending uint32
+	n       int
+}
+
+func (self *jpeg_bit_writer) write_byte(b byte) {
+	self.buf.WriteByte(b)
+	if b == 0xff {
+		self.buf.WriteByte(0) // byte stuffing
+	}
+}
+
+func (self *jpeg_bit_writer) write(c huffman_code) {
+	for i := c.length - 1; i >= 0; i-- {
+		self.pending = self.pending<<1 | (c.code>>i)&1
+		if self.n++; self.n == 8 {
+			self.write_byte(byte(self.pending))
+			self.pending, self.n = 0, 0
+		}
+	}
+}
+
+// Pad the last byte with one bits, as per section F.1.2.3
+func (self *jpeg_bit_writer) flush() {
+	if self.n > 0 {
+		self.write_byte(byte(self.pending<<(8-self.n) | (1<<(8-self.n) - 1)))
+		self.pending, self.n = 0, 0
+	}
+}
+
+type jpeg_component struct {
+	id, h, v int
+}
+
+type jpeg_scan_component struct {
+	jpeg_component
+	dc, ac huffman_code
+}
+
+func decode_truncated_jpeg(data []byte) (image.Image, error) {
+	var components []jpeg_component
+	var dc_codes, ac_codes [4]*huffman_code
+	width, height, max_h, max_v, restart_interval := 0, 0, 1, 1, 0
+	progressive, seen_scan := false, false
+	pos := 2
+	complete_upto := 0 // the end of the last complete scan
+	for pos+2 <= len(data) {
+		if data[pos] != 0xff {
+			pos++
+			continue
+		}
+		marker_start, marker := pos, data[pos+1]
+		pos += 2
+		if marker == 0xff || marker == 0 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			if marker == 0xff {
+				pos--
+			}
+			continue
+		}
+		if marker == 0xd9 {
+			return nil, fmt.Errorf("JPEG image is not truncated and its image data cannot be recovered")
+		}
+		if pos+2 > len(data) {
+			break
+		}
+		end := pos + int(binary.BigEndian.Uint16(data[pos:]))
+		if end > len(data) {
+			break
+		}
+		segment := data[pos+2 : end]
+		switch marker {
+		case 0xc0, 0xc1, 0xc2:
+			progressive = marker == 0xc2
+			if len(segment) < 6 || len(segment) < 6+3*int(segment[5]) {
+				return nil, fmt.Errorf("JPEG image has an invalid frame header")
+			}
+			height, width = int(binary.BigEndian.Uint16(segment[1:])), int(binary.BigEndian.Uint16(segment[3:]))
+			for i := 0; i < int(segment[5]); i++ {
+				c := segment[6+3*i:]
+				components = append(components, jpeg_component{id: int(c[0]), h: int(c[1] >> 4), v: int(c[1] & 0xf)})
+				max_h, max_v = utils.Max(max_h, int(c[1]>>4)), utils.Max(max_v, int(c[1]&0xf))
+			}
+		case 0xc3, 0xc5, 0xc6, 0xc7, 0xc9, 0xca, 0xcb, 0xcd, 0xce, 0xcf:
+			return nil, fmt.Errorf("Recovering lossless, hierarchical or arithmetic coded JPEG images is not supported")
+		case 0xc4:
+			for s := segment; len(s) >= 17; {
+				counts, num := s[1:17], 0
+				for _, c := range counts {
+					num += int(c)
+				}
+				if len(s) < 17+num {
+					break
+				}
+				symbols := s[17 : 17+num]
+				// the codes for a zero DC difference and for end of block
+				if code, found := find_huffman_code(counts, symbols, 0); found {
+					if s[0]>>4 == 0 {
+						dc_codes[s[0]&3] = &code
+					} else {
+						ac_codes[s[0]&3] = &code
+					}
+				}
+				s = s[17+num:]
+			}
+		case 0xdd:
+			if len(segment) >= 2 {
+				restart_interval = int(binary.BigEndian.Uint16(segment))
+			}
+		case 0xda:
+			if len(segment) < 1 || len(segment) < 1+2*int(segment[0]) || width == 0 || height == 0 {
+				return nil, fmt.Errorf("JPEG image has an invalid scan header")
+			}
+			scan_data := end
+			// find the marker ending this scan, skipping stuffed bytes and restart markers
+			scan_end, last_rst, num_rst := -1, -1, 0
+			for i := scan_data; i+1 < len(data); i++ {
+				if data[i] == 0xff {
+					if m := data[i+1]; m >= 0xd0 && m <= 0xd7 {
+						last_rst, num_rst = i+2, num_rst+1
+					} else if m != 0 && m != 0xff {
+						scan_end = i
+						break
+					}
+					i++
+				}
+			}
+			if scan_end > -1 {
+				seen_scan = true
+				complete_upto = scan_end
+				pos = scan_end
+				continue
+			}
+			// this scan is truncated
+			if progressive {
+				if !seen_scan {
+					return nil, fmt.Errorf("JPEG image has no complete scans")
+				}
+				// use all the complete scans, the image will be blurry
+				return jpeg.Decode(io.MultiReader(bytes.NewReader(data[:marker_start]), bytes.NewReader([]byte{0xff, 0xd9})))
+			}
+			var scan []jpeg_scan_component
+			for i := 0; i < int(segment[0]); i++ {
+				id, tables := int(segment[1+2*i]), segment[2+2*i]
+				dc, ac := dc_codes[(tables>>4)&3], ac_codes[tables&3]
+				if dc == nil || ac == nil {
+					return nil, fmt.Errorf("JPEG image has missing Huffman tables")
+				}
+				for _, c := range components {
+					if c.id == id {
+						scan = append(scan, jpeg_scan_component{c, *dc, *ac})
+					}
+				}
+			}
+			if len(scan) != int(segment[0]) {
+				return nil, fmt.Errorf("JPEG image has an invalid scan header")
+			}
+			cut, start_mcu := len(data), 0
+			if restart_interval > 0 && last_rst > -1 {
+				// restart from the last restart marker, discarding the
+				// partial data after it
+				cut, start_mcu = last_rst, num_rst*restart_interval
+			} else {
+				for cut > scan_data && data[cut-1] == 0xff {
+					cut--
+				}
+			}
+			if cut == scan_data && !seen_scan {
+				return nil, fmt.Errorf("JPEG image has no image data")
+			}
+			filler := jpeg_filler(scan, width, height, max_h, max_v, restart_interval, start_mcu)
+			return jpeg.Decode(io.MultiReader(bytes.NewReader(data[:cut]), bytes.NewReader(filler), bytes.NewReader([]byte{0xff, 0xd9})))
+		}
+		pos = end
+	}
+	if !seen_scan {
+		return nil, fmt.Errorf("JPEG image has no image data")
+	}
+	// truncated after a complete scan
+	return jpeg.Decode(io.MultiReader(bytes.NewReader(data[:complete_upto]), bytes.NewReader([]byte{0xff, 0xd9})))
+}
+
+// Generate entropy coded data for the MCUs from start_mcu to the end of the
+// image, with every block having a zero DC difference and no AC coefficients.
+// Blocks are counted the way image/jpeg does.
+func jpeg_filler(scan []jpeg_scan_component, width, height, max_h, max_v, restart_interval, start_mcu int) []byte {
+	mxx, myy := (width+8*max_h-1)/(8*max_h), (height+8*max_v-1)/(8*max_v)
+	w := jpeg_bit_writer{}
+	block_count := 0
+	for mcu := 0; mcu < mxx*myy; mcu++ {
+		for _, c := range scan {
+			for j := 0; j < c.h*c.v; j++ {
+				if len(scan) == 1 {
+					// non-interleaved scans have no data for blocks outside the image
+					q := mxx * c.h
+					bx, by := block_count%q, block_count/q
+					block_count++
+					if bx*8 >= width || by*8 >= height {
+						continue
+					}
+				}
+				if mcu >= start_mcu {
+					w.write(c.dc)
+					w.write(c.ac)
+				}
+			}
+		}
+		if mcu >= start_mcu && restart_interval > 0 && (mcu+1)%restart_interval == 0 && mcu+1 < mxx*myy {
+			w.flush()
+			w.buf.Write([]byte{0xff, byte(0xd0 + ((mcu+1)/restart_interval-1)%8)})
+		}
+	}
+	w.flush()
+	return w.buf.Bytes()
+}
+
+// }}}
@@ -0,0 +1,187 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+var _ = fmt.Print
+
+func truncated_test_image(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	// some noise so that the image does not compress too well
+	noise := uint32(1)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			noise = noise*1103515245 + 12345
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 8), uint8(y * 8), uint8(noise >> 24), 255})
+		}
+	}
+	return img
+}
+
+// Go cannot encode interlaced PNG images, so do it by hand, without filtering
+func encode_interlaced_png(img *image.NRGBA) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	var raw bytes.Buffer
+	for _, p := range adam7_passes {
+		for y := p.y; y < h; y += p.dy {
+			if p.x >= w {
+				break
+			}
+			raw.WriteByte(0)
+			for x := p.x; x < w; x += p.dx {
+				raw.Write(img.Pix[img.PixOffset(x, y):][:4])
+			}
+		}
+	}
+	var b, z bytes.Buffer
+	b.WriteString(png_signature)
+	hdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(hdr, uint32(w))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(h))
+	hdr[8], hdr[9], hdr[12] = 8, 6, 1
+	write_png_chunk(&b, "IHDR", hdr)
+	zw := zlib.NewWriter(&z)
+	zw.Write(raw.Bytes())
+	zw.Close()
+	write_png_chunk(&b, "IDAT", z.Bytes())
+	write_png_chunk(&b, "IEND", nil)
+	return b.Bytes()
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	src := truncated_test_image(32, 32)
+	var b bytes.Buffer
+	png.Encode(&b, src)
+	data := b.Bytes()
+	if _, err := png.Decode(bytes.NewReader(data[:len(data)/2])); err == nil {
+		t.Fatalf("Truncated PNG image decoded without error")
+	}
+	if IsTruncatedPNG(bytes.NewReader(data)) || !IsTruncatedPNG(bytes.NewReader(data[:len(data)-1])) {
+		t.Fatalf("IsTruncatedPNG() failed")
+	}
+	if IsTruncatedPNG(bytes.NewReader(append(append([]byte{}, data...), "trailing data"...))) {
+		t.Fatalf("IsTruncatedPNG() failed for a PNG image with trailing data")
+	}
+	if !IsTruncatedPNG(bytes.NewReader(data[:len(data)/2])) {
+		t.Fatalf("IsTruncatedPNG() failed for a PNG image truncated in the middle")
+	}
+	img, err := DecodeTruncated(data[:len(data)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != src.Bounds() {
+		t.Fatalf("Incorrect size for truncated PNG: %v", img.Bounds())
+	}
+	if c := color.NRGBAModel.Convert(img.At(5, 1)); c != src.NRGBAAt(5, 1) {
+		t.Fatalf("Incorrect pixel in the decoded part of the PNG image: %v", c)
+	}
+	if _, _, _, a := img.At(31, 31).RGBA(); a != 0 {
+		t.Fatalf("The missing part of the PNG image is not transparent")
+	}
+
+	data = encode_interlaced_png(src)
+	img, err = DecodeTruncated(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if c := color.NRGBAModel.Convert(img.At(x, y)); c != src.NRGBAAt(x, y) {
+				t.Fatalf("Incorrect pixel at (%d, %d) in the interlaced PNG image: %v != %v", x, y, c, src.NRGBAAt(x, y))
+			}
+		}
+	}
+	// only the first few passes are available, so the image is blocky but
+	// every pixel is filled in from a pixel above and to the left of it in
+	// the same 8x8 block
+	img, err = DecodeTruncated(data[:len(data)/3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	num_exact := 0
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			c, found := color.NRGBAModel.Convert(img.At(x, y)), false
+			for sy := y &^ 7; sy <= y && !found; sy++ {
+				for sx := x &^ 7; sx <= x && !found; sx++ {
+					found = c == src.NRGBAAt(sx, sy)
+				}
+			}
+			if !found {
+				t.Fatalf("Pixel at (%d, %d) in the truncated interlaced PNG image not filled in: %v", x, y, c)
+			}
+			if c == src.NRGBAAt(x, y) {
+				num_exact++
+			}
+		}
+	}
+	if num_exact == 32*32 {
+		t.Fatalf("Truncated interlaced PNG image decoded completely")
+	}
+
+	b.Reset()
+	jpeg.Encode(&b, truncated_test_image(64, 64), &jpeg.Options{Quality: 90})
+	data = b.Bytes()
+	img, err = DecodeTruncated(data[:len(data)*2/3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 64, 64) {
+		t.Fatalf("Incorrect size for truncated JPEG: %v", img.Bounds())
+	}
+	r, g, _, _ := img.At(20, 4).RGBA()
+	if r>>8 < 140 || r>>8 > 180 || g>>8 > 60 {
+		t.Fatalf("Incorrect pixel in the decoded part of the JPEG image: %v", img.At(20, 4))
+	}
+	if _, err = DecodeTruncated(data[:100]); err == nil {
+		t.Fatalf("JPEG image with no image data decoded without error")
+	}
+	if _, err = DecodeTruncated(data); err == nil {
+		t.Fatalf("Complete JPEG image treated as truncated")
+	}
+
+	// insert a restart interval of one MCU and replace the image data with data generated
+	// for the standard Huffman tables image/jpeg uses, making every block gray
+	sos := bytes.Index(data, []byte{0xff, 0xda})
+	sos_end := sos + 2 + int(binary.BigEndian.Uint16(data[sos+2:]))
+	y := jpeg_component{id: 1, h: 2, v: 2}
+	scan := []jpeg_scan_component{
+		{y, huffman_code{0, 2}, huffman_code{0b1010, 4}},
+		{jpeg_component{id: 2, h: 1, v: 1}, huffman_code{0, 2}, huffman_code{0, 2}},
+		{jpeg_component{id: 3, h: 1, v: 1}, huffman_code{0, 2}, huffman_code{0, 2}},
+	}
+	filler := jpeg_filler(scan, 64, 64, 2, 2, 1, 0)
+	b = bytes.Buffer{}
+	b.Write(data[:sos])
+	b.Write([]byte{0xff, 0xdd, 0, 4, 0, 1})
+	b.Write(data[sos:sos_end])
+	b.Write(filler)
+	b.Write([]byte{0xff, 0xd9})
+	data = b.Bytes()
+	if bytes.Count(filler, []byte{0xff, 0xd0}) != 2 || bytes.Count(filler, []byte{0xff, 0xd7}) != 1 {
+		t.Fatalf("Incorrect restart markers in generated JPEG data")
+	}
+	for _, d := range [][]byte{data, data[:len(data)-len(filler)/2]} {
+		if len(d) < len(data) {
+			if img, err = DecodeTruncated(d); err != nil {
+				t.Fatal(err)
+			}
+		} else if img, err = jpeg.Decode(bytes.NewReader(d)); err != nil {
+			t.Fatal(err)
+		}
+		if r, g, b, _ := img.At(63, 63).RGBA(); r>>8 != 128 || g>>8 != 128 || b>>8 != 128 {
+			t.Fatalf("Generated JPEG data is not gray: %v", img.At(63, 63))
+		}
+	}
+}
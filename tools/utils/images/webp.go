@@ -0,0 +1,180 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+
+	"kitty/tools/utils"
+
+	"golang.org/x/image/webp"
+)
+
+var _ = fmt.Print
+
+type webp_chunk struct {
+	fourcc string
+	data   []byte
+}
+
+func parse_webp_chunks(data []byte) (ans []webp_chunk, err error) {
+	for len(data) >= 8 {
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if size < 0 || 8+size > len(data) {
+			return nil, fmt.Errorf("WebP chunk %#v is truncated", string(data[:4]))
+		}
+		ans = append(ans, webp_chunk{fourcc: string(data[:4]), data: data[8 : 8+size]})
+		data = data[utils.Min(len(data), 8+size+size&1):]
+	}
+	return
+}
+
+func write_webp_chunk(w *bytes.Buffer, fourcc string, data []byte) {
+	var b [4]byte
+	w.WriteString(fourcc)
+	binary.LittleEndian.PutUint32(b[:], uint32(len(data)))
+	w.Write(b[:])
+	w.Write(data)
+	if len(data)&1 != 0 {
+		w.WriteByte(0)
+	}
+}
+
+func webp_uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// Return true if the WebP image has the animation flag set in its VP8X chunk
+func IsAnimatedWebP(r io.ReaderAt) (ans bool) {
+	iterate_riff_chunks(r, func(fourcc string, data *io.SectionReader) bool {
+		if fourcc == "VP8X" {
+			var flags [1]byte
+			if _, err := data.ReadAt(flags[:], 0); err == nil {
+				ans = flags[0]&2 != 0
+			}
+		}
+		return false
+	})
+	return
+}
+
+// Decode the image data of a single frame of an animated WebP image by
+// wrapping it into a standalone WebP image
+func decode_webp_frame(width, height int, data []byte) (image.Image, error) {
+	chunks, err := parse_webp_chunks(data)
+	if err != nil {
+		return nil, err
+	}
+	var alpha, bitstream *webp_chunk
+	for i, c := range chunks {
+		switch c.fourcc {
+		case "ALPH":
+			alpha = &chunks[i]
+		case "VP8 ", "VP8L":
+			bitstream = &chunks[i]
+		}
+	}
+	if bitstream == nil {
+		return nil, fmt.Errorf("no image data")
+	}
+	var body bytes.Buffer
+	if alpha != nil && bitstream.fourcc == "VP8 " {
+		// lossy images store their alpha channel separately, which needs a
+		// VP8X chunk with the alpha flag set
+		vp8x := make([]byte, 10)
+		vp8x[0] = 0x10
+		vp8x[4], vp8x[5], vp8x[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+		vp8x[7], vp8x[8], vp8x[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+		write_webp_chunk(&body, "VP8X", vp8x)
+		write_webp_chunk(&body, "ALPH", alpha.data)
+	}
+	write_webp_chunk(&body, bitstream.fourcc, bitstream.data)
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(4+body.Len()))
+	b.WriteString("WEBP")
+	b.Write(body.Bytes())
+	return webp.Decode(&b)
+}
+
+// Decode every frame of an animated WebP image, compositing them according
+// to their blending and disposal methods. The canvas starts out transparent,
+// ignoring the background color in the ANIM chunk, as browsers do.
+func DecodeAnimatedWebP(r io.Reader) (ans *Animation, err error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 12 || string(raw[:4]) != "RIFF" || string(raw[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("Not a WebP image")
+	}
+	end := utils.Min(len(raw), 8+int(binary.LittleEndian.Uint32(raw[4:8])))
+	chunks, err := parse_webp_chunks(raw[12:end])
+	if err != nil {
+		return nil, err
+	}
+	ans = &Animation{}
+	var img *image.NRGBA
+	for _, c := range chunks {
+		d := c.data
+		switch c.fourcc {
+		case "VP8X":
+			if len(d) < 10 {
+				return nil, fmt.Errorf("Invalid VP8X chunk in WebP image")
+			}
+			canvas := image.Rect(0, 0, webp_uint24(d[4:])+1, webp_uint24(d[7:])+1)
+			if err = check_animation_size(canvas, 1); err != nil {
+				return nil, err
+			}
+			img = image.NewNRGBA(canvas)
+		case "ANIM":
+			if len(d) < 6 {
+				return nil, fmt.Errorf("Invalid ANIM chunk in animated WebP image")
+			}
+			ans.LoopCount = int(binary.LittleEndian.Uint16(d[4:]))
+		case "ANMF":
+			if img == nil {
+				return nil, fmt.Errorf("Animated WebP image has no VP8X chunk")
+			}
+			if len(d) < 16 {
+				return nil, fmt.Errorf("Invalid ANMF chunk in animated WebP image")
+			}
+			if len(ans.Frames) >= max_animation_frames {
+				return nil, fmt.Errorf("Animated WebP image has too many frames")
+			}
+			if err = check_animation_size(img.Rect, len(ans.Frames)+1); err != nil {
+				return nil, err
+			}
+			x, y := 2*webp_uint24(d), 2*webp_uint24(d[3:])
+			bounds := image.Rect(x, y, x+webp_uint24(d[6:])+1, y+webp_uint24(d[9:])+1)
+			if !bounds.In(img.Rect) {
+				return nil, fmt.Errorf("Frame %d of animated WebP image is outside the image", len(ans.Frames)+1)
+			}
+			duration_ms, flags := webp_uint24(d[12:]), d[15]
+			frame_img, err := decode_webp_frame(bounds.Dx(), bounds.Dy(), d[16:])
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decode frame %d of animated WebP image: %w", len(ans.Frames)+1, err)
+			}
+			op := draw.Over
+			if flags&2 != 0 {
+				op = draw.Src
+			}
+			draw.Draw(img, bounds, frame_img, frame_img.Bounds().Min, op)
+			ans.Frames = append(ans.Frames, clone_nrgba(img))
+			ans.Delays = append(ans.Delays, (duration_ms+5)/10)
+			if flags&1 != 0 {
+				// dispose to the background
+				draw.Draw(img, bounds, image.Transparent, image.Point{}, draw.Src)
+			}
+		}
+	}
+	if len(ans.Frames) == 0 {
+		return nil, fmt.Errorf("Animated WebP image has no frames")
+	}
+	return ans, nil
+}
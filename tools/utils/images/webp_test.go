@@ -0,0 +1,108 @@
+// License: GPLv3 Copyright: 2023, Kovid Goyal, <kovid at kovidgoyal.net>
+
+package images
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/color"
+	"testing"
+)
+
+var _ = fmt.Print
+
+// A lossless WebP bitstream for an image of a single color, using prefix
+// codes with a single symbol each, so that pixels take no bits at all
+func solid_vp8l(width, height int, c color.NRGBA) []byte {
+	var b bytes.Buffer
+	var pending uint64
+	n := 0
+	write := func(val uint64, bits int) {
+		pending |= val << n
+		for n += bits; n >= 8; n -= 8 {
+			b.WriteByte(byte(pending))
+			pending >>= 8
+		}
+	}
+	write(0x2f, 8)
+	write(uint64(width-1), 14)
+	write(uint64(height-1), 14)
+	write(1, 1) // alpha is used
+	write(0, 3) // version
+	write(0, 1) // no transforms
+	write(0, 1) // no color cache
+	write(0, 1) // no meta prefix codes
+	for _, symbol := range []uint8{c.G, c.R, c.B, c.A} {
+		write(1, 1) // simple code
+		write(0, 1) // one symbol
+		write(1, 1) // of eight bits
+		write(uint64(symbol), 8)
+	}
+	write(0b0001, 4) // the distance code, a single one bit symbol
+	write(0, 16)
+	return b.Bytes()
+}
+
+func webp_frame(x, y, w, h, duration_ms int, flags byte, c color.NRGBA) []byte {
+	var b bytes.Buffer
+	u24 := func(v int) { b.Write([]byte{byte(v), byte(v >> 8), byte(v >> 16)}) }
+	u24(x / 2)
+	u24(y / 2)
+	u24(w - 1)
+	u24(h - 1)
+	u24(duration_ms)
+	b.WriteByte(flags)
+	write_webp_chunk(&b, "VP8L", solid_vp8l(w, h, c))
+	return b.Bytes()
+}
+
+func TestAnimatedWebP(t *testing.T) {
+	red, blue := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 128}
+	var body bytes.Buffer
+	write_webp_chunk(&body, "VP8X", []byte{0x12, 0, 0, 0, 3, 0, 0, 3, 0, 0})
+	write_webp_chunk(&body, "ANIM", []byte{0, 0, 0, 0, 3, 0})
+	write_webp_chunk(&body, "ANMF", webp_frame(0, 0, 4, 4, 100, 0, red))
+	// blended over the first frame, then disposed to the background
+	write_webp_chunk(&body, "ANMF", webp_frame(2, 2, 2, 2, 54, 1, blue))
+	// not blended
+	write_webp_chunk(&body, "ANMF", webp_frame(0, 0, 2, 2, 0, 2, blue))
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(4+body.Len()))
+	b.WriteString("WEBP")
+	b.Write(body.Bytes())
+	data := b.Bytes()
+
+	if !IsAnimatedWebP(bytes.NewReader(data)) {
+		t.Fatalf("Animated WebP image not recognized")
+	}
+	if n := FrameCount(bytes.NewReader(data), "WEBP"); n != 3 {
+		t.Fatalf("Incorrect frame count: %d", n)
+	}
+	a, err := DecodeAnimatedWebP(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Frames) != 3 || a.LoopCount != 3 {
+		t.Fatalf("Incorrect number of frames or loop count: %d %d", len(a.Frames), a.LoopCount)
+	}
+	if fmt.Sprint(a.Delays) != "[10 5 0]" {
+		t.Fatalf("Incorrect delays: %v", a.Delays)
+	}
+	for _, x := range []struct {
+		frame, x, y int
+		expected    color.NRGBA
+	}{
+		{0, 3, 3, red},
+		{1, 0, 0, red},
+		{1, 3, 3, color.NRGBA{127, 0, 128, 255}},
+		{2, 3, 3, color.NRGBA{}},
+		{2, 1, 1, blue},
+		{2, 2, 1, red},
+	} {
+		if c := a.Frames[x.frame].NRGBAAt(x.x, x.y); c != x.expected {
+			t.Fatalf("Incorrect pixel at (%d, %d) in frame %d: %v != %v", x.x, x.y, x.frame, c, x.expected)
+		}
+	}
+}